@@ -37,6 +37,14 @@ func TestCarCollectionIntegration(t *testing.T) {
 	`)
 	require.NoError(t, err)
 
+	// Only the Toyota has been enriched with its full spec sheet
+	_, err = testDB.Exec(ctx, `
+		UPDATE cars
+		SET fuel_type = 'Gasoline', displacement = 2.0, cylinder_count = 4, forced_induction = false,
+			transmission_type = 'CVT', body_type = 'Sedan', doors = 4, specs_enriched_at = NOW()
+		WHERE make = 'Toyota' AND model = 'Corolla' AND trim = 'XSE'`)
+	require.NoError(t, err)
+
 	// Link user to cars with context and image paths
 	_, err = testDB.Exec(ctx, `
 		INSERT INTO user_cars (user_id, car_id, color, low_res_image, high_res_image)
@@ -119,6 +127,74 @@ func TestCarCollectionIntegration(t *testing.T) {
 		assert.Equal(t, userCarIDs[0], specificCars[0].UserCarID)
 		assert.Equal(t, userCarIDs[1], specificCars[1].UserCarID)
 	})
+
+	t.Run("Test Full Specs", func(t *testing.T) {
+		url := fmt.Sprintf("/user/%d/cars", userDetailsResp.ID)
+		resp, body = makeRequest(t, http.MethodGet, url, nil, authResp.AccessToken)
+		require.Equal(t, http.StatusOK, resp.StatusCode, "body: %s", body)
+
+		var cars []car
+		require.NoError(t, json.Unmarshal(body, &cars))
+		for _, c := range cars {
+			if c.Make != "Toyota" {
+				// Specs that haven't been filled in are left out
+				assert.Nil(t, c.FuelType)
+				assert.Nil(t, c.Doors)
+				continue
+			}
+			require.NotNil(t, c.FuelType)
+			assert.Equal(t, "Gasoline", *c.FuelType)
+			require.NotNil(t, c.Displacement)
+			assert.Equal(t, 2.0, *c.Displacement)
+			require.NotNil(t, c.ForcedInduction)
+			assert.False(t, *c.ForcedInduction)
+			require.NotNil(t, c.Doors)
+			assert.Equal(t, 4, *c.Doors)
+			assert.Nil(t, c.BatteryCapacity)
+		}
+	})
+
+	t.Run("Test Unit Preference", func(t *testing.T) {
+		// Specs are stored in metric and shown in imperial until the user
+		// picks otherwise
+		getToyota := func() car {
+			url := fmt.Sprintf("/user/%d/cars", userDetailsResp.ID)
+			resp, body := makeRequest(t, http.MethodGet, url, nil, authResp.AccessToken)
+			require.Equal(t, http.StatusOK, resp.StatusCode, "body: %s", body)
+
+			var cars []car
+			require.NoError(t, json.Unmarshal(body, &cars))
+			for _, c := range cars {
+				if c.Make == "Toyota" {
+					return c
+				}
+			}
+			t.Fatal("Toyota missing from collection")
+			return car{}
+		}
+
+		toyota := getToyota()
+		assert.Equal(t, "imperial", toyota.Units)
+		require.NotNil(t, toyota.Torque)
+		assert.Equal(t, 111, *toyota.Torque) // 151 Nm
+		require.NotNil(t, toyota.TopSpeed)
+		assert.Equal(t, 75, *toyota.TopSpeed) // 120 km/h
+
+		resp, body := makeRequest(t, http.MethodPost, "/user/profile/units",
+			map[string]string{"unit_preference": "furlongs"}, authResp.AccessToken)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "body: %s", body)
+
+		resp, body = makeRequest(t, http.MethodPost, "/user/profile/units",
+			map[string]string{"unit_preference": "metric"}, authResp.AccessToken)
+		require.Equal(t, http.StatusOK, resp.StatusCode, "body: %s", body)
+
+		toyota = getToyota()
+		assert.Equal(t, "metric", toyota.Units)
+		require.NotNil(t, toyota.Torque)
+		assert.Equal(t, 151, *toyota.Torque)
+		require.NotNil(t, toyota.TopSpeed)
+		assert.Equal(t, 120, *toyota.TopSpeed)
+	})
 }
 
 type car struct {
@@ -142,4 +218,11 @@ type car struct {
 	LowResImage    *string  `json:"low_res_image,omitempty"`
 	HighResImage   *string  `json:"high_res_image,omitempty"`
 	DateCollected  *string  `json:"date_collected,omitempty"`
+
+	FuelType        *string  `json:"fuel_type,omitempty"`
+	Displacement    *float64 `json:"displacement,omitempty"`
+	ForcedInduction *bool    `json:"forced_induction,omitempty"`
+	BatteryCapacity *float64 `json:"battery_capacity,omitempty"`
+	Doors           *int     `json:"doors,omitempty"`
+	Units           string   `json:"units"`
 }
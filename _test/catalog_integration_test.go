@@ -0,0 +1,109 @@
+package test
+
+import (
+	"CarBN/catalog"
+	"CarBN/common"
+	"CarBN/rarity"
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCatalogIntegration_NormalizeAndMerge(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	ctx = context.WithValue(ctx, common.LoggerCtxKey, logger)
+
+	svc := catalog.NewService(testDB, rarity.NewService(testDB))
+
+	// "BMW 330i" resolves to the 3 Series through the seeded aliases
+	identity, err := svc.Normalize(ctx, testDB, catalog.Identity{
+		Make: "bmw", Model: "BMW 330i", Trim: "Base", Year: "2019 - 2023",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "3 Series", identity.Model)
+	assert.Equal(t, "330i", identity.Trim)
+	assert.Equal(t, "2019-2023", identity.Year)
+	assert.Equal(t, 2019, identity.YearStart)
+	assert.Equal(t, 2023, identity.YearEnd)
+
+	var canonicalID, duplicateID int
+	err = testDB.QueryRow(ctx, `
+		INSERT INTO cars (make, model, trim, year, year_start, year_end, color_images)
+		VALUES ('BMW', '3 Series', '330i', '2019-2023', 2019, 2023, '{"blue": {"high_res": "a.jpg", "low_res": "a_low.jpg"}}')
+		RETURNING id`).Scan(&canonicalID)
+	require.NoError(t, err)
+	err = testDB.QueryRow(ctx, `
+		INSERT INTO cars (make, model, trim, year, year_start, year_end, color_images)
+		VALUES ('BMW', '330i', '', '2020-2023', 2020, 2023, '{"blue": {"high_res": "b.jpg", "low_res": "b_low.jpg"}, "red": {"high_res": "c.jpg", "low_res": "c_low.jpg"}}')
+		RETURNING id`).Scan(&duplicateID)
+	require.NoError(t, err)
+
+	// An overlapping year range finds the same car
+	foundID, err := svc.FindCar(ctx, testDB, catalog.Identity{
+		Make: "BMW", Model: "3 Series", Trim: "330i", YearStart: 2020, YearEnd: 2022,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, canonicalID, foundID)
+
+	// A different generation doesn't
+	foundID, err = svc.FindCar(ctx, testDB, catalog.Identity{
+		Make: "BMW", Model: "3 Series", Trim: "330i", YearStart: 2012, YearEnd: 2019,
+	})
+	require.NoError(t, err)
+	assert.Zero(t, foundID)
+
+	user := createTestUser(t)
+	userID := createTestUserInDB(t, user)
+	var userCarID int
+	err = testDB.QueryRow(ctx, `
+		INSERT INTO user_cars (user_id, car_id, color, high_res_image, low_res_image)
+		VALUES ($1, $2, 'red', 'c.jpg', 'c_low.jpg')
+		RETURNING id`, userID, duplicateID).Scan(&userCarID)
+	require.NoError(t, err)
+	_, err = testDB.Exec(ctx, `
+		INSERT INTO rarity_history (car_id, new_rarity, explanation)
+		VALUES ($1, 2, '{}')`, duplicateID)
+	require.NoError(t, err)
+
+	result, err := svc.MergeCars(ctx, canonicalID, []int{duplicateID}, false, userID)
+	require.NoError(t, err)
+	assert.Equal(t, []int{duplicateID}, result.MergedCarIDs)
+	assert.EqualValues(t, 1, result.UserCarsMoved)
+
+	var carID int
+	require.NoError(t, testDB.QueryRow(ctx, "SELECT car_id FROM user_cars WHERE id = $1", userCarID).Scan(&carID))
+	assert.Equal(t, canonicalID, carID)
+
+	var blueImage, redImage string
+	require.NoError(t, testDB.QueryRow(ctx, `
+		SELECT color_images->'blue'->>'high_res', color_images->'red'->>'high_res'
+		FROM cars WHERE id = $1`, canonicalID).Scan(&blueImage, &redImage))
+	assert.Equal(t, "a.jpg", blueImage, "canonical car's images should win")
+	assert.Equal(t, "c.jpg", redImage)
+
+	// The duplicate's rarity history follows it, and the canonical car is
+	// re-evaluated with its new copy
+	var history int
+	require.NoError(t, testDB.QueryRow(ctx, "SELECT COUNT(*) FROM rarity_history WHERE car_id = $1", canonicalID).Scan(&history))
+	assert.GreaterOrEqual(t, history, 2)
+	var rarityExplanation *string
+	require.NoError(t, testDB.QueryRow(ctx, "SELECT rarity_explanation::text FROM cars WHERE id = $1", canonicalID).Scan(&rarityExplanation))
+	assert.NotNil(t, rarityExplanation)
+
+	var remaining int
+	require.NoError(t, testDB.QueryRow(ctx, "SELECT COUNT(*) FROM cars WHERE id = $1", duplicateID).Scan(&remaining))
+	assert.Zero(t, remaining)
+
+	// Only admins can use the merge endpoint
+	token := loginUser(t, user.Email, user.Password)
+	resp, body := makeRequest(t, http.MethodPost, "/admin/catalog/merge", map[string]interface{}{
+		"canonical_car_id":  canonicalID,
+		"duplicate_car_ids": []int{canonicalID + 1000},
+	}, token)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode, "body: %s", body)
+}
@@ -0,0 +1,153 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type creditBuckets struct {
+	Subscription int `json:"subscription"`
+	Pack         int `json:"pack"`
+	Promo        int `json:"promo"`
+}
+
+type creditHistoryResponse struct {
+	Balance  int           `json:"balance"`
+	Reserved int           `json:"reserved"`
+	Credits  creditBuckets `json:"credits"`
+	Items    []struct {
+		Type         string  `json:"type"`
+		Bucket       *string `json:"bucket"`
+		Amount       int     `json:"amount"`
+		BalanceAfter int     `json:"balance_after"`
+		Reference    *string `json:"reference"`
+	} `json:"items"`
+}
+
+func getCreditHistory(t *testing.T, token string) creditHistoryResponse {
+	resp, body := makeRequest(t, http.MethodGet, "/user/credits/history", nil, token)
+	require.Equal(t, http.StatusOK, resp.StatusCode, "body: %s", body)
+
+	var history creditHistoryResponse
+	require.NoError(t, json.Unmarshal(body, &history))
+	return history
+}
+
+func TestCreditLedgerIntegration_FailedScanReleasesCredit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Forget earlier scans of the test photo so it isn't rejected as recycled
+	_, err := testDB.Exec(ctx, "DELETE FROM scan_history")
+	require.NoError(t, err)
+
+	user := createTestUser(t)
+	userId := createTestUserInDB(t, user)
+	token := loginUser(t, user.Email, user.Password)
+
+	// A rejected scan reserves a credit and hands it back
+	resp, body := makeRequest(t, http.MethodPost, "/scan",
+		map[string]string{"base64_image": loadImage(t, BAD_IMAGE)}, token)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode, "body: %s", body)
+
+	var status string
+	err = testDB.QueryRow(ctx,
+		"SELECT status FROM credit_reservations WHERE user_id = $1",
+		userId).Scan(&status)
+	require.NoError(t, err)
+	assert.Equal(t, "released", status)
+
+	// Only the free credits are in the ledger
+	history := getCreditHistory(t, token)
+	assert.Equal(t, 6, history.Balance)
+	assert.Zero(t, history.Reserved)
+	assert.Equal(t, creditBuckets{Promo: 6}, history.Credits)
+	require.Len(t, history.Items, 1)
+	assert.Equal(t, "grant", history.Items[0].Type)
+	require.NotNil(t, history.Items[0].Bucket)
+	assert.Equal(t, "promo", *history.Items[0].Bucket)
+	assert.Equal(t, 6, history.Items[0].Amount)
+	assert.Equal(t, 6, history.Items[0].BalanceAfter)
+}
+
+func TestCreditLedgerIntegration_NoCredits(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	user := createTestUser(t)
+	userId := createTestUserInDB(t, user)
+	token := loginUser(t, user.Email, user.Password)
+
+	// Hold the user's only credit with a scan in progress
+	_, err := testDB.Exec(ctx,
+		"INSERT INTO user_subscriptions (user_id, scan_credits_remaining, pack_credits) VALUES ($1, 1, 1)",
+		userId)
+	require.NoError(t, err)
+	_, err = testDB.Exec(ctx,
+		"INSERT INTO credit_reservations (user_id, expires_at) VALUES ($1, NOW() + INTERVAL '1 hour')",
+		userId)
+	require.NoError(t, err)
+
+	resp, body := makeRequest(t, http.MethodPost, "/scan",
+		map[string]string{"base64_image": loadImage(t, GOOD_IMAGE)}, token)
+	require.Equal(t, http.StatusPaymentRequired, resp.StatusCode, "body: %s", body)
+	assert.Contains(t, string(body), `"code":"no_scan_credits"`)
+
+	history := getCreditHistory(t, token)
+	assert.Equal(t, 1, history.Balance)
+	assert.Equal(t, 1, history.Reserved)
+}
+
+func TestCreditLedgerIntegration_Expiry(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	user := createTestUser(t)
+	userId := createTestUserInDB(t, user)
+	token := loginUser(t, user.Email, user.Password)
+
+	// A lapsed subscription's allowance and expired promo credits don't count,
+	// pack credits and promo credits that don't expire do
+	_, err := testDB.Exec(ctx, `
+		INSERT INTO user_subscriptions (user_id, scan_credits_remaining, subscription_credits, pack_credits, subscription_end)
+		VALUES ($1, 10, 3, 2, NOW() - INTERVAL '1 day')`,
+		userId)
+	require.NoError(t, err)
+	_, err = testDB.Exec(ctx, `
+		INSERT INTO promo_credits (user_id, amount, remaining, expires_at)
+		VALUES ($1, 4, 4, NOW() - INTERVAL '1 hour'), ($1, 1, 1, NULL)`,
+		userId)
+	require.NoError(t, err)
+
+	resp, body := makeRequest(t, http.MethodGet, "/user/subscription", nil, token)
+	require.Equal(t, http.StatusOK, resp.StatusCode, "body: %s", body)
+
+	var subscription struct {
+		ScanCreditsRemaining int           `json:"scan_credits_remaining"`
+		Credits              creditBuckets `json:"credits"`
+	}
+	require.NoError(t, json.Unmarshal(body, &subscription))
+	assert.Equal(t, 3, subscription.ScanCreditsRemaining)
+	assert.Equal(t, creditBuckets{Pack: 2, Promo: 1}, subscription.Credits)
+
+	// The next time the credits are touched they're written off in the ledger
+	_, err = testDB.Exec(ctx, "DELETE FROM scan_history")
+	require.NoError(t, err)
+	resp, body = makeRequest(t, http.MethodPost, "/scan",
+		map[string]string{"base64_image": loadImage(t, BAD_IMAGE)}, token)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode, "body: %s", body)
+
+	history := getCreditHistory(t, token)
+	assert.Equal(t, 3, history.Balance)
+	require.Len(t, history.Items, 2)
+	for _, item := range history.Items {
+		assert.Equal(t, "expire", item.Type)
+	}
+	assert.Equal(t, 3, history.Items[0].BalanceAfter)
+}
@@ -0,0 +1,97 @@
+package test
+
+import (
+	"CarBN/common"
+	"CarBN/imagegc"
+	"CarBN/storage"
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImageGCIntegration_CollectsUnreferencedImages(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	ctx = context.WithValue(ctx, common.LoggerCtxKey, logger)
+
+	t.Setenv("IMAGE_GC_MODE", imagegc.ModeArchive)
+	t.Setenv("IMAGE_GC_RETENTION", "0s")
+	t.Setenv("IMAGE_GC_REJECTED_SCAN_RETENTION", "720h")
+
+	store, err := storage.NewLocalStore(t.TempDir())
+	require.NoError(t, err)
+
+	user := createTestUser(t)
+	userID := createTestUserInDB(t, user)
+	prefix := fmt.Sprintf("%scar_gc_%d/Red/", storage.GeneratedPrefix, time.Now().UnixNano())
+	currentRender := prefix + "high_res_2.jpg"
+	oldRender := prefix + "high_res_1.jpg"
+	currentPicture := fmt.Sprintf("%suser_%d_2.jpg", storage.ProfilePicturesPrefix, userID)
+	oldPicture := fmt.Sprintf("%suser_%d_1.jpg", storage.ProfilePicturesPrefix, userID)
+	recentRejected := fmt.Sprintf("%suser_%d/rejected_scan_2.jpg", storage.ScansPrefix, userID)
+	oldRejected := fmt.Sprintf("%suser_%d/rejected_scan_1.jpg", storage.ScansPrefix, userID)
+
+	var carID int
+	require.NoError(t, testDB.QueryRow(ctx, `
+		INSERT INTO cars (make, model, trim, year) VALUES ('GC', 'Test', '', '2020')
+		RETURNING id`).Scan(&carID))
+	_, err = testDB.Exec(ctx, `
+		INSERT INTO user_cars (user_id, car_id, color, high_res_image, low_res_image)
+		VALUES ($1, $2, 'Red', $3, $3)`, userID, carID, currentRender)
+	require.NoError(t, err)
+	_, err = testDB.Exec(ctx, "UPDATE users SET profile_picture = $1 WHERE id = $2", currentPicture, userID)
+	require.NoError(t, err)
+	_, err = testDB.Exec(ctx, `
+		INSERT INTO scan_history (user_id, color, image_path, success, outcome, scanned_at)
+		VALUES ($1, '', $2, false, 'rejected_fake', NOW() - INTERVAL '60 days'),
+			($1, '', $3, false, 'rejected_fake', NOW())`, userID, oldRejected, recentRejected)
+	require.NoError(t, err)
+
+	for _, key := range []string{currentRender, oldRender, storage.VariantKey(currentRender, 256), storage.VariantKey(oldRender, 256),
+		currentPicture, oldPicture, recentRejected, oldRejected} {
+		require.NoError(t, store.Put(ctx, key, []byte("image"), "image/jpeg"))
+	}
+	collected := []string{oldRender, storage.VariantKey(oldRender, 256), oldPicture, oldRejected}
+	sort.Strings(collected)
+
+	svc := imagegc.NewService(testDB, store)
+
+	// A dry run reports without touching anything
+	report, err := svc.Run(ctx, true)
+	require.NoError(t, err)
+	sort.Strings(report.Keys)
+	assert.Equal(t, collected, report.Keys)
+	assert.Equal(t, 4, report.Collected)
+	assert.EqualValues(t, 4*len("image"), report.CollectedBytes)
+	for _, key := range collected {
+		_, err := storage.ReadAll(ctx, store, key)
+		assert.NoError(t, err, key)
+	}
+
+	report, err = svc.Run(ctx, false)
+	require.NoError(t, err)
+	assert.Equal(t, 4, report.Collected)
+	assert.Zero(t, report.Failed)
+	for _, key := range collected {
+		_, err := storage.ReadAll(ctx, store, key)
+		assert.ErrorIs(t, err, storage.ErrNotFound, key)
+		_, err = storage.ReadAll(ctx, store, imagegc.ArchivePrefix+key)
+		assert.NoError(t, err, key)
+	}
+	for _, key := range []string{currentRender, storage.VariantKey(currentRender, 256), currentPicture, recentRejected} {
+		_, err := storage.ReadAll(ctx, store, key)
+		assert.NoError(t, err, key)
+	}
+
+	// The rejected scan's history follows its photo to the archive
+	var archivedPath string
+	require.NoError(t, testDB.QueryRow(ctx, `
+		SELECT image_path FROM scan_history
+		WHERE user_id = $1 AND scanned_at < NOW() - INTERVAL '1 day'`, userID).Scan(&archivedPath))
+	assert.Equal(t, imagegc.ArchivePrefix+oldRejected, archivedPath)
+}
@@ -0,0 +1,80 @@
+#!/bin/bash
+# Runs the integration tests against a server whose AI providers are all
+# cmd/fakeai, so the scan → car → image flow runs without network access.
+# The server reads .env as usual, which must set up the database. Extra
+# arguments go to go test, e.g.
+#   _test/run_offline.sh -run TestScan
+set -e  # Exit on error
+
+cd "$(dirname "$0")/.."
+
+if [ -f .env ]; then
+    set -a
+    . ./.env
+    set +a
+fi
+
+FAKEAI_ADDR="${FAKEAI_ADDR:-127.0.0.1:5000}"
+FAKEAI_URL="http://$FAKEAI_ADDR"
+SERVER_URL="http://localhost:8080"
+
+WORK_DIR=$(mktemp -d)
+PIDS=()
+cleanup() {
+    for pid in "${PIDS[@]}"; do
+        kill "$pid" 2>/dev/null || true
+    done
+    rm -rf "$WORK_DIR"
+}
+trap cleanup EXIT
+
+wait_for() {
+    for _ in $(seq 1 60); do
+        if curl -s -o /dev/null "$1"; then
+            return 0
+        fi
+        sleep 1
+    done
+    echo "$2 didn't start; see $3"
+    cat "$3"
+    exit 1
+}
+
+echo "Building the fake AI server and the server..."
+go build -o "$WORK_DIR/fakeai" ./cmd/fakeai
+go build -o "$WORK_DIR/server" main.go
+
+# The built-in fixtures identify every photo as the same car. The bad test
+# photo gets the rejection instead, as the real providers would reply.
+FIXTURES="$WORK_DIR/fixtures"
+cp -r cmd/fakeai/fixtures "$FIXTURES"
+if [ -f _test/testdata/test_car_bad.jpeg ]; then
+    mkdir -p "$FIXTURES/photos"
+    cp "$FIXTURES/rejected.json" \
+       "$FIXTURES/photos/$(sha256sum _test/testdata/test_car_bad.jpeg | cut -d' ' -f1).json"
+fi
+
+echo "Starting the fake AI server on $FAKEAI_ADDR..."
+FAKEAI_ADDR="$FAKEAI_ADDR" FAKEAI_FIXTURES="$FIXTURES" \
+    "$WORK_DIR/fakeai" > "$WORK_DIR/fakeai.log" 2>&1 &
+PIDS+=($!)
+wait_for "$FAKEAI_URL" "Fake AI server" "$WORK_DIR/fakeai.log"
+
+echo "Starting the server..."
+VISION_PROVIDERS=default \
+DEFAULT_BASE_URL="$FAKEAI_URL" \
+DEFAULT_API_KEY=fake \
+GEMINI_BASE_URL="$FAKEAI_URL" \
+GEMINI_API_KEY=fake \
+IMAGE_GEN_PROVIDER=imagen \
+AI_REPLAY_MODE="" \
+    "$WORK_DIR/server" > "$WORK_DIR/server.log" 2>&1 &
+PIDS+=($!)
+wait_for "$SERVER_URL" "Server" "$WORK_DIR/server.log"
+
+echo "Running the integration tests..."
+TEST_BASE_URL="$SERVER_URL" go test ./_test "$@" || {
+    echo "Tests failed; server log:"
+    tail -n 100 "$WORK_DIR/server.log"
+    exit 1
+}
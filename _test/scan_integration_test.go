@@ -1,9 +1,15 @@
 package test
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -62,25 +68,30 @@ func TestScanIntegration_GoodImage(t *testing.T) {
 
 	// Update the scan response struct to include all new fields
 	var scanResp struct {
-		ID             int      `json:"id"`
-		UserCarID      int      `json:"user_car_id"`
-		Make           string   `json:"make"`
-		Model          string   `json:"model"`
-		Year           int      `json:"year"`
-		Color          string   `json:"color"`
-		Trim           string   `json:"trim,omitempty"`
-		Horsepower     *int     `json:"horsepower,omitempty"`
-		Torque         *int     `json:"torque,omitempty"`
-		TopSpeed       *int     `json:"top_speed,omitempty"`
-		Acceleration   *float64 `json:"acceleration,omitempty"`
-		EngineType     *string  `json:"engine_type,omitempty"`
-		DrivetrainType *string  `json:"drivetrain_type,omitempty"`
-		CurbWeight     *float64 `json:"curb_weight,omitempty"`
-		Price          *int     `json:"price,omitempty"`
-		Description    *string  `json:"description,omitempty"`
-		Rarity         *int     `json:"rarity,omitempty"`
-		LowResImage    *string  `json:"low_res_image,omitempty"`
-		HighResImage   *string  `json:"high_res_image,omitempty"`
+		ID                int      `json:"id"`
+		UserCarID         int      `json:"user_car_id"`
+		Make              string   `json:"make"`
+		Model             string   `json:"model"`
+		Year              int      `json:"year"`
+		Color             string   `json:"color"`
+		Trim              string   `json:"trim,omitempty"`
+		Horsepower        *int     `json:"horsepower,omitempty"`
+		Torque            *int     `json:"torque,omitempty"`
+		TopSpeed          *int     `json:"top_speed,omitempty"`
+		Acceleration      *float64 `json:"acceleration,omitempty"`
+		EngineType        *string  `json:"engine_type,omitempty"`
+		DrivetrainType    *string  `json:"drivetrain_type,omitempty"`
+		CurbWeight        *float64 `json:"curb_weight,omitempty"`
+		Price             *int     `json:"price,omitempty"`
+		Description       *string  `json:"description,omitempty"`
+		Rarity            *int     `json:"rarity,omitempty"`
+		LowResImage       *string  `json:"low_res_image,omitempty"`
+		HighResImage      *string  `json:"high_res_image,omitempty"`
+		RarityExplanation *struct {
+			Rarity  int    `json:"rarity"`
+			Copies  int    `json:"copies"`
+			Summary string `json:"summary"`
+		} `json:"rarity_explanation,omitempty"`
 	}
 	require.NoError(t, json.Unmarshal(body, &scanResp))
 
@@ -92,6 +103,12 @@ func TestScanIntegration_GoodImage(t *testing.T) {
 	assert.NotZero(t, scanResp.Year)
 	assert.NotEmpty(t, scanResp.Color)
 
+	// A newly created car is rated with the rarity engine
+	require.NotNil(t, scanResp.RarityExplanation)
+	require.NotNil(t, scanResp.Rarity)
+	assert.Equal(t, *scanResp.Rarity, scanResp.RarityExplanation.Rarity)
+	assert.NotEmpty(t, scanResp.RarityExplanation.Summary)
+
 	// Verify optional fields are present and have values
 	assert.NotNil(t, scanResp.Horsepower)
 	assert.NotNil(t, scanResp.Torque)
@@ -114,6 +131,29 @@ func TestScanIntegration_GoodImage(t *testing.T) {
 	require.NoError(t, err)
 	require.True(t, carExists, "Car should exist in database")
 
+	// The scan and the new car record the prompt versions that produced them
+	var scanPrompt, specsPrompt *string
+	err = testDB.QueryRow(ctx, `
+		SELECT sh.prompt_version, c.prompt_version
+		FROM scan_history sh JOIN cars c ON c.id = sh.car_id
+		WHERE sh.car_id = $1 AND sh.success`,
+		scanResp.ID).Scan(&scanPrompt, &specsPrompt)
+	require.NoError(t, err)
+	require.NotNil(t, scanPrompt)
+	assert.Regexp(t, `^scan_image@v\d+$`, *scanPrompt)
+	require.NotNil(t, specsPrompt)
+	assert.Regexp(t, `^identify_car_details@v\d+$`, *specsPrompt)
+
+	// The vision call is recorded against the user and linked to the scan
+	var visionCalls int
+	err = testDB.QueryRow(ctx, `
+		SELECT COUNT(*) FROM ai_usage a
+		JOIN scan_history sh ON sh.id = a.scan_history_id
+		WHERE sh.car_id = $1 AND sh.success AND a.user_id = $2 AND a.kind = 'vision' AND a.success`,
+		scanResp.ID, userId).Scan(&visionCalls)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, visionCalls, 1, "vision call should be recorded for the scan")
+
 	// Verify user_car was created
 	var userCarExists bool
 	err = testDB.QueryRow(ctx,
@@ -122,16 +162,17 @@ func TestScanIntegration_GoodImage(t *testing.T) {
 	require.NoError(t, err)
 	require.True(t, userCarExists, "User car association should exist in database")
 
-	// Verify car images were saved
-	var colorImages map[string]map[string]string
-	err = testDB.QueryRow(ctx,
-		"SELECT color_images FROM cars WHERE id = $1",
-		scanResp.ID).Scan(&colorImages)
-	require.NoError(t, err)
-	require.NotNil(t, colorImages)
-
+	// Verify car images were saved once the background render finishes
 	colorKey := strings.ToLower(scanResp.Color)
-	require.Contains(t, colorImages, colorKey)
+	var colorImages map[string]map[string]string
+	require.Eventually(t, func() bool {
+		err = testDB.QueryRow(ctx,
+			"SELECT color_images FROM cars WHERE id = $1",
+			scanResp.ID).Scan(&colorImages)
+		require.NoError(t, err)
+		_, rendered := colorImages[colorKey]
+		return rendered
+	}, 180*time.Second, 2*time.Second, "car image should be rendered")
 	require.Contains(t, colorImages[colorKey], "high_res")
 	require.Contains(t, colorImages[colorKey], "low_res")
 
@@ -140,6 +181,23 @@ func TestScanIntegration_GoodImage(t *testing.T) {
 	lowResPath := colorImages[colorKey]["low_res"]
 	assert.FileExists(t, highResPath)
 	assert.FileExists(t, lowResPath)
+
+	// Verify the same photo can't be scanned again, even by another user
+	other := createTestUser(t)
+	createTestUserInDB(t, other)
+	otherToken := loginUser(t, other.Email, other.Password)
+	resp, body = makeRequest(t, http.MethodPost, "/scan", scanPayload, otherToken)
+	require.Equal(t, http.StatusConflict, resp.StatusCode, "body: %s", body)
+
+	var errResp struct {
+		Code      string `json:"code"`
+		Message   string `json:"message"`
+		RequestID string `json:"request_id"`
+	}
+	require.NoError(t, json.Unmarshal(body, &errResp))
+	assert.Equal(t, "recycled_image", errResp.Code)
+	assert.Contains(t, errResp.Message, "this photo has already been scanned")
+	assert.NotEmpty(t, errResp.RequestID)
 }
 
 func TestScanIntegration_BadImage(t *testing.T) {
@@ -153,7 +211,7 @@ func TestScanIntegration_BadImage(t *testing.T) {
 
 	// Create a test user
 	user := createTestUser(t)
-	createTestUserInDB(t, user)
+	userId := createTestUserInDB(t, user)
 
 	// Login to get access token
 	resp, body := makeRequest(t, http.MethodPost, "/login",
@@ -174,6 +232,7 @@ func TestScanIntegration_BadImage(t *testing.T) {
 	}
 	resp, body = makeRequest(t, http.MethodPost, "/scan", scanPayload, authResp.AccessToken)
 	require.Equal(t, http.StatusBadRequest, resp.StatusCode, "body: %s", body)
+	assert.Contains(t, string(body), `"code":"scan_rejected"`)
 
 	// Verify no car was created in database
 	var carCount int
@@ -181,4 +240,445 @@ func TestScanIntegration_BadImage(t *testing.T) {
 		"SELECT COUNT(*) FROM cars").Scan(&carCount)
 	require.NoError(t, err)
 	assert.Zero(t, carCount, "No cars should be created for rejected images")
+
+	// Verify the rejection was recorded and shows up in the user's history
+	var outcome string
+	var promptVersion *string
+	err = testDB.QueryRow(ctx,
+		"SELECT outcome, prompt_version FROM scan_history WHERE user_id = $1 ORDER BY id DESC LIMIT 1",
+		userId).Scan(&outcome, &promptVersion)
+	require.NoError(t, err)
+	assert.Equal(t, "rejected_fake", outcome)
+	// Rejections count towards the prompt version that rejected them
+	assert.NotNil(t, promptVersion)
+
+	resp, body = makeRequest(t, http.MethodGet, "/scan/history", nil, authResp.AccessToken)
+	require.Equal(t, http.StatusOK, resp.StatusCode, "body: %s", body)
+
+	var history struct {
+		Items []struct {
+			Outcome string  `json:"outcome"`
+			Success bool    `json:"success"`
+			Reason  *string `json:"reason"`
+		} `json:"items"`
+	}
+	require.NoError(t, json.Unmarshal(body, &history))
+	require.Len(t, history.Items, 1)
+	assert.Equal(t, "rejected_fake", history.Items[0].Outcome)
+	assert.False(t, history.Items[0].Success)
+	require.NotNil(t, history.Items[0].Reason)
+}
+
+func TestScanJobIntegration_GoodImage(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 240*time.Second)
+	defer cancel()
+
+	// Forget earlier scans of the test photo so it isn't rejected as recycled
+	_, err := testDB.Exec(ctx, "DELETE FROM scan_history")
+	require.NoError(t, err)
+
+	user := createTestUser(t)
+	userId := createTestUserInDB(t, user)
+	token := loginUser(t, user.Email, user.Password)
+
+	scanPayload := map[string]interface{}{
+		"base64_image": loadImage(t, GOOD_IMAGE),
+	}
+	resp, body := makeRequest(t, http.MethodPost, "/scan/jobs", scanPayload, token)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode, "body: %s", body)
+
+	type scanJobResp struct {
+		ID    int     `json:"id"`
+		Stage string  `json:"stage"`
+		Error *string `json:"error,omitempty"`
+		Car   *struct {
+			ID        int `json:"id"`
+			UserCarID int `json:"user_car_id"`
+		} `json:"car,omitempty"`
+	}
+	var job scanJobResp
+	require.NoError(t, json.Unmarshal(body, &job))
+	require.NotZero(t, job.ID)
+	assert.Equal(t, "queued", job.Stage)
+
+	// Poll until the job finishes
+	for job.Stage != "done" && job.Stage != "failed" {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("scan job %d did not finish, last stage: %s", job.ID, job.Stage)
+		case <-time.After(2 * time.Second):
+		}
+
+		resp, body = makeRequest(t, http.MethodGet, fmt.Sprintf("/scan/jobs/%d", job.ID), nil, token)
+		require.Equal(t, http.StatusOK, resp.StatusCode, "body: %s", body)
+		require.NoError(t, json.Unmarshal(body, &job))
+	}
+
+	require.Equal(t, "done", job.Stage, "job error: %v", job.Error)
+	require.NotNil(t, job.Car)
+
+	var userCarExists bool
+	err = testDB.QueryRow(ctx,
+		"SELECT EXISTS(SELECT 1 FROM user_cars WHERE id = $1 AND user_id = $2)",
+		job.Car.UserCarID, userId).Scan(&userCarExists)
+	require.NoError(t, err)
+	require.True(t, userCarExists, "User car association should exist in database")
+
+	// Other users can't see the job
+	other := createTestUser(t)
+	createTestUserInDB(t, other)
+	otherToken := loginUser(t, other.Email, other.Password)
+	resp, body = makeRequest(t, http.MethodGet, fmt.Sprintf("/scan/jobs/%d", job.ID), nil, otherToken)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "body: %s", body)
+}
+
+func TestScanConfirmIntegration(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 240*time.Second)
+	defer cancel()
+
+	user := createTestUser(t)
+	userId := createTestUserInDB(t, user)
+	token := loginUser(t, user.Email, user.Password)
+
+	imgBytes, err := os.ReadFile(GOOD_IMAGE)
+	require.NoError(t, err)
+
+	// A scan the vision model wasn't sure about
+	var pendingID int
+	err = testDB.QueryRow(ctx, `
+		INSERT INTO pending_scans (user_id, color, candidates, image_data, expires_at)
+		VALUES ($1, 'White', $2, $3, NOW() + INTERVAL '1 hour')
+		RETURNING id`,
+		userId,
+		`[{"make": "Toyota", "model": "Corolla", "trim": "LE", "year": "2020-2022", "confidence": 0.45},
+		  {"make": "Toyota", "model": "Camry", "trim": "LE", "year": "2018-2024", "confidence": 0.3}]`,
+		imgBytes,
+	).Scan(&pendingID)
+	require.NoError(t, err)
+
+	confirmURL := fmt.Sprintf("/scan/%d/confirm", pendingID)
+
+	// Out of range candidates are rejected without using up the scan
+	resp, body := makeRequest(t, http.MethodPost, confirmURL, map[string]int{"candidate_index": 5}, token)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode, "body: %s", body)
+
+	// Other users can't confirm it
+	other := createTestUser(t)
+	createTestUserInDB(t, other)
+	otherToken := loginUser(t, other.Email, other.Password)
+	resp, body = makeRequest(t, http.MethodPost, confirmURL, map[string]int{"candidate_index": 0}, otherToken)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode, "body: %s", body)
+
+	resp, body = makeRequest(t, http.MethodPost, confirmURL, map[string]int{"candidate_index": 1}, token)
+	require.Equal(t, http.StatusCreated, resp.StatusCode, "body: %s", body)
+
+	var scanResp struct {
+		UserCarID int    `json:"user_car_id"`
+		Make      string `json:"make"`
+		Model     string `json:"model"`
+	}
+	require.NoError(t, json.Unmarshal(body, &scanResp))
+	assert.Equal(t, "Toyota", scanResp.Make)
+	assert.Equal(t, "Camry", scanResp.Model)
+
+	var status string
+	var chosen, userCarID *int
+	err = testDB.QueryRow(ctx,
+		"SELECT status, chosen_candidate, user_car_id FROM pending_scans WHERE id = $1",
+		pendingID).Scan(&status, &chosen, &userCarID)
+	require.NoError(t, err)
+	assert.Equal(t, "confirmed", status)
+	require.NotNil(t, chosen)
+	assert.Equal(t, 1, *chosen)
+	require.NotNil(t, userCarID)
+	assert.Equal(t, scanResp.UserCarID, *userCarID)
+
+	// A scan can only be confirmed once
+	resp, body = makeRequest(t, http.MethodPost, confirmURL, map[string]int{"candidate_index": 0}, token)
+	require.Equal(t, http.StatusConflict, resp.StatusCode, "body: %s", body)
+
+	var errResp struct {
+		Code string `json:"code"`
+	}
+	require.NoError(t, json.Unmarshal(body, &errResp))
+	assert.Equal(t, "scan_already_confirmed", errResp.Code)
+}
+
+// Helper to send a scan photo as a raw or multipart body instead of JSON.
+func makeUploadRequest(t *testing.T, path, contentType string, body []byte, token string) (*http.Response, []byte) {
+	req, err := http.NewRequest(http.MethodPost, getBaseURL()+path, bytes.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := httpClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, respBody
+}
+
+// oversizedPNGHeader returns the start of a PNG of the given size, enough for
+// its dimensions to be read
+func oversizedPNGHeader(t *testing.T, width, height uint32) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+	chunk := []byte("IHDR")
+	chunk = binary.BigEndian.AppendUint32(chunk, width)
+	chunk = binary.BigEndian.AppendUint32(chunk, height)
+	chunk = append(chunk, 8, 2, 0, 0, 0) // 8-bit RGB
+	require.NoError(t, binary.Write(&buf, binary.BigEndian, uint32(len(chunk)-4)))
+	buf.Write(chunk)
+	require.NoError(t, binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(chunk)))
+	return buf.Bytes()
+}
+
+func TestScanUploadIntegration(t *testing.T) {
+	user := createTestUser(t)
+	createTestUserInDB(t, user)
+	token := loginUser(t, user.Email, user.Password)
+
+	// The body is sniffed, so a declared image type isn't enough
+	resp, body := makeUploadRequest(t, "/scan", "image/jpeg", []byte("definitely not a photo"), token)
+	require.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode, "body: %s", body)
+
+	var errResp struct {
+		Code string `json:"code"`
+	}
+	require.NoError(t, json.Unmarshal(body, &errResp))
+	assert.Equal(t, "unsupported_media_type", errResp.Code)
+
+	// A multipart form without an image field
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	require.NoError(t, writer.WriteField("note", "no photo here"))
+	require.NoError(t, writer.Close())
+	resp, body = makeUploadRequest(t, "/scan", writer.FormDataContentType(), form.Bytes(), token)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode, "body: %s", body)
+
+	// A small file claiming huge dimensions is rejected before it's decoded
+	resp, body = makeUploadRequest(t, "/scan", "image/png", oversizedPNGHeader(t, 10000, 10000), token)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode, "body: %s", body)
+	assert.Contains(t, string(body), "megapixels")
+
+	// A multipart photo is queued like a base64 one
+	imgBytes, err := os.ReadFile(GOOD_IMAGE)
+	require.NoError(t, err)
+	form.Reset()
+	writer = multipart.NewWriter(&form)
+	part, err := writer.CreateFormFile("image", "car.jpeg")
+	require.NoError(t, err)
+	_, err = part.Write(imgBytes)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	resp, body = makeUploadRequest(t, "/scan/jobs", writer.FormDataContentType(), form.Bytes(), token)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode, "body: %s", body)
+
+	var job struct {
+		ID    int    `json:"id"`
+		Stage string `json:"stage"`
+	}
+	require.NoError(t, json.Unmarshal(body, &job))
+	assert.NotZero(t, job.ID)
+
+	var imageType string
+	err = testDB.QueryRow(context.Background(),
+		"SELECT image_type FROM scan_jobs WHERE id = $1", job.ID).Scan(&imageType)
+	require.NoError(t, err)
+	assert.Equal(t, "image/jpeg", imageType)
+}
+
+func TestTwoPhotoScanIntegration_SamePhoto(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Forget earlier scans of the test photo so it isn't rejected as recycled
+	_, err := testDB.Exec(ctx, "DELETE FROM scan_history")
+	require.NoError(t, err)
+
+	user := createTestUser(t)
+	userId := createTestUserInDB(t, user)
+	token := loginUser(t, user.Email, user.Password)
+
+	// The same picture twice is rejected before the vision model sees it
+	base64Image := loadImage(t, GOOD_IMAGE)
+	resp, body := makeRequest(t, http.MethodPost, "/scan", map[string]string{
+		"base64_image":        base64Image,
+		"second_base64_image": base64Image,
+	}, token)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode, "body: %s", body)
+
+	var errResp struct {
+		Code string `json:"code"`
+	}
+	require.NoError(t, json.Unmarshal(body, &errResp))
+	assert.Equal(t, "scan_photos_not_distinct", errResp.Code)
+
+	var outcome string
+	var photoCount int
+	err = testDB.QueryRow(ctx,
+		"SELECT outcome, photo_count FROM scan_history WHERE user_id = $1",
+		userId).Scan(&outcome, &photoCount)
+	require.NoError(t, err)
+	assert.Equal(t, "photos_not_distinct", outcome)
+	assert.Equal(t, 2, photoCount)
+}
+
+func TestScanIntegration_RetryAfterFailedScan(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 240*time.Second)
+	defer cancel()
+
+	// Forget earlier scans of the test photo so it isn't rejected as recycled
+	_, err := testDB.Exec(ctx, "DELETE FROM scan_history")
+	require.NoError(t, err)
+
+	user := createTestUser(t)
+	userId := createTestUserInDB(t, user)
+	token := loginUser(t, user.Email, user.Password)
+
+	// Sending the photo twice fails before the vision model is called, but
+	// still records its hash
+	base64Image := loadImage(t, GOOD_IMAGE)
+	resp, body := makeRequest(t, http.MethodPost, "/scan", map[string]string{
+		"base64_image":        base64Image,
+		"second_base64_image": base64Image,
+	}, token)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode, "body: %s", body)
+
+	// Make it a scan whose vision call failed
+	tag, err := testDB.Exec(ctx, `
+		UPDATE scan_history SET outcome = 'ai_error', rejection_reason = 'vision model unavailable'
+		WHERE user_id = $1 AND image_hash IS NOT NULL`, userId)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, tag.RowsAffected())
+
+	// Retrying with the same photo isn't treated as recycling it
+	resp, body = makeRequest(t, http.MethodPost, "/scan", map[string]string{
+		"base64_image": base64Image,
+	}, token)
+	require.NotEqual(t, http.StatusConflict, resp.StatusCode, "body: %s", body)
+
+	var outcome string
+	err = testDB.QueryRow(ctx,
+		"SELECT outcome FROM scan_history WHERE user_id = $1 ORDER BY id DESC LIMIT 1",
+		userId).Scan(&outcome)
+	require.NoError(t, err)
+	assert.NotEqual(t, "recycled_image", outcome)
+}
+
+func TestScanConfirmIntegration_RecycledWhileWaiting(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	user := createTestUser(t)
+	userId := createTestUserInDB(t, user)
+	token := loginUser(t, user.Email, user.Password)
+
+	imgBytes, err := os.ReadFile(GOOD_IMAGE)
+	require.NoError(t, err)
+	imageHash := time.Now().UnixNano()
+
+	var pendingID int
+	err = testDB.QueryRow(ctx, `
+		INSERT INTO pending_scans (user_id, color, candidates, image_data, image_hash, expires_at)
+		VALUES ($1, 'White', $2, $3, $4, NOW() + INTERVAL '1 hour')
+		RETURNING id`,
+		userId, `[{"make": "Toyota", "model": "Corolla", "trim": "LE", "year": "2020-2022", "confidence": 0.45}]`,
+		imgBytes, imageHash,
+	).Scan(&pendingID)
+	require.NoError(t, err)
+
+	// Someone else collects a car with the same photo while the scan waits
+	other := createTestUser(t)
+	otherID := createTestUserInDB(t, other)
+	_, err = testDB.Exec(ctx, `
+		INSERT INTO scan_history (user_id, color, image_path, success, outcome, image_hash)
+		VALUES ($1, 'White', '', true, 'success', $2)`, otherID, imageHash)
+	require.NoError(t, err)
+
+	resp, body := makeRequest(t, http.MethodPost, fmt.Sprintf("/scan/%d/confirm", pendingID), map[string]int{"candidate_index": 0}, token)
+	require.Equal(t, http.StatusConflict, resp.StatusCode, "body: %s", body)
+
+	var errResp struct {
+		Code string `json:"code"`
+	}
+	require.NoError(t, json.Unmarshal(body, &errResp))
+	assert.Equal(t, "recycled_image", errResp.Code)
+
+	var userCars int
+	require.NoError(t, testDB.QueryRow(ctx, "SELECT COUNT(*) FROM user_cars WHERE user_id = $1", userId).Scan(&userCars))
+	assert.Zero(t, userCars)
+}
+
+func TestScanIntegration_PendingScanPhotoIsNotRecycled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	// Forget earlier scans of the test photo so it isn't rejected as recycled
+	_, err := testDB.Exec(ctx, "DELETE FROM scan_history")
+	require.NoError(t, err)
+	_, err = testDB.Exec(ctx, "DELETE FROM pending_scans")
+	require.NoError(t, err)
+
+	// Another user's scan of the photo is waiting for confirmation. Sending
+	// the photo twice records its hash without calling the vision model.
+	other := createTestUser(t)
+	otherID := createTestUserInDB(t, other)
+	otherToken := loginUser(t, other.Email, other.Password)
+	base64Image := loadImage(t, GOOD_IMAGE)
+	resp, body := makeRequest(t, http.MethodPost, "/scan", map[string]string{
+		"base64_image":        base64Image,
+		"second_base64_image": base64Image,
+	}, otherToken)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode, "body: %s", body)
+	_, err = testDB.Exec(ctx, `
+		INSERT INTO pending_scans (user_id, color, candidates, image_hash, expires_at)
+		SELECT user_id, 'White', '[]', image_hash, NOW() + INTERVAL '1 hour'
+		FROM scan_history WHERE user_id = $1`, otherID)
+	require.NoError(t, err)
+	_, err = testDB.Exec(ctx, "DELETE FROM scan_history WHERE user_id = $1", otherID)
+	require.NoError(t, err)
+
+	user := createTestUser(t)
+	createTestUserInDB(t, user)
+	token := loginUser(t, user.Email, user.Password)
+	resp, body = makeRequest(t, http.MethodPost, "/scan", map[string]string{"base64_image": base64Image}, token)
+	require.Equal(t, http.StatusConflict, resp.StatusCode, "body: %s", body)
+	assert.Contains(t, string(body), `"code":"recycled_image"`)
+}
+
+func TestScanIntegration_ExpiredPendingScanIsRecorded(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	user := createTestUser(t)
+	userId := createTestUserInDB(t, user)
+
+	var pendingID int
+	err := testDB.QueryRow(ctx, `
+		INSERT INTO pending_scans (user_id, color, candidates, image_data, image_hash, expires_at)
+		VALUES ($1, 'White', '[]', $2, $3, NOW() - INTERVAL '1 minute')
+		RETURNING id`,
+		userId, []byte("photo"), time.Now().UnixNano(),
+	).Scan(&pendingID)
+	require.NoError(t, err)
+
+	// The scan workers sweep expired scans between jobs
+	require.Eventually(t, func() bool {
+		var status string
+		require.NoError(t, testDB.QueryRow(ctx, "SELECT status FROM pending_scans WHERE id = $1", pendingID).Scan(&status))
+		return status == "expired"
+	}, 30*time.Second, time.Second, "pending scan should expire")
+
+	var outcome string
+	var success bool
+	err = testDB.QueryRow(ctx,
+		"SELECT outcome, success FROM scan_history WHERE user_id = $1",
+		userId).Scan(&outcome, &success)
+	require.NoError(t, err)
+	assert.Equal(t, "expired", outcome)
+	assert.False(t, success)
 }
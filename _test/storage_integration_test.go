@@ -0,0 +1,278 @@
+package test
+
+import (
+	"CarBN/common"
+	"CarBN/storage"
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestStorageIntegration_BlobStores runs the same checks against the local
+// store and, when TEST_S3_ENDPOINT is set, an S3-compatible service such as
+// MinIO (see docs/storage.md)
+func TestStorageIntegration_BlobStores(t *testing.T) {
+	local, err := storage.NewLocalStore(t.TempDir())
+	require.NoError(t, err)
+	t.Run("local", func(t *testing.T) { testBlobStore(t, local) })
+
+	t.Run("s3", func(t *testing.T) {
+		endpoint := os.Getenv("TEST_S3_ENDPOINT")
+		if endpoint == "" {
+			t.Skip("TEST_S3_ENDPOINT not set")
+		}
+		store, err := storage.NewS3Store(storage.S3Config{
+			Endpoint:        endpoint,
+			Region:          os.Getenv("TEST_S3_REGION"),
+			Bucket:          os.Getenv("TEST_S3_BUCKET"),
+			AccessKeyID:     os.Getenv("TEST_S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("TEST_S3_SECRET_ACCESS_KEY"),
+			PathStyle:       true,
+		})
+		require.NoError(t, err)
+		testBlobStore(t, store)
+	})
+}
+
+func testBlobStore(t *testing.T, store storage.BlobStore) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Keys are unique per run so a shared bucket can be reused
+	prefix := fmt.Sprintf("%stest_%d/", storage.GeneratedPrefix, time.Now().UnixNano())
+	highRes := prefix + "Pearl White/high_res_1.jpg"
+	lowRes := prefix + "Pearl White/low_res_1.jpg"
+	t.Cleanup(func() {
+		store.Delete(context.Background(), highRes)
+		store.Delete(context.Background(), lowRes)
+	})
+
+	require.NoError(t, store.Put(ctx, highRes, []byte("high res"), "image/jpeg"))
+	require.NoError(t, store.Put(ctx, lowRes, []byte("low"), "image/jpeg"))
+
+	body, obj, err := store.Get(ctx, highRes)
+	require.NoError(t, err)
+	data := make([]byte, 64)
+	n, _ := body.Read(data)
+	body.Close()
+	assert.Equal(t, "high res", string(data[:n]))
+	assert.Equal(t, int64(8), obj.Size)
+	assert.Equal(t, "image/jpeg", obj.ContentType)
+
+	// Overwriting replaces the blob
+	require.NoError(t, store.Put(ctx, highRes, []byte("high res 2"), "image/jpeg"))
+	data, err = storage.ReadAll(ctx, store, highRes)
+	require.NoError(t, err)
+	assert.Equal(t, "high res 2", string(data))
+
+	var keys []string
+	require.NoError(t, store.List(ctx, prefix, func(obj storage.Object) error {
+		keys = append(keys, obj.Key)
+		return nil
+	}))
+	sort.Strings(keys)
+	assert.Equal(t, []string{highRes, lowRes}, keys)
+
+	// Missing blobs are ErrNotFound and deleting them is fine
+	require.NoError(t, store.Delete(ctx, lowRes))
+	_, _, err = store.Get(ctx, lowRes)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	assert.NoError(t, store.Delete(ctx, lowRes))
+
+	// Keys can't climb out of the store
+	assert.Error(t, store.Put(ctx, "../escape.jpg", []byte("x"), "image/jpeg"))
+	_, _, err = store.Get(ctx, "/etc/passwd")
+	assert.Error(t, err)
+}
+
+func TestStorageIntegration_Variants(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	store, err := storage.NewLocalStore(t.TempDir())
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 800, 400))))
+	key := storage.GeneratedPrefix + "car_1/Red/high_res_1700000000000.jpg"
+	placeholder, err := storage.SaveImage(ctx, store, key, buf.Bytes())
+	require.NoError(t, err)
+
+	// A 4x3 BlurHash is 28 characters
+	assert.Len(t, placeholder.BlurHash, 28)
+	assert.Equal(t, "#000000", placeholder.DominantColor)
+
+	// Each variant keeps the aspect ratio and never upscales
+	for _, want := range []image.Point{{256, 128}, {512, 256}, {800, 400}} {
+		width := storage.SnapWidth(want.X)
+		data, err := storage.ReadAll(ctx, store, storage.VariantKey(key, width))
+		require.NoError(t, err, "variant w%d", width)
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		require.NoError(t, err)
+		assert.Equal(t, want, image.Point{config.Width, config.Height}, "variant w%d", width)
+	}
+
+	urls := storage.URLsFor(key)
+	require.NotNil(t, urls)
+	assert.Equal(t, "generated/car_1/Red/high_res_1700000000000.jpg?w=256", urls.Thumb)
+	assert.Nil(t, storage.URLsFor("images/placeholder.jpg"))
+}
+
+func TestStorageIntegration_SignedURLs(t *testing.T) {
+	t.Setenv("IMAGE_URL_SECRET", "test-secret")
+	t.Setenv("IMAGE_URL_TTL", "1h")
+	t.Setenv("IMAGE_URL_POLICY", storage.URLPolicyPrivate)
+	signer, err := storage.NewURLSignerFromEnv(false)
+	require.NoError(t, err)
+	require.NotNil(t, signer)
+
+	query := func(signed string) url.Values {
+		_, raw, _ := strings.Cut(signed, "?")
+		values, err := url.ParseQuery(raw)
+		require.NoError(t, err)
+		return values
+	}
+
+	// Car renders are shared by everyone who collects the car
+	render := storage.GeneratedPrefix + "car_1/Red/high_res_1700000000000.jpg"
+	assert.Equal(t, render, signer.Sign(render))
+	assert.NoError(t, signer.Verify(render, nil))
+
+	picture := storage.ProfilePicturesPrefix + "user_1_1700000000000.jpg"
+	signed := signer.Sign(picture)
+	assert.True(t, strings.HasPrefix(signed, picture+"?exp="), signed)
+	assert.NoError(t, signer.Verify(picture, query(signed)))
+
+	// One signature covers every variant of the image
+	variants := signer.SignVariants(storage.URLsFor(picture))
+	require.NotNil(t, variants)
+	values := query(variants.Thumb)
+	assert.Equal(t, "256", values.Get("w"))
+	assert.NoError(t, signer.Verify(storage.VariantKey(picture, 1024), values))
+
+	assert.ErrorIs(t, signer.Verify(picture, nil), storage.ErrURLUnsigned)
+	assert.ErrorIs(t, signer.Verify(storage.ProfilePicturesPrefix+"user_2_1700000000000.jpg", query(signed)), storage.ErrURLInvalid)
+	tampered := query(signed)
+	tampered.Set("exp", "1")
+	assert.ErrorIs(t, signer.Verify(picture, tampered), storage.ErrURLInvalid)
+}
+
+// TestStorageIntegration_SignedLocalImages checks that a production server on
+// the local backend serves images itself, so their signatures are enforced
+func TestStorageIntegration_SignedLocalImages(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	t.Setenv("STORAGE_BACKEND", storage.BackendLocal)
+	t.Setenv("STORAGE_DIR", t.TempDir())
+	t.Setenv("SCAN_STORAGE_DIR", t.TempDir())
+	t.Setenv("IMAGE_URL_SECRET", "")
+	t.Setenv("JWT_SECRET", "test-jwt-secret")
+	_, err := storage.NewURLSignerFromEnv(false)
+	assert.Error(t, err, "production needs its own IMAGE_URL_SECRET")
+	unsigned, err := storage.NewURLSignerFromEnv(true)
+	require.NoError(t, err)
+	assert.Nil(t, unsigned, "development may leave URLs unsigned")
+
+	t.Setenv("IMAGE_URL_SECRET", "test-secret")
+	t.Setenv("IMAGE_URL_POLICY", storage.URLPolicyPrivate)
+	signer, err := storage.NewURLSignerFromEnv(false)
+	require.NoError(t, err)
+	require.NotNil(t, signer)
+	require.True(t, storage.ServesImages(false, signer))
+
+	store, err := storage.NewFromEnv()
+	require.NoError(t, err)
+	picture := storage.ProfilePicturesPrefix + "user_1_1700000000000.jpg"
+	var img bytes.Buffer
+	require.NoError(t, png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 8, 8))))
+	require.NoError(t, storage.PutImage(ctx, store, picture, img.Bytes()))
+
+	// Registered the way main does it
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /images/", storage.NewHTTPHandler(store, signer).HandleGetImage)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), common.LoggerCtxKey, logger)))
+	}))
+	defer server.Close()
+
+	get := func(path string) int {
+		resp, err := http.Get(server.URL + "/images/" + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusForbidden, get(picture))
+	assert.Equal(t, http.StatusOK, get(signer.Sign(picture)))
+}
+
+// TestStorageIntegration_PrivateDir checks that the local backend keeps scan
+// photos and archived images out of the served directory
+func TestStorageIntegration_PrivateDir(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	publicDir, privateDir := t.TempDir(), t.TempDir()
+	t.Setenv("STORAGE_BACKEND", storage.BackendLocal)
+	t.Setenv("STORAGE_DIR", publicDir)
+	t.Setenv("SCAN_STORAGE_DIR", privateDir)
+
+	// A scan photo saved by an earlier version is moved out at startup
+	legacy, err := storage.NewLocalStore(publicDir)
+	require.NoError(t, err)
+	require.NoError(t, legacy.Put(ctx, storage.ScansPrefix+"user_1/rejected_scan_1.jpg", []byte("old scan"), "image/jpeg"))
+
+	store, err := storage.NewFromEnv()
+	require.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(publicDir, "scans", "user_1", "rejected_scan_1.jpg"))
+	assert.FileExists(t, filepath.Join(privateDir, "scans", "user_1", "rejected_scan_1.jpg"))
+
+	require.NoError(t, store.Put(ctx, storage.ScansPrefix+"user_1/scan_2.jpg", []byte("scan"), "image/jpeg"))
+	require.NoError(t, store.Put(ctx, "archive/generated/car_1/Red/high_res_1.jpg", []byte("archived"), "image/jpeg"))
+	require.NoError(t, store.Put(ctx, storage.GeneratedPrefix+"car_1/Red/high_res_2.jpg", []byte("render"), "image/jpeg"))
+	assert.FileExists(t, filepath.Join(privateDir, "scans", "user_1", "scan_2.jpg"))
+	assert.FileExists(t, filepath.Join(privateDir, "archive", "generated", "car_1", "Red", "high_res_1.jpg"))
+	assert.FileExists(t, filepath.Join(publicDir, "generated", "car_1", "Red", "high_res_2.jpg"))
+	for _, prefix := range []string{storage.ScansPrefix, "archive/"} {
+		require.NoError(t, legacy.List(ctx, prefix, func(obj storage.Object) error {
+			t.Errorf("%s is in the served directory", obj.Key)
+			return nil
+		}))
+	}
+
+	// The store still reads and lists both as one
+	data, err := storage.ReadAll(ctx, store, storage.ScansPrefix+"user_1/rejected_scan_1.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, "old scan", string(data))
+	var keys []string
+	require.NoError(t, store.List(ctx, "", func(obj storage.Object) error {
+		keys = append(keys, obj.Key)
+		return nil
+	}))
+	sort.Strings(keys)
+	assert.Equal(t, []string{
+		"archive/generated/car_1/Red/high_res_1.jpg",
+		"generated/car_1/Red/high_res_2.jpg",
+		"scans/user_1/rejected_scan_1.jpg",
+		"scans/user_1/scan_2.jpg",
+	}, keys)
+
+	// The private directory can't be one the public one serves
+	t.Setenv("SCAN_STORAGE_DIR", filepath.Join(publicDir, "private"))
+	_, err = storage.NewFromEnv()
+	assert.Error(t, err)
+}
@@ -0,0 +1,87 @@
+package catalog
+
+import (
+	"CarBN/common"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+type HTTPHandler struct {
+	service *Service
+}
+
+func NewHTTPHandler(s *Service) *HTTPHandler {
+	return &HTTPHandler{service: s}
+}
+
+type mergeRequest struct {
+	CanonicalCarID  int   `json:"canonical_car_id"`
+	DuplicateCarIDs []int `json:"duplicate_car_ids"`
+	AddAliases      bool  `json:"add_aliases"`
+}
+
+// HandleMergeCars folds duplicate cars into a canonical one
+func (h *HTTPHandler) HandleMergeCars(w http.ResponseWriter, r *http.Request) {
+	logger := r.Context().Value(common.LoggerCtxKey).(*log.Logger)
+
+	userID, ok := r.Context().Value(common.UserIDCtxKey).(int)
+	if !ok {
+		logger.Printf("Invalid user ID in context")
+		common.WriteError(w, r, common.ErrInvalidUserContext)
+		return
+	}
+
+	var req mergeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		common.WriteError(w, r, common.BadRequest("invalid request body").Wrap(err))
+		return
+	}
+
+	logger.Printf("Admin %d merging cars %v into car %d", userID, req.DuplicateCarIDs, req.CanonicalCarID)
+	result, err := h.service.MergeCars(r.Context(), req.CanonicalCarID, req.DuplicateCarIDs, req.AddAliases, userID)
+	if err != nil {
+		logger.Printf("Failed to merge cars: %v", err)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to merge cars"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+type aliasRequest struct {
+	Type  string `json:"type"` // "make" or "model"
+	Alias string `json:"alias"`
+	Make  string `json:"make"`
+	Model string `json:"model,omitempty"`
+	Trim  string `json:"trim,omitempty"`
+}
+
+// HandleAddAlias adds or replaces a make or model alias
+func (h *HTTPHandler) HandleAddAlias(w http.ResponseWriter, r *http.Request) {
+	logger := r.Context().Value(common.LoggerCtxKey).(*log.Logger)
+
+	var req aliasRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		common.WriteError(w, r, common.BadRequest("invalid request body").Wrap(err))
+		return
+	}
+
+	var err error
+	switch req.Type {
+	case "make":
+		err = h.service.AddMakeAlias(r.Context(), req.Alias, req.Make)
+	case "model":
+		err = h.service.AddModelAlias(r.Context(), req.Make, req.Alias, req.Model, req.Trim)
+	default:
+		err = common.BadRequest(`type must be "make" or "model"`)
+	}
+	if err != nil {
+		logger.Printf("Failed to add %s alias %q: %v", req.Type, req.Alias, err)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to add alias"))
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
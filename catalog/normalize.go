@@ -0,0 +1,152 @@
+package catalog
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Identity is the make/model/trim/year of a car as reported by the vision
+// model, or after normalization, as stored in the catalog
+type Identity struct {
+	Make      string
+	Model     string
+	Trim      string
+	Year      string
+	YearStart int // 0 when the year couldn't be parsed
+	YearEnd   int
+}
+
+// placeholderTrims are trims the vision model reports when it can't tell
+var placeholderTrims = map[string]bool{
+	"base": true, "standard": true, "n/a": true, "na": true, "none": true,
+	"unknown": true, "-": true, "default": true,
+}
+
+var yearRangePattern = regexp.MustCompile(`^(\d{4})(?:\s*[-–—/]\s*(\d{2}|\d{4}|present|current|now))?$`)
+
+// cleanName trims a name and collapses runs of whitespace
+func cleanName(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// trimPrefixFold removes prefix and the space after it from s, ignoring case
+func trimPrefixFold(s, prefix string) string {
+	if prefix == "" || len(s) <= len(prefix) {
+		return s
+	}
+	if strings.EqualFold(s[:len(prefix)], prefix) && s[len(prefix)] == ' ' {
+		return strings.TrimSpace(s[len(prefix):])
+	}
+	return s
+}
+
+// CanonicalModel strips a repeated make from the model, as in "BMW 3 Series"
+func CanonicalModel(make, model string) string {
+	return trimPrefixFold(cleanName(model), make)
+}
+
+// CanonicalTrim strips a repeated model from the trim and drops trims that
+// only mean the model couldn't tell
+func CanonicalTrim(model, trim string) string {
+	trim = trimPrefixFold(cleanName(trim), model)
+	if placeholderTrims[strings.ToLower(trim)] {
+		return ""
+	}
+	return trim
+}
+
+// ParseYearRange parses the "YYYY-YYYY" years the prompt asks for, along with
+// single years, two digit ends ("2019-23") and open ranges ("2019-present").
+// It returns 0, 0 if s isn't a year.
+func ParseYearRange(s string, now time.Time) (int, int) {
+	m := yearRangePattern.FindStringSubmatch(strings.ToLower(strings.TrimSpace(s)))
+	if m == nil {
+		return 0, 0
+	}
+
+	start, _ := strconv.Atoi(m[1])
+	end := start
+	switch {
+	case m[2] == "":
+	case m[2] == "present" || m[2] == "current" || m[2] == "now":
+		end = now.Year()
+	case len(m[2]) == 2:
+		suffix, _ := strconv.Atoi(m[2])
+		end = start - start%100 + suffix
+	default:
+		end, _ = strconv.Atoi(m[2])
+	}
+
+	if end < start {
+		return 0, 0
+	}
+	return start, end
+}
+
+// FormatYearRange is the inverse of ParseYearRange
+func FormatYearRange(start, end int) string {
+	if start == 0 {
+		return ""
+	}
+	if end == start {
+		return strconv.Itoa(start)
+	}
+	return fmt.Sprintf("%d-%d", start, end)
+}
+
+// yearOverlap returns how many years two ranges share
+func yearOverlap(aStart, aEnd, bStart, bEnd int) int {
+	return min(aEnd, bEnd) - max(aStart, bStart) + 1
+}
+
+// sameGeneration reports whether two year ranges describe the same car. The
+// ranges must share at least half of the shorter one, so a single year of
+// overlap between consecutive generations isn't enough.
+func sameGeneration(aStart, aEnd, bStart, bEnd int) bool {
+	overlap := yearOverlap(aStart, aEnd, bStart, bEnd)
+	shorter := min(aEnd-aStart, bEnd-bStart) + 1
+	return overlap > 0 && overlap*2 >= shorter
+}
+
+// candidate is an existing catalog car that may match an Identity
+type candidate struct {
+	id        int
+	trim      string
+	yearStart int
+	yearEnd   int
+}
+
+// bestMatch picks the candidate that describes the same car as id, or returns
+// 0. Candidates must already share the make and model and be in id order.
+func bestMatch(id Identity, candidates []candidate) int {
+	bestID, bestScore := 0, -1
+	for _, c := range candidates {
+		score := 0
+
+		// An unknown trim matches any trim, but an exact match is preferred
+		if id.Trim != "" && !strings.EqualFold(id.Trim, c.trim) {
+			continue
+		}
+		if strings.EqualFold(id.Trim, c.trim) {
+			score += 1000
+		}
+
+		if id.YearStart != 0 && c.yearStart != 0 {
+			if !sameGeneration(id.YearStart, id.YearEnd, c.yearStart, c.yearEnd) {
+				continue
+			}
+			score += yearOverlap(id.YearStart, id.YearEnd, c.yearStart, c.yearEnd)
+			if id.YearStart == c.yearStart && id.YearEnd == c.yearEnd {
+				score += 100
+			}
+		}
+
+		if score > bestScore {
+			bestID, bestScore = c.id, score
+		}
+	}
+	return bestID
+}
@@ -0,0 +1,129 @@
+package catalog
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseYearRange(t *testing.T) {
+	now := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		in         string
+		start, end int
+	}{
+		{"2020", 2020, 2020},
+		{"2019-2023", 2019, 2023},
+		{" 2019 - 2023 ", 2019, 2023},
+		{"2019–2023", 2019, 2023},
+		{"2019/2023", 2019, 2023},
+		{"2019-23", 2019, 2023},
+		{"1998-02", 0, 0},
+		{"2019-present", 2019, 2025},
+		{"2019-Current", 2019, 2025},
+		{"2023-2019", 0, 0},
+		{"", 0, 0},
+		{"2020s", 0, 0},
+		{"around 2020", 0, 0},
+	}
+	for _, tt := range tests {
+		start, end := ParseYearRange(tt.in, now)
+		if start != tt.start || end != tt.end {
+			t.Errorf("ParseYearRange(%q) = %d, %d, want %d, %d", tt.in, start, end, tt.start, tt.end)
+		}
+	}
+}
+
+func TestFormatYearRange(t *testing.T) {
+	tests := []struct {
+		start, end int
+		want       string
+	}{
+		{0, 0, ""},
+		{2020, 2020, "2020"},
+		{2019, 2023, "2019-2023"},
+	}
+	for _, tt := range tests {
+		if got := FormatYearRange(tt.start, tt.end); got != tt.want {
+			t.Errorf("FormatYearRange(%d, %d) = %q, want %q", tt.start, tt.end, got, tt.want)
+		}
+	}
+}
+
+func TestCanonicalNames(t *testing.T) {
+	tests := []struct {
+		make, model, trim   string
+		wantModel, wantTrim string
+	}{
+		{"BMW", "3 Series", "330i", "3 Series", "330i"},
+		{"BMW", "BMW 3 Series", "3 Series 330i", "3 Series", "330i"},
+		{"BMW", "bmw  3   Series", " 330i ", "3 Series", "330i"},
+		{"Toyota", "Corolla", "Base", "Corolla", ""},
+		{"Toyota", "Corolla", "unknown", "Corolla", ""},
+		{"Toyota", "Corolla", "Corolla", "Corolla", "Corolla"},
+		{"Mini", "Minivan", "", "Minivan", ""},
+	}
+	for _, tt := range tests {
+		model := CanonicalModel(tt.make, tt.model)
+		trim := CanonicalTrim(model, tt.trim)
+		if model != tt.wantModel || trim != tt.wantTrim {
+			t.Errorf("canonical %q %q %q = %q %q, want %q %q",
+				tt.make, tt.model, tt.trim, model, trim, tt.wantModel, tt.wantTrim)
+		}
+	}
+}
+
+func TestSameGeneration(t *testing.T) {
+	tests := []struct {
+		aStart, aEnd, bStart, bEnd int
+		want                       bool
+	}{
+		{2019, 2023, 2019, 2023, true},
+		{2020, 2020, 2019, 2023, true},
+		{2019, 2023, 2021, 2025, true},
+		{2015, 2019, 2019, 2023, false},
+		{2010, 2014, 2019, 2023, false},
+	}
+	for _, tt := range tests {
+		if got := sameGeneration(tt.aStart, tt.aEnd, tt.bStart, tt.bEnd); got != tt.want {
+			t.Errorf("sameGeneration(%d-%d, %d-%d) = %v, want %v",
+				tt.aStart, tt.aEnd, tt.bStart, tt.bEnd, got, tt.want)
+		}
+	}
+}
+
+func TestBestMatch(t *testing.T) {
+	cars := []candidate{
+		{id: 1, trim: "330i", yearStart: 2015, yearEnd: 2019},
+		{id: 2, trim: "330i", yearStart: 2019, yearEnd: 2023},
+		{id: 3, trim: "M340i", yearStart: 2019, yearEnd: 2023},
+		{id: 4, trim: "", yearStart: 2019, yearEnd: 2023},
+		{id: 5, trim: "330e", yearStart: 0, yearEnd: 0},
+	}
+
+	tests := []struct {
+		name string
+		id   Identity
+		want int
+	}{
+		{"exact trim and years", Identity{Trim: "330i", YearStart: 2019, YearEnd: 2023}, 2},
+		{"trim case is ignored", Identity{Trim: "m340I", YearStart: 2020, YearEnd: 2020}, 3},
+		{"single year in a generation", Identity{Trim: "330i", YearStart: 2017, YearEnd: 2017}, 1},
+		{"consecutive generation doesn't match", Identity{Trim: "330i", YearStart: 2023, YearEnd: 2027}, 0},
+		{"unknown trim prefers an empty trim", Identity{YearStart: 2019, YearEnd: 2023}, 4},
+		{"unknown years match any years", Identity{Trim: "330i"}, 1},
+		{"unparsed candidate years match", Identity{Trim: "330e", YearStart: 2021, YearEnd: 2021}, 5},
+		{"different trim", Identity{Trim: "320d", YearStart: 2019, YearEnd: 2023}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bestMatch(tt.id, cars); got != tt.want {
+				t.Errorf("bestMatch = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	if got := bestMatch(Identity{Trim: "330i"}, nil); got != 0 {
+		t.Errorf("bestMatch with no candidates = %d, want 0", got)
+	}
+}
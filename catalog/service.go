@@ -0,0 +1,321 @@
+package catalog
+
+import (
+	"CarBN/common"
+	"CarBN/rarity"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Querier is satisfied by both the pool and a transaction, so lookups can run
+// inside the scan transaction
+type Querier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+type Service struct {
+	db     *pgxpool.Pool
+	rarity *rarity.Service
+}
+
+func NewService(db *pgxpool.Pool, rarityService *rarity.Service) *Service {
+	return &Service{db: db, rarity: rarityService}
+}
+
+// Normalize maps a scanned identity onto the catalog's names: make and model
+// aliases are resolved, repeated prefixes and placeholder trims dropped, and
+// the year parsed into a range
+func (s *Service) Normalize(ctx context.Context, q Querier, id Identity) (Identity, error) {
+	id.Make = cleanName(id.Make)
+
+	var make string
+	err := q.QueryRow(ctx, "SELECT make FROM car_make_aliases WHERE alias = $1", strings.ToLower(id.Make)).Scan(&make)
+	if err == nil {
+		id.Make = make
+	} else if !errors.Is(err, pgx.ErrNoRows) {
+		return id, fmt.Errorf("failed to look up make alias: %w", err)
+	}
+
+	id.Model = CanonicalModel(id.Make, id.Model)
+	id.Trim = cleanName(id.Trim)
+
+	var model, aliasTrim string
+	err = q.QueryRow(ctx,
+		"SELECT model, trim FROM car_model_aliases WHERE make = $1 AND alias = $2",
+		strings.ToLower(id.Make), strings.ToLower(id.Model),
+	).Scan(&model, &aliasTrim)
+	if err == nil {
+		id.Model = model
+		if aliasTrim != "" && !strings.Contains(strings.ToLower(id.Trim), strings.ToLower(aliasTrim)) {
+			id.Trim = aliasTrim + " " + id.Trim
+		}
+	} else if !errors.Is(err, pgx.ErrNoRows) {
+		return id, fmt.Errorf("failed to look up model alias: %w", err)
+	}
+
+	id.Trim = CanonicalTrim(id.Model, id.Trim)
+
+	id.YearStart, id.YearEnd = ParseYearRange(id.Year, time.Now())
+	if id.YearStart != 0 {
+		id.Year = FormatYearRange(id.YearStart, id.YearEnd)
+	} else {
+		id.Year = cleanName(id.Year)
+	}
+
+	return id, nil
+}
+
+// FindCar returns the ID of the catalog car matching a normalized identity,
+// or 0 if there isn't one
+func (s *Service) FindCar(ctx context.Context, q Querier, id Identity) (int, error) {
+	rows, err := q.Query(ctx, `
+		SELECT id, COALESCE(trim, ''), COALESCE(year_start, 0), COALESCE(year_end, 0)
+		FROM cars
+		WHERE LOWER(make) = LOWER($1) AND LOWER(model) = LOWER($2)
+		ORDER BY id`,
+		id.Make, id.Model,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query cars: %w", err)
+	}
+	defer rows.Close()
+
+	var candidates []candidate
+	for rows.Next() {
+		var c candidate
+		if err := rows.Scan(&c.id, &c.trim, &c.yearStart, &c.yearEnd); err != nil {
+			return 0, fmt.Errorf("failed to scan car: %w", err)
+		}
+		candidates = append(candidates, c)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read cars: %w", err)
+	}
+
+	return bestMatch(id, candidates), nil
+}
+
+// AddMakeAlias maps alias to a canonical make for future scans
+func (s *Service) AddMakeAlias(ctx context.Context, alias, make string) error {
+	alias, make = strings.ToLower(cleanName(alias)), cleanName(make)
+	if alias == "" || make == "" {
+		return common.BadRequest("alias and make are required")
+	}
+
+	_, err := s.db.Exec(ctx, `
+		INSERT INTO car_make_aliases (alias, make) VALUES ($1, $2)
+		ON CONFLICT (alias) DO UPDATE SET make = EXCLUDED.make`,
+		alias, make,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save make alias: %w", err)
+	}
+	return nil
+}
+
+// AddModelAlias maps alias to a canonical model, and optionally a trim, of a
+// canonical make for future scans
+func (s *Service) AddModelAlias(ctx context.Context, make, alias, model, trim string) error {
+	make, alias, model, trim = strings.ToLower(cleanName(make)), strings.ToLower(cleanName(alias)), cleanName(model), cleanName(trim)
+	if make == "" || alias == "" || model == "" {
+		return common.BadRequest("make, alias and model are required")
+	}
+
+	_, err := s.db.Exec(ctx, `
+		INSERT INTO car_model_aliases (make, alias, model, trim) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (make, alias) DO UPDATE SET model = EXCLUDED.model, trim = EXCLUDED.trim`,
+		make, alias, model, trim,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save model alias: %w", err)
+	}
+	return nil
+}
+
+// MergeResult summarizes what a merge moved onto the canonical car
+type MergeResult struct {
+	CanonicalCarID int   `json:"canonical_car_id"`
+	MergedCarIDs   []int `json:"merged_car_ids"`
+	UserCarsMoved  int64 `json:"user_cars_moved"`
+	ScansMoved     int64 `json:"scans_moved"`
+	RenderJobs     int64 `json:"render_jobs_moved"`
+	AliasesAdded   int   `json:"aliases_added"`
+}
+
+type mergedCar struct {
+	id    int
+	make  string
+	model string
+	year  *string
+	trim  *string
+}
+
+// MergeCars folds duplicate cars into a canonical one. User cars, scan
+// history and render jobs are re-pointed, color images the canonical car
+// doesn't have are copied over, and the duplicates are deleted. With
+// addAliases, each duplicate's model name becomes an alias of the canonical
+// model so later scans find it directly.
+func (s *Service) MergeCars(ctx context.Context, canonicalID int, duplicateIDs []int, addAliases bool, mergedBy int) (*MergeResult, error) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+
+	if len(duplicateIDs) == 0 {
+		return nil, common.BadRequest("at least one duplicate car is required")
+	}
+	for _, id := range duplicateIDs {
+		if id == canonicalID {
+			return nil, common.BadRequest("a car can't be merged into itself")
+		}
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+			logger.Printf("Warning: transaction rollback error: %v", err)
+		}
+	}()
+
+	var canonicalMake, canonicalModel string
+	var canonicalTrim *string
+	err = tx.QueryRow(ctx,
+		"SELECT make, model, trim FROM cars WHERE id = $1 FOR UPDATE",
+		canonicalID,
+	).Scan(&canonicalMake, &canonicalModel, &canonicalTrim)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, common.NotFound(fmt.Sprintf("car %d not found", canonicalID))
+		}
+		return nil, fmt.Errorf("failed to load canonical car: %w", err)
+	}
+
+	rows, err := tx.Query(ctx,
+		"SELECT id, make, model, year, trim FROM cars WHERE id = ANY($1) ORDER BY id FOR UPDATE",
+		duplicateIDs,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load duplicate cars: %w", err)
+	}
+	var duplicates []mergedCar
+	for rows.Next() {
+		var d mergedCar
+		if err := rows.Scan(&d.id, &d.make, &d.model, &d.year, &d.trim); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan duplicate car: %w", err)
+		}
+		duplicates = append(duplicates, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load duplicate cars: %w", err)
+	}
+	if len(duplicates) != len(duplicateIDs) {
+		return nil, common.NotFound("one or more duplicate cars not found")
+	}
+
+	result := &MergeResult{CanonicalCarID: canonicalID}
+	for _, d := range duplicates {
+		userCars, err := tx.Exec(ctx, "UPDATE user_cars SET car_id = $1 WHERE car_id = $2", canonicalID, d.id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to move user cars of car %d: %w", d.id, err)
+		}
+		scans, err := tx.Exec(ctx, "UPDATE scan_history SET car_id = $1 WHERE car_id = $2", canonicalID, d.id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to move scan history of car %d: %w", d.id, err)
+		}
+		// Deleting the duplicate would drop its rarity history and unlink
+		// its AI usage, so both follow the car
+		if _, err := tx.Exec(ctx, "UPDATE rarity_history SET car_id = $1 WHERE car_id = $2", canonicalID, d.id); err != nil {
+			return nil, fmt.Errorf("failed to move rarity history of car %d: %w", d.id, err)
+		}
+		if _, err := tx.Exec(ctx, "UPDATE ai_usage SET car_id = $1 WHERE car_id = $2", canonicalID, d.id); err != nil {
+			return nil, fmt.Errorf("failed to move AI usage of car %d: %w", d.id, err)
+		}
+
+		// Only one active render per car/color is allowed, so drop the
+		// duplicate's job where the canonical car already has one
+		if _, err := tx.Exec(ctx, `
+			DELETE FROM render_jobs d
+			WHERE d.car_id = $1 AND d.status IN ('pending', 'processing')
+			  AND EXISTS (
+				SELECT 1 FROM render_jobs c
+				WHERE c.car_id = $2 AND c.color = d.color AND c.status IN ('pending', 'processing')
+			  )`,
+			d.id, canonicalID,
+		); err != nil {
+			return nil, fmt.Errorf("failed to drop duplicate render jobs of car %d: %w", d.id, err)
+		}
+		renders, err := tx.Exec(ctx, "UPDATE render_jobs SET car_id = $1 WHERE car_id = $2", canonicalID, d.id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to move render jobs of car %d: %w", d.id, err)
+		}
+
+		// The canonical car's own images win where both have a color
+		if _, err := tx.Exec(ctx, `
+			UPDATE cars
+			SET color_images = COALESCE((SELECT color_images FROM cars WHERE id = $1), '{}'::jsonb) ||
+				COALESCE(color_images, '{}'::jsonb)
+			WHERE id = $2`,
+			d.id, canonicalID,
+		); err != nil {
+			return nil, fmt.Errorf("failed to merge color images of car %d: %w", d.id, err)
+		}
+
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO car_merges (
+				duplicate_car_id, canonical_car_id, duplicate_make, duplicate_model,
+				duplicate_year, duplicate_trim, user_cars_moved, scans_moved, merged_by
+			) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+			d.id, canonicalID, d.make, d.model, d.year, d.trim,
+			userCars.RowsAffected(), scans.RowsAffected(), mergedBy,
+		); err != nil {
+			return nil, fmt.Errorf("failed to record merge of car %d: %w", d.id, err)
+		}
+
+		if _, err := tx.Exec(ctx, "DELETE FROM cars WHERE id = $1", d.id); err != nil {
+			return nil, fmt.Errorf("failed to delete car %d: %w", d.id, err)
+		}
+
+		if addAliases && !strings.EqualFold(d.model, canonicalModel) {
+			trim := ""
+			if canonicalTrim != nil {
+				trim = *canonicalTrim
+			}
+			if _, err := tx.Exec(ctx, `
+				INSERT INTO car_model_aliases (make, alias, model, trim) VALUES ($1, $2, $3, $4)
+				ON CONFLICT (make, alias) DO NOTHING`,
+				strings.ToLower(canonicalMake), strings.ToLower(CanonicalModel(canonicalMake, d.model)), canonicalModel, trim,
+			); err != nil {
+				return nil, fmt.Errorf("failed to add alias for car %d: %w", d.id, err)
+			}
+			result.AliasesAdded++
+		}
+
+		result.MergedCarIDs = append(result.MergedCarIDs, d.id)
+		result.UserCarsMoved += userCars.RowsAffected()
+		result.ScansMoved += scans.RowsAffected()
+		result.RenderJobs += renders.RowsAffected()
+	}
+
+	// The canonical car has gained the duplicates' copies
+	if err := s.rarity.RecomputeCar(ctx, tx, canonicalID); err != nil {
+		return nil, fmt.Errorf("failed to recompute rarity: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	logger.Printf("Merged cars %v into car %d: %d user cars, %d scans, %d render jobs moved",
+		result.MergedCarIDs, canonicalID, result.UserCarsMoved, result.ScansMoved, result.RenderJobs)
+	return result, nil
+}
@@ -0,0 +1,46 @@
+package catalog
+
+// Specs is the full spec sheet of a car beyond the basics every car card
+// shows. Fields are nil until the car has been enriched, and stay nil when
+// they don't apply (e.g. battery_capacity for a gasoline car). The units
+// noted are those stored; ConvertUnits converts them for output.
+type Specs struct {
+	FuelType         *string  `json:"fuel_type,omitempty"`
+	Displacement     *float64 `json:"displacement,omitempty"` // Liters
+	CylinderCount    *int     `json:"cylinder_count,omitempty"`
+	ForcedInduction  *bool    `json:"forced_induction,omitempty"`
+	Hybrid           *bool    `json:"hybrid,omitempty"`
+	BatteryCapacity  *float64 `json:"battery_capacity,omitempty"` // kWh
+	Range            *float64 `json:"range,omitempty"`            // Kilometers on a full charge
+	ChargingTime     *float64 `json:"charging_time,omitempty"`    // Hours
+	TransmissionType *string  `json:"transmission_type,omitempty"`
+	GearCount        *int     `json:"gear_count,omitempty"`
+	Length           *float64 `json:"length,omitempty"` // Millimeters
+	Width            *float64 `json:"width,omitempty"`
+	Height           *float64 `json:"height,omitempty"`
+	Wheelbase        *float64 `json:"wheelbase,omitempty"`
+	GroundClearance  *float64 `json:"ground_clearance,omitempty"`
+	BodyType         *string  `json:"body_type,omitempty"`
+	Doors            *int     `json:"doors,omitempty"`
+	WheelSize        *float64 `json:"wheel_size,omitempty"` // Inches
+
+	// The unit system of every spec of the car, set by ConvertUnits
+	Units string `json:"units,omitempty"`
+}
+
+// SpecColumns selects the Specs columns of the cars table aliased as c, in
+// the order ScanTargets expects them
+const SpecColumns = `c.fuel_type, c.displacement, c.cylinder_count, c.forced_induction, c.hybrid,
+	c.battery_capacity, c.range, c.charging_time, c.transmission_type, c.gear_count,
+	c.length, c.width, c.height, c.wheelbase, c.ground_clearance,
+	c.body_type, c.doors, c.wheel_size`
+
+// ScanTargets returns pointers to the fields for scanning SpecColumns
+func (s *Specs) ScanTargets() []interface{} {
+	return []interface{}{
+		&s.FuelType, &s.Displacement, &s.CylinderCount, &s.ForcedInduction, &s.Hybrid,
+		&s.BatteryCapacity, &s.Range, &s.ChargingTime, &s.TransmissionType, &s.GearCount,
+		&s.Length, &s.Width, &s.Height, &s.Wheelbase, &s.GroundClearance,
+		&s.BodyType, &s.Doors, &s.WheelSize,
+	}
+}
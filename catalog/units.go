@@ -0,0 +1,97 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Unit systems car specs are returned in. Specs are stored in metric units
+// (Nm, km/h, kg, km, mm) and converted for users who prefer imperial.
+// Horsepower, displacement (liters), battery capacity (kWh), charging time,
+// acceleration and wheel size (inches) read the same in both.
+const (
+	UnitsMetric   = "metric"
+	UnitsImperial = "imperial"
+
+	// Users who haven't picked get the units specs were shown in before
+	// they were stored in metric
+	DefaultUnits = UnitsImperial
+)
+
+const (
+	newtonMetersPerPoundFoot = 1.3558179483
+	kilometersPerMile        = 1.609344
+	kilogramsPerPound        = 0.45359237
+	millimetersPerInch       = 25.4
+)
+
+// ValidUnits reports whether units is a unit system specs can be returned in
+func ValidUnits(units string) bool {
+	return units == UnitsMetric || units == UnitsImperial
+}
+
+// UnitPreference returns the unit system userID wants specs in
+func UnitPreference(ctx context.Context, q Querier, userID int) (string, error) {
+	var units string
+	err := q.QueryRow(ctx, "SELECT unit_preference FROM users WHERE id = $1", userID).Scan(&units)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return DefaultUnits, nil
+		}
+		return "", fmt.Errorf("failed to get unit preference: %w", err)
+	}
+	return units, nil
+}
+
+// Torque converts newton meters to units (lb-ft for imperial)
+func Torque(nm int, units string) int {
+	if units != UnitsImperial {
+		return nm
+	}
+	return int(math.Round(float64(nm) / newtonMetersPerPoundFoot))
+}
+
+// Speed converts km/h to units (mph for imperial)
+func Speed(kmh int, units string) int {
+	if units != UnitsImperial {
+		return kmh
+	}
+	return int(math.Round(float64(kmh) / kilometersPerMile))
+}
+
+// Weight converts kilograms to units (lbs for imperial)
+func Weight(kg float64, units string) float64 {
+	if units != UnitsImperial {
+		return kg
+	}
+	return roundTo(kg/kilogramsPerPound, 1)
+}
+
+// ConvertUnits converts the specs, read in metric, to units and records which
+// units they're in
+func (s *Specs) ConvertUnits(units string) {
+	s.Units = units
+	if units != UnitsImperial {
+		return
+	}
+
+	if s.Range != nil {
+		miles := roundTo(*s.Range/kilometersPerMile, 1)
+		s.Range = &miles
+	}
+	for _, length := range []**float64{&s.Length, &s.Width, &s.Height, &s.Wheelbase, &s.GroundClearance} {
+		if *length != nil {
+			inches := roundTo(**length/millimetersPerInch, 1)
+			*length = &inches
+		}
+	}
+}
+
+func roundTo(v float64, decimals int) float64 {
+	scale := math.Pow(10, float64(decimals))
+	return math.Round(v*scale) / scale
+}
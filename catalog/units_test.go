@@ -0,0 +1,68 @@
+package catalog
+
+import "testing"
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		name  string
+		units string
+		got   float64
+		want  float64
+	}{
+		{"torque metric", UnitsMetric, float64(Torque(400, UnitsMetric)), 400},
+		{"torque imperial", UnitsImperial, float64(Torque(400, UnitsImperial)), 295},
+		{"speed metric", UnitsMetric, float64(Speed(250, UnitsMetric)), 250},
+		{"speed imperial", UnitsImperial, float64(Speed(250, UnitsImperial)), 155},
+		{"weight metric", UnitsMetric, Weight(1500, UnitsMetric), 1500},
+		{"weight imperial", UnitsImperial, Weight(1500, UnitsImperial), 3306.9},
+		{"unknown units stay metric", "furlongs", float64(Speed(250, "furlongs")), 250},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestSpecsConvertUnits(t *testing.T) {
+	ptr := func(v float64) *float64 { return &v }
+
+	specs := Specs{Range: ptr(400), Length: ptr(4630), Width: ptr(1780), GroundClearance: ptr(135), WheelSize: ptr(18)}
+	specs.ConvertUnits(UnitsImperial)
+
+	want := map[string]struct {
+		got  *float64
+		want float64
+	}{
+		"range":            {specs.Range, 248.5},
+		"length":           {specs.Length, 182.3},
+		"width":            {specs.Width, 70.1},
+		"ground_clearance": {specs.GroundClearance, 5.3},
+		"wheel_size":       {specs.WheelSize, 18},
+	}
+	for name, v := range want {
+		if v.got == nil || *v.got != v.want {
+			t.Errorf("%s = %v, want %v", name, v.got, v.want)
+		}
+	}
+	if specs.Height != nil || specs.Wheelbase != nil {
+		t.Errorf("missing specs were filled in: height %v, wheelbase %v", specs.Height, specs.Wheelbase)
+	}
+	if specs.Units != UnitsImperial {
+		t.Errorf("units = %q, want %q", specs.Units, UnitsImperial)
+	}
+
+	metric := Specs{Range: ptr(400)}
+	metric.ConvertUnits(UnitsMetric)
+	if *metric.Range != 400 || metric.Units != UnitsMetric {
+		t.Errorf("metric specs = %v %q, want unchanged", *metric.Range, metric.Units)
+	}
+}
+
+func TestValidUnits(t *testing.T) {
+	for units, want := range map[string]bool{UnitsMetric: true, UnitsImperial: true, "": false, "Metric": false} {
+		if got := ValidUnits(units); got != want {
+			t.Errorf("ValidUnits(%q) = %v, want %v", units, got, want)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+// Command fakeai is a stand-in for the AI providers the server talks to, so
+// the scan → car → image flow can run offline. It answers the
+// OpenAI-compatible /chat/completions and /images/generations endpoints and
+// the Gemini generateContent and Imagen predict endpoints with canned
+// fixtures.
+//
+// Point the server at it with:
+//
+//	DEFAULT_BASE_URL=http://127.0.0.1:5000
+//	GEMINI_BASE_URL=http://127.0.0.1:5000
+//	IMAGE_GEN_BASE_URL=http://127.0.0.1:5000
+//
+// See docs/ai_testing.md for the fixtures and how to override them.
+package main
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+//go:embed fixtures
+var embedded embed.FS
+
+// Fixture files. A photo's sha256 in photos/ overrides the scan reply for it.
+const (
+	scanFixture   = "scan.json"
+	specsFixture  = "specs.json"
+	imageFixture  = "car.png"
+	photosFixture = "photos"
+)
+
+type server struct {
+	fixtures fs.FS
+}
+
+func main() {
+	addr := os.Getenv("FAKEAI_ADDR")
+	if addr == "" {
+		addr = "127.0.0.1:5000"
+	}
+
+	var fixtures fs.FS
+	if dir := os.Getenv("FAKEAI_FIXTURES"); dir != "" {
+		fixtures = os.DirFS(dir)
+	} else {
+		sub, err := fs.Sub(embedded, "fixtures")
+		if err != nil {
+			log.Fatalf("Failed to open built-in fixtures: %v", err)
+		}
+		fixtures = sub
+	}
+	s := &server{fixtures: fixtures}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /chat/completions", s.handleChatCompletions)
+	mux.HandleFunc("POST /v1/chat/completions", s.handleChatCompletions)
+	mux.HandleFunc("POST /images/generations", s.handleImageGenerations)
+	mux.HandleFunc("POST /v1/images/generations", s.handleImageGenerations)
+	mux.HandleFunc("POST /v1beta/models/{call}", s.handleGemini)
+
+	log.Printf("Fake AI server listening on %s", addr)
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
+
+// handleChatCompletions answers a chat completion with the scan reply when
+// the message has a photo, and the spec sheet otherwise
+func (s *server) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Messages []struct {
+			Content json.RawMessage `json:"content"`
+		} `json:"messages"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var photo string
+	for _, m := range req.Messages {
+		var parts []struct {
+			Type     string `json:"type"`
+			ImageURL struct {
+				URL string `json:"url"`
+			} `json:"image_url"`
+		}
+		// Plain text messages have a string as content
+		if json.Unmarshal(m.Content, &parts) != nil {
+			continue
+		}
+		for _, p := range parts {
+			if p.Type == "image_url" {
+				_, photo, _ = strings.Cut(p.ImageURL.URL, ",")
+			}
+		}
+	}
+
+	reply, err := s.reply(photo)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"id":     "chatcmpl-fake",
+		"object": "chat.completion",
+		"choices": []interface{}{
+			map[string]interface{}{
+				"index":         0,
+				"message":       map[string]string{"role": "assistant", "content": reply},
+				"finish_reason": "stop",
+			},
+		},
+	})
+}
+
+// handleImageGenerations answers an image generation with the car image
+func (s *server) handleImageGenerations(w http.ResponseWriter, r *http.Request) {
+	image, err := fs.ReadFile(s.fixtures, imageFixture)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"created": 0,
+		"data": []interface{}{
+			map[string]string{"b64_json": base64.StdEncoding.EncodeToString(image)},
+		},
+	})
+}
+
+// handleGemini answers models/{model}:generateContent like handleChatCompletions
+// and models/{model}:predict with the car image
+func (s *server) handleGemini(w http.ResponseWriter, r *http.Request) {
+	_, method, _ := strings.Cut(r.PathValue("call"), ":")
+	switch method {
+	case "generateContent":
+		var req struct {
+			Contents []struct {
+				Parts []struct {
+					InlineData *struct {
+						Data string `json:"data"`
+					} `json:"inlineData"`
+				} `json:"parts"`
+			} `json:"contents"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		var photo string
+		for _, c := range req.Contents {
+			for _, p := range c.Parts {
+				if p.InlineData != nil {
+					photo = p.InlineData.Data
+				}
+			}
+		}
+
+		reply, err := s.reply(photo)
+		if err != nil {
+			s.fail(w, err)
+			return
+		}
+
+		writeJSON(w, map[string]interface{}{
+			"candidates": []interface{}{
+				map[string]interface{}{
+					"content": map[string]interface{}{
+						"role":  "model",
+						"parts": []interface{}{map[string]string{"text": reply}},
+					},
+					"finishReason": "STOP",
+				},
+			},
+		})
+	case "predict":
+		image, err := fs.ReadFile(s.fixtures, imageFixture)
+		if err != nil {
+			s.fail(w, err)
+			return
+		}
+
+		writeJSON(w, map[string]interface{}{
+			"predictions": []interface{}{
+				map[string]string{
+					"bytesBase64Encoded": base64.StdEncoding.EncodeToString(image),
+					"mimeType":           "image/png",
+				},
+			},
+		})
+	default:
+		http.Error(w, fmt.Sprintf("unsupported method %q", method), http.StatusNotFound)
+	}
+}
+
+// reply returns the model's answer: the scan reply for the base64 encoded
+// photo, or the spec sheet when there's no photo
+func (s *server) reply(photo string) (string, error) {
+	if photo == "" {
+		data, err := fs.ReadFile(s.fixtures, specsFixture)
+		return string(data), err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(photo)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode photo: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	override := photosFixture + "/" + hex.EncodeToString(sum[:]) + ".json"
+
+	reply, err := fs.ReadFile(s.fixtures, override)
+	if errors.Is(err, fs.ErrNotExist) {
+		reply, err = fs.ReadFile(s.fixtures, scanFixture)
+	}
+	return string(reply), err
+}
+
+func (s *server) fail(w http.ResponseWriter, err error) {
+	log.Printf("Error: %v", err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
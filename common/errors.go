@@ -0,0 +1,191 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// Error kinds. Every AppError has one, and it decides the HTTP status the
+// error is reported with. Use errors.Is(err, ErrNotFound) and friends to
+// branch on the kind.
+var (
+	ErrBadRequest       = errors.New("bad request")
+	ErrUnauthorized     = errors.New("unauthorized")
+	ErrForbidden        = errors.New("forbidden")
+	ErrNotFound         = errors.New("not found")
+	ErrMethodNotAllowed = errors.New("method not allowed")
+	ErrConflict         = errors.New("conflict")
+	ErrPayloadTooLarge  = errors.New("payload too large")
+	ErrUnsupportedMedia = errors.New("unsupported media type")
+	ErrPaymentRequired  = errors.New("payment required")
+	ErrRateLimited      = errors.New("rate limited")
+	ErrUpstreamFailure  = errors.New("upstream failure")
+	ErrInternal         = errors.New("internal error")
+)
+
+var kindStatus = map[error]int{
+	ErrBadRequest:       http.StatusBadRequest,
+	ErrUnauthorized:     http.StatusUnauthorized,
+	ErrForbidden:        http.StatusForbidden,
+	ErrNotFound:         http.StatusNotFound,
+	ErrMethodNotAllowed: http.StatusMethodNotAllowed,
+	ErrConflict:         http.StatusConflict,
+	ErrPayloadTooLarge:  http.StatusRequestEntityTooLarge,
+	ErrUnsupportedMedia: http.StatusUnsupportedMediaType,
+	ErrPaymentRequired:  http.StatusPaymentRequired,
+	ErrRateLimited:      http.StatusTooManyRequests,
+	ErrUpstreamFailure:  http.StatusBadGateway,
+	ErrInternal:         http.StatusInternalServerError,
+}
+
+var kindCode = map[error]string{
+	ErrBadRequest:       "bad_request",
+	ErrUnauthorized:     "unauthorized",
+	ErrForbidden:        "forbidden",
+	ErrNotFound:         "not_found",
+	ErrMethodNotAllowed: "method_not_allowed",
+	ErrConflict:         "conflict",
+	ErrPayloadTooLarge:  "payload_too_large",
+	ErrUnsupportedMedia: "unsupported_media_type",
+	ErrPaymentRequired:  "payment_required",
+	ErrRateLimited:      "rate_limited",
+	ErrUpstreamFailure:  "upstream_failure",
+	ErrInternal:         "internal_error",
+}
+
+// AppError is an error that can be shown to API clients. Code is a stable,
+// machine readable identifier the clients branch on; Message is safe to show
+// to users. Fields holds per field messages for validation errors. The
+// wrapped Err is only logged.
+type AppError struct {
+	Kind    error
+	Code    string
+	Message string
+	Fields  map[string]string
+	Err     error
+}
+
+func (e *AppError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *AppError) Unwrap() []error {
+	if e.Err != nil {
+		return []error{e.Kind, e.Err}
+	}
+	return []error{e.Kind}
+}
+
+// Is matches AppErrors by code, so errors.Is(err, ErrDuplicateScan) holds for
+// copies made with Wrap
+func (e *AppError) Is(target error) bool {
+	t, ok := target.(*AppError)
+	return ok && t.Code == e.Code
+}
+
+// Wrap returns a copy of e with err as the underlying cause
+func (e *AppError) Wrap(err error) *AppError {
+	wrapped := *e
+	wrapped.Err = err
+	return &wrapped
+}
+
+// WithFields returns a copy of e with per field messages
+func (e *AppError) WithFields(fields map[string]string) *AppError {
+	withFields := *e
+	withFields.Fields = fields
+	return &withFields
+}
+
+// StatusCode returns the HTTP status for the error's kind
+func (e *AppError) StatusCode() int {
+	if status, ok := kindStatus[e.Kind]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// NewError creates an AppError with a specific code
+func NewError(kind error, code, message string) *AppError {
+	return &AppError{Kind: kind, Code: code, Message: message}
+}
+
+func newKindError(kind error, message string) *AppError {
+	return NewError(kind, kindCode[kind], message)
+}
+
+// Helpers for errors that don't need a more specific code than their kind
+func BadRequest(message string) *AppError       { return newKindError(ErrBadRequest, message) }
+func Unauthorized(message string) *AppError     { return newKindError(ErrUnauthorized, message) }
+func Forbidden(message string) *AppError        { return newKindError(ErrForbidden, message) }
+func NotFound(message string) *AppError         { return newKindError(ErrNotFound, message) }
+func MethodNotAllowed(message string) *AppError { return newKindError(ErrMethodNotAllowed, message) }
+func Conflict(message string) *AppError         { return newKindError(ErrConflict, message) }
+func PayloadTooLarge(message string) *AppError  { return newKindError(ErrPayloadTooLarge, message) }
+func UnsupportedMedia(message string) *AppError { return newKindError(ErrUnsupportedMedia, message) }
+func PaymentRequired(message string) *AppError  { return newKindError(ErrPaymentRequired, message) }
+func RateLimited(message string) *AppError      { return newKindError(ErrRateLimited, message) }
+func UpstreamFailure(message string) *AppError  { return newKindError(ErrUpstreamFailure, message) }
+func Internal(message string) *AppError         { return newKindError(ErrInternal, message) }
+
+// Errors shared between packages that clients need to tell apart
+var (
+	ErrScanRejected          = NewError(ErrBadRequest, "scan_rejected", RejectedScanError)
+	ErrScanMetadataRejected  = NewError(ErrBadRequest, "scan_metadata_rejected", ExifRejectedScanError)
+	ErrDuplicateScan         = NewError(ErrConflict, "duplicate_scan", DuplicateScanError)
+	ErrRecycledScan          = NewError(ErrConflict, "recycled_image", RecycledScanError)
+	ErrScanPhotosNotDistinct = NewError(ErrBadRequest, "scan_photos_not_distinct", SamePhotosScanError)
+	ErrScanPhotosMismatch    = NewError(ErrBadRequest, "scan_photos_mismatch", PhotoMismatchError)
+	ErrSecondPhotoRequired   = NewError(ErrBadRequest, "second_photo_required", "scans need a second photo of the car from a different angle")
+	ErrNoScanCredits         = NewError(ErrPaymentRequired, "no_scan_credits", "no scan credits remaining")
+	ErrReservationExpired    = NewError(ErrConflict, "credit_reservation_expired", "the scan took too long and its credit was released, please scan again")
+	ErrInsufficientCurrency  = NewError(ErrPaymentRequired, "insufficient_currency", "insufficient currency")
+	ErrInvalidUserContext    = Internal("invalid user ID in context")
+	ErrTokenExpired          = NewError(ErrUnauthorized, "token_expired", "Token expired")
+	ErrInvalidRefreshToken   = NewError(ErrUnauthorized, "invalid_refresh_token", "Refresh token has expired or is invalid")
+)
+
+// ErrorResponse is the JSON envelope every handler uses to report errors
+type ErrorResponse struct {
+	Code      string            `json:"code"`
+	Message   string            `json:"message"`
+	Errors    map[string]string `json:"errors,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+}
+
+// WriteError writes err as an ErrorResponse. Errors that aren't AppErrors are
+// reported as internal errors without exposing their message.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	var appErr *AppError
+	if !errors.As(err, &appErr) {
+		appErr = Internal("internal server error")
+	}
+
+	requestID, _ := r.Context().Value(RequestIDCtxKey).(string)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(appErr.StatusCode())
+	if encErr := json.NewEncoder(w).Encode(ErrorResponse{
+		Code:      appErr.Code,
+		Message:   appErr.Message,
+		Errors:    appErr.Fields,
+		RequestID: requestID,
+	}); encErr != nil {
+		http.Error(w, "Failed to encode error response", http.StatusInternalServerError)
+	}
+}
+
+// WriteErrorOr writes err if it's an AppError, and fallback wrapping err
+// otherwise. Handlers use it for service errors that may or may not be typed.
+func WriteErrorOr(w http.ResponseWriter, r *http.Request, err error, fallback *AppError) {
+	var appErr *AppError
+	if errors.As(err, &appErr) {
+		WriteError(w, r, err)
+		return
+	}
+	WriteError(w, r, fallback.Wrap(err))
+}
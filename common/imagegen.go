@@ -0,0 +1,308 @@
+package common
+
+import (
+	"CarBN/replay"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Names of the image generators
+const (
+	ImageGeneratorImagen      = "imagen"
+	ImageGeneratorOpenAI      = "openai"
+	ImageGeneratorPlaceholder = "placeholder"
+)
+
+const defaultOpenAIImageModel = "gpt-image-1"
+
+// ImageRequest describes a car image to generate. Prompt is rendered from the
+// prompt registry; the car's details are there for generators that draw the
+// car themselves, like the placeholder.
+type ImageRequest struct {
+	Prompt  string
+	CarID   int
+	Year    string
+	Make    string
+	Model   string
+	Trim    string
+	Color   string
+	Premium bool
+}
+
+// ImageGenerator generates car images, returning them base64 encoded
+type ImageGenerator interface {
+	Name() string
+	Model() string
+	GenerateCarImage(ctx context.Context, req ImageRequest) (string, error)
+}
+
+// NewImageGeneratorFromEnv builds the generator named by IMAGE_GEN_PROVIDER:
+// "imagen" (Imagen through the Gemini API), "openai" (an OpenAI-compatible
+// /images/generations endpoint at IMAGE_GEN_BASE_URL with IMAGE_GEN_API_KEY)
+// or "placeholder" (text cards drawn locally). IMAGE_GEN_MODEL overrides the
+// model. Without IMAGE_GEN_PROVIDER, Imagen is used when GEMINI_API_KEY is set;
+// otherwise the placeholder is only used in dev mode, since the cards it draws
+// are saved as the car's image for good.
+func NewImageGeneratorFromEnv(ctx context.Context, devMode bool) (ImageGenerator, error) {
+	name := strings.ToLower(os.Getenv("IMAGE_GEN_PROVIDER"))
+	if name == "" {
+		switch {
+		case os.Getenv("GEMINI_API_KEY") != "":
+			name = ImageGeneratorImagen
+		case devMode:
+			name = ImageGeneratorPlaceholder
+		default:
+			return nil, errors.New("IMAGE_GEN_PROVIDER not set and GEMINI_API_KEY not set")
+		}
+	}
+	model := os.Getenv("IMAGE_GEN_MODEL")
+
+	var generator ImageGenerator
+	switch name {
+	case ImageGeneratorImagen:
+		gemini, err := NewGeminiClient(ctx, os.Getenv("GEMINI_API_KEY"), model)
+		if err != nil {
+			return nil, err
+		}
+		generator = gemini
+	case ImageGeneratorOpenAI:
+		baseURL := strings.TrimSuffix(os.Getenv("IMAGE_GEN_BASE_URL"), "/")
+		if baseURL == "" {
+			return nil, errors.New("IMAGE_GEN_BASE_URL not set")
+		}
+		if model == "" {
+			model = defaultOpenAIImageModel
+		}
+		client := replay.NewClientFromEnv()
+		client.Timeout = 120 * time.Second
+		generator = &OpenAIImageGenerator{
+			baseURL: baseURL,
+			apiKey:  os.Getenv("IMAGE_GEN_API_KEY"),
+			model:   model,
+			client:  client,
+		}
+	case ImageGeneratorPlaceholder:
+		generator = &PlaceholderImageGenerator{}
+	default:
+		return nil, fmt.Errorf("unknown IMAGE_GEN_PROVIDER %q", name)
+	}
+
+	log.Printf("Image generator: %s", generator.Name())
+	return generator, nil
+}
+
+// OpenAIImageGenerator talks to any OpenAI-compatible /images/generations endpoint
+type OpenAIImageGenerator struct {
+	baseURL string
+	apiKey  string
+	model   string
+	client  *http.Client
+}
+
+func (g *OpenAIImageGenerator) Name() string {
+	return ImageGeneratorOpenAI
+}
+
+func (g *OpenAIImageGenerator) Model() string {
+	return g.model
+}
+
+func (g *OpenAIImageGenerator) GenerateCarImage(ctx context.Context, req ImageRequest) (string, error) {
+	payload := map[string]interface{}{
+		"model":  g.model,
+		"prompt": req.Prompt,
+		"n":      1,
+		"size":   "1024x1024",
+	}
+	// gpt-image models always return base64; the others need asking
+	if !strings.HasPrefix(g.model, "gpt-image") {
+		payload["response_format"] = "b64_json"
+	}
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal image payload: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", g.baseURL+"/images/generations", bytes.NewReader(payloadBytes))
+	if err != nil {
+		return "", fmt.Errorf("failed to create image request: %w", err)
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+g.apiKey)
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := g.client.Do(httpReq)
+	if err != nil {
+		return "", fmt.Errorf("image request error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response body: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("image API returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var imageResp struct {
+		Data []struct {
+			B64JSON string `json:"b64_json"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &imageResp); err != nil {
+		return "", fmt.Errorf("failed to decode image response: %w", err)
+	}
+	if len(imageResp.Data) == 0 || imageResp.Data[0].B64JSON == "" {
+		return "", fmt.Errorf("no images generated")
+	}
+	return imageResp.Data[0].B64JSON, nil
+}
+
+const placeholderSize = 1024
+
+// placeholderColors are the paint colors the placeholder knows by name; any
+// other color gets a shade derived from its name
+var placeholderColors = map[string]color.RGBA{
+	"white":  {232, 232, 228, 255},
+	"black":  {28, 28, 30, 255},
+	"silver": {176, 180, 186, 255},
+	"gray":   {110, 114, 120, 255},
+	"grey":   {110, 114, 120, 255},
+	"red":    {178, 34, 34, 255},
+	"blue":   {30, 70, 160, 255},
+	"green":  {34, 110, 60, 255},
+	"yellow": {230, 190, 30, 255},
+	"orange": {225, 110, 25, 255},
+	"brown":  {110, 70, 40, 255},
+	"beige":  {214, 196, 160, 255},
+	"gold":   {200, 160, 60, 255},
+	"purple": {100, 50, 140, 255},
+}
+
+// placeholderLine is a line of text on a placeholder card
+type placeholderLine struct {
+	text string
+	font []byte
+	size float64
+}
+
+// PlaceholderImageGenerator draws a card with the car's year, make, model and
+// color on a background of that color. It needs no API key and draws the same
+// card for the same car every time, for development and tests.
+type PlaceholderImageGenerator struct{}
+
+func (g *PlaceholderImageGenerator) Name() string {
+	return ImageGeneratorPlaceholder
+}
+
+func (g *PlaceholderImageGenerator) Model() string {
+	return ""
+}
+
+func (g *PlaceholderImageGenerator) GenerateCarImage(ctx context.Context, req ImageRequest) (string, error) {
+	background := placeholderColor(req.Color)
+	img := image.NewRGBA(image.Rect(0, 0, placeholderSize, placeholderSize))
+
+	// Darken the background towards the bottom so the card isn't flat
+	for y := 0; y < placeholderSize; y++ {
+		shade := 1 - 0.35*float64(y)/placeholderSize
+		c := color.RGBA{
+			R: uint8(float64(background.R) * shade),
+			G: uint8(float64(background.G) * shade),
+			B: uint8(float64(background.B) * shade),
+			A: 255,
+		}
+		for x := 0; x < placeholderSize; x++ {
+			img.SetRGBA(x, y, c)
+		}
+	}
+
+	// Dark text on light paint, light text on dark paint
+	text := color.RGBA{245, 245, 245, 255}
+	if luminance(background) > 150 {
+		text = color.RGBA{25, 25, 25, 255}
+	}
+
+	lines := []placeholderLine{
+		{strings.TrimSpace(req.Year + " " + req.Make), goregular.TTF, 56},
+		{req.Model, gobold.TTF, 96},
+		{req.Trim, goregular.TTF, 48},
+		{req.Color, goregular.TTF, 40},
+	}
+	if req.Premium {
+		lines = append(lines, placeholderLine{"PREMIUM", gobold.TTF, 40})
+	}
+
+	y := 380
+	for _, line := range lines {
+		if line.text == "" {
+			continue
+		}
+		face, err := placeholderFace(line.font, line.size)
+		if err != nil {
+			return "", err
+		}
+		drawer := &font.Drawer{Dst: img, Src: image.NewUniform(text), Face: face}
+		width := drawer.MeasureString(line.text).Round()
+		drawer.Dot = fixed.P((placeholderSize-width)/2, y)
+		drawer.DrawString(line.text)
+		face.Close()
+		y += int(line.size * 1.6)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", fmt.Errorf("failed to encode placeholder image: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func placeholderFace(ttf []byte, size float64) (font.Face, error) {
+	f, err := opentype.Parse(ttf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse placeholder font: %w", err)
+	}
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create placeholder font face: %w", err)
+	}
+	return face, nil
+}
+
+// placeholderColor matches a paint color like "Pearl White" by its words, or
+// derives a shade from the name
+func placeholderColor(name string) color.RGBA {
+	for _, word := range strings.Fields(strings.ToLower(name)) {
+		if c, ok := placeholderColors[word]; ok {
+			return c
+		}
+	}
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(name)))
+	sum := h.Sum32()
+	return color.RGBA{uint8(60 + sum%140), uint8(60 + (sum>>8)%140), uint8(60 + (sum>>16)%140), 255}
+}
+
+func luminance(c color.RGBA) float64 {
+	return 0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B)
+}
@@ -19,14 +19,14 @@ func NewHTTPHandler(s *Service) *HTTPHandler {
 func (h *HTTPHandler) HandleGetFeed(w http.ResponseWriter, r *http.Request) {
 	logger, ok := r.Context().Value(common.LoggerCtxKey).(*log.Logger)
 	if !ok {
-		http.Error(w, "logger not found in context", http.StatusInternalServerError)
+		common.WriteError(w, r, common.Internal("logger not found in context"))
 		return
 	}
 
 	userID, ok := r.Context().Value(common.UserIDCtxKey).(int)
 	if !ok {
 		logger.Printf("invalid user ID in context")
-		http.Error(w, "invalid user ID in context", http.StatusInternalServerError)
+		common.WriteError(w, r, common.ErrInvalidUserContext)
 		return
 	}
 
@@ -37,7 +37,7 @@ func (h *HTTPHandler) HandleGetFeed(w http.ResponseWriter, r *http.Request) {
 		pageSize, err = strconv.Atoi(pageSizeStr)
 		if err != nil {
 			logger.Printf("invalid page_size parameter: %v", err)
-			http.Error(w, "invalid page_size", http.StatusBadRequest)
+			common.WriteErrorOr(w, r, err, common.BadRequest("invalid page_size"))
 			return
 		}
 	}
@@ -51,7 +51,7 @@ func (h *HTTPHandler) HandleGetFeed(w http.ResponseWriter, r *http.Request) {
 	feed, err := h.service.GetFeed(r.Context(), userID, cursor, pageSize, feedType)
 	if err != nil {
 		logger.Printf("failed to get feed: %v", err)
-		http.Error(w, "failed to get feed", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to get feed"))
 		return
 	}
 
@@ -59,7 +59,7 @@ func (h *HTTPHandler) HandleGetFeed(w http.ResponseWriter, r *http.Request) {
 
 	if err := json.NewEncoder(w).Encode(feed); err != nil {
 		logger.Printf("failed to encode feed response: %v", err)
-		http.Error(w, "failed to encode feed", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to encode feed"))
 		return
 	}
 
@@ -69,28 +69,28 @@ func (h *HTTPHandler) HandleGetFeed(w http.ResponseWriter, r *http.Request) {
 func (h *HTTPHandler) HandleGetFeedItem(w http.ResponseWriter, r *http.Request) {
 	logger, ok := r.Context().Value(common.LoggerCtxKey).(*log.Logger)
 	if !ok {
-		http.Error(w, "logger not found in context", http.StatusInternalServerError)
+		common.WriteError(w, r, common.Internal("logger not found in context"))
 		return
 	}
 
 	userID, ok := r.Context().Value(common.UserIDCtxKey).(int)
 	if !ok {
 		logger.Printf("invalid user ID in context")
-		http.Error(w, "invalid user ID in context", http.StatusInternalServerError)
+		common.WriteError(w, r, common.ErrInvalidUserContext)
 		return
 	}
 
 	feedItemID, err := strconv.Atoi(r.PathValue("feed_item_id"))
 	if err != nil {
 		logger.Printf("invalid feed item ID: %v", err)
-		http.Error(w, "invalid feed item ID", http.StatusBadRequest)
+		common.WriteErrorOr(w, r, err, common.BadRequest("invalid feed item ID"))
 		return
 	}
 
 	item, err := h.service.GetFeedItem(r.Context(), feedItemID, userID)
 	if err != nil {
 		logger.Printf("failed to get feed item: %v", err)
-		http.Error(w, "failed to get feed item", http.StatusNotFound)
+		common.WriteErrorOr(w, r, err, common.NotFound("feed item not found"))
 		return
 	}
 
@@ -98,7 +98,7 @@ func (h *HTTPHandler) HandleGetFeedItem(w http.ResponseWriter, r *http.Request)
 
 	if err := json.NewEncoder(w).Encode(item); err != nil {
 		logger.Printf("failed to encode feed item response: %v", err)
-		http.Error(w, "failed to encode feed item", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to encode feed item"))
 		return
 	}
 
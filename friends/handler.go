@@ -31,20 +31,20 @@ func (h *HTTPHandler) HandleSendFriendRequest(w http.ResponseWriter, r *http.Req
 	var req friendRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		logger.Printf("Invalid friend request data: %v", err)
-		http.Error(w, "invalid request data", http.StatusBadRequest)
+		common.WriteErrorOr(w, r, err, common.BadRequest("invalid request data"))
 		return
 	}
 
 	userID, ok := r.Context().Value(common.UserIDCtxKey).(int)
 	if !ok {
 		logger.Printf("Invalid user ID in context")
-		http.Error(w, "invalid user ID in context", http.StatusInternalServerError)
+		common.WriteError(w, r, common.ErrInvalidUserContext)
 		return
 	}
 
 	if err := h.service.SendFriendRequest(r.Context(), userID, req.FriendID); err != nil {
 		logger.Printf("Failed to process friend request from user %d to user %d: %v", userID, req.FriendID, err)
-		http.Error(w, "failed to send friend request", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to send friend request"))
 		return
 	}
 
@@ -58,27 +58,27 @@ func (h *HTTPHandler) HandleFriendRequestResponse(w http.ResponseWriter, r *http
 	var req friendRequestResponse
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		logger.Printf("Invalid friend request response data: %v", err)
-		http.Error(w, "invalid request data", http.StatusBadRequest)
+		common.WriteErrorOr(w, r, err, common.BadRequest("invalid request data"))
 		return
 	}
 
 	if req.Response == "accept" {
 		if err := h.service.AcceptFriendRequest(r.Context(), req.RequestID); err != nil {
 			logger.Printf("Failed to accept friend request %d: %v", req.RequestID, err)
-			http.Error(w, "failed to accept request", http.StatusInternalServerError)
+			common.WriteErrorOr(w, r, err, common.Internal("failed to accept request"))
 			return
 		}
 		logger.Printf("Friend request %d accepted successfully", req.RequestID)
 	} else if req.Response == "reject" {
 		if err := h.service.RejectFriendRequest(r.Context(), req.RequestID); err != nil {
 			logger.Printf("Failed to reject friend request %d: %v", req.RequestID, err)
-			http.Error(w, "failed to reject request", http.StatusInternalServerError)
+			common.WriteErrorOr(w, r, err, common.Internal("failed to reject request"))
 			return
 		}
 		logger.Printf("Friend request %d rejected successfully", req.RequestID)
 	} else {
 		logger.Printf("Invalid friend request response type: %s", req.Response)
-		http.Error(w, "invalid response", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("invalid response"))
 		return
 	}
 
@@ -93,7 +93,7 @@ func (h *HTTPHandler) HandleGetFriends(w http.ResponseWriter, r *http.Request) {
 	targetUserID, err := strconv.Atoi(targetUserIDStr)
 	if err != nil {
 		logger.Printf("Invalid user ID: %s", targetUserIDStr)
-		http.Error(w, "invalid user ID", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("invalid user ID"))
 		return
 	}
 
@@ -111,14 +111,14 @@ func (h *HTTPHandler) HandleGetFriends(w http.ResponseWriter, r *http.Request) {
 	friends, err := h.service.GetFriends(r.Context(), targetUserID, limit, offset)
 	if err != nil {
 		logger.Printf("Failed to get friends for user %d: %v", targetUserID, err)
-		http.Error(w, "failed to get friends", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to get friends"))
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(friends); err != nil {
 		logger.Printf("Failed to encode friends response: %v", err)
-		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to encode response"))
 		return
 	}
 
@@ -133,7 +133,7 @@ func (h *HTTPHandler) HandleCheckFriendship(w http.ResponseWriter, r *http.Reque
 	targetUserID, err := strconv.Atoi(targetUserIDStr)
 	if err != nil {
 		logger.Printf("Invalid user ID: %s", targetUserIDStr)
-		http.Error(w, "invalid user ID", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("invalid user ID"))
 		return
 	}
 
@@ -141,14 +141,14 @@ func (h *HTTPHandler) HandleCheckFriendship(w http.ResponseWriter, r *http.Reque
 	currentUserID, ok := r.Context().Value(common.UserIDCtxKey).(int)
 	if !ok {
 		logger.Printf("Invalid user ID in context")
-		http.Error(w, "invalid user ID in context", http.StatusInternalServerError)
+		common.WriteError(w, r, common.ErrInvalidUserContext)
 		return
 	}
 
 	isFriend, err := h.service.CheckFriendship(r.Context(), currentUserID, targetUserID)
 	if err != nil {
 		logger.Printf("Failed to check friendship status: %v", err)
-		http.Error(w, "failed to check friendship status", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to check friendship status"))
 		return
 	}
 
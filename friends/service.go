@@ -3,6 +3,7 @@ package friends
 import (
 	"CarBN/common"
 	"CarBN/feed"
+	"CarBN/storage"
 	"context"
 	"fmt"
 	"log"
@@ -11,14 +12,16 @@ import (
 )
 
 type Service struct {
-	db   *pgxpool.Pool
-	feed *feed.Service
+	db     *pgxpool.Pool
+	feed   *feed.Service
+	signer *storage.URLSigner
 }
 
-func NewService(db *pgxpool.Pool, feedSvc *feed.Service) *Service {
+func NewService(db *pgxpool.Pool, feedSvc *feed.Service, signer *storage.URLSigner) *Service {
 	return &Service{
-		db:   db,
-		feed: feedSvc,
+		db:     db,
+		feed:   feedSvc,
+		signer: signer,
 	}
 }
 
@@ -125,9 +128,10 @@ func (s *Service) CheckFriendship(ctx context.Context, userID, friendID int) (bo
 }
 
 type Friend struct {
-	ID             int     `json:"id"`
-	DisplayName    *string `json:"display_name"`
-	ProfilePicture *string `json:"profile_picture"`
+	ID                        int                  `json:"id"`
+	DisplayName               *string              `json:"display_name"`
+	ProfilePicture            *string              `json:"profile_picture"`
+	ProfilePicturePlaceholder *storage.Placeholder `json:"profile_picture_placeholder,omitempty"`
 }
 
 type PaginatedFriends struct {
@@ -164,7 +168,7 @@ func (s *Service) GetFriends(ctx context.Context, userID int, limit int, offset
 	}
 
 	query := `
-		SELECT u.id, u.display_name, u.profile_picture
+		SELECT u.id, u.display_name, u.profile_picture, u.profile_picture_blurhash, u.profile_picture_dominant_color
 		FROM friends f
 		JOIN users u ON (f.friend_id = u.id AND f.user_id = $1) 
 			OR (f.user_id = u.id AND f.friend_id = $1)
@@ -183,10 +187,13 @@ func (s *Service) GetFriends(ctx context.Context, userID int, limit int, offset
 	var friends []Friend
 	for rows.Next() {
 		var friend Friend
-		if err := rows.Scan(&friend.ID, &friend.DisplayName, &friend.ProfilePicture); err != nil {
+		var blurHash, dominantColor *string
+		if err := rows.Scan(&friend.ID, &friend.DisplayName, &friend.ProfilePicture, &blurHash, &dominantColor); err != nil {
 			logger.Printf("Error scanning friend row: %v", err)
 			return PaginatedFriends{}, fmt.Errorf("error scanning friend data: %w", err)
 		}
+		friend.ProfilePicturePlaceholder = storage.NewPlaceholder(blurHash, dominantColor)
+		s.signer.SignPtr(friend.ProfilePicture)
 		friends = append(friends, friend)
 	}
 
@@ -0,0 +1,43 @@
+package imagegc
+
+import (
+	"CarBN/common"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+type HTTPHandler struct {
+	service *Service
+}
+
+func NewHTTPHandler(s *Service) *HTTPHandler {
+	return &HTTPHandler{service: s}
+}
+
+// HandleRunGC collects unreferenced images and reports what was collected.
+// With ?dry_run=true nothing is removed.
+func (h *HTTPHandler) HandleRunGC(w http.ResponseWriter, r *http.Request) {
+	logger := r.Context().Value(common.LoggerCtxKey).(*log.Logger)
+
+	dryRun := false
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		var err error
+		dryRun, err = strconv.ParseBool(v)
+		if err != nil {
+			common.WriteError(w, r, common.BadRequest("dry_run must be true or false"))
+			return
+		}
+	}
+
+	report, err := h.service.Run(r.Context(), dryRun)
+	if err != nil {
+		logger.Printf("Failed to collect images: %v", err)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to collect images"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,299 @@
+package imagegc
+
+import (
+	"CarBN/common"
+	"CarBN/storage"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// What happens to unreferenced images
+const (
+	ModeArchive = "archive" // Moved under ArchivePrefix, which is never served
+	ModeDelete  = "delete"
+)
+
+// ArchivePrefix is where archived images are moved, keeping their key
+const ArchivePrefix = storage.ArchivePrefix
+
+const (
+	defaultRetention             = 7 * 24 * time.Hour
+	defaultRejectedScanRetention = 30 * 24 * time.Hour
+	// maxReportKeys caps the keys listed in a report; the counts cover all of them
+	maxReportKeys = 1000
+)
+
+// collectedPrefixes are the parts of the store the collector walks
+var collectedPrefixes = []string{
+	storage.GeneratedPrefix,
+	storage.ProfilePicturesPrefix,
+	storage.ScansPrefix,
+	storage.VariantsPrefix,
+}
+
+// upgradeImageKeys are the image paths kept in a premium upgrade's metadata
+var upgradeImageKeys = []string{"premium_low_res", "premium_high_res", "original_low_res", "original_high_res"}
+
+// Report is the outcome of a collection. In a dry run nothing is removed and
+// Collected is what would have been.
+type Report struct {
+	DryRun         bool                    `json:"dry_run"`
+	Mode           string                  `json:"mode"`
+	Retention      string                  `json:"retention"`
+	Scanned        int                     `json:"scanned"`
+	Referenced     int                     `json:"referenced"`
+	Retained       int                     `json:"retained"` // Unreferenced but newer than the retention period
+	Collected      int                     `json:"collected"`
+	CollectedBytes int64                   `json:"collected_bytes"`
+	Failed         int                     `json:"failed"`
+	Prefixes       map[string]*PrefixStats `json:"prefixes"`
+	Keys           []string                `json:"keys,omitempty"` // The first 1000 collected keys
+	StartedAt      string                  `json:"started_at"`
+	FinishedAt     string                  `json:"finished_at"`
+}
+
+// PrefixStats counts the blobs under one prefix
+type PrefixStats struct {
+	Scanned        int   `json:"scanned"`
+	Collected      int   `json:"collected"`
+	CollectedBytes int64 `json:"collected_bytes"`
+}
+
+// Service removes or archives stored images nothing in the database refers to
+// any more: superseded renders and profile pictures, photos of scans that
+// never committed and rejected scan photos past their review period
+type Service struct {
+	db                    *pgxpool.Pool
+	store                 storage.BlobStore
+	mode                  string
+	retention             time.Duration
+	rejectedScanRetention time.Duration
+	running               sync.Mutex
+}
+
+// NewService configures the collector from IMAGE_GC_MODE, IMAGE_GC_RETENTION
+// and IMAGE_GC_REJECTED_SCAN_RETENTION
+func NewService(db *pgxpool.Pool, store storage.BlobStore) *Service {
+	mode := strings.ToLower(os.Getenv("IMAGE_GC_MODE"))
+	switch mode {
+	case "":
+		mode = ModeArchive
+	case ModeArchive, ModeDelete:
+	default:
+		log.Printf("Warning: unknown IMAGE_GC_MODE %q, using %s", mode, ModeArchive)
+		mode = ModeArchive
+	}
+
+	retention := defaultRetention
+	if v := os.Getenv("IMAGE_GC_RETENTION"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			retention = d
+		} else {
+			log.Printf("Warning: invalid IMAGE_GC_RETENTION %q, using %s", v, defaultRetention)
+		}
+	}
+
+	// 0 keeps rejected scan photos for as long as their scan is in the history
+	rejectedScanRetention := defaultRejectedScanRetention
+	if v := os.Getenv("IMAGE_GC_REJECTED_SCAN_RETENTION"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			rejectedScanRetention = d
+		} else {
+			log.Printf("Warning: invalid IMAGE_GC_REJECTED_SCAN_RETENTION %q, using %s", v, defaultRejectedScanRetention)
+		}
+	}
+
+	return &Service{
+		db:                    db,
+		store:                 store,
+		mode:                  mode,
+		retention:             retention,
+		rejectedScanRetention: rejectedScanRetention,
+	}
+}
+
+// Run collects every unreferenced image older than the retention period. A
+// dry run only reports what it would collect.
+func (s *Service) Run(ctx context.Context, dryRun bool) (*Report, error) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+
+	if !s.running.TryLock() {
+		return nil, common.Conflict("image collection is already running")
+	}
+	defer s.running.Unlock()
+
+	report := &Report{
+		DryRun:    dryRun,
+		Mode:      s.mode,
+		Retention: s.retention.String(),
+		Prefixes:  make(map[string]*PrefixStats),
+		StartedAt: common.FormatTimestamp(time.Now()),
+	}
+
+	// References are loaded first, so an image saved after this point is
+	// newer than the cutoff and kept even though it isn't in the set
+	cutoff := time.Now().Add(-s.retention)
+	referenced, err := s.referencedKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, prefix := range collectedPrefixes {
+		stats := &PrefixStats{}
+		report.Prefixes[prefix] = stats
+
+		var orphans []storage.Object
+		err := s.store.List(ctx, prefix, func(obj storage.Object) error {
+			stats.Scanned++
+			report.Scanned++
+			key := obj.Key
+			if source, _, ok := storage.VariantSource(key); ok {
+				key = source
+			}
+			switch {
+			case referenced[key]:
+				report.Referenced++
+			case obj.ModTime.After(cutoff):
+				report.Retained++
+			default:
+				orphans = append(orphans, obj)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", prefix, err)
+		}
+
+		for _, obj := range orphans {
+			if !dryRun {
+				if err := s.collect(ctx, obj); err != nil {
+					if ctx.Err() != nil {
+						return nil, ctx.Err()
+					}
+					logger.Printf("Failed to collect image %s: %v", obj.Key, err)
+					report.Failed++
+					continue
+				}
+			}
+			stats.Collected++
+			stats.CollectedBytes += obj.Size
+			report.Collected++
+			report.CollectedBytes += obj.Size
+			if len(report.Keys) < maxReportKeys {
+				report.Keys = append(report.Keys, obj.Key)
+			}
+		}
+	}
+
+	report.FinishedAt = common.FormatTimestamp(time.Now())
+	verb := "Collected"
+	if dryRun {
+		verb = "Dry run would collect"
+	}
+	logger.Printf("%s %d of %d images (%d bytes, mode %s), %d failed", verb, report.Collected, report.Scanned, report.CollectedBytes, s.mode, report.Failed)
+	return report, nil
+}
+
+// referencedKeys returns the keys of every image the database refers to.
+// Photos of rejected scans only count until their review period is over.
+func (s *Service) referencedKeys(ctx context.Context) (map[string]bool, error) {
+	rows, err := s.db.Query(ctx, `
+		SELECT path FROM (
+			SELECT high_res_image AS path FROM user_cars
+			UNION ALL SELECT low_res_image FROM user_cars
+			UNION ALL SELECT img.value->>'high_res'
+				FROM cars, jsonb_each(CASE WHEN jsonb_typeof(color_images) = 'object' THEN color_images ELSE '{}' END) img
+			UNION ALL SELECT img.value->>'low_res'
+				FROM cars, jsonb_each(CASE WHEN jsonb_typeof(color_images) = 'object' THEN color_images ELSE '{}' END) img
+			UNION ALL SELECT metadata->>k FROM car_upgrades, unnest($1::text[]) k
+				WHERE jsonb_typeof(metadata) = 'object'
+			UNION ALL SELECT profile_picture FROM users
+			UNION ALL SELECT image_path FROM scan_history
+				WHERE success OR $2::float8 = 0 OR scanned_at > NOW() - make_interval(secs => $2)
+			UNION ALL SELECT second_image_path FROM scan_history
+				WHERE success OR $2::float8 = 0 OR scanned_at > NOW() - make_interval(secs => $2)
+		) refs
+		WHERE path IS NOT NULL AND path <> ''`,
+		upgradeImageKeys, s.rejectedScanRetention.Seconds(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query referenced images: %w", err)
+	}
+	defer rows.Close()
+
+	referenced := make(map[string]bool)
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, fmt.Errorf("failed to read referenced image: %w", err)
+		}
+		referenced[path] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query referenced images: %w", err)
+	}
+	return referenced, nil
+}
+
+// collect archives or deletes an image. The scan history of a rejected scan
+// follows its photo, so support isn't sent to a missing file.
+func (s *Service) collect(ctx context.Context, obj storage.Object) error {
+	newPath := ""
+	if s.mode == ModeArchive {
+		newPath = ArchivePrefix + obj.Key
+		data, err := storage.ReadAll(ctx, s.store, obj.Key)
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.store.Put(ctx, newPath, data, obj.ContentType); err != nil {
+			return err
+		}
+	}
+	if err := s.store.Delete(ctx, obj.Key); err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(obj.Key, storage.ScansPrefix) {
+		if _, err := s.db.Exec(ctx, `
+			UPDATE scan_history SET image_path = $1 WHERE image_path = $2`,
+			newPath, obj.Key,
+		); err != nil {
+			return fmt.Errorf("failed to update scan history of %s: %w", obj.Key, err)
+		}
+	}
+	return nil
+}
+
+// StartScheduler collects images now and then every interval until ctx is
+// cancelled. With dryRun set it only logs what it would collect.
+func (s *Service) StartScheduler(ctx context.Context, interval time.Duration, dryRun bool) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if _, err := s.Run(ctx, dryRun); err != nil {
+				logger.Printf("Image collection error: %v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
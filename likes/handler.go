@@ -21,13 +21,13 @@ func (h *Handler) CreateFeedItemLike(w http.ResponseWriter, r *http.Request) {
 
 	feedItemID, err := strconv.Atoi(feedItemIDStr)
 	if err != nil {
-		http.Error(w, "Invalid feed item ID", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("Invalid feed item ID"))
 		return
 	}
 
 	like, err := h.service.CreateLike(r.Context(), userID, feedItemID, TargetTypeFeedItem)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to create like"))
 		return
 	}
 
@@ -41,12 +41,12 @@ func (h *Handler) DeleteFeedItemLike(w http.ResponseWriter, r *http.Request) {
 
 	feedItemID, err := strconv.Atoi(feedItemIDStr)
 	if err != nil {
-		http.Error(w, "Invalid feed item ID", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("Invalid feed item ID"))
 		return
 	}
 
 	if err := h.service.DeleteLike(r.Context(), userID, feedItemID, TargetTypeFeedItem); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to delete like"))
 		return
 	}
 
@@ -59,13 +59,13 @@ func (h *Handler) CreateUserCarLike(w http.ResponseWriter, r *http.Request) {
 
 	userCarID, err := strconv.Atoi(userCarIDStr)
 	if err != nil {
-		http.Error(w, "Invalid user car ID", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("Invalid user car ID"))
 		return
 	}
 
 	like, err := h.service.CreateLike(r.Context(), userID, userCarID, TargetTypeUserCar)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to create like"))
 		return
 	}
 
@@ -79,12 +79,12 @@ func (h *Handler) DeleteUserCarLike(w http.ResponseWriter, r *http.Request) {
 
 	userCarID, err := strconv.Atoi(userCarIDStr)
 	if err != nil {
-		http.Error(w, "Invalid user car ID", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("Invalid user car ID"))
 		return
 	}
 
 	if err := h.service.DeleteLike(r.Context(), userID, userCarID, TargetTypeUserCar); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to delete like"))
 		return
 	}
 
@@ -95,7 +95,7 @@ func (h *Handler) GetFeedItemLikes(w http.ResponseWriter, r *http.Request) {
 	feedItemIDStr := r.PathValue("feedItemId")
 	feedItemID, err := strconv.Atoi(feedItemIDStr)
 	if err != nil {
-		http.Error(w, "Invalid feed item ID", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("Invalid feed item ID"))
 		return
 	}
 
@@ -104,7 +104,7 @@ func (h *Handler) GetFeedItemLikes(w http.ResponseWriter, r *http.Request) {
 
 	likes, err := h.service.GetFeedItemLikes(r.Context(), feedItemID, cursor, pageSize)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to get likes"))
 		return
 	}
 
@@ -116,7 +116,7 @@ func (h *Handler) GetUserCarLikes(w http.ResponseWriter, r *http.Request) {
 	userCarIDStr := r.PathValue("userCarId")
 	userCarID, err := strconv.Atoi(userCarIDStr)
 	if err != nil {
-		http.Error(w, "Invalid user car ID", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("Invalid user car ID"))
 		return
 	}
 
@@ -125,7 +125,7 @@ func (h *Handler) GetUserCarLikes(w http.ResponseWriter, r *http.Request) {
 
 	likes, err := h.service.GetUserCarLikes(r.Context(), userCarID, cursor, pageSize)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to get likes"))
 		return
 	}
 
@@ -137,7 +137,7 @@ func (h *Handler) GetUserReceivedLikes(w http.ResponseWriter, r *http.Request) {
 	userIDStr := r.PathValue("userId")
 	userID, err := strconv.Atoi(userIDStr)
 	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("Invalid user ID"))
 		return
 	}
 
@@ -146,7 +146,7 @@ func (h *Handler) GetUserReceivedLikes(w http.ResponseWriter, r *http.Request) {
 
 	likes, err := h.service.GetUserReceivedLikes(r.Context(), userID, cursor, pageSize)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to get received likes"))
 		return
 	}
 
@@ -160,13 +160,13 @@ func (h *Handler) CheckUserCarLike(w http.ResponseWriter, r *http.Request) {
 
 	userCarID, err := strconv.Atoi(userCarIDStr)
 	if err != nil {
-		http.Error(w, "Invalid user car ID", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("Invalid user car ID"))
 		return
 	}
 
 	hasLiked, err := h.service.UserHasLiked(r.Context(), userID, userCarID, TargetTypeUserCar)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to check like"))
 		return
 	}
 
@@ -179,13 +179,13 @@ func (h *Handler) GetUserCarLikesCount(w http.ResponseWriter, r *http.Request) {
 
 	userCarID, err := strconv.Atoi(userCarIDStr)
 	if err != nil {
-		http.Error(w, "Invalid user car ID", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("Invalid user car ID"))
 		return
 	}
 
 	count, err := h.service.GetLikesCount(r.Context(), userCarID, TargetTypeUserCar)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to get likes count"))
 		return
 	}
 
@@ -199,13 +199,13 @@ func (h *Handler) CheckFeedItemLike(w http.ResponseWriter, r *http.Request) {
 
 	feedItemID, err := strconv.Atoi(feedItemIDStr)
 	if err != nil {
-		http.Error(w, "Invalid feed item ID", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("Invalid feed item ID"))
 		return
 	}
 
 	hasLiked, err := h.service.UserHasLiked(r.Context(), userID, feedItemID, TargetTypeFeedItem)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to check like"))
 		return
 	}
 
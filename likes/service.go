@@ -135,7 +135,7 @@ func (s *Service) DeleteLike(ctx context.Context, userID int, targetID int, targ
 	}
 
 	if result.RowsAffected() == 0 {
-		return fmt.Errorf("like not found")
+		return common.NotFound("like not found")
 	}
 
 	return nil
@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/go-playground/validator/v10"
@@ -41,11 +40,6 @@ type AuthResponse struct {
 	ExpiresIn    int    `json:"expiresIn"`
 }
 
-type ErrorResponse struct {
-	Message string            `json:"message"`
-	Errors  map[string]string `json:"errors,omitempty"`
-}
-
 // HandleGoogleSignIn handles the Google Sign-In authentication
 func (h *HTTPHandler) HandleGoogleSignIn(w http.ResponseWriter, r *http.Request) {
 	logger := r.Context().Value(common.LoggerCtxKey).(*log.Logger)
@@ -53,14 +47,14 @@ func (h *HTTPHandler) HandleGoogleSignIn(w http.ResponseWriter, r *http.Request)
 
 	if r.Method != http.MethodPost {
 		logger.Printf("[Google SignIn] Method not allowed: %s", r.Method)
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		common.WriteError(w, r, common.MethodNotAllowed("Method not allowed"))
 		return
 	}
 
 	var req GoogleSignInRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		logger.Printf("[Google SignIn] Failed to decode request body: %v", err)
-		sendJSONError(w, "Invalid request body", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("Invalid request body"))
 		return
 	}
 
@@ -75,7 +69,7 @@ func (h *HTTPHandler) HandleGoogleSignIn(w http.ResponseWriter, r *http.Request)
 	// Validate request
 	if err := h.validate.Struct(req); err != nil {
 		logger.Printf("[Google SignIn] Validation failed: %v", err)
-		sendValidationError(w, err)
+		sendValidationError(w, r, err)
 		return
 	}
 	logger.Printf("[Google SignIn] Request validation successful")
@@ -85,7 +79,7 @@ func (h *HTTPHandler) HandleGoogleSignIn(w http.ResponseWriter, r *http.Request)
 	accessToken, refreshToken, err := h.service.GoogleSignIn(r.Context(), req.IDToken, req.DisplayName)
 	if err != nil {
 		logger.Printf("[Google SignIn] Authentication failed: %v", err)
-		sendJSONError(w, err.Error(), http.StatusUnauthorized)
+		common.WriteErrorOr(w, r, err, common.Unauthorized("Authentication failed"))
 		return
 	}
 	processingTime := time.Since(startTime)
@@ -110,14 +104,14 @@ func (h *HTTPHandler) HandleAppleSignIn(w http.ResponseWriter, r *http.Request)
 
 	if r.Method != http.MethodPost {
 		logger.Printf("[Apple SignIn] Method not allowed: %s", r.Method)
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		common.WriteError(w, r, common.MethodNotAllowed("Method not allowed"))
 		return
 	}
 
 	var req AppleSignInRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		logger.Printf("[Apple SignIn] Failed to decode request body: %v", err)
-		sendJSONError(w, "Invalid request body", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("Invalid request body"))
 		return
 	}
 
@@ -132,7 +126,7 @@ func (h *HTTPHandler) HandleAppleSignIn(w http.ResponseWriter, r *http.Request)
 	// Validate request
 	if err := h.validate.Struct(req); err != nil {
 		logger.Printf("[Apple SignIn] Validation failed: %v", err)
-		sendValidationError(w, err)
+		sendValidationError(w, r, err)
 		return
 	}
 	logger.Printf("[Apple SignIn] Request validation successful")
@@ -142,7 +136,7 @@ func (h *HTTPHandler) HandleAppleSignIn(w http.ResponseWriter, r *http.Request)
 	accessToken, refreshToken, err := h.service.AppleSignIn(r.Context(), req.IDToken, req.DisplayName)
 	if err != nil {
 		logger.Printf("[Apple SignIn] Authentication failed: %v", err)
-		sendJSONError(w, err.Error(), http.StatusUnauthorized)
+		common.WriteErrorOr(w, r, err, common.Unauthorized("Authentication failed"))
 		return
 	}
 	processingTime := time.Since(startTime)
@@ -171,7 +165,7 @@ func (h *HTTPHandler) HandleRefresh(w http.ResponseWriter, r *http.Request) {
 	var req RefreshRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		logger.Printf("[Token Refresh] Failed to decode request body: %v", err)
-		sendJSONError(w, "Invalid request format", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("Invalid request format"))
 		return
 	}
 
@@ -184,7 +178,7 @@ func (h *HTTPHandler) HandleRefresh(w http.ResponseWriter, r *http.Request) {
 
 	if err := h.validate.Struct(req); err != nil {
 		logger.Printf("[Token Refresh] Request validation failed: %v", err)
-		sendValidationError(w, err)
+		sendValidationError(w, r, err)
 		return
 	}
 
@@ -195,19 +189,7 @@ func (h *HTTPHandler) HandleRefresh(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		logger.Printf("[Token Refresh] Failed to refresh tokens: %v (processing time: %v)", err, processingTime)
-		statusCode := http.StatusUnauthorized
-		message := "Token refresh failed"
-
-		if strings.Contains(err.Error(), "invalid or expired refresh token") {
-			logger.Printf("[Token Refresh] Token was invalid or expired")
-			message = "Refresh token has expired or is invalid"
-		} else if strings.Contains(err.Error(), "failed to sign") {
-			logger.Printf("[Token Refresh] Internal error while signing new tokens")
-			statusCode = http.StatusInternalServerError
-			message = "Failed to generate new tokens"
-		}
-
-		sendJSONError(w, message, statusCode)
+		common.WriteErrorOr(w, r, err, common.Unauthorized("Token refresh failed"))
 		return
 	}
 
@@ -235,7 +217,7 @@ func (h *HTTPHandler) HandleLogout(w http.ResponseWriter, r *http.Request) {
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		logger.Printf("[Logout] Failed to decode request body: %v", err)
-		sendJSONError(w, "Invalid request format", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("Invalid request format"))
 		return
 	}
 
@@ -248,14 +230,14 @@ func (h *HTTPHandler) HandleLogout(w http.ResponseWriter, r *http.Request) {
 
 	if err := h.validate.Struct(req); err != nil {
 		logger.Printf("[Logout] Validation failed: %v", err)
-		sendValidationError(w, err)
+		sendValidationError(w, r, err)
 		return
 	}
 
 	startTime := time.Now()
 	if err := h.service.Logout(r.Context(), req.RefreshToken); err != nil {
 		logger.Printf("[Logout] Failed after %v: %v", time.Since(startTime), err)
-		sendJSONError(w, "Logout failed", http.StatusUnauthorized)
+		common.WriteError(w, r, common.Unauthorized("Logout failed").Wrap(err))
 		return
 	}
 
@@ -288,11 +270,7 @@ func sendJSONResponse(w http.ResponseWriter, data interface{}, status int) {
 	}
 }
 
-func sendJSONError(w http.ResponseWriter, message string, status int) {
-	sendJSONResponse(w, ErrorResponse{Message: message}, status)
-}
-
-func sendValidationError(w http.ResponseWriter, err error) {
+func sendValidationError(w http.ResponseWriter, r *http.Request, err error) {
 	errors := make(map[string]string)
 	for _, err := range err.(validator.ValidationErrors) {
 		field := err.Field()
@@ -308,10 +286,7 @@ func sendValidationError(w http.ResponseWriter, err error) {
 		}
 	}
 
-	sendJSONResponse(w, ErrorResponse{
-		Message: "Validation failed",
-		Errors:  errors,
-	}, http.StatusBadRequest)
+	common.WriteError(w, r, common.NewError(common.ErrBadRequest, "validation_failed", "Validation failed").WithFields(errors))
 }
 
 // In your HTTP handlers file
@@ -322,7 +297,7 @@ func (h *HTTPHandler) HandleAppleEmailUpdateNotification(w http.ResponseWriter,
 	var payload AppleEmailUpdatePayload
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
 		logger.Printf("[Apple Email Update] Failed to decode payload: %v", err)
-		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		common.WriteErrorOr(w, r, err, common.BadRequest("Invalid payload"))
 		return
 	}
 
@@ -333,7 +308,7 @@ func (h *HTTPHandler) HandleAppleEmailUpdateNotification(w http.ResponseWriter,
 	startTime := time.Now()
 	if err := h.service.HandleAppleEmailUpdate(r.Context(), payload); err != nil {
 		logger.Printf("[Apple Email Update] Failed after %v: %v", time.Since(startTime), err)
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("Internal error"))
 		return
 	}
 
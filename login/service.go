@@ -6,11 +6,13 @@ import (
 	"crypto/rsa"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -31,6 +33,7 @@ type Config struct {
 	AppleServiceID     string
 	AppleKeyID         string
 	ApplePrivateKey    []byte
+	AdminUserIDs       map[int]bool // Users allowed through AdminMiddleware
 }
 
 // Service holds DB and config
@@ -101,14 +104,14 @@ func (s *Service) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
 			logger.Printf("Auth failed: missing Authorization header")
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			common.WriteError(w, r, common.Unauthorized("Unauthorized"))
 			return
 		}
 
 		parts := strings.SplitN(authHeader, " ", 2)
 		if len(parts) != 2 || parts[0] != "Bearer" {
 			logger.Printf("Auth failed: invalid Authorization header format")
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			common.WriteError(w, r, common.Unauthorized("Unauthorized"))
 			return
 		}
 
@@ -124,17 +127,17 @@ func (s *Service) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 
 		if err != nil {
 			logger.Printf("Auth failed: token parse error: %v", err)
-			if err.Error() == "Token is expired" {
-				http.Error(w, "Token expired", http.StatusUnauthorized)
+			if errors.Is(err, jwt.ErrTokenExpired) {
+				common.WriteError(w, r, common.ErrTokenExpired)
 				return
 			}
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			common.WriteError(w, r, common.Unauthorized("Invalid token"))
 			return
 		}
 
 		if !token.Valid {
 			logger.Printf("Auth failed: invalid token")
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			common.WriteError(w, r, common.Unauthorized("Invalid token"))
 			return
 		}
 
@@ -142,7 +145,7 @@ func (s *Service) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		claims, ok := token.Claims.(*MyClaims)
 		if !ok {
 			logger.Printf("Auth failed: invalid token claims type")
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			common.WriteError(w, r, common.Unauthorized("Invalid token"))
 			return
 		}
 
@@ -158,13 +161,13 @@ func (s *Service) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 
 		if err != nil {
 			logger.Printf("Auth failed: database error: %v", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			common.WriteError(w, r, common.Internal("Internal server error"))
 			return
 		}
 
 		if !exists {
 			logger.Printf("Auth failed: user %d not found or inactive", claims.UserID)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			common.WriteError(w, r, common.Unauthorized("Unauthorized"))
 			return
 		}
 
@@ -175,6 +178,41 @@ func (s *Service) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// AdminMiddleware authenticates like AuthMiddleware and then only lets
+// through users listed in Config.AdminUserIDs
+func (s *Service) AdminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return s.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		logger := r.Context().Value(common.LoggerCtxKey).(*log.Logger)
+
+		userID := r.Context().Value(common.UserIDCtxKey).(int)
+		if !s.config.AdminUserIDs[userID] {
+			logger.Printf("Admin access denied for user ID: %d", userID)
+			common.WriteError(w, r, common.Forbidden("admin access required"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ParseAdminUserIDs parses a comma separated list of user IDs, as found in
+// ADMIN_USER_IDS
+func ParseAdminUserIDs(s string) map[int]bool {
+	ids := make(map[int]bool)
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		id, err := strconv.Atoi(field)
+		if err != nil {
+			log.Printf("Warning: ignoring invalid admin user ID %q", field)
+			continue
+		}
+		ids[id] = true
+	}
+	return ids
+}
+
 // GoogleSignIn handles authentication with Google
 func (s *Service) GoogleSignIn(ctx context.Context, idToken string, displayName string) (string, string, error) {
 	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
@@ -569,14 +607,14 @@ func (s *Service) RefreshTokens(ctx context.Context, refreshTokenStr string) (st
 	newAccessToken, err := s.generateJWT(claims.UserID, s.config.AccessTokenExpiry, logger)
 	if err != nil {
 		logger.Printf("[Token Refresh] Failed to generate new access token: %v", err)
-		return "", "", fmt.Errorf("failed to sign access token: %w", err)
+		return "", "", common.Internal("Failed to generate new tokens").Wrap(fmt.Errorf("failed to sign access token: %w", err))
 	}
 	logger.Printf("[Token Refresh] New access token generated successfully")
 
 	newRefreshToken, err := s.generateJWT(claims.UserID, s.config.RefreshTokenExpiry, logger)
 	if err != nil {
 		logger.Printf("[Token Refresh] Failed to generate new refresh token: %v", err)
-		return "", "", fmt.Errorf("failed to sign refresh token: %w", err)
+		return "", "", common.Internal("Failed to generate new tokens").Wrap(fmt.Errorf("failed to sign refresh token: %w", err))
 	}
 	logger.Printf("[Token Refresh] New refresh token generated successfully")
 
@@ -770,7 +808,7 @@ func (s *Service) validateRefreshToken(ctx context.Context, tokenStr string) (*M
 	}
 	if !exists {
 		logger.Printf("[Token Validation] Token not found in database or expired")
-		return nil, fmt.Errorf("invalid or expired refresh token")
+		return nil, common.ErrInvalidRefreshToken
 	}
 	logger.Printf("[Token Validation] Token found in database and is not expired")
 
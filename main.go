@@ -1,15 +1,21 @@
 package main
 
 import (
+	"CarBN/catalog"
 	"CarBN/common"
 	"CarBN/feed"
 	"CarBN/friends"
+	"CarBN/imagegc"
 	"CarBN/likes"
 	"CarBN/login"
 	"CarBN/postgres"
+	"CarBN/prompts"
+	"CarBN/rarity"
 	"CarBN/scan"
+	"CarBN/storage"
 	"CarBN/subscription"
 	"CarBN/trade"
+	"CarBN/usage"
 	"CarBN/user"
 	"context"
 	"log"
@@ -17,6 +23,7 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -51,30 +58,6 @@ func Chain(handler http.HandlerFunc, middleware ...func(http.HandlerFunc) http.H
 	return handler
 }
 
-// Simplify the imageFileHandler since we're now using consistent paths
-func imageFileHandler(fs http.FileSystem) http.HandlerFunc {
-	fileServer := http.FileServer(fs)
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Save original path and strip /images/ prefix
-		path := strings.TrimPrefix(r.URL.Path, "/images/")
-
-		// URL decode the path to handle spaces and special characters
-		decodedPath, err := url.QueryUnescape(path)
-		if err != nil {
-			http.Error(w, "Invalid path", http.StatusBadRequest)
-			return
-		}
-
-		// Update the request path without the /images/ prefix
-		r2 := new(http.Request)
-		*r2 = *r
-		r2.URL = new(url.URL)
-		*r2.URL = *r.URL
-		r2.URL.Path = decodedPath
-		fileServer.ServeHTTP(w, r2)
-	}
-}
-
 func main() {
 	err := godotenv.Load()
 	if err != nil {
@@ -83,6 +66,7 @@ func main() {
 
 	// Initialize logger
 	logger := log.New(os.Stdout, "[CarBN] ", log.LstdFlags)
+	devMode := os.Getenv("CARBN_DEV") == "development"
 
 	// Create root context with cancellation
 	ctx, cancel := context.WithCancel(context.Background())
@@ -98,6 +82,22 @@ func main() {
 	defer postgres.CloseDB(ctx)
 	logger.Println("Database connection established")
 
+	// Load the AI prompts; a broken PROMPTS_DIR must not start serving scans
+	promptRegistry, err := prompts.NewRegistryFromEnv()
+	if err != nil {
+		logger.Fatalf("Prompt registry initialization failed: %v", err)
+	}
+
+	// Open image storage; a misconfigured bucket must not start serving scans
+	imageStore, err := storage.NewFromEnv()
+	if err != nil {
+		logger.Fatalf("Image storage initialization failed: %v", err)
+	}
+	imageSigner, err := storage.NewURLSignerFromEnv(devMode)
+	if err != nil {
+		logger.Fatalf("Image URL signer initialization failed: %v", err)
+	}
+
 	// Initialize services
 	loginSvc := login.NewService(postgres.DB, login.Config{
 		JWTSecret:          []byte(os.Getenv("JWT_SECRET")),
@@ -108,14 +108,60 @@ func main() {
 		AppleServiceID:     os.Getenv("APPLE_SERVICE_ID"),
 		AppleKeyID:         os.Getenv("APPLE_KEY_ID"),
 		ApplePrivateKey:    []byte(os.Getenv("APPLE_PRIVATE_KEY")),
+		AdminUserIDs:       login.ParseAdminUserIDs(os.Getenv("ADMIN_USER_IDS")),
 	})
-	userSvc := user.NewService(postgres.DB, os.Getenv("GENERATED_SAVE_DIR"))
+	usageSvc := usage.NewService(postgres.DB)
+	// Pick the image generator; without one, new cars would be saved with
+	// placeholder cards for good
+	baseGenerator, err := common.NewImageGeneratorFromEnv(ctx, devMode)
+	if err != nil {
+		logger.Fatalf("Image generator initialization failed: %v", err)
+	}
+	imageGenerator := usageSvc.MeterImages(baseGenerator)
+	userSvc := user.NewService(postgres.DB, imageStore, imageSigner, promptRegistry, imageGenerator)
 	subscriptionSvc := subscription.NewSubscriptionService(postgres.DB) // Add subscription service
 	feedSvc := feed.NewService(postgres.DB)
-	friendsSvc := friends.NewService(postgres.DB, feedSvc)
+	friendsSvc := friends.NewService(postgres.DB, feedSvc, imageSigner)
 	tradeSvc := trade.NewService(postgres.DB, feedSvc, subscriptionSvc) // Add subscription service to trade
 	likesSvc := likes.NewService(postgres.DB)
-	scanSvc := scan.NewService(postgres.DB, feedSvc, subscriptionSvc) // Add subscription service to scan
+	raritySvc := rarity.NewService(postgres.DB)
+	catalogSvc := catalog.NewService(postgres.DB, raritySvc)
+	imageGCSvc := imagegc.NewService(postgres.DB, imageStore)
+	scanSvc := scan.NewService(postgres.DB, feedSvc, subscriptionSvc, catalogSvc, raritySvc, scan.NewRecognizerFromEnv(usageSvc), promptRegistry, imageGenerator, imageStore, imageSigner)
+
+	// Start background scan workers
+	scanWorkers, err := strconv.Atoi(os.Getenv("SCAN_WORKERS"))
+	if err != nil || scanWorkers < 1 {
+		scanWorkers = 4
+	}
+	scanSvc.StartWorkers(ctx, scanWorkers)
+
+	renderWorkers, err := strconv.Atoi(os.Getenv("RENDER_WORKERS"))
+	if err != nil || renderWorkers < 1 {
+		renderWorkers = 2
+	}
+	scanSvc.StartRenderWorkers(ctx, renderWorkers)
+	scanSvc.StartGeneratedImageIndexer(ctx, time.Hour)
+	scanSvc.StartPlaceholderBackfill(ctx, time.Hour)
+	scanSvc.StartSpecBackfillWorker(ctx)
+
+	rarityInterval, err := time.ParseDuration(os.Getenv("RARITY_RECOMPUTE_INTERVAL"))
+	if err != nil || rarityInterval <= 0 {
+		rarityInterval = 6 * time.Hour
+	}
+	raritySvc.StartScheduler(ctx, rarityInterval)
+
+	// Collect unreferenced images daily; IMAGE_GC_INTERVAL=0 turns it off
+	imageGCInterval := 24 * time.Hour
+	if v := os.Getenv("IMAGE_GC_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			imageGCInterval = d
+		}
+	}
+	if imageGCInterval > 0 {
+		imageGCDryRun, _ := strconv.ParseBool(os.Getenv("IMAGE_GC_DRY_RUN"))
+		imageGCSvc.StartScheduler(ctx, imageGCInterval, imageGCDryRun)
+	}
 
 	// Initialize handlers
 	loginHandler := login.NewHTTPHandler(loginSvc)
@@ -126,15 +172,18 @@ func main() {
 	tradeHandler := trade.NewHTTPHandler(tradeSvc)
 	scanHandler := scan.NewHTTPHandler(scanSvc)
 	likesHandler := likes.NewHandler(likesSvc)
+	catalogHandler := catalog.NewHTTPHandler(catalogSvc)
+	usageHandler := usage.NewHTTPHandler(usageSvc)
+	imageGCHandler := imagegc.NewHTTPHandler(imageGCSvc)
+	imageHandler := storage.NewHTTPHandler(imageStore, imageSigner)
 
 	// Setup router
 	mux := http.NewServeMux()
 
-	// Only serve images in development mode
-	if os.Getenv("CARBN_DEV") == "development" {
-		// Serve image files from root images directory
-		imageDir := http.Dir("_resources/images")
-		mux.HandleFunc("/images/", imageFileHandler(imageDir))
+	// Serve images in development mode, whenever they're in a bucket nothing
+	// else in front of the server can read, and whenever their URLs are signed
+	if storage.ServesImages(devMode, imageSigner) {
+		mux.HandleFunc("GET /images/", imageHandler.HandleGetImage)
 	}
 
 	// Auth routes
@@ -150,6 +199,7 @@ func main() {
 	mux.HandleFunc("GET /user/friend-requests", loginSvc.AuthMiddleware(userHandler.HandleGetPendingFriendRequests))
 	mux.HandleFunc("POST /user/profile/picture", loginSvc.AuthMiddleware(userHandler.HandleUploadProfilePicture))
 	mux.HandleFunc("POST /user/profile/display-name", loginSvc.AuthMiddleware(userHandler.HandleUpdateDisplayName))
+	mux.HandleFunc("POST /user/profile/units", loginSvc.AuthMiddleware(userHandler.HandleUpdateUnitPreference))
 	mux.HandleFunc("GET /user/{user_id}/details", loginSvc.AuthMiddleware(userHandler.HandleGetUserProfile))
 	mux.HandleFunc("GET /user/search", loginSvc.AuthMiddleware(userHandler.HandleSearchUsers))
 	mux.HandleFunc("GET /user/{user_id}/friends", loginSvc.AuthMiddleware(friendsHandler.HandleGetFriends))
@@ -208,6 +258,20 @@ func main() {
 	mux.HandleFunc("GET /trade/{trade_id}", loginSvc.AuthMiddleware(tradeHandler.HandleGetTrade))
 
 	mux.HandleFunc("POST /scan", loginSvc.AuthMiddleware(scanHandler.HandleScanPost))
+	mux.HandleFunc("POST /scan/jobs", loginSvc.AuthMiddleware(scanHandler.HandleCreateScanJob))
+	mux.HandleFunc("GET /scan/jobs/{id}", loginSvc.AuthMiddleware(scanHandler.HandleGetScanJob))
+	mux.HandleFunc("GET /scan/history", loginSvc.AuthMiddleware(scanHandler.HandleGetScanHistory))
+	mux.HandleFunc("POST /scan/{id}/confirm", loginSvc.AuthMiddleware(scanHandler.HandleConfirmScan))
+
+	// Admin routes
+	mux.HandleFunc("POST /admin/catalog/merge", loginSvc.AdminMiddleware(catalogHandler.HandleMergeCars))
+	mux.HandleFunc("POST /admin/catalog/aliases", loginSvc.AdminMiddleware(catalogHandler.HandleAddAlias))
+	mux.HandleFunc("POST /admin/users/{user_id}/credits", loginSvc.AdminMiddleware(subscriptionHandler.HandleAdjustCredits))
+	mux.HandleFunc("POST /admin/cars/specs/backfill", loginSvc.AdminMiddleware(scanHandler.HandleStartSpecBackfill))
+	mux.HandleFunc("GET /admin/cars/specs/backfill", loginSvc.AdminMiddleware(scanHandler.HandleGetSpecBackfill))
+	mux.HandleFunc("GET /admin/prompts", loginSvc.AdminMiddleware(scanHandler.HandleGetPromptStats))
+	mux.HandleFunc("GET /admin/ai-usage", loginSvc.AdminMiddleware(usageHandler.HandleGetSummary))
+	mux.HandleFunc("POST /admin/images/gc", loginSvc.AdminMiddleware(imageGCHandler.HandleRunGC))
 
 	// Likes routes
 	mux.HandleFunc("POST /likes/{feedItemId}", loginSvc.AuthMiddleware(likesHandler.CreateFeedItemLike))
@@ -228,6 +292,7 @@ func main() {
 
 	// Add subscription routes
 	mux.HandleFunc("GET /user/subscription", loginSvc.AuthMiddleware(subscriptionHandler.HandleGetUserSubscription))
+	mux.HandleFunc("GET /user/credits/history", loginSvc.AuthMiddleware(subscriptionHandler.HandleGetCreditHistory))
 	mux.HandleFunc("GET /user/{user_id}/subscription/status", loginSvc.AuthMiddleware(subscriptionHandler.HandleGetUserSubscriptionStatus))
 	mux.HandleFunc("POST /subscription/purchase", loginSvc.AuthMiddleware(subscriptionHandler.HandlePurchaseSubscription))
 	mux.HandleFunc("POST /scanpack/purchase", loginSvc.AuthMiddleware(subscriptionHandler.HandlePurchaseScanPack))
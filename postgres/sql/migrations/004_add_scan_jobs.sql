@@ -0,0 +1,23 @@
+-- Migration to add scan_jobs table for asynchronous scan processing
+
+-- Scans are submitted as jobs and processed by a worker pool. The uploaded image
+-- is kept on the row until the job finishes so a restart can pick the job up again.
+CREATE TABLE IF NOT EXISTS scan_jobs (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    stage VARCHAR(30) NOT NULL DEFAULT 'queued',  -- 'queued', 'identifying', 'fetching_specs', 'done', 'failed'
+    image_data BYTEA,                              -- Uploaded image, cleared once the job finishes
+    user_car_id INT REFERENCES user_cars(id) ON DELETE SET NULL,
+    error_message TEXT,
+    attempts INT NOT NULL DEFAULT 0,
+    locked_until TIMESTAMPTZ,                      -- Lease held by the worker processing the job
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    finished_at TIMESTAMPTZ
+);
+
+-- Create index for workers claiming pending jobs
+CREATE INDEX IF NOT EXISTS idx_scan_jobs_stage ON scan_jobs(stage, id);
+
+-- Create index for user job lookups
+CREATE INDEX IF NOT EXISTS idx_scan_jobs_user_id ON scan_jobs(user_id);
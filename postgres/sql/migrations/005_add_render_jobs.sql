@@ -0,0 +1,25 @@
+-- Migration to add render_jobs table for background car image generation
+
+-- Scans commit immediately with a placeholder image and queue a render job for
+-- the car/color pair. Jobs that fail retry with backoff and end up as 'dead'
+-- once they run out of attempts, which serves as the dead letter list.
+CREATE TABLE IF NOT EXISTS render_jobs (
+    id SERIAL PRIMARY KEY,
+    car_id INT NOT NULL REFERENCES cars(id) ON DELETE CASCADE,
+    color VARCHAR(50) NOT NULL,                      -- Lowercased, matches the cars.color_images key
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',   -- 'pending', 'processing', 'done', 'dead'
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    locked_until TIMESTAMPTZ,                        -- Lease held by the worker rendering the image
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    finished_at TIMESTAMPTZ
+);
+
+-- Create unique index so concurrent scans of the same car and color share a job
+CREATE UNIQUE INDEX IF NOT EXISTS idx_render_jobs_active ON render_jobs(car_id, color)
+    WHERE status IN ('pending', 'processing');
+
+-- Create index for workers claiming due jobs
+CREATE INDEX IF NOT EXISTS idx_render_jobs_status ON render_jobs(status, next_attempt_at);
@@ -0,0 +1,14 @@
+-- Migration to add perceptual hashes for detecting recycled scan photos
+
+-- Store the 64-bit dHash of every submitted image
+ALTER TABLE scan_history ADD COLUMN IF NOT EXISTS image_hash BIGINT;
+
+-- Scans rejected before a car is identified have no car
+ALTER TABLE scan_history ALTER COLUMN car_id DROP NOT NULL;
+
+-- Hashes of generated catalog images, so photos of them can be rejected
+CREATE TABLE IF NOT EXISTS generated_image_hashes (
+    image_path TEXT PRIMARY KEY,        -- Relative path, e.g. generated/car_1/white/high_res_123.jpg
+    image_hash BIGINT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
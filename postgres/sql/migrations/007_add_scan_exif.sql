@@ -0,0 +1,11 @@
+-- Migration to record EXIF metadata and moderation flags on scans
+
+-- Camera, capture time and GPS extracted from the photo, NULL when it had no EXIF
+ALTER TABLE scan_history ADD COLUMN IF NOT EXISTS exif JSONB;
+
+-- Scans that violated the EXIF policy but were let through for review
+ALTER TABLE scan_history ADD COLUMN IF NOT EXISTS flagged BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE scan_history ADD COLUMN IF NOT EXISTS flag_reasons TEXT[];
+
+-- Create index for the moderation queue
+CREATE INDEX IF NOT EXISTS idx_scan_history_flagged ON scan_history(scanned_at) WHERE flagged;
@@ -0,0 +1,24 @@
+-- Migration to record the outcome of every scan attempt in scan_history
+
+ALTER TABLE scan_history ADD COLUMN IF NOT EXISTS outcome VARCHAR(30);
+
+-- Backfill existing rows from what was recorded before outcomes existed
+UPDATE scan_history
+SET outcome = CASE
+    WHEN success THEN 'success'
+    WHEN rejection_reason LIKE 'recycled image:%' THEN 'recycled_image'
+    WHEN rejection_reason LIKE 'exif:%' THEN 'exif_rejected'
+    ELSE 'rejected_fake'
+END
+WHERE outcome IS NULL;
+
+ALTER TABLE scan_history ALTER COLUMN outcome SET NOT NULL;
+ALTER TABLE scan_history ALTER COLUMN outcome SET DEFAULT 'success';
+ALTER TABLE scan_history DROP CONSTRAINT IF EXISTS scan_history_outcome_check;
+ALTER TABLE scan_history ADD CONSTRAINT scan_history_outcome_check CHECK (outcome IN (
+    'success', 'rejected_fake', 'recycled_image', 'exif_rejected', 'duplicate',
+    'no_credits', 'ai_error', 'image_gen_error', 'internal_error'
+));
+
+-- Create index for paging through a user's scan history
+CREATE INDEX IF NOT EXISTS idx_scan_history_user_id_id ON scan_history(user_id, id DESC);
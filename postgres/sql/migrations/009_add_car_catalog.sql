@@ -0,0 +1,82 @@
+-- Migration to add a canonical car catalog: name aliases, parsed year ranges
+-- and an audit trail of merged duplicate cars
+
+-- Year ranges parsed from the "YYYY-YYYY" year string, used to match cars
+-- whose ranges the vision model reports slightly differently
+ALTER TABLE cars ADD COLUMN IF NOT EXISTS year_start INT;
+ALTER TABLE cars ADD COLUMN IF NOT EXISTS year_end INT;
+
+UPDATE cars
+SET year_start = substring(year from '^\s*(\d{4})')::int,
+    year_end = COALESCE(
+        substring(year from '^\s*\d{4}\s*[-–]\s*(\d{4})')::int,
+        substring(year from '^\s*(\d{4})')::int
+    )
+WHERE year ~ '^\s*\d{4}';
+
+CREATE INDEX IF NOT EXISTS idx_cars_lower_make_model ON cars(LOWER(make), LOWER(model));
+
+-- Alternative spellings of a make, e.g. "VW" for "Volkswagen"
+CREATE TABLE IF NOT EXISTS car_make_aliases (
+    alias VARCHAR(100) PRIMARY KEY,     -- Lowercase
+    make VARCHAR(100) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Alternative names for a model of a canonical make. A trim is prepended to
+-- the scanned trim, so "BMW 330i" becomes the 3 Series with the 330i trim.
+CREATE TABLE IF NOT EXISTS car_model_aliases (
+    make VARCHAR(100) NOT NULL,         -- Canonical make, lowercase
+    alias VARCHAR(100) NOT NULL,        -- Lowercase
+    model VARCHAR(100) NOT NULL,
+    trim VARCHAR(100) NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (make, alias)
+);
+
+INSERT INTO car_make_aliases (alias, make) VALUES
+    ('vw', 'Volkswagen'),
+    ('chevy', 'Chevrolet'),
+    ('mercedes', 'Mercedes-Benz'),
+    ('mercedes benz', 'Mercedes-Benz'),
+    ('merc', 'Mercedes-Benz'),
+    ('alfa', 'Alfa Romeo'),
+    ('land-rover', 'Land Rover'),
+    ('rolls royce', 'Rolls-Royce'),
+    ('aston', 'Aston Martin')
+ON CONFLICT (alias) DO NOTHING;
+
+INSERT INTO car_model_aliases (make, alias, model, trim) VALUES
+    ('bmw', '3-series', '3 Series', ''),
+    ('bmw', '330i', '3 Series', '330i'),
+    ('bmw', '340i', '3 Series', 'M340i'),
+    ('bmw', 'm340i', '3 Series', 'M340i'),
+    ('bmw', '5-series', '5 Series', ''),
+    ('bmw', '530i', '5 Series', '530i'),
+    ('bmw', '540i', '5 Series', '540i'),
+    ('mercedes-benz', 'c', 'C-Class', ''),
+    ('mercedes-benz', 'c class', 'C-Class', ''),
+    ('mercedes-benz', 'e', 'E-Class', ''),
+    ('mercedes-benz', 'e class', 'E-Class', ''),
+    ('mercedes-benz', 's', 'S-Class', ''),
+    ('mercedes-benz', 's class', 'S-Class', ''),
+    ('tesla', 'model-3', 'Model 3', ''),
+    ('tesla', 'model-y', 'Model Y', '')
+ON CONFLICT (make, alias) DO NOTHING;
+
+-- Duplicate cars folded into a canonical car by an admin
+CREATE TABLE IF NOT EXISTS car_merges (
+    id SERIAL PRIMARY KEY,
+    duplicate_car_id INT NOT NULL,      -- The duplicate row is deleted, so no foreign key
+    canonical_car_id INT NOT NULL REFERENCES cars(id) ON DELETE CASCADE,
+    duplicate_make VARCHAR(100) NOT NULL,
+    duplicate_model VARCHAR(100) NOT NULL,
+    duplicate_year VARCHAR(20),
+    duplicate_trim VARCHAR(100),
+    user_cars_moved INT NOT NULL DEFAULT 0,
+    scans_moved INT NOT NULL DEFAULT 0,
+    merged_by INT,
+    merged_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_car_merges_canonical ON car_merges(canonical_car_id);
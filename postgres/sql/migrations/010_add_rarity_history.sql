@@ -0,0 +1,17 @@
+-- Migration to derive rarity from price and collection scarcity
+
+-- How the current rarity was computed, returned to clients with the car
+ALTER TABLE cars ADD COLUMN IF NOT EXISTS rarity_explanation JSONB;
+ALTER TABLE cars ADD COLUMN IF NOT EXISTS rarity_updated_at TIMESTAMPTZ;
+
+-- Every change of a car's rarity made by the recompute job
+CREATE TABLE IF NOT EXISTS rarity_history (
+    id SERIAL PRIMARY KEY,
+    car_id INT NOT NULL REFERENCES cars(id) ON DELETE CASCADE,
+    old_rarity INT,                     -- NULL the first time a car is evaluated
+    new_rarity INT NOT NULL,
+    explanation JSONB NOT NULL,
+    computed_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_rarity_history_car ON rarity_history(car_id, computed_at DESC);
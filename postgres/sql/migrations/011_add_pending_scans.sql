@@ -0,0 +1,31 @@
+-- Migration to let users confirm low confidence scans
+
+-- A scan the vision model wasn't sure about waits here until the user picks one
+-- of the candidates. The photo and its evidence are kept so the scan can be
+-- completed, and recorded in scan_history, once it's confirmed.
+CREATE TABLE IF NOT EXISTS pending_scans (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',  -- 'pending', 'confirming', 'confirmed', 'expired'
+    color VARCHAR(50) NOT NULL,
+    candidates JSONB NOT NULL,                      -- [{make, model, trim, year, confidence}], most confident first
+    image_data BYTEA,                               -- Uploaded image, cleared once confirmed or expired
+    image_hash BIGINT,
+    exif JSONB,
+    flag_reasons TEXT[],
+    chosen_candidate INT,                           -- Index into candidates picked by the user
+    user_car_id INT REFERENCES user_cars(id) ON DELETE SET NULL,
+    locked_until TIMESTAMPTZ,                       -- Lease held by a confirmation in progress
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    confirmed_at TIMESTAMPTZ
+);
+
+-- Create index for expiring unconfirmed scans
+CREATE INDEX IF NOT EXISTS idx_pending_scans_status ON pending_scans(status, expires_at);
+
+-- Create index for user lookups
+CREATE INDEX IF NOT EXISTS idx_pending_scans_user_id ON pending_scans(user_id);
+
+-- Scan jobs that end up waiting for confirmation point at their pending scan
+ALTER TABLE scan_jobs ADD COLUMN IF NOT EXISTS pending_scan_id INT REFERENCES pending_scans(id) ON DELETE SET NULL;
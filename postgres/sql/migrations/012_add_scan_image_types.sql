@@ -0,0 +1,6 @@
+-- Migration to keep the type of uploaded scan photos
+
+-- Scans can be uploaded as JPEG, PNG, WebP or HEIC. Rows from before this
+-- migration always held JPEGs sent as base64.
+ALTER TABLE scan_jobs ADD COLUMN IF NOT EXISTS image_type VARCHAR(30) NOT NULL DEFAULT 'image/jpeg';
+ALTER TABLE pending_scans ADD COLUMN IF NOT EXISTS image_type VARCHAR(30) NOT NULL DEFAULT 'image/jpeg';
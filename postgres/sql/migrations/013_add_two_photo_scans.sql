@@ -0,0 +1,23 @@
+-- Migration to scan a car from two photos
+
+-- The second photo of a two-photo scan; checked for recycling like the first
+ALTER TABLE scan_history ADD COLUMN IF NOT EXISTS photo_count SMALLINT NOT NULL DEFAULT 1;
+ALTER TABLE scan_history ADD COLUMN IF NOT EXISTS second_image_path TEXT;
+ALTER TABLE scan_history ADD COLUMN IF NOT EXISTS second_image_hash BIGINT;
+ALTER TABLE scan_history ADD COLUMN IF NOT EXISTS second_exif JSONB;
+
+ALTER TABLE scan_history DROP CONSTRAINT IF EXISTS scan_history_outcome_check;
+ALTER TABLE scan_history ADD CONSTRAINT scan_history_outcome_check CHECK (outcome IN (
+    'success', 'rejected_fake', 'recycled_image', 'exif_rejected', 'duplicate',
+    'no_credits', 'ai_error', 'image_gen_error', 'internal_error',
+    'photos_not_distinct', 'photos_mismatch'
+));
+
+-- Scans waiting on a worker or a confirmation keep both photos until they finish
+ALTER TABLE scan_jobs ADD COLUMN IF NOT EXISTS second_image_data BYTEA;
+ALTER TABLE scan_jobs ADD COLUMN IF NOT EXISTS second_image_type VARCHAR(30);
+
+ALTER TABLE pending_scans ADD COLUMN IF NOT EXISTS second_image_data BYTEA;
+ALTER TABLE pending_scans ADD COLUMN IF NOT EXISTS second_image_type VARCHAR(30);
+ALTER TABLE pending_scans ADD COLUMN IF NOT EXISTS second_image_hash BIGINT;
+ALTER TABLE pending_scans ADD COLUMN IF NOT EXISTS second_exif JSONB;
@@ -0,0 +1,47 @@
+-- Migration to track scan credits in a ledger
+
+-- Every change to a user's scan credits. user_subscriptions.scan_credits_remaining
+-- stays as the cached balance, and is only changed together with a ledger entry
+-- while the user_subscriptions row is locked.
+CREATE TABLE IF NOT EXISTS credit_ledger (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    entry_type VARCHAR(20) NOT NULL CHECK (entry_type IN (
+        'grant', 'purchase', 'scan', 'refund', 'admin_adjust'
+    )),
+    amount INT NOT NULL,                -- Credits added, negative when spent
+    balance_after INT NOT NULL,
+    reference VARCHAR(255),             -- App Store transaction, scanned car or admin
+    note TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Create index for credit history
+CREATE INDEX IF NOT EXISTS idx_credit_ledger_user_id ON credit_ledger(user_id, id DESC);
+
+-- A credit set aside when a scan starts. It's captured as a 'scan' ledger entry
+-- when the car is added, or released when the scan fails. Held reservations
+-- count against the balance until they expire.
+CREATE TABLE IF NOT EXISTS credit_reservations (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    status VARCHAR(20) NOT NULL DEFAULT 'held',  -- 'held', 'captured', 'released', 'expired'
+    ledger_entry_id INT REFERENCES credit_ledger(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    settled_at TIMESTAMPTZ
+);
+
+-- Create index for counting held credits
+CREATE INDEX IF NOT EXISTS idx_credit_reservations_user_status ON credit_reservations(user_id, status);
+
+-- Scan jobs hold their credit from submission until they finish
+ALTER TABLE scan_jobs ADD COLUMN IF NOT EXISTS credit_reservation_id INT REFERENCES credit_reservations(id) ON DELETE SET NULL;
+
+-- Open the ledger with each user's current balance
+UPDATE user_subscriptions SET scan_credits_remaining = 0 WHERE scan_credits_remaining IS NULL;
+
+INSERT INTO credit_ledger (user_id, entry_type, amount, balance_after, note)
+SELECT us.user_id, 'grant', us.scan_credits_remaining, us.scan_credits_remaining, 'opening balance'
+FROM user_subscriptions us
+WHERE NOT EXISTS (SELECT 1 FROM credit_ledger cl WHERE cl.user_id = us.user_id);
@@ -0,0 +1,46 @@
+-- Migration to keep scan credits in separate buckets
+
+-- The monthly allowance of the user's subscription, reset on every renewal and
+-- lost when the subscription lapses, and credits from scan packs, which never
+-- expire. scan_credits_remaining stays as the cached total of every bucket.
+--
+-- There's no telling which existing credits came from where, so they're kept
+-- as pack credits rather than risk taking any away. They're moved in the same
+-- step that adds the columns, so running the migration again doesn't count
+-- them twice.
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'user_subscriptions' AND column_name = 'pack_credits'
+    ) THEN
+        ALTER TABLE user_subscriptions ADD COLUMN subscription_credits INT NOT NULL DEFAULT 0;
+        ALTER TABLE user_subscriptions ADD COLUMN pack_credits INT NOT NULL DEFAULT 0;
+
+        UPDATE user_subscriptions SET pack_credits = COALESCE(scan_credits_remaining, 0);
+    END IF;
+END $$;
+
+-- Promotional credits, such as the free credits new users get. Each grant may
+-- expire on its own.
+CREATE TABLE IF NOT EXISTS promo_credits (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    amount INT NOT NULL,
+    remaining INT NOT NULL,
+    expires_at TIMESTAMPTZ,                -- NULL for credits that never expire
+    note TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Create index for spending promo credits
+CREATE INDEX IF NOT EXISTS idx_promo_credits_user_id ON promo_credits(user_id) WHERE remaining > 0;
+
+-- Ledger entries say which bucket they changed; NULL for entries from before
+-- buckets. Leftover allowances and lapsed promo credits are recorded as 'expire'.
+ALTER TABLE credit_ledger ADD COLUMN IF NOT EXISTS bucket VARCHAR(20);
+
+ALTER TABLE credit_ledger DROP CONSTRAINT IF EXISTS credit_ledger_entry_type_check;
+ALTER TABLE credit_ledger ADD CONSTRAINT credit_ledger_entry_type_check CHECK (entry_type IN (
+    'grant', 'purchase', 'scan', 'refund', 'admin_adjust', 'expire'
+));
@@ -0,0 +1,29 @@
+-- Migration to fill in the full spec sheet of every car
+
+-- When the car's specs were last requested from the AI; NULL for cars created
+-- before enrichment, which the backfill picks up
+ALTER TABLE cars ADD COLUMN IF NOT EXISTS specs_enriched_at TIMESTAMPTZ;
+
+-- Create index for the backfill finding cars that still need specs
+CREATE INDEX IF NOT EXISTS idx_cars_specs_pending ON cars(id) WHERE specs_enriched_at IS NULL;
+
+-- Runs of the admin spec backfill. A run works through the cars in id order and
+-- records the last car it finished, so a run interrupted by a restart resumes
+-- where it left off.
+CREATE TABLE IF NOT EXISTS spec_backfill_runs (
+    id SERIAL PRIMARY KEY,
+    status VARCHAR(20) NOT NULL DEFAULT 'running',   -- 'running', 'completed'
+    last_car_id INT NOT NULL DEFAULT 0,
+    enriched INT NOT NULL DEFAULT 0,
+    failed INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    locked_until TIMESTAMPTZ,                        -- Lease held by the worker running the backfill
+    started_by INT REFERENCES users(id) ON DELETE SET NULL,
+    started_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    finished_at TIMESTAMPTZ
+);
+
+-- Create unique index so only one run is in progress at a time
+CREATE UNIQUE INDEX IF NOT EXISTS idx_spec_backfill_runs_running ON spec_backfill_runs((status))
+    WHERE status = 'running';
@@ -0,0 +1,55 @@
+-- Migration to store car specs in metric units and let users pick the units
+-- they're shown in
+
+-- Specs were requested from the AI in imperial units until now, but it often
+-- answered in metric anyway, and for torque, top speed, curb weight and range
+-- the value alone can't tell which: 250 could be mph or km/h. Those values are
+-- cleared and the car marked for the spec backfill, which fetches them again in
+-- metric. Values too large to be imperial, like a torque over 2500, were metric
+-- and are kept. Dimensions are unambiguous, as an imperial length in inches is
+-- far below any length in mm, so they're converted to mm. This runs in the
+-- same step that adds unit_preference so running the migration again doesn't
+-- convert twice.
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'users' AND column_name = 'unit_preference'
+    ) THEN
+        UPDATE cars SET
+            torque = CASE WHEN torque > 0 AND torque <= 2500 THEN NULL ELSE torque END,
+            top_speed = CASE WHEN top_speed > 0 AND top_speed <= 320 THEN NULL ELSE top_speed END,
+            curb_weight = CASE WHEN curb_weight > 0 AND curb_weight <= 12000 THEN NULL ELSE curb_weight END,
+            range = CASE WHEN range > 0 AND range <= 750 THEN NULL ELSE range END,
+            specs_enriched_at = NULL
+        WHERE (torque > 0 AND torque <= 2500)
+            OR (top_speed > 0 AND top_speed <= 320)
+            OR (curb_weight > 0 AND curb_weight <= 12000)
+            OR (range > 0 AND range <= 750);
+        UPDATE cars SET length = ROUND((length * 25.4)::numeric)
+            WHERE length > 0 AND length <= 300;
+        UPDATE cars SET width = ROUND((width * 25.4)::numeric)
+            WHERE width > 0 AND width <= 120;
+        UPDATE cars SET height = ROUND((height * 25.4)::numeric)
+            WHERE height > 0 AND height <= 120;
+        UPDATE cars SET wheelbase = ROUND((wheelbase * 25.4)::numeric)
+            WHERE wheelbase > 0 AND wheelbase <= 200;
+        UPDATE cars SET ground_clearance = ROUND((ground_clearance * 25.4)::numeric)
+            WHERE ground_clearance > 0 AND ground_clearance <= 20;
+
+        -- The units car specs are shown to the user in; specs are always stored
+        -- in metric. Existing users keep the imperial units they've been seeing.
+        ALTER TABLE users ADD COLUMN unit_preference VARCHAR(10) NOT NULL DEFAULT 'imperial'
+            CHECK (unit_preference IN ('metric', 'imperial'));
+    END IF;
+END $$;
+
+COMMENT ON COLUMN cars.torque IS 'Torque in Nm';
+COMMENT ON COLUMN cars.top_speed IS 'Top speed in km/h';
+COMMENT ON COLUMN cars.curb_weight IS 'Curb weight in kg';
+COMMENT ON COLUMN cars.range IS 'Electric range on a full charge in km';
+COMMENT ON COLUMN cars.length IS 'Length in mm';
+COMMENT ON COLUMN cars.width IS 'Width in mm';
+COMMENT ON COLUMN cars.height IS 'Height in mm';
+COMMENT ON COLUMN cars.wheelbase IS 'Wheelbase in mm';
+COMMENT ON COLUMN cars.ground_clearance IS 'Ground clearance in mm';
@@ -0,0 +1,18 @@
+-- Migration to record which version of each AI prompt produced a scan, car or
+-- image. Versions are refs like 'scan_image@v2' from the prompt registry;
+-- rows from before the registry have NULL.
+
+-- The scan prompt the photos were identified with
+ALTER TABLE scan_history ADD COLUMN IF NOT EXISTS prompt_version VARCHAR(100);
+ALTER TABLE pending_scans ADD COLUMN IF NOT EXISTS prompt_version VARCHAR(100);
+
+-- The spec prompt the car's specs were requested with
+ALTER TABLE cars ADD COLUMN IF NOT EXISTS prompt_version VARCHAR(100);
+
+-- The image prompt the premium image was rendered with. Standard renders keep
+-- theirs in the color's entry of cars.color_images.
+ALTER TABLE car_upgrades ADD COLUMN IF NOT EXISTS prompt_version VARCHAR(100);
+
+-- Create index for comparing outcomes between scan prompt versions
+CREATE INDEX IF NOT EXISTS idx_scan_history_prompt_version ON scan_history(prompt_version, outcome)
+    WHERE prompt_version IS NOT NULL;
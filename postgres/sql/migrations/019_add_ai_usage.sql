@@ -0,0 +1,30 @@
+-- Migration to record every call to an AI provider with its token usage,
+-- latency and estimated cost, so spend can be broken down per day, provider
+-- and user
+
+CREATE TABLE IF NOT EXISTS ai_usage (
+    id SERIAL PRIMARY KEY,
+    user_id INT REFERENCES users(id) ON DELETE SET NULL,                    -- NULL for calls made for no user, e.g. renders and backfills
+    scan_history_id INT REFERENCES scan_history(id) ON DELETE SET NULL,    -- The scan the call was made for
+    pending_scan_id INT REFERENCES pending_scans(id) ON DELETE SET NULL,   -- Set until a low confidence scan is confirmed
+    car_id INT REFERENCES cars(id) ON DELETE SET NULL,                      -- The car an image was rendered for
+    kind VARCHAR(10) NOT NULL CHECK (kind IN ('vision', 'chat', 'image')),
+    provider VARCHAR(50) NOT NULL,
+    model VARCHAR(100),
+    input_tokens INT,                   -- NULL when the provider didn't report usage
+    output_tokens INT,
+    images INT NOT NULL DEFAULT 0,
+    latency_ms INT NOT NULL,
+    success BOOLEAN NOT NULL,
+    error TEXT,
+    estimated_cost NUMERIC(12, 6),      -- USD; NULL when the model has no known price
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Create indexes for the spend breakdowns
+CREATE INDEX IF NOT EXISTS idx_ai_usage_created_at ON ai_usage(created_at);
+CREATE INDEX IF NOT EXISTS idx_ai_usage_user_id ON ai_usage(user_id, created_at) WHERE user_id IS NOT NULL;
+
+-- Create indexes for linking calls to their scan
+CREATE INDEX IF NOT EXISTS idx_ai_usage_scan_history_id ON ai_usage(scan_history_id) WHERE scan_history_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_ai_usage_pending_scan_id ON ai_usage(pending_scan_id) WHERE pending_scan_id IS NOT NULL;
@@ -0,0 +1,20 @@
+-- Migration to store image paths as keys in the image store. Keys are
+-- relative to the store's root, which is what /images/ serves, e.g.
+-- generated/car_1/red/high_res_123.jpg. Generated images already used keys.
+-- Move the files of an existing local install to match:
+--   <old SCAN_SAVE_DIR>/*      -> <STORAGE_DIR>/scans/
+--   <old GENERATED_SAVE_DIR>/* -> <STORAGE_DIR>/generated/
+
+-- Profile pictures were relative to _resources rather than the image root
+UPDATE users
+SET profile_picture = substring(profile_picture FROM length('images/') + 1)
+WHERE profile_picture LIKE 'images/profile_pictures/%';
+
+-- Scan photos were relative to SCAN_SAVE_DIR and now live under scans/
+UPDATE scan_history
+SET image_path = 'scans/' || image_path
+WHERE image_path <> '' AND image_path NOT LIKE 'scans/%';
+
+UPDATE scan_history
+SET second_image_path = 'scans/' || second_image_path
+WHERE second_image_path <> '' AND second_image_path NOT LIKE 'scans/%';
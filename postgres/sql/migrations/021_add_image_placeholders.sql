@@ -0,0 +1,13 @@
+-- Migration to keep a placeholder for every car and profile image, drawn by
+-- clients while the image loads: a BlurHash and the dominant color (#rrggbb).
+-- NULL means not computed yet, which the placeholder backfill picks up; an
+-- empty hash means the image couldn't be read.
+
+ALTER TABLE user_cars ADD COLUMN IF NOT EXISTS image_blurhash TEXT;
+ALTER TABLE user_cars ADD COLUMN IF NOT EXISTS image_dominant_color VARCHAR(7);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS profile_picture_blurhash TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS profile_picture_dominant_color VARCHAR(7);
+
+-- cars.color_images entries gain "blurhash" and "dominant_color" keys next to
+-- "high_res" and "low_res"
@@ -0,0 +1,9 @@
+-- Migration to record pending scans that expire without being confirmed
+
+ALTER TABLE scan_history DROP CONSTRAINT IF EXISTS scan_history_outcome_check;
+ALTER TABLE scan_history ADD CONSTRAINT scan_history_outcome_check CHECK (outcome IN (
+    'success', 'rejected_fake', 'recycled_image', 'exif_rejected', 'duplicate',
+    'no_credits', 'ai_error', 'image_gen_error', 'internal_error',
+    'photos_not_distinct', 'photos_mismatch', 'expired'
+));
+
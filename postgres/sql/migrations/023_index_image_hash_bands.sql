@@ -0,0 +1,51 @@
+-- Migration to index the 16-bit bands of image hashes, so looking for a
+-- recycled photo doesn't compare it with every scan ever made
+
+-- A photo within the Hamming distance threshold of an earlier one matches it
+-- closely in at least one band. Only scans a photo can be recycled from are
+-- indexed; the expressions must stay in step with hashBandsSQL in
+-- scan/phash.go.
+
+CREATE INDEX IF NOT EXISTS idx_scan_history_image_hash_band0
+    ON scan_history (((image_hash >> 48) & 65535))
+    WHERE success OR outcome IN ('rejected_fake', 'recycled_image', 'exif_rejected');
+
+CREATE INDEX IF NOT EXISTS idx_scan_history_image_hash_band1
+    ON scan_history (((image_hash >> 32) & 65535))
+    WHERE success OR outcome IN ('rejected_fake', 'recycled_image', 'exif_rejected');
+
+CREATE INDEX IF NOT EXISTS idx_scan_history_image_hash_band2
+    ON scan_history (((image_hash >> 16) & 65535))
+    WHERE success OR outcome IN ('rejected_fake', 'recycled_image', 'exif_rejected');
+
+CREATE INDEX IF NOT EXISTS idx_scan_history_image_hash_band3
+    ON scan_history (((image_hash >> 0) & 65535))
+    WHERE success OR outcome IN ('rejected_fake', 'recycled_image', 'exif_rejected');
+
+CREATE INDEX IF NOT EXISTS idx_scan_history_second_image_hash_band0
+    ON scan_history (((second_image_hash >> 48) & 65535))
+    WHERE success OR outcome IN ('rejected_fake', 'recycled_image', 'exif_rejected');
+
+CREATE INDEX IF NOT EXISTS idx_scan_history_second_image_hash_band1
+    ON scan_history (((second_image_hash >> 32) & 65535))
+    WHERE success OR outcome IN ('rejected_fake', 'recycled_image', 'exif_rejected');
+
+CREATE INDEX IF NOT EXISTS idx_scan_history_second_image_hash_band2
+    ON scan_history (((second_image_hash >> 16) & 65535))
+    WHERE success OR outcome IN ('rejected_fake', 'recycled_image', 'exif_rejected');
+
+CREATE INDEX IF NOT EXISTS idx_scan_history_second_image_hash_band3
+    ON scan_history (((second_image_hash >> 0) & 65535))
+    WHERE success OR outcome IN ('rejected_fake', 'recycled_image', 'exif_rejected');
+
+CREATE INDEX IF NOT EXISTS idx_generated_image_hashes_image_hash_band0
+    ON generated_image_hashes (((image_hash >> 48) & 65535));
+
+CREATE INDEX IF NOT EXISTS idx_generated_image_hashes_image_hash_band1
+    ON generated_image_hashes (((image_hash >> 32) & 65535));
+
+CREATE INDEX IF NOT EXISTS idx_generated_image_hashes_image_hash_band2
+    ON generated_image_hashes (((image_hash >> 16) & 65535));
+
+CREATE INDEX IF NOT EXISTS idx_generated_image_hashes_image_hash_band3
+    ON generated_image_hashes (((image_hash >> 0) & 65535));
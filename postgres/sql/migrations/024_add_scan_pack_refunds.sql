@@ -0,0 +1,11 @@
+-- Migration to record when a scan pack was refunded
+
+-- The App Store can deliver a REFUND notification more than once. A pack's
+-- credits are only taken back the first time, when refunded_at is set.
+ALTER TABLE scan_pack_purchases ADD COLUMN IF NOT EXISTS refunded_at TIMESTAMPTZ;
+
+-- Packs refunded so far have a refund entry in the ledger
+UPDATE scan_pack_purchases p
+SET refunded_at = cl.created_at
+FROM credit_ledger cl
+WHERE cl.entry_type = 'refund' AND cl.reference = p.transaction_id AND p.refunded_at IS NULL;
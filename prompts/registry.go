@@ -0,0 +1,204 @@
+package prompts
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Names of the prompts in the registry
+const (
+	ScanImage          = "scan_image"           // Identifies the car in a scan photo
+	IdentifyCarDetails = "identify_car_details" // Asks for the spec sheet of a car
+	CarImage           = "car_image"            // Renders the image of a newly scanned car
+	PremiumCarImage    = "premium_car_image"    // Renders the premium image upgrade
+)
+
+// requiredVars are the variables each prompt is rendered with. Templates are
+// checked against them when the registry loads, so a version using a variable
+// that isn't passed fails at startup rather than on a scan.
+var requiredVars = map[string][]string{
+	ScanImage:          nil,
+	IdentifyCarDetails: {"year", "make", "model", "trim", "fields"},
+	CarImage:           {"year", "make", "model", "trim", "color"},
+	PremiumCarImage:    {"year", "make", "model", "trim", "color", "background"},
+}
+
+const manifestFile = "prompts.json"
+
+//go:embed templates
+var embedded embed.FS
+
+// Vars are the values a prompt's template is rendered with, referenced in the
+// template as {{.name}}
+type Vars map[string]string
+
+// Prompt is one version of a prompt. Weight is its share of the traffic
+// among the versions of the prompt; 0 keeps a version around without serving it.
+type Prompt struct {
+	Name    string `json:"name"`
+	Version int    `json:"version"`
+	Weight  int    `json:"weight"`
+	tmpl    *template.Template
+}
+
+// Ref identifies the prompt version, e.g. "scan_image@v2". It's what's stored
+// on the rows a prompt produced.
+func (p *Prompt) Ref() string {
+	return fmt.Sprintf("%s@v%d", p.Name, p.Version)
+}
+
+// ParseRef splits a ref made by Ref into the prompt's name and version
+func ParseRef(ref string) (name string, version int, ok bool) {
+	i := strings.LastIndex(ref, "@v")
+	if i <= 0 {
+		return "", 0, false
+	}
+	version, err := strconv.Atoi(ref[i+2:])
+	if err != nil || version < 1 {
+		return "", 0, false
+	}
+	return ref[:i], version, true
+}
+
+// Render fills in the prompt's template
+func (p *Prompt) Render(vars Vars) (string, error) {
+	var b strings.Builder
+	if err := p.tmpl.Execute(&b, vars); err != nil {
+		return "", fmt.Errorf("failed to render prompt %s: %w", p.Ref(), err)
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// Registry holds every version of every prompt
+type Registry struct {
+	prompts map[string][]*Prompt
+}
+
+// NewRegistryFromEnv loads the prompts built into the binary, or those in
+// PROMPTS_DIR when it's set. The directory has the same layout as
+// prompts/templates: a prompts.json manifest listing the versions of each
+// prompt and their weights, and a <name>/v<version>.tmpl file per version.
+func NewRegistryFromEnv() (*Registry, error) {
+	if dir := os.Getenv("PROMPTS_DIR"); dir != "" {
+		return Load(os.DirFS(dir))
+	}
+	templates, err := fs.Sub(embedded, "templates")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open built-in prompts: %w", err)
+	}
+	return Load(templates)
+}
+
+// Load reads a registry from fsys, failing if any prompt is missing, has no
+// version with a positive weight, or has a template that doesn't render
+func Load(fsys fs.FS) (*Registry, error) {
+	data, err := fs.ReadFile(fsys, manifestFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read prompt manifest: %w", err)
+	}
+	var manifest map[string][]Prompt
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse prompt manifest: %w", err)
+	}
+
+	r := &Registry{prompts: make(map[string][]*Prompt, len(manifest))}
+	for name, versions := range manifest {
+		vars, known := requiredVars[name]
+		if !known {
+			return nil, fmt.Errorf("unknown prompt %q in manifest", name)
+		}
+
+		sample := make(Vars, len(vars))
+		for _, v := range vars {
+			sample[v] = v
+		}
+
+		seen := make(map[int]bool, len(versions))
+		serving := false
+		for _, v := range versions {
+			p := v
+			p.Name = name
+			if p.Version < 1 || seen[p.Version] {
+				return nil, fmt.Errorf("prompt %s has an invalid or repeated version %d", name, p.Version)
+			}
+			if p.Weight < 0 {
+				return nil, fmt.Errorf("prompt %s has a negative weight", p.Ref())
+			}
+			seen[p.Version] = true
+			serving = serving || p.Weight > 0
+
+			file := path.Join(name, fmt.Sprintf("v%d.tmpl", p.Version))
+			text, err := fs.ReadFile(fsys, file)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read prompt %s: %w", p.Ref(), err)
+			}
+			p.tmpl, err = template.New(file).Option("missingkey=error").Parse(string(text))
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse prompt %s: %w", p.Ref(), err)
+			}
+			if _, err := p.Render(sample); err != nil {
+				return nil, err
+			}
+			r.prompts[name] = append(r.prompts[name], &p)
+		}
+		if !serving {
+			return nil, fmt.Errorf("prompt %s has no version with a positive weight", name)
+		}
+		sort.Slice(r.prompts[name], func(i, j int) bool {
+			return r.prompts[name][i].Version < r.prompts[name][j].Version
+		})
+	}
+
+	for name := range requiredVars {
+		if _, ok := r.prompts[name]; !ok {
+			return nil, fmt.Errorf("prompt %s is missing from the manifest", name)
+		}
+	}
+	return r, nil
+}
+
+// Pick chooses a version of the prompt at random, in proportion to the weights
+// of its versions
+func (r *Registry) Pick(name string) (*Prompt, error) {
+	versions, ok := r.prompts[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown prompt %q", name)
+	}
+
+	total := 0
+	for _, p := range versions {
+		total += p.Weight
+	}
+	n := rand.Intn(total)
+	for _, p := range versions {
+		if n < p.Weight {
+			return p, nil
+		}
+		n -= p.Weight
+	}
+	return versions[len(versions)-1], nil
+}
+
+// Versions returns every version of every prompt, ordered by name and version
+func (r *Registry) Versions() []*Prompt {
+	names := make([]string, 0, len(r.prompts))
+	for name := range r.prompts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var all []*Prompt
+	for _, name := range names {
+		all = append(all, r.prompts[name]...)
+	}
+	return all
+}
@@ -0,0 +1,105 @@
+package rarity
+
+import (
+	"CarBN/common"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	MinRarity = 1
+	MaxRarity = 5
+
+	defaultPriceWeight = 0.6
+	defaultMinSample   = 500
+)
+
+// priceTiers are the lowest prices for rarity 5 down to 2
+var priceTiers = []int{500000, 150000, 50000, 25000}
+
+// scarcityTiers are the most copies in circulation for rarity 5 down to 2
+var scarcityTiers = []int{1, 3, 10, 50}
+
+// Config weighs the tiers against each other
+type Config struct {
+	// PriceWeight is the share of the score that comes from price; the rest
+	// comes from scarcity
+	PriceWeight float64
+	// MinSample is how many copies must be collected across all cars before
+	// scarcity counts. With fewer, most cars have a single copy and would
+	// all look unique, so rarity comes from price alone.
+	MinSample int
+}
+
+// Explanation describes how a car's rarity was computed. It's stored with
+// the car and returned to clients alongside the rarity.
+type Explanation struct {
+	Rarity       int     `json:"rarity"`
+	Price        int     `json:"price"`
+	PriceTier    int     `json:"price_tier"`
+	Copies       int     `json:"copies"`
+	ScarcityTier int     `json:"scarcity_tier"`
+	Sample       int     `json:"sample"`
+	PriceWeight  float64 `json:"price_weight"`
+	Score        float64 `json:"score"`
+	Summary      string  `json:"summary"`
+	ComputedAt   string  `json:"computed_at"`
+}
+
+// PriceTier maps an estimated price to 1-5
+func PriceTier(price int) int {
+	for i, threshold := range priceTiers {
+		if price >= threshold {
+			return MaxRarity - i
+		}
+	}
+	return MinRarity
+}
+
+// ScarcityTier maps the number of copies collected across all users to 1-5
+func ScarcityTier(copies int) int {
+	for i, threshold := range scarcityTiers {
+		if copies <= threshold {
+			return MaxRarity - i
+		}
+	}
+	return MinRarity
+}
+
+// Evaluate blends the price and scarcity tiers into a rarity. sample is the
+// number of copies collected across all cars.
+func Evaluate(price, copies, sample int, cfg Config, now time.Time) Explanation {
+	priceTier := PriceTier(price)
+	scarcityTier := ScarcityTier(copies)
+	priceWeight := cfg.PriceWeight
+	if sample < cfg.MinSample {
+		priceWeight = 1
+	}
+	score := priceWeight*float64(priceTier) + (1-priceWeight)*float64(scarcityTier)
+	rarity := min(max(int(math.Round(score)), MinRarity), MaxRarity)
+
+	copiesText := fmt.Sprintf("%d copies", copies)
+	if copies == 1 {
+		copiesText = "1 copy"
+	}
+	summary := fmt.Sprintf("Priced around $%d (tier %d) with %s collected (tier %d)",
+		price, priceTier, copiesText, scarcityTier)
+	if sample < cfg.MinSample {
+		summary = fmt.Sprintf("Priced around $%d (tier %d); scarcity counts once %d copies are collected",
+			price, priceTier, cfg.MinSample)
+	}
+
+	return Explanation{
+		Rarity:       rarity,
+		Price:        price,
+		PriceTier:    priceTier,
+		Copies:       copies,
+		ScarcityTier: scarcityTier,
+		Sample:       sample,
+		PriceWeight:  priceWeight,
+		Score:        math.Round(score*100) / 100,
+		Summary:      summary,
+		ComputedAt:   common.FormatTimestamp(now),
+	}
+}
@@ -0,0 +1,99 @@
+package rarity
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPriceTier(t *testing.T) {
+	tests := []struct {
+		price, want int
+	}{
+		{0, 1},
+		{24999, 1},
+		{25000, 2},
+		{50000, 3},
+		{149999, 3},
+		{150000, 4},
+		{500000, 5},
+		{3000000, 5},
+	}
+	for _, tt := range tests {
+		if got := PriceTier(tt.price); got != tt.want {
+			t.Errorf("PriceTier(%d) = %d, want %d", tt.price, got, tt.want)
+		}
+	}
+}
+
+func TestScarcityTier(t *testing.T) {
+	tests := []struct {
+		copies, want int
+	}{
+		{1, 5},
+		{2, 4},
+		{3, 4},
+		{10, 3},
+		{11, 2},
+		{50, 2},
+		{51, 1},
+	}
+	for _, tt := range tests {
+		if got := ScarcityTier(tt.copies); got != tt.want {
+			t.Errorf("ScarcityTier(%d) = %d, want %d", tt.copies, got, tt.want)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	cfg := Config{PriceWeight: defaultPriceWeight, MinSample: defaultMinSample}
+
+	tests := []struct {
+		name        string
+		price       int
+		copies      int
+		sample      int
+		minSample   int
+		priceWeight float64
+		wantRarity  int
+		wantScore   float64
+	}{
+		{"cheap and common", 20000, 500, 5000, defaultMinSample, defaultPriceWeight, 1, 1},
+		{"exotic and unique", 1000000, 1, 5000, defaultMinSample, defaultPriceWeight, 5, 5},
+		{"exotic but common", 1000000, 500, 5000, defaultMinSample, defaultPriceWeight, 3, 3.4},
+		{"cheap but unique", 20000, 1, 5000, defaultMinSample, defaultPriceWeight, 3, 2.6},
+		{"price only", 60000, 500, 5000, defaultMinSample, 1, 3, 3},
+		{"scarcity only", 1000000, 40, 5000, defaultMinSample, 0, 2, 2},
+		{"small sample ignores scarcity", 20000, 1, defaultMinSample - 1, defaultMinSample, defaultPriceWeight, 1, 1},
+		{"sample at the minimum counts scarcity", 20000, 1, defaultMinSample, defaultMinSample, defaultPriceWeight, 3, 2.6},
+		{"no minimum sample", 20000, 1, 1, 0, 0, 5, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{PriceWeight: tt.priceWeight, MinSample: tt.minSample}
+			e := Evaluate(tt.price, tt.copies, tt.sample, cfg, now)
+			if e.Rarity != tt.wantRarity || e.Score != tt.wantScore {
+				t.Errorf("Evaluate = rarity %d, score %v, want %d, %v", e.Rarity, e.Score, tt.wantRarity, tt.wantScore)
+			}
+			if e.Rarity < MinRarity || e.Rarity > MaxRarity {
+				t.Errorf("rarity %d outside %d-%d", e.Rarity, MinRarity, MaxRarity)
+			}
+		})
+	}
+
+	e := Evaluate(30000, 1, 5000, cfg, now)
+	if want := "Priced around $30000 (tier 2) with 1 copy collected (tier 5)"; e.Summary != want {
+		t.Errorf("summary = %q, want %q", e.Summary, want)
+	}
+	if e.ComputedAt == "" {
+		t.Error("computed_at is empty")
+	}
+
+	e = Evaluate(30000, 1, 10, cfg, now)
+	if want := "Priced around $30000 (tier 2); scarcity counts once 500 copies are collected"; e.Summary != want {
+		t.Errorf("summary = %q, want %q", e.Summary, want)
+	}
+	if e.PriceWeight != 1 || e.Sample != 10 {
+		t.Errorf("price weight %v, sample %d, want 1, 10", e.PriceWeight, e.Sample)
+	}
+}
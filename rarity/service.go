@@ -0,0 +1,239 @@
+package rarity
+
+import (
+	"CarBN/common"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+type Service struct {
+	db     *pgxpool.Pool
+	config Config
+}
+
+// NewService creates the rarity engine. RARITY_PRICE_WEIGHT (0-1, default
+// 0.6) sets how much of the rarity comes from price rather than scarcity, and
+// RARITY_MIN_SAMPLE (default 500) how many copies must be collected before
+// scarcity counts at all.
+func NewService(db *pgxpool.Pool) *Service {
+	config := Config{PriceWeight: defaultPriceWeight, MinSample: defaultMinSample}
+	if v := os.Getenv("RARITY_PRICE_WEIGHT"); v != "" {
+		if w, err := strconv.ParseFloat(v, 64); err == nil && w >= 0 && w <= 1 {
+			config.PriceWeight = w
+		} else {
+			log.Printf("Warning: invalid RARITY_PRICE_WEIGHT %q, using %.2f", v, defaultPriceWeight)
+		}
+	}
+	if v := os.Getenv("RARITY_MIN_SAMPLE"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			config.MinSample = n
+		} else {
+			log.Printf("Warning: invalid RARITY_MIN_SAMPLE %q, using %d", v, defaultMinSample)
+		}
+	}
+
+	return &Service{db: db, config: config}
+}
+
+// queryRower is satisfied by both the pool and a transaction
+type queryRower interface {
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// sampleSQL counts the copies collected across all cars. Sold cars belong to
+// user 0 and don't count towards scarcity.
+const sampleSQL = "SELECT COUNT(*) FROM user_cars WHERE user_id <> 0"
+
+// Evaluate computes the rarity of a car with the configured weights against
+// the copies collected so far
+func (s *Service) Evaluate(ctx context.Context, q queryRower, price, copies int) (Explanation, error) {
+	var sample int
+	if err := q.QueryRow(ctx, sampleSQL).Scan(&sample); err != nil {
+		return Explanation{}, fmt.Errorf("failed to count collected cars: %w", err)
+	}
+	return Evaluate(price, copies, sample, s.config, time.Now()), nil
+}
+
+// Recompute re-evaluates every car against the current number of copies in
+// circulation, recording a history row for each car whose rarity changed.
+// Only cars whose rarity or its inputs changed are written. It returns the
+// number of cars whose rarity changed.
+func (s *Service) Recompute(ctx context.Context) (int, error) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+
+	type car struct {
+		id, oldRarity, copies int
+		price                 int64
+	}
+	var cars []car
+	sample := 0
+
+	// Sold cars belong to user 0 and don't count towards scarcity
+	rows, err := s.db.Query(ctx, `
+		SELECT c.id, COALESCE(c.price, 0)::bigint, COALESCE(c.rarity, 0),
+			COUNT(uc.id) FILTER (WHERE uc.user_id <> 0)
+		FROM cars c
+		LEFT JOIN user_cars uc ON uc.car_id = c.id
+		GROUP BY c.id`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query cars: %w", err)
+	}
+
+	for rows.Next() {
+		var c car
+		if err := rows.Scan(&c.id, &c.price, &c.oldRarity, &c.copies); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan car: %w", err)
+		}
+		cars = append(cars, c)
+		sample += c.copies
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read cars: %w", err)
+	}
+
+	now := time.Now()
+	var ids, rarities []int
+	var explanations []string
+	var changedIDs, oldRarities, newRarities []int
+	var changedExplanations []string
+	for _, c := range cars {
+		explanation := Evaluate(int(c.price), c.copies, sample, s.config, now)
+		data, err := json.Marshal(explanation)
+		if err != nil {
+			return 0, fmt.Errorf("failed to encode rarity explanation: %w", err)
+		}
+
+		ids = append(ids, c.id)
+		rarities = append(rarities, explanation.Rarity)
+		explanations = append(explanations, string(data))
+		if explanation.Rarity != c.oldRarity {
+			changedIDs = append(changedIDs, c.id)
+			oldRarities = append(oldRarities, c.oldRarity)
+			newRarities = append(newRarities, explanation.Rarity)
+			changedExplanations = append(changedExplanations, string(data))
+		}
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+			logger.Printf("Warning: transaction rollback error: %v", err)
+		}
+	}()
+
+	// The explanation's timestamp always differs, so it's left out of the
+	// comparison; cars are rewritten only when their inputs or rarity moved
+	updated, err := tx.Exec(ctx, `
+		UPDATE cars c
+		SET rarity = u.rarity, rarity_explanation = u.explanation::jsonb, rarity_updated_at = NOW()
+		FROM unnest($1::int[], $2::int[], $3::text[]) AS u(id, rarity, explanation)
+		WHERE c.id = u.id
+		AND (c.rarity IS DISTINCT FROM u.rarity
+			OR c.rarity_explanation - 'computed_at' IS DISTINCT FROM u.explanation::jsonb - 'computed_at')`,
+		ids, rarities, explanations,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to update rarities: %w", err)
+	}
+
+	if len(changedIDs) > 0 {
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO rarity_history (car_id, old_rarity, new_rarity, explanation)
+			SELECT id, NULLIF(old_rarity, 0), new_rarity, explanation::jsonb
+			FROM unnest($1::int[], $2::int[], $3::int[], $4::text[]) AS u(id, old_rarity, new_rarity, explanation)`,
+			changedIDs, oldRarities, newRarities, changedExplanations,
+		); err != nil {
+			return 0, fmt.Errorf("failed to record rarity history: %w", err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	logger.Printf("Recomputed rarity for %d cars from %d copies, %d updated, %d changed rarity",
+		len(ids), sample, updated.RowsAffected(), len(changedIDs))
+	return len(changedIDs), nil
+}
+
+// RecomputeCar re-evaluates one car in tx, recording a history row if its
+// rarity changed. It's for changes to a car's copies that shouldn't wait for
+// the next Recompute, like a merge of duplicate cars.
+func (s *Service) RecomputeCar(ctx context.Context, tx pgx.Tx, carID int) error {
+	var oldRarity, copies int
+	var price int64
+	err := tx.QueryRow(ctx, `
+		SELECT COALESCE(c.price, 0)::bigint, COALESCE(c.rarity, 0),
+			(SELECT COUNT(*) FROM user_cars uc WHERE uc.car_id = c.id AND uc.user_id <> 0)
+		FROM cars c
+		WHERE c.id = $1`,
+		carID,
+	).Scan(&price, &oldRarity, &copies)
+	if err != nil {
+		return fmt.Errorf("failed to get car %d: %w", carID, err)
+	}
+
+	explanation, err := s.Evaluate(ctx, tx, int(price), copies)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(explanation)
+	if err != nil {
+		return fmt.Errorf("failed to encode rarity explanation: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx, `
+		UPDATE cars SET rarity = $1, rarity_explanation = $2, rarity_updated_at = NOW()
+		WHERE id = $3`,
+		explanation.Rarity, data, carID,
+	); err != nil {
+		return fmt.Errorf("failed to update rarity of car %d: %w", carID, err)
+	}
+	if explanation.Rarity != oldRarity {
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO rarity_history (car_id, old_rarity, new_rarity, explanation)
+			VALUES ($1, NULLIF($2, 0), $3, $4)`,
+			carID, oldRarity, explanation.Rarity, data,
+		); err != nil {
+			return fmt.Errorf("failed to record rarity history of car %d: %w", carID, err)
+		}
+	}
+	return nil
+}
+
+// StartScheduler recomputes rarities now and then every interval until ctx
+// is cancelled
+func (s *Service) StartScheduler(ctx context.Context, interval time.Duration) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if _, err := s.Recompute(ctx); err != nil {
+				logger.Printf("Rarity recompute error: %v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
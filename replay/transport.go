@@ -0,0 +1,185 @@
+package replay
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Modes of the transport
+const (
+	ModeRecord = "record" // Send requests to the provider and save each successful reply
+	ModeReplay = "replay" // Answer requests from saved replies only, never touching the network
+)
+
+const defaultDir = "_test/testdata/cassettes"
+
+// Transport records the HTTP traffic to the AI providers as cassette files and
+// plays it back, so the scan flow can run offline against replies recorded
+// once from the real providers.
+//
+// A request is matched to its recording by a hash of its method, path and
+// body. The query string and headers are left out, so API keys never end up
+// in a cassette and replaying doesn't need real keys. Only 2xx replies are
+// recorded; errors pass through so a rate limited run doesn't get saved.
+type Transport struct {
+	mode string
+	dir  string
+	next http.RoundTripper
+}
+
+// cassette is one recorded reply, stored as <dir>/<key>.json
+type cassette struct {
+	Method      string `json:"method"`
+	URL         string `json:"url"`
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type"`
+	Body        string `json:"body"`
+}
+
+// NewTransport wraps next, which may be nil for http.DefaultTransport, in a
+// transport that records to or replays from dir
+func NewTransport(mode, dir string, next http.RoundTripper) (*Transport, error) {
+	if mode != ModeRecord && mode != ModeReplay {
+		return nil, fmt.Errorf("unknown replay mode %q", mode)
+	}
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &Transport{mode: mode, dir: dir, next: next}, nil
+}
+
+// WrapFromEnv wraps next in a Transport when AI_REPLAY_MODE is "record" or
+// "replay", using the cassettes in AI_REPLAY_DIR (default
+// _test/testdata/cassettes). With AI_REPLAY_MODE unset next is returned as is.
+func WrapFromEnv(next http.RoundTripper) http.RoundTripper {
+	mode := strings.ToLower(os.Getenv("AI_REPLAY_MODE"))
+	if mode == "" {
+		return next
+	}
+	dir := os.Getenv("AI_REPLAY_DIR")
+	if dir == "" {
+		dir = defaultDir
+	}
+
+	t, err := NewTransport(mode, dir, next)
+	if err != nil {
+		log.Printf("Warning: ignoring AI_REPLAY_MODE: %v", err)
+		return next
+	}
+	return t
+}
+
+// NewClientFromEnv returns an http.Client for talking to the AI providers,
+// going through a Transport when AI_REPLAY_MODE is set
+func NewClientFromEnv() *http.Client {
+	return &http.Client{Transport: WrapFromEnv(http.DefaultTransport)}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read request body: %w", err)
+		}
+	}
+	key := requestKey(req, body)
+	file := filepath.Join(t.dir, key+".json")
+
+	if t.mode == ModeReplay {
+		data, err := os.ReadFile(file)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("no recording of %s %s (cassette %s)", req.Method, req.URL.Path, key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cassette: %w", err)
+		}
+		var c cassette
+		if err := json.Unmarshal(data, &c); err != nil {
+			return nil, fmt.Errorf("failed to parse cassette %s: %w", key, err)
+		}
+		return c.response(req), nil
+	}
+
+	// Record: the body was consumed for the key, so hand the provider a copy
+	out := req.Clone(req.Context())
+	out.Body = io.NopCloser(bytes.NewReader(body))
+	out.ContentLength = int64(len(body))
+	resp, err := t.next.RoundTrip(out)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		c := cassette{
+			Method:      req.Method,
+			URL:         req.URL.Scheme + "://" + req.URL.Host + req.URL.Path,
+			Status:      resp.StatusCode,
+			ContentType: resp.Header.Get("Content-Type"),
+			Body:        string(respBody),
+		}
+		if err := c.save(file); err != nil {
+			log.Printf("Warning: failed to record %s %s: %v", req.Method, req.URL.Path, err)
+		}
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+	resp.ContentLength = int64(len(respBody))
+	resp.Header.Del("Content-Length")
+	return resp, nil
+}
+
+// requestKey identifies a request by its method, path and body
+func requestKey(req *http.Request, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", req.Method, req.URL.Path)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *cassette) save(file string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode cassette: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return fmt.Errorf("failed to create cassette directory: %w", err)
+	}
+	return os.WriteFile(file, data, 0644)
+}
+
+func (c *cassette) response(req *http.Request) *http.Response {
+	header := make(http.Header)
+	if c.ContentType != "" {
+		header.Set("Content-Type", c.ContentType)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", c.Status, http.StatusText(c.Status)),
+		StatusCode:    c.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(c.Body)),
+		ContentLength: int64(len(c.Body)),
+		Request:       req,
+	}
+}
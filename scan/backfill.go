@@ -0,0 +1,285 @@
+package scan
+
+import (
+	"CarBN/common"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Spec backfill run statuses
+const (
+	SpecBackfillRunning   = "running"
+	SpecBackfillCompleted = "completed"
+)
+
+const (
+	defaultSpecBackfillDelay = time.Second
+	specBackfillBatchSize    = 20
+	specBackfillLease        = 5 * time.Minute
+	specBackfillPollPeriod   = time.Minute
+)
+
+// SpecBackfillRun is the progress of a backfill of car specs
+type SpecBackfillRun struct {
+	ID         int     `json:"id"`
+	Status     string  `json:"status"`
+	LastCarID  int     `json:"last_car_id"`
+	Enriched   int     `json:"enriched"`
+	Failed     int     `json:"failed"`
+	Remaining  int     `json:"remaining"` // Cars after last_car_id still missing specs
+	LastError  *string `json:"last_error,omitempty"`
+	StartedBy  *int    `json:"started_by,omitempty"`
+	StartedAt  string  `json:"started_at"`
+	UpdatedAt  string  `json:"updated_at"`
+	FinishedAt *string `json:"finished_at,omitempty"`
+}
+
+// StartSpecBackfill starts a run filling in the specs of every car created
+// before enrichment, or returns the run already in progress
+func (s *Service) StartSpecBackfill(ctx context.Context, adminID int) (*SpecBackfillRun, error) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+
+	var runID int
+	err := s.db.QueryRow(ctx, `
+		INSERT INTO spec_backfill_runs (status, started_by)
+		VALUES ($1, $2)
+		ON CONFLICT ((status)) WHERE status = 'running' DO NOTHING
+		RETURNING id`,
+		SpecBackfillRunning, adminID,
+	).Scan(&runID)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("failed to start spec backfill: %w", err)
+	}
+	if err == nil {
+		logger.Printf("Admin %d started spec backfill run %d", adminID, runID)
+		select {
+		case s.backfillSignal <- struct{}{}:
+		default:
+		}
+	}
+
+	return s.GetSpecBackfill(ctx)
+}
+
+// GetSpecBackfill returns the latest backfill run
+func (s *Service) GetSpecBackfill(ctx context.Context) (*SpecBackfillRun, error) {
+	var run SpecBackfillRun
+	var startedAt, updatedAt time.Time
+	var finishedAt *time.Time
+	err := s.db.QueryRow(ctx, `
+		SELECT r.id, r.status, r.last_car_id, r.enriched, r.failed, r.last_error, r.started_by,
+			r.started_at, r.updated_at, r.finished_at,
+			(SELECT COUNT(*) FROM cars c WHERE c.specs_enriched_at IS NULL AND c.id > r.last_car_id)
+		FROM spec_backfill_runs r
+		ORDER BY r.id DESC
+		LIMIT 1`,
+	).Scan(&run.ID, &run.Status, &run.LastCarID, &run.Enriched, &run.Failed, &run.LastError, &run.StartedBy,
+		&startedAt, &updatedAt, &finishedAt, &run.Remaining)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, common.NotFound("no spec backfill has been run")
+		}
+		return nil, fmt.Errorf("failed to get spec backfill: %w", err)
+	}
+
+	run.StartedAt = common.FormatTimestamp(startedAt)
+	run.UpdatedAt = common.FormatTimestamp(updatedAt)
+	if finishedAt != nil {
+		formatted := common.FormatTimestamp(*finishedAt)
+		run.FinishedAt = &formatted
+	}
+	return &run, nil
+}
+
+// StartSpecBackfillWorker runs backfills until ctx is cancelled. A run left
+// in progress by a previous process is resumed once its lease expires.
+func (s *Service) StartSpecBackfillWorker(ctx context.Context) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+
+	go func() {
+		ticker := time.NewTicker(specBackfillPollPeriod)
+		defer ticker.Stop()
+
+		for {
+			if err := s.runSpecBackfill(ctx); err != nil {
+				logger.Printf("Spec backfill error: %v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.backfillSignal:
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// runSpecBackfill claims the run in progress, if there is one, and works
+// through the cars missing specs, recording its progress after every car
+func (s *Service) runSpecBackfill(ctx context.Context) error {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+
+	var runID, lastCarID int
+	err := s.db.QueryRow(ctx, `
+		UPDATE spec_backfill_runs
+		SET locked_until = NOW() + make_interval(secs => $1), updated_at = NOW()
+		WHERE status = $2 AND (locked_until IS NULL OR locked_until < NOW())
+		RETURNING id, last_car_id`,
+		specBackfillLease.Seconds(), SpecBackfillRunning,
+	).Scan(&runID, &lastCarID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("failed to claim spec backfill: %w", err)
+	}
+	logger.Printf("Running spec backfill %d from car %d", runID, lastCarID)
+
+	// Let the next process pick the run straight back up if this one stops
+	defer func() {
+		if _, err := s.db.Exec(context.WithoutCancel(ctx), `
+			UPDATE spec_backfill_runs SET locked_until = NULL WHERE id = $1`,
+			runID,
+		); err != nil {
+			logger.Printf("Warning: failed to release spec backfill %d: %v", runID, err)
+		}
+	}()
+
+	type pendingCar struct {
+		id                      int
+		make, model, trim, year string
+	}
+	for {
+		rows, err := s.db.Query(ctx, `
+			SELECT c.id, c.make, c.model, COALESCE(c.trim, ''), COALESCE(c.year, '')
+			FROM cars c
+			WHERE c.specs_enriched_at IS NULL AND c.id > $1
+			ORDER BY c.id
+			LIMIT $2`,
+			lastCarID, specBackfillBatchSize,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to query cars missing specs: %w", err)
+		}
+		var batch []pendingCar
+		for rows.Next() {
+			var c pendingCar
+			if err := rows.Scan(&c.id, &c.make, &c.model, &c.trim, &c.year); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to read car: %w", err)
+			}
+			batch = append(batch, c)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to query cars missing specs: %w", err)
+		}
+
+		if len(batch) == 0 {
+			if _, err := s.db.Exec(ctx, `
+				UPDATE spec_backfill_runs
+				SET status = $1, finished_at = NOW(), updated_at = NOW()
+				WHERE id = $2`,
+				SpecBackfillCompleted, runID,
+			); err != nil {
+				return fmt.Errorf("failed to finish spec backfill: %w", err)
+			}
+			logger.Printf("Spec backfill %d completed", runID)
+			return nil
+		}
+
+		for _, c := range batch {
+			enriched, failed := 1, 0
+			var lastError *string
+			if err := s.enrichCar(ctx, c.id, c.make, c.model, c.trim, c.year); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				logger.Printf("Failed to enrich car %d: %v", c.id, err)
+				msg := fmt.Sprintf("car %d: %v", c.id, err)
+				enriched, failed, lastError = 0, 1, &msg
+			}
+
+			lastCarID = c.id
+			if _, err := s.db.Exec(ctx, `
+				UPDATE spec_backfill_runs
+				SET last_car_id = $1, enriched = enriched + $2, failed = failed + $3,
+					last_error = COALESCE($4, last_error),
+					locked_until = NOW() + make_interval(secs => $5), updated_at = NOW()
+				WHERE id = $6`,
+				lastCarID, enriched, failed, lastError, specBackfillLease.Seconds(), runID,
+			); err != nil {
+				return fmt.Errorf("failed to record spec backfill progress: %w", err)
+			}
+
+			// Go easy on the AI provider's rate limits
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(s.specBackfillDelay):
+			}
+		}
+	}
+}
+
+// enrichCar fills in the specs a car is missing. Values the car already has
+// are kept, so the backfill never overwrites specs a scan or an admin set.
+func (s *Service) enrichCar(ctx context.Context, carID int, make, model, trim, year string) error {
+	specs, promptVersion, err := s.identifyCarSpecs(ctx, make, model, trim, year)
+	if err != nil {
+		return fmt.Errorf("failed to get car specs: %w", err)
+	}
+
+	// Cars created before enrichment stored 0 and "" for specs the AI
+	// didn't return, which count as missing here
+	_, err = s.db.Exec(ctx, `
+		UPDATE cars SET
+			horsepower = COALESCE(NULLIF(horsepower, 0), $2),
+			torque = COALESCE(NULLIF(torque, 0), $3),
+			top_speed = COALESCE(NULLIF(top_speed, 0), $4),
+			acceleration = COALESCE(NULLIF(acceleration, 0), $5),
+			engine_type = COALESCE(NULLIF(engine_type, ''), $6),
+			drivetrain_type = COALESCE(NULLIF(drivetrain_type, ''), $7),
+			curb_weight = COALESCE(NULLIF(curb_weight, 0), $8),
+			price = COALESCE(NULLIF(price, 0), $9),
+			description = COALESCE(NULLIF(description, ''), $10),
+			fuel_type = COALESCE(fuel_type, $11),
+			displacement = COALESCE(displacement, $12),
+			cylinder_count = COALESCE(cylinder_count, $13),
+			forced_induction = COALESCE(forced_induction, $14),
+			hybrid = COALESCE(hybrid, $15),
+			battery_capacity = COALESCE(battery_capacity, $16),
+			range = COALESCE(range, $17),
+			charging_time = COALESCE(charging_time, $18),
+			transmission_type = COALESCE(transmission_type, $19),
+			gear_count = COALESCE(gear_count, $20),
+			length = COALESCE(length, $21),
+			width = COALESCE(width, $22),
+			height = COALESCE(height, $23),
+			wheelbase = COALESCE(wheelbase, $24),
+			ground_clearance = COALESCE(ground_clearance, $25),
+			body_type = COALESCE(body_type, $26),
+			doors = COALESCE(doors, $27),
+			wheel_size = COALESCE(wheel_size, $28),
+			specs_enriched_at = NOW(),
+			prompt_version = COALESCE(prompt_version, $29)
+		WHERE id = $1`,
+		carID,
+		specs.Horsepower, specs.Torque, specs.TopSpeed, specs.Acceleration,
+		specs.EngineType, specs.DrivetrainType, specs.CurbWeight, specs.Price, specs.Description,
+		specs.FuelType, specs.Displacement, specs.CylinderCount, specs.ForcedInduction, specs.Hybrid,
+		specs.BatteryCapacity, specs.Range, specs.ChargingTime, specs.TransmissionType, specs.GearCount,
+		specs.Length, specs.Width, specs.Height, specs.Wheelbase, specs.GroundClearance,
+		specs.BodyType, specs.Doors, specs.WheelSize, promptVersion,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update car specs: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,423 @@
+package scan
+
+import (
+	"CarBN/common"
+	"CarBN/usage"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	defaultConfidenceThreshold = 0.6
+	defaultMaxCandidates       = 3
+	defaultConfirmationTTL     = 24 * time.Hour
+)
+
+// Pending scan statuses
+const (
+	PendingScanStatusPending    = "pending"
+	PendingScanStatusConfirming = "confirming" // Held by a confirmation in progress
+	PendingScanStatusConfirmed  = "confirmed"
+	PendingScanStatusExpired    = "expired"
+)
+
+// CarCandidate is one possible identification of a scanned car
+type CarCandidate struct {
+	Make       string  `json:"make"`
+	Model      string  `json:"model"`
+	Trim       string  `json:"trim"`
+	Year       string  `json:"year"`
+	Confidence float64 `json:"confidence"`
+}
+
+// PendingScan is a low confidence scan waiting for the user to pick which
+// candidate is the right car. No credit is spent until it's confirmed.
+type PendingScan struct {
+	ID         int            `json:"id"`
+	Status     string         `json:"status"`
+	Color      string         `json:"color"`
+	Candidates []CarCandidate `json:"candidates"`
+	CreatedAt  string         `json:"created_at"`
+	ExpiresAt  string         `json:"expires_at"`
+}
+
+func (c CarCandidate) toCarDetails(color string) *CarDetails {
+	return &CarDetails{
+		Make:  c.Make,
+		Model: c.Model,
+		Trim:  c.Trim,
+		Year:  c.Year,
+		Color: color,
+	}
+}
+
+func (c CarCandidate) sameCar(other CarCandidate) bool {
+	return strings.EqualFold(strings.TrimSpace(c.Make), strings.TrimSpace(other.Make)) &&
+		strings.EqualFold(strings.TrimSpace(c.Model), strings.TrimSpace(other.Model)) &&
+		strings.EqualFold(strings.TrimSpace(c.Trim), strings.TrimSpace(other.Trim)) &&
+		strings.EqualFold(strings.TrimSpace(c.Year), strings.TrimSpace(other.Year))
+}
+
+// rankCandidates merges the model's primary guess with its alternatives and
+// returns at most limit of them, most confident first. The result is never
+// empty. A guess without a reported confidence is taken to be certain, so
+// providers that don't report one never ask for confirmation.
+func rankCandidates(details *CarDetails, limit int) []CarCandidate {
+	primary := CarCandidate{
+		Make:       details.Make,
+		Model:      details.Model,
+		Trim:       details.Trim,
+		Year:       details.Year,
+		Confidence: 1,
+	}
+	hasConfidence := details.Confidence != nil
+	if hasConfidence {
+		primary.Confidence = clampConfidence(*details.Confidence)
+	}
+
+	candidates := []CarCandidate{primary}
+	for _, c := range details.Candidates {
+		if strings.TrimSpace(c.Make) == "" || strings.TrimSpace(c.Model) == "" {
+			continue
+		}
+		c.Confidence = clampConfidence(c.Confidence)
+
+		duplicate := false
+		for i := range candidates {
+			if !candidates[i].sameCar(c) {
+				continue
+			}
+			// The primary guess is normally repeated as the first candidate,
+			// which may be the only place its confidence is given
+			if i == 0 && !hasConfidence {
+				candidates[i].Confidence = c.Confidence
+				hasConfidence = true
+			} else {
+				candidates[i].Confidence = max(candidates[i].Confidence, c.Confidence)
+			}
+			duplicate = true
+			break
+		}
+		if !duplicate {
+			candidates = append(candidates, c)
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Confidence > candidates[j].Confidence
+	})
+	if limit > 0 && len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+	return candidates
+}
+
+func clampConfidence(c float64) float64 {
+	return min(max(c, 0), 1)
+}
+
+// createPendingScan keeps the photo and candidates of a low confidence scan
+// until the user confirms it or it expires
+func (s *Service) createPendingScan(ctx context.Context, userID int, upload, second *Upload, color string, candidates []CarCandidate, evidence *scanEvidence, promptVersion string) (*PendingScan, error) {
+	pending := PendingScan{
+		Status:     PendingScanStatusPending,
+		Color:      color,
+		Candidates: candidates,
+	}
+	var secondData []byte
+	var secondType *string
+	if second != nil {
+		secondData, secondType = second.Data, &second.ContentType
+	}
+	secondEvidence := evidence.secondPhoto()
+
+	var createdAt, expiresAt time.Time
+	err := s.db.QueryRow(ctx, `
+		INSERT INTO pending_scans (user_id, status, color, candidates, image_data, image_type, image_hash, exif, flag_reasons,
+			second_image_data, second_image_type, second_image_hash, second_exif, prompt_version, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, NULLIF($14, ''), NOW() + make_interval(secs => $15))
+		RETURNING id, created_at, expires_at`,
+		userID, PendingScanStatusPending, color, candidates, upload.Data, upload.ContentType,
+		evidence.imageHash, evidence.metadata, evidence.violations,
+		secondData, secondType, secondEvidence.imageHash, secondEvidence.metadata, promptVersion, s.confirmationTTL.Seconds(),
+	).Scan(&pending.ID, &createdAt, &expiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pending scan: %w", err)
+	}
+
+	// The calls that identified the scan are linked to it once it's confirmed
+	if err := usage.LinkPendingScan(ctx, s.db, pending.ID); err != nil {
+		logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+		logger.Printf("Warning: failed to link AI usage to pending scan %d: %v", pending.ID, err)
+	}
+
+	pending.CreatedAt = common.FormatTimestamp(createdAt)
+	pending.ExpiresAt = common.FormatTimestamp(expiresAt)
+	return &pending, nil
+}
+
+// getPendingScan returns a pending scan owned by userID
+func (s *Service) getPendingScan(ctx context.Context, userID, pendingID int) (*PendingScan, error) {
+	var pending PendingScan
+	var createdAt, expiresAt time.Time
+	var lockedUntil *time.Time
+	err := s.db.QueryRow(ctx, `
+		SELECT id, status, color, candidates, created_at, expires_at, locked_until
+		FROM pending_scans
+		WHERE id = $1 AND user_id = $2`,
+		pendingID, userID,
+	).Scan(&pending.ID, &pending.Status, &pending.Color, &pending.Candidates, &createdAt, &expiresAt, &lockedUntil)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, common.NotFound("pending scan not found")
+		}
+		return nil, fmt.Errorf("failed to get pending scan: %w", err)
+	}
+
+	// Expired scans are only marked once the sweeper gets to them, and a
+	// confirmation that crashed is as good as never started
+	now := time.Now()
+	abandoned := pending.Status == PendingScanStatusConfirming && (lockedUntil == nil || now.After(*lockedUntil))
+	if (pending.Status == PendingScanStatusPending || abandoned) && now.After(expiresAt) {
+		pending.Status = PendingScanStatusExpired
+	}
+	pending.CreatedAt = common.FormatTimestamp(createdAt)
+	pending.ExpiresAt = common.FormatTimestamp(expiresAt)
+	return &pending, nil
+}
+
+// ConfirmScan finishes a pending scan with the candidate the user picked,
+// adding the car to their collection and spending a scan credit
+func (s *Service) ConfirmScan(ctx context.Context, userID, pendingID, candidateIndex int) (_ *car, err error) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+	ctx = usage.WithPendingScan(ctx, userID, pendingID)
+
+	// Claim the scan so concurrent confirmations can't both add the car. A
+	// claim left behind by a crashed request lapses with the lease.
+	var color string
+	var candidates []CarCandidate
+	upload := &Upload{}
+	var secondData []byte
+	var secondType *string
+	var promptVersion *string
+	evidence := &scanEvidence{}
+	secondEvidence := &scanEvidence{}
+	err = s.db.QueryRow(ctx, `
+		UPDATE pending_scans
+		SET status = $1, locked_until = NOW() + make_interval(secs => $2)
+		WHERE id = $3 AND user_id = $4 AND expires_at > NOW()
+		  AND (status = $5 OR (status = $1 AND locked_until < NOW()))
+		RETURNING color, candidates, image_data, image_type, image_hash, exif, flag_reasons,
+			second_image_data, second_image_type, second_image_hash, second_exif, prompt_version`,
+		PendingScanStatusConfirming, scanJobLease.Seconds(), pendingID, userID, PendingScanStatusPending,
+	).Scan(&color, &candidates, &upload.Data, &upload.ContentType, &evidence.imageHash, &evidence.metadata, &evidence.violations,
+		&secondData, &secondType, &secondEvidence.imageHash, &secondEvidence.metadata, &promptVersion)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, s.pendingScanUnavailable(ctx, userID, pendingID)
+		}
+		return nil, fmt.Errorf("failed to claim pending scan: %w", err)
+	}
+
+	// Anything short of success hands the scan back so the user can retry
+	defer func() {
+		if err == nil {
+			return
+		}
+		releaseCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+		if _, dbErr := s.db.Exec(releaseCtx, `
+			UPDATE pending_scans SET status = $1, locked_until = NULL
+			WHERE id = $2 AND status = $3`,
+			PendingScanStatusPending, pendingID, PendingScanStatusConfirming,
+		); dbErr != nil {
+			logger.Printf("Warning: failed to release pending scan %d: %v", pendingID, dbErr)
+		}
+	}()
+
+	var second *Upload
+	if secondType != nil {
+		second = &Upload{Data: secondData, ContentType: *secondType}
+		evidence.second = secondEvidence
+	}
+
+	if candidateIndex < 0 || candidateIndex >= len(candidates) {
+		return nil, common.BadRequest("invalid candidate index")
+	}
+	candidate := candidates[candidateIndex]
+
+	attempt := &scanAttempt{evidence: evidence, color: color}
+	if promptVersion != nil {
+		attempt.promptVersion = *promptVersion
+	}
+	defer func() {
+		if err != nil && !attempt.recorded {
+			s.recordFailedScan(ctx, userID, upload, attempt, err)
+		}
+	}()
+
+	// Another scan of the same photo may have been added while this one waited
+	if err := s.checkRecycledImages(ctx, userID, evidence, pendingID); err != nil {
+		return nil, err
+	}
+
+	// Credits may have run out while the scan waited
+	reservationID, err := s.subscriptionService.ReserveScanCredit(ctx, userID)
+	if err != nil {
+		if errors.Is(err, common.ErrNoScanCredits) {
+			return nil, withOutcome(ScanOutcomeNoCredits, err)
+		}
+		logger.Printf("Failed to reserve scan credit: %v", err)
+		return nil, fmt.Errorf("failed to reserve scan credit: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			s.releaseScanCredit(ctx, reservationID)
+		}
+	}()
+
+	logger.Printf("User %d confirmed pending scan %d as %s %s %s %s",
+		userID, pendingID, candidate.Year, candidate.Make, candidate.Model, candidate.Trim)
+	// The scan is only confirmed, and its job done, if the car is added
+	complete := func(ctx context.Context, tx pgx.Tx, userCarID int) error {
+		if _, err := tx.Exec(ctx, `
+			UPDATE pending_scans
+			SET status = $1, chosen_candidate = $2, user_car_id = $3, image_data = NULL, second_image_data = NULL,
+				locked_until = NULL, confirmed_at = NOW()
+			WHERE id = $4`,
+			PendingScanStatusConfirmed, candidateIndex, userCarID, pendingID,
+		); err != nil {
+			return fmt.Errorf("failed to mark pending scan %d confirmed: %w", pendingID, err)
+		}
+		if _, err := tx.Exec(ctx, `
+			UPDATE scan_jobs
+			SET stage = $1, user_car_id = $2, finished_at = NOW(), updated_at = NOW()
+			WHERE pending_scan_id = $3 AND stage = $4`,
+			ScanStageDone, userCarID, pendingID, ScanStageAwaitingConfirmation,
+		); err != nil {
+			return fmt.Errorf("failed to finish scan job for pending scan %d: %w", pendingID, err)
+		}
+		return nil
+	}
+	return s.completeScan(ctx, userID, reservationID, upload, second, candidate.toCarDetails(color), attempt, scanHooks{complete: complete})
+}
+
+// pendingScanUnavailable explains why a pending scan couldn't be claimed
+func (s *Service) pendingScanUnavailable(ctx context.Context, userID, pendingID int) error {
+	pending, err := s.getPendingScan(ctx, userID, pendingID)
+	if err != nil {
+		return err
+	}
+
+	switch pending.Status {
+	case PendingScanStatusExpired:
+		return common.NewError(common.ErrConflict, "scan_confirmation_expired", "scan confirmation has expired, please scan the car again")
+	case PendingScanStatusConfirming:
+		return common.NewError(common.ErrConflict, "scan_confirmation_in_progress", "scan is already being confirmed")
+	default:
+		return common.NewError(common.ErrConflict, "scan_already_confirmed", "scan has already been confirmed")
+	}
+}
+
+// expirePendingScans drops the photos of scans that were never confirmed,
+// records them in the scan history and fails the jobs waiting on them. That
+// includes scans whose confirmation crashed and left its claim to lapse.
+func (s *Service) expirePendingScans(ctx context.Context) error {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+			logger.Printf("Warning: transaction rollback error: %v", err)
+		}
+	}()
+
+	type expiredScan struct {
+		id, userID, photoCount int
+		color                  string
+		imageHash              *int64
+		metadata               *ScanMetadata
+		flagReasons            []string
+		secondImageHash        *int64
+		secondMetadata         *ScanMetadata
+		promptVersion          *string
+	}
+	rows, err := tx.Query(ctx, `
+		UPDATE pending_scans
+		SET status = $1, image_data = NULL, second_image_data = NULL, locked_until = NULL
+		WHERE expires_at < NOW()
+		  AND (status = $2 OR (status = $3 AND locked_until < NOW()))
+		RETURNING id, user_id, CASE WHEN second_image_type IS NULL THEN 1 ELSE 2 END, color,
+			image_hash, exif, flag_reasons, second_image_hash, second_exif, prompt_version`,
+		PendingScanStatusExpired, PendingScanStatusPending, PendingScanStatusConfirming,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to expire pending scans: %w", err)
+	}
+	var expired []expiredScan
+	for rows.Next() {
+		var e expiredScan
+		if err := rows.Scan(&e.id, &e.userID, &e.photoCount, &e.color, &e.imageHash, &e.metadata, &e.flagReasons,
+			&e.secondImageHash, &e.secondMetadata, &e.promptVersion); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read expired pending scan: %w", err)
+		}
+		expired = append(expired, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to expire pending scans: %w", err)
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+
+	ids := make([]int, 0, len(expired))
+	for _, e := range expired {
+		ids = append(ids, e.id)
+		var scanHistoryID int
+		err := tx.QueryRow(ctx, `
+			INSERT INTO scan_history (user_id, color, image_path, success, outcome, rejection_reason, image_hash, exif, flagged, flag_reasons,
+				photo_count, second_image_hash, second_exif, prompt_version)
+			VALUES ($1, $2, '', false, $3, 'scan confirmation expired', $4, $5, $6, $7, $8, $9, $10, $11)
+			RETURNING id`,
+			e.userID, e.color, ScanOutcomeExpired, e.imageHash, e.metadata, len(e.flagReasons) > 0, e.flagReasons,
+			e.photoCount, e.secondImageHash, e.secondMetadata, e.promptVersion,
+		).Scan(&scanHistoryID)
+		if err != nil {
+			return fmt.Errorf("failed to record expired pending scan %d: %w", e.id, err)
+		}
+		// The calls that identified the scan were linked to it while it waited
+		if _, err := tx.Exec(ctx, `
+			UPDATE ai_usage SET scan_history_id = $1 WHERE pending_scan_id = $2`,
+			scanHistoryID, e.id,
+		); err != nil {
+			return fmt.Errorf("failed to link AI usage to expired pending scan %d: %w", e.id, err)
+		}
+	}
+
+	if _, err := tx.Exec(ctx, `
+		UPDATE scan_jobs
+		SET stage = $1, error_message = 'scan confirmation expired', finished_at = NOW(), updated_at = NOW()
+		WHERE stage = $2 AND pending_scan_id = ANY($3)`,
+		ScanStageFailed, ScanStageAwaitingConfirmation, ids,
+	); err != nil {
+		return fmt.Errorf("failed to fail scan jobs of expired pending scans: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit expired pending scans: %w", err)
+	}
+	logger.Printf("Expired %d pending scans", len(expired))
+	return nil
+}
@@ -0,0 +1,86 @@
+package scan
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRankCandidates(t *testing.T) {
+	conf := func(c float64) *float64 { return &c }
+	m3 := CarCandidate{Make: "BMW", Model: "M3", Year: "2021"}
+	m4 := CarCandidate{Make: "BMW", Model: "M4", Year: "2021"}
+	c63 := CarCandidate{Make: "Mercedes-AMG", Model: "C63", Year: "2019"}
+	with := func(c CarCandidate, confidence float64) CarCandidate {
+		c.Confidence = confidence
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		details CarDetails
+		limit   int
+		want    []CarCandidate
+	}{
+		{
+			name:    "no confidence is certain",
+			details: CarDetails{Make: "BMW", Model: "M3", Year: "2021"},
+			limit:   3,
+			want:    []CarCandidate{with(m3, 1)},
+		},
+		{
+			name:    "confidence is clamped",
+			details: CarDetails{Make: "BMW", Model: "M3", Year: "2021", Confidence: conf(1.4)},
+			limit:   3,
+			want:    []CarCandidate{with(m3, 1)},
+		},
+		{
+			name: "alternatives sorted by confidence",
+			details: CarDetails{Make: "BMW", Model: "M3", Year: "2021", Confidence: conf(0.5),
+				Candidates: []CarCandidate{with(c63, 0.1), with(m4, 0.4)}},
+			limit: 3,
+			want:  []CarCandidate{with(m3, 0.5), with(m4, 0.4), with(c63, 0.1)},
+		},
+		{
+			name: "primary confidence taken from its repeat",
+			details: CarDetails{Make: "BMW", Model: "M3", Year: "2021",
+				Candidates: []CarCandidate{{Make: "bmw", Model: " m3", Year: "2021", Confidence: 0.3}, with(m4, 0.6)}},
+			limit: 3,
+			want:  []CarCandidate{with(m4, 0.6), with(m3, 0.3)},
+		},
+		{
+			name: "duplicates keep the highest confidence",
+			details: CarDetails{Make: "BMW", Model: "M3", Year: "2021", Confidence: conf(0.2),
+				Candidates: []CarCandidate{with(m4, 0.3), with(m3, 0.5), with(m4, 0.7)}},
+			limit: 3,
+			want:  []CarCandidate{with(m4, 0.7), with(m3, 0.5)},
+		},
+		{
+			name: "incomplete candidates dropped",
+			details: CarDetails{Make: "BMW", Model: "M3", Year: "2021", Confidence: conf(0.5),
+				Candidates: []CarCandidate{{Make: "BMW", Confidence: 0.9}, {Model: "M4", Confidence: 0.9}}},
+			limit: 3,
+			want:  []CarCandidate{with(m3, 0.5)},
+		},
+		{
+			name: "limited",
+			details: CarDetails{Make: "BMW", Model: "M3", Year: "2021", Confidence: conf(0.5),
+				Candidates: []CarCandidate{with(c63, 0.1), with(m4, 0.4)}},
+			limit: 2,
+			want:  []CarCandidate{with(m3, 0.5), with(m4, 0.4)},
+		},
+		{
+			name: "no limit",
+			details: CarDetails{Make: "BMW", Model: "M3", Year: "2021", Confidence: conf(0.5),
+				Candidates: []CarCandidate{with(c63, 0.1), with(m4, 0.4)}},
+			limit: 0,
+			want:  []CarCandidate{with(m3, 0.5), with(m4, 0.4), with(c63, 0.1)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rankCandidates(&tt.details, tt.limit); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rankCandidates =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package scan
+
+import (
+	"CarBN/common"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// EXIF policy actions
+const (
+	ExifPolicyOff    = "off"
+	ExifPolicyFlag   = "flag"
+	ExifPolicyReject = "reject"
+)
+
+const defaultExifMaxAge = 7 * 24 * time.Hour
+
+var defaultEditingSoftware = []string{
+	"photoshop", "lightroom", "gimp", "snapseed", "picsart", "facetune",
+	"canva", "pixelmator", "affinity", "vsco", "lensa",
+}
+
+// ScanMetadata is the EXIF metadata extracted from a scan photo
+type ScanMetadata struct {
+	CameraMake  string     `json:"camera_make,omitempty"`
+	CameraModel string     `json:"camera_model,omitempty"`
+	Software    string     `json:"software,omitempty"`
+	CapturedAt  *time.Time `json:"captured_at,omitempty"`
+	Latitude    *float64   `json:"latitude,omitempty"`
+	Longitude   *float64   `json:"longitude,omitempty"`
+}
+
+// ExifPolicy decides what to do with photos whose metadata looks wrong.
+// With the flag action the scan goes through but is marked for moderation.
+type ExifPolicy struct {
+	Action          string
+	MaxAge          time.Duration // Largest allowed gap between capture time and now, 0 to skip
+	RequireCamera   bool
+	EditingSoftware []string // Lowercase substrings of the Software tag that violate the policy
+}
+
+// NewExifPolicyFromEnv builds the policy from SCAN_EXIF_POLICY,
+// SCAN_EXIF_MAX_AGE, SCAN_EXIF_REQUIRE_CAMERA and SCAN_EXIF_EDITING_SOFTWARE
+func NewExifPolicyFromEnv() ExifPolicy {
+	policy := ExifPolicy{
+		Action:          ExifPolicyFlag,
+		MaxAge:          defaultExifMaxAge,
+		RequireCamera:   true,
+		EditingSoftware: defaultEditingSoftware,
+	}
+
+	switch action := strings.ToLower(os.Getenv("SCAN_EXIF_POLICY")); action {
+	case "":
+	case ExifPolicyOff, ExifPolicyFlag, ExifPolicyReject:
+		policy.Action = action
+	default:
+		log.Printf("Warning: invalid SCAN_EXIF_POLICY %q, using %s", action, policy.Action)
+	}
+
+	if v := os.Getenv("SCAN_EXIF_MAX_AGE"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			policy.MaxAge = d
+		} else {
+			log.Printf("Warning: invalid SCAN_EXIF_MAX_AGE %q, using %s", v, policy.MaxAge)
+		}
+	}
+
+	if v := os.Getenv("SCAN_EXIF_REQUIRE_CAMERA"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			policy.RequireCamera = b
+		} else {
+			log.Printf("Warning: invalid SCAN_EXIF_REQUIRE_CAMERA %q", v)
+		}
+	}
+
+	if v := os.Getenv("SCAN_EXIF_EDITING_SOFTWARE"); v != "" {
+		policy.EditingSoftware = nil
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				policy.EditingSoftware = append(policy.EditingSoftware, name)
+			}
+		}
+	}
+
+	return policy
+}
+
+// Check returns the ways metadata violates the policy. A nil metadata means
+// the photo had no EXIF at all.
+func (p ExifPolicy) Check(metadata *ScanMetadata, now time.Time) []string {
+	if p.Action == ExifPolicyOff {
+		return nil
+	}
+
+	var violations []string
+	if metadata == nil {
+		if p.RequireCamera {
+			violations = append(violations, "photo has no EXIF metadata")
+		}
+		return violations
+	}
+
+	if p.RequireCamera && (metadata.CameraMake == "" || metadata.CameraModel == "") {
+		violations = append(violations, "missing camera make or model")
+	}
+
+	if p.MaxAge > 0 && metadata.CapturedAt != nil {
+		gap := now.Sub(*metadata.CapturedAt)
+		if gap < 0 {
+			gap = -gap
+		}
+		if gap > p.MaxAge {
+			violations = append(violations, fmt.Sprintf("captured at %s, more than %s from now",
+				common.FormatTimestamp(*metadata.CapturedAt), p.MaxAge))
+		}
+	}
+
+	if metadata.Software != "" {
+		software := strings.ToLower(metadata.Software)
+		for _, editor := range p.EditingSoftware {
+			if strings.Contains(software, editor) {
+				violations = append(violations, fmt.Sprintf("edited with %s", metadata.Software))
+				break
+			}
+		}
+	}
+
+	return violations
+}
+
+// extractScanMetadata reads the EXIF block from a JPEG, returning nil if the
+// image has none
+func extractScanMetadata(data []byte) *ScanMetadata {
+	x, err := exif.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+
+	metadata := &ScanMetadata{
+		CameraMake:  exifString(x, exif.Make),
+		CameraModel: exifString(x, exif.Model),
+		Software:    exifString(x, exif.Software),
+	}
+
+	if capturedAt, err := x.DateTime(); err == nil {
+		metadata.CapturedAt = &capturedAt
+	}
+
+	if lat, long, err := x.LatLong(); err == nil {
+		metadata.Latitude = &lat
+		metadata.Longitude = &long
+	}
+
+	return metadata
+}
+
+func exifString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	value, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(value, "\x00"))
+}
+
+// scanEvidence is what we learn from the submitted photo itself, before any
+// AI call, and is recorded with every scan outcome
+type scanEvidence struct {
+	imageHash  *int64
+	metadata   *ScanMetadata
+	violations []string // Includes the second photo's, prefixed with "second photo: "
+	second     *scanEvidence
+}
+
+// secondPhoto returns the evidence for the second photo of a two-photo
+// scan, or an empty one for a single photo
+func (e *scanEvidence) secondPhoto() *scanEvidence {
+	if e.second == nil {
+		return &scanEvidence{}
+	}
+	return e.second
+}
+
+func (e *scanEvidence) photoCount() int {
+	if e.second == nil {
+		return 1
+	}
+	return 2
+}
+
+// unhashableViolation is the violation recorded for a photo that can't be
+// hashed, such as a HEIC photo, which recycled photo detection can't check
+const unhashableViolation = "photo can't be checked for reuse"
+
+// inspectScanImage hashes the photo and checks its EXIF against the policy.
+// A photo that can't be decoded still goes to the vision model, the final
+// judge of whether it's a usable photo, but can't be checked for reuse, so it
+// violates the policy whatever its EXIF: it's flagged for moderation, or
+// rejected when the policy rejects.
+func (s *Service) inspectScanImage(ctx context.Context, data []byte) *scanEvidence {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+	evidence := &scanEvidence{}
+
+	evidence.metadata = extractScanMetadata(data)
+	evidence.violations = s.exifPolicy.Check(evidence.metadata, time.Now())
+
+	if hash, err := hashImageData(data); err != nil {
+		logger.Printf("Warning: failed to hash scan image: %v", err)
+		if s.phashThreshold >= 0 {
+			evidence.violations = append(evidence.violations, unhashableViolation)
+		}
+	} else {
+		signed := int64(hash)
+		evidence.imageHash = &signed
+	}
+	return evidence
+}
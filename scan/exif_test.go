@@ -0,0 +1,65 @@
+package scan
+
+import (
+	"CarBN/common"
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"slices"
+	"testing"
+)
+
+func testContext() context.Context {
+	return context.WithValue(context.Background(), common.LoggerCtxKey, log.New(io.Discard, "", 0))
+}
+
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, 32, 24))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 7)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestInspectScanImageUnhashable(t *testing.T) {
+	heic := append([]byte{0, 0, 0, 0x18}, []byte("ftypheic\x00\x00\x00\x00mif1heic")...)
+
+	tests := []struct {
+		name           string
+		data           []byte
+		action         string
+		threshold      int
+		wantHash       bool
+		wantViolations []string
+	}{
+		{"decodable photo", testPNG(t), ExifPolicyOff, defaultPHashThreshold, true, nil},
+		{"HEIC photo", heic, ExifPolicyOff, defaultPHashThreshold, false, []string{unhashableViolation}},
+		{"corrupt photo", []byte("\xff\xd8\xff\xe0 not really a jpeg"), ExifPolicyOff, defaultPHashThreshold, false, []string{unhashableViolation}},
+		{"recycled check disabled", heic, ExifPolicyOff, -1, false, nil},
+		{"with EXIF violations", heic, ExifPolicyFlag, defaultPHashThreshold, false,
+			[]string{"photo has no EXIF metadata", unhashableViolation}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{
+				exifPolicy:     ExifPolicy{Action: tt.action, RequireCamera: true},
+				phashThreshold: tt.threshold,
+			}
+			evidence := s.inspectScanImage(testContext(), tt.data)
+			if (evidence.imageHash != nil) != tt.wantHash {
+				t.Errorf("imageHash = %v, want hash %v", evidence.imageHash, tt.wantHash)
+			}
+			if !slices.Equal(evidence.violations, tt.wantViolations) {
+				t.Errorf("violations = %q, want %q", evidence.violations, tt.wantViolations)
+			}
+		})
+	}
+}
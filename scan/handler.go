@@ -2,15 +2,18 @@ package scan
 
 import (
 	"CarBN/common"
-	"encoding/base64"
+	"context"
 	"encoding/json"
-	"errors"
-	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 )
 
+// errScanTimeout is returned by POST /scan for scans that run past
+// SCAN_SYNC_TIMEOUT
+var errScanTimeout = common.NewError(common.ErrUpstreamFailure, "scan_timeout", "the scan took too long, please try again")
+
 type HTTPHandler struct {
 	service *Service
 }
@@ -28,15 +31,13 @@ func (h *HTTPHandler) HandleScanPost(w http.ResponseWriter, r *http.Request) {
 		logger = log.New(os.Stdout, "[CarBN] ", log.LstdFlags)
 	}
 
-	// Limit request body size
-	r.Body = http.MaxBytesReader(w, r.Body, 10<<20)
 	defer r.Body.Close()
 
-	// Parse and validate request
-	req, err := h.parseScanRequest(r)
+	// Read and validate the photo
+	upload, second, err := readUploads(w, r, h.service.maxUploadBytes)
 	if err != nil {
 		logger.Printf("Error parsing scan request: %v", err)
-		h.handleError(w, err, http.StatusBadRequest)
+		common.WriteError(w, r, err)
 		return
 	}
 
@@ -44,65 +45,217 @@ func (h *HTTPHandler) HandleScanPost(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value(common.UserIDCtxKey).(int)
 	if !ok {
 		logger.Printf("Invalid user ID in context")
-		h.handleError(w, errors.New("invalid user ID in context"), http.StatusInternalServerError)
+		common.WriteError(w, r, common.ErrInvalidUserContext)
 		return
 	}
 
+	// Scans that take longer than this belong in a job, so the request
+	// doesn't hold a connection for minutes
+	ctx, cancel := context.WithTimeout(r.Context(), h.service.syncScanTimeout)
+	defer cancel()
+
 	logger.Printf("Processing scan for user %d", userID)
-	response, err := h.service.ScanImage(r.Context(), userID, req.Base64Image)
+	response, err := h.service.ScanImage(ctx, userID, upload, second)
 	if err != nil {
 		logger.Printf("Scan processing failed for user %d: %v", userID, err)
-		switch err.Error() {
-		case common.DuplicateScanError:
-			h.handleError(w, err, http.StatusConflict) // 409 Conflict for duplicates
-		case common.RejectedScanError:
-			h.handleError(w, err, http.StatusBadRequest)
-		default:
-			h.handleError(w, fmt.Errorf("scan processing failed: %w", err), http.StatusInternalServerError)
+		if ctx.Err() == context.DeadlineExceeded {
+			err = errScanTimeout.Wrap(err)
 		}
+		common.WriteErrorOr(w, r, err, common.Internal("scan processing failed"))
+		return
+	}
+
+	if response.Pending != nil {
+		logger.Printf("Scan for user %d is awaiting confirmation, pending scan ID: %d", userID, response.Pending.ID)
+		h.writeJSONResponse(w, http.StatusAccepted, response.Pending)
+		return
+	}
+
+	logger.Printf("Successfully processed scan for user %d, car ID: %d", userID, response.Car.ID)
+	h.writeJSONResponse(w, http.StatusCreated, response.Car)
+}
+
+// HandleConfirmScan resolves a low confidence scan with the candidate the
+// user picked
+func (h *HTTPHandler) HandleConfirmScan(w http.ResponseWriter, r *http.Request) {
+	logger := r.Context().Value(common.LoggerCtxKey).(*log.Logger)
+
+	userID, ok := r.Context().Value(common.UserIDCtxKey).(int)
+	if !ok {
+		logger.Printf("Invalid user ID in context")
+		common.WriteError(w, r, common.ErrInvalidUserContext)
+		return
+	}
+
+	pendingID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		common.WriteError(w, r, common.BadRequest("invalid pending scan ID"))
+		return
+	}
+
+	var req struct {
+		CandidateIndex *int `json:"candidate_index"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		common.WriteError(w, r, common.BadRequest("invalid request body").Wrap(err))
+		return
+	}
+	if req.CandidateIndex == nil {
+		common.WriteError(w, r, common.BadRequest("missing candidate_index"))
+		return
+	}
+
+	response, err := h.service.ConfirmScan(r.Context(), userID, pendingID, *req.CandidateIndex)
+	if err != nil {
+		logger.Printf("Failed to confirm pending scan %d for user %d: %v", pendingID, userID, err)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to confirm scan"))
 		return
 	}
 
-	logger.Printf("Successfully processed scan for user %d, car ID: %d", userID, response.ID)
+	logger.Printf("Confirmed pending scan %d for user %d, car ID: %d", pendingID, userID, response.ID)
 	h.writeJSONResponse(w, http.StatusCreated, response)
 }
 
-type scanRequest struct {
-	Base64Image string `json:"base64_image"`
+// HandleCreateScanJob queues a scan and returns immediately with the job, which
+// the client polls through HandleGetScanJob.
+func (h *HTTPHandler) HandleCreateScanJob(w http.ResponseWriter, r *http.Request) {
+	logger := r.Context().Value(common.LoggerCtxKey).(*log.Logger)
+
+	defer r.Body.Close()
+
+	upload, second, err := readUploads(w, r, h.service.maxUploadBytes)
+	if err != nil {
+		logger.Printf("Error parsing scan job request: %v", err)
+		common.WriteError(w, r, err)
+		return
+	}
+
+	userID, ok := r.Context().Value(common.UserIDCtxKey).(int)
+	if !ok {
+		logger.Printf("Invalid user ID in context")
+		common.WriteError(w, r, common.ErrInvalidUserContext)
+		return
+	}
+
+	job, err := h.service.SubmitScanJob(r.Context(), userID, upload, second)
+	if err != nil {
+		logger.Printf("Failed to submit scan job for user %d: %v", userID, err)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to submit scan"))
+		return
+	}
+
+	h.writeJSONResponse(w, http.StatusAccepted, job)
 }
 
-func (h *HTTPHandler) parseScanRequest(r *http.Request) (*scanRequest, error) {
-	var req scanRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		return nil, fmt.Errorf("invalid request body: %w", err)
+// HandleGetScanJob returns the current stage of a scan job, and the scanned
+// car once the job is done
+func (h *HTTPHandler) HandleGetScanJob(w http.ResponseWriter, r *http.Request) {
+	logger := r.Context().Value(common.LoggerCtxKey).(*log.Logger)
+
+	userID, ok := r.Context().Value(common.UserIDCtxKey).(int)
+	if !ok {
+		logger.Printf("Invalid user ID in context")
+		common.WriteError(w, r, common.ErrInvalidUserContext)
+		return
 	}
 
-	if req.Base64Image == "" {
-		return nil, errors.New("missing base64_image")
+	jobID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		common.WriteError(w, r, common.BadRequest("invalid scan job ID"))
+		return
 	}
 
-	// Basic Base64 validation
-	if !isValidBase64(req.Base64Image) {
-		return nil, errors.New("invalid base64 format")
+	job, err := h.service.GetScanJob(r.Context(), userID, jobID)
+	if err != nil {
+		logger.Printf("Failed to get scan job %d: %v", jobID, err)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to get scan job"))
+		return
 	}
 
-	return &req, nil
+	h.writeJSONResponse(w, http.StatusOK, job)
 }
 
-func (h *HTTPHandler) handleError(w http.ResponseWriter, err error, statusCode int) {
-	response := struct {
-		Error string `json:"error"`
-		Code  int    `json:"code"`
-	}{
-		Error: err.Error(),
-		Code:  statusCode,
+// HandleGetScanHistory returns the user's scan attempts and their outcomes,
+// newest first
+func (h *HTTPHandler) HandleGetScanHistory(w http.ResponseWriter, r *http.Request) {
+	logger := r.Context().Value(common.LoggerCtxKey).(*log.Logger)
+
+	userID, ok := r.Context().Value(common.UserIDCtxKey).(int)
+	if !ok {
+		logger.Printf("Invalid user ID in context")
+		common.WriteError(w, r, common.ErrInvalidUserContext)
+		return
+	}
+
+	pageSize := 20
+	if pageSizeStr := r.URL.Query().Get("page_size"); pageSizeStr != "" {
+		var err error
+		pageSize, err = strconv.Atoi(pageSizeStr)
+		if err != nil {
+			common.WriteError(w, r, common.BadRequest("invalid page_size"))
+			return
+		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		http.Error(w, "Failed to encode error response", http.StatusInternalServerError)
+	history, err := h.service.GetScanHistory(r.Context(), userID, r.URL.Query().Get("cursor"), pageSize)
+	if err != nil {
+		logger.Printf("Failed to get scan history for user %d: %v", userID, err)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to get scan history"))
+		return
+	}
+
+	h.writeJSONResponse(w, http.StatusOK, history)
+}
+
+// HandleStartSpecBackfill starts filling in the specs of cars created before
+// enrichment, or returns the backfill already in progress
+func (h *HTTPHandler) HandleStartSpecBackfill(w http.ResponseWriter, r *http.Request) {
+	logger := r.Context().Value(common.LoggerCtxKey).(*log.Logger)
+
+	adminID, ok := r.Context().Value(common.UserIDCtxKey).(int)
+	if !ok {
+		logger.Printf("Invalid user ID in context")
+		common.WriteError(w, r, common.ErrInvalidUserContext)
+		return
+	}
+
+	run, err := h.service.StartSpecBackfill(r.Context(), adminID)
+	if err != nil {
+		logger.Printf("Failed to start spec backfill: %v", err)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to start spec backfill"))
+		return
+	}
+
+	h.writeJSONResponse(w, http.StatusAccepted, run)
+}
+
+// HandleGetSpecBackfill returns the progress of the latest spec backfill
+func (h *HTTPHandler) HandleGetSpecBackfill(w http.ResponseWriter, r *http.Request) {
+	logger := r.Context().Value(common.LoggerCtxKey).(*log.Logger)
+
+	run, err := h.service.GetSpecBackfill(r.Context())
+	if err != nil {
+		logger.Printf("Failed to get spec backfill: %v", err)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to get spec backfill"))
+		return
+	}
+
+	h.writeJSONResponse(w, http.StatusOK, run)
+}
+
+// HandleGetPromptStats lists the prompt versions with their usage, so
+// rejection rates can be compared between versions
+func (h *HTTPHandler) HandleGetPromptStats(w http.ResponseWriter, r *http.Request) {
+	logger := r.Context().Value(common.LoggerCtxKey).(*log.Logger)
+
+	stats, err := h.service.GetPromptStats(r.Context())
+	if err != nil {
+		logger.Printf("Failed to get prompt stats: %v", err)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to get prompt stats"))
+		return
 	}
+
+	h.writeJSONResponse(w, http.StatusOK, stats)
 }
 
 func (h *HTTPHandler) writeJSONResponse(w http.ResponseWriter, status int, data interface{}) {
@@ -113,8 +266,3 @@ func (h *HTTPHandler) writeJSONResponse(w http.ResponseWriter, status int, data
 		http.Error(w, "Failed to encode JSON response", http.StatusInternalServerError)
 	}
 }
-
-func isValidBase64(s string) bool {
-	_, err := base64.StdEncoding.DecodeString(s)
-	return err == nil
-}
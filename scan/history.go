@@ -0,0 +1,206 @@
+package scan
+
+import (
+	"CarBN/common"
+	"CarBN/usage"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ScanOutcome is why a scan ended the way it did, recorded on every
+// scan_history row
+type ScanOutcome string
+
+const (
+	ScanOutcomeSuccess       ScanOutcome = "success"
+	ScanOutcomeRejectedFake  ScanOutcome = "rejected_fake"  // Vision model thinks it isn't a real photo of a car
+	ScanOutcomeRecycledImage ScanOutcome = "recycled_image" // Perceptual hash matches an earlier scan or generated image
+	ScanOutcomeExifRejected  ScanOutcome = "exif_rejected"  // Photo metadata failed the EXIF policy
+	ScanOutcomeDuplicate     ScanOutcome = "duplicate"      // Same car scanned within 24 hours
+	ScanOutcomeNoCredits     ScanOutcome = "no_credits"
+	ScanOutcomeAIError       ScanOutcome = "ai_error"        // Identification or spec lookup failed
+	ScanOutcomeImageGenError ScanOutcome = "image_gen_error" // Car image couldn't be generated or queued
+	ScanOutcomeInternalError ScanOutcome = "internal_error"
+
+	ScanOutcomePhotosNotDistinct ScanOutcome = "photos_not_distinct" // Both photos of a two-photo scan are the same picture
+	ScanOutcomePhotosMismatch    ScanOutcome = "photos_mismatch"     // The two photos show different cars
+	ScanOutcomeExpired           ScanOutcome = "expired"             // A low confidence scan was never confirmed
+)
+
+// scanError tags a scan failure with its outcome. It's transparent to callers,
+// who still see the wrapped error, and usually an AppError, through it.
+type scanError struct {
+	outcome ScanOutcome
+	detail  string // Recorded as the rejection reason instead of the message when set
+	err     error
+}
+
+func (e *scanError) Error() string { return e.err.Error() }
+func (e *scanError) Unwrap() error { return e.err }
+
+func withOutcome(outcome ScanOutcome, err error) error {
+	return &scanError{outcome: outcome, err: err}
+}
+
+func withOutcomeDetail(outcome ScanOutcome, detail string, err error) error {
+	return &scanError{outcome: outcome, detail: detail, err: err}
+}
+
+// scanAttempt collects what's known about a scan as it moves through the
+// pipeline, so a failure at any point can be recorded with it
+type scanAttempt struct {
+	evidence *scanEvidence
+	carID    *int
+	color    string
+	recorded bool
+
+	// Ref of the scan prompt version the photos were identified with; empty
+	// when the scan failed before identification
+	promptVersion string
+}
+
+// recordFailedScan writes a scan_history row for a scan that ended in err
+func (s *Service) recordFailedScan(ctx context.Context, userID int, upload *Upload, attempt *scanAttempt, err error) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+
+	outcome := ScanOutcomeInternalError
+	reason := err.Error()
+	var se *scanError
+	if errors.As(err, &se) {
+		outcome = se.outcome
+		if se.detail != "" {
+			reason = se.detail
+		}
+	}
+
+	// Keep the photo when it was rejected so support can review it
+	imagePath := ""
+	switch outcome {
+	case ScanOutcomeRejectedFake, ScanOutcomeRecycledImage, ScanOutcomeExifRejected:
+		imagePath = s.saveRejectedScan(ctx, userID, upload)
+	}
+
+	evidence := attempt.evidence
+	if evidence == nil {
+		evidence = &scanEvidence{}
+	}
+
+	// Use a fresh context so a cancelled request still gets its outcome recorded
+	recordCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+
+	second := evidence.secondPhoto()
+	var scanHistoryID int
+	dbErr := s.db.QueryRow(recordCtx,
+		`INSERT INTO scan_history (user_id, car_id, color, image_path, success, outcome, rejection_reason, image_hash, exif, flagged, flag_reasons,
+			photo_count, second_image_hash, second_exif, prompt_version)
+		 VALUES ($1, $2, $3, $4, false, $5, $6, $7, $8, $9, $10, $11, $12, $13, NULLIF($14, ''))
+		 RETURNING id`,
+		userID, attempt.carID, attempt.color, imagePath, outcome, reason,
+		evidence.imageHash, evidence.metadata, len(evidence.violations) > 0, evidence.violations,
+		evidence.photoCount(), second.imageHash, second.metadata, attempt.promptVersion,
+	).Scan(&scanHistoryID)
+	if dbErr != nil {
+		logger.Printf("Warning: failed to record %s scan for user %d: %v", outcome, userID, dbErr)
+		return
+	}
+
+	// Failed scans may still have cost an AI call
+	if err := usage.LinkScan(recordCtx, s.db, scanHistoryID); err != nil {
+		logger.Printf("Warning: failed to link AI usage to scan %d: %v", scanHistoryID, err)
+	}
+}
+
+// ScanHistoryEntry is one scan attempt as shown to the user
+type ScanHistoryEntry struct {
+	ID          int         `json:"id"`
+	Outcome     ScanOutcome `json:"outcome"`
+	Success     bool        `json:"success"`
+	Reason      *string     `json:"reason,omitempty"`
+	CarID       *int        `json:"car_id,omitempty"`
+	Make        *string     `json:"make,omitempty"`
+	Model       *string     `json:"model,omitempty"`
+	Year        *string     `json:"year,omitempty"`
+	Trim        *string     `json:"trim,omitempty"`
+	Color       string      `json:"color,omitempty"`
+	PhotoCount  int         `json:"photo_count"`
+	Flagged     bool        `json:"flagged"`
+	FlagReasons []string    `json:"flag_reasons,omitempty"`
+	ScannedAt   string      `json:"scanned_at"`
+}
+
+type PaginatedScanHistory struct {
+	Items      []ScanHistoryEntry `json:"items"`
+	NextCursor string             `json:"next_cursor,omitempty"`
+}
+
+// GetScanHistory returns a user's scan attempts, newest first
+func (s *Service) GetScanHistory(ctx context.Context, userID int, cursor string, pageSize int) (*PaginatedScanHistory, error) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+
+	if pageSize <= 0 || pageSize > 100 {
+		pageSize = 20
+	}
+
+	// IDs are assigned in scan order, so paging on the ID alone is exact even
+	// though the cursor's timestamp only has second precision
+	cursorID := 0
+	if cursor != "" {
+		decoded, err := common.DecodeCursor(cursor)
+		if err != nil {
+			return nil, common.BadRequest("invalid cursor").Wrap(err)
+		}
+		cursorID = decoded.ID
+	}
+
+	rows, err := s.db.Query(ctx, `
+		SELECT sh.id, sh.outcome, sh.success, sh.rejection_reason, sh.car_id,
+			   c.make, c.model, c.year, c.trim, sh.color, sh.photo_count, sh.flagged, sh.flag_reasons, sh.scanned_at
+		FROM scan_history sh
+		LEFT JOIN cars c ON c.id = sh.car_id
+		WHERE sh.user_id = $1 AND ($2 = 0 OR sh.id < $2)
+		ORDER BY sh.id DESC
+		LIMIT $3`,
+		userID, cursorID, pageSize+1,
+	)
+	if err != nil {
+		logger.Printf("Failed to query scan history for user %d: %v", userID, err)
+		return nil, fmt.Errorf("failed to query scan history: %w", err)
+	}
+	defer rows.Close()
+
+	entries := make([]ScanHistoryEntry, 0, pageSize+1)
+	scannedAts := make([]time.Time, 0, pageSize+1)
+	for rows.Next() {
+		var entry ScanHistoryEntry
+		var scannedAt time.Time
+		if err := rows.Scan(
+			&entry.ID, &entry.Outcome, &entry.Success, &entry.Reason, &entry.CarID,
+			&entry.Make, &entry.Model, &entry.Year, &entry.Trim, &entry.Color, &entry.PhotoCount,
+			&entry.Flagged, &entry.FlagReasons, &scannedAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan history entry: %w", err)
+		}
+		if entry.Reason != nil && *entry.Reason == "" {
+			entry.Reason = nil
+		}
+		entry.ScannedAt = common.FormatTimestamp(scannedAt)
+		entries = append(entries, entry)
+		scannedAts = append(scannedAts, scannedAt)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read scan history: %w", err)
+	}
+
+	result := &PaginatedScanHistory{Items: entries}
+	if len(entries) > pageSize {
+		last := pageSize - 1
+		result.NextCursor = common.EncodeCursor(scannedAts[last], entries[last].ID)
+		result.Items = entries[:pageSize]
+	}
+
+	return result, nil
+}
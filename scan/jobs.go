@@ -0,0 +1,335 @@
+package scan
+
+import (
+	"CarBN/common"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Scan job stages, in the order a job moves through them
+const (
+	ScanStageQueued        = "queued"
+	ScanStageIdentifying   = "identifying"
+	ScanStageFetchingSpecs = "fetching_specs"
+	ScanStageDone          = "done"
+	ScanStageFailed        = "failed"
+
+	// The scan needs the user to pick a candidate through POST /scan/{id}/confirm
+	// before it's done. Workers leave these jobs alone.
+	ScanStageAwaitingConfirmation = "awaiting_confirmation"
+)
+
+const (
+	// scanJobLease is how long a worker may hold a job before another worker
+	// (or the same process after a restart) is allowed to pick it up again.
+	scanJobLease       = 5 * time.Minute
+	scanJobMaxAttempts = 3
+	scanJobPollPeriod  = 2 * time.Second
+	// scanJobSweepPeriod is how often abandoned jobs and unconfirmed scans
+	// are expired
+	scanJobSweepPeriod = time.Minute
+)
+
+// ScanJob is the client-facing view of an asynchronous scan
+type ScanJob struct {
+	ID         int          `json:"id"`
+	Stage      string       `json:"stage"`
+	Error      *string      `json:"error,omitempty"`
+	Car        *car         `json:"car,omitempty"`
+	Pending    *PendingScan `json:"pending_scan,omitempty"`
+	CreatedAt  string       `json:"created_at"`
+	UpdatedAt  string       `json:"updated_at"`
+	FinishedAt *string      `json:"finished_at,omitempty"`
+}
+
+// SubmitScanJob stores the photos and queues them for the worker pool,
+// reserving the scan credit up front. second is nil for single photo scans.
+func (s *Service) SubmitScanJob(ctx context.Context, userID int, upload, second *Upload) (*ScanJob, error) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+
+	if second == nil && s.requireTwoPhotos {
+		return nil, common.ErrSecondPhotoRequired
+	}
+
+	// Fail fast so users without credits don't wait on a job that can't
+	// succeed, and so queued jobs can't spend the same credit twice
+	reservationID, err := s.reserveScanCredit(ctx, userID, upload)
+	if err != nil {
+		return nil, err
+	}
+
+	var secondData []byte
+	var secondType *string
+	if second != nil {
+		secondData, secondType = second.Data, &second.ContentType
+	}
+
+	var jobID int
+	err = s.db.QueryRow(ctx, `
+		INSERT INTO scan_jobs (user_id, stage, image_data, image_type, second_image_data, second_image_type, credit_reservation_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id`,
+		userID, ScanStageQueued, upload.Data, upload.ContentType, secondData, secondType, reservationID,
+	).Scan(&jobID)
+	if err != nil {
+		logger.Printf("Failed to create scan job for user %d: %v", userID, err)
+		s.releaseScanCredit(ctx, reservationID)
+		return nil, fmt.Errorf("failed to create scan job: %w", err)
+	}
+
+	// Wake an idle worker; if they're all busy the poll loop will find the job
+	select {
+	case s.jobSignal <- struct{}{}:
+	default:
+	}
+
+	logger.Printf("Queued scan job %d for user %d", jobID, userID)
+	return s.GetScanJob(ctx, userID, jobID)
+}
+
+// GetScanJob returns a job owned by userID, including the car once it's done
+// and the candidates while it awaits confirmation
+func (s *Service) GetScanJob(ctx context.Context, userID int, jobID int) (*ScanJob, error) {
+	var job ScanJob
+	var userCarID, pendingScanID *int
+	var createdAt, updatedAt time.Time
+	var finishedAt *time.Time
+	err := s.db.QueryRow(ctx, `
+		SELECT id, stage, error_message, user_car_id, pending_scan_id, created_at, updated_at, finished_at
+		FROM scan_jobs
+		WHERE id = $1 AND user_id = $2`,
+		jobID, userID,
+	).Scan(&job.ID, &job.Stage, &job.Error, &userCarID, &pendingScanID, &createdAt, &updatedAt, &finishedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, common.NotFound("scan job not found")
+		}
+		return nil, fmt.Errorf("failed to get scan job: %w", err)
+	}
+
+	job.CreatedAt = common.FormatTimestamp(createdAt)
+	job.UpdatedAt = common.FormatTimestamp(updatedAt)
+	if finishedAt != nil {
+		formatted := common.FormatTimestamp(*finishedAt)
+		job.FinishedAt = &formatted
+	}
+
+	if userCarID != nil {
+		job.Car, err = s.getScannedCar(ctx, *userCarID)
+		if err != nil {
+			return nil, err
+		}
+	} else if pendingScanID != nil && job.Stage == ScanStageAwaitingConfirmation {
+		job.Pending, err = s.getPendingScan(ctx, userID, *pendingScanID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &job, nil
+}
+
+// StartWorkers launches n scan workers, and one sweeper that expires the jobs
+// and scans they've given up on, that run until ctx is cancelled. Jobs left
+// mid-flight by a previous process are picked up once their lease expires.
+func (s *Service) StartWorkers(ctx context.Context, n int) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+	logger.Printf("Starting %d scan workers", n)
+
+	for i := 0; i < n; i++ {
+		go s.runWorker(ctx)
+	}
+	go s.runSweeper(ctx)
+}
+
+// runSweeper expires abandoned jobs and unconfirmed scans every
+// scanJobSweepPeriod
+func (s *Service) runSweeper(ctx context.Context) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+	ticker := time.NewTicker(scanJobSweepPeriod)
+	defer ticker.Stop()
+
+	for {
+		// Give up on jobs that keep getting abandoned rather than retrying forever
+		if err := s.expireAbandonedJobs(ctx); err != nil {
+			logger.Printf("Scan sweeper error: %v", err)
+		}
+		if err := s.expirePendingScans(ctx); err != nil {
+			logger.Printf("Scan sweeper error: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Service) runWorker(ctx context.Context) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+	ticker := time.NewTicker(scanJobPollPeriod)
+	defer ticker.Stop()
+
+	for {
+		// Drain the queue before going back to sleep
+		for {
+			claimed, err := s.processNextJob(ctx)
+			if err != nil {
+				logger.Printf("Scan worker error: %v", err)
+				break
+			}
+			if !claimed {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.jobSignal:
+		case <-ticker.C:
+		}
+	}
+}
+
+// processNextJob claims one runnable job and processes it, reporting whether
+// there was a job to claim.
+func (s *Service) processNextJob(ctx context.Context) (bool, error) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+
+	var jobID, userID int
+	var reservationID *int
+	upload := &Upload{}
+	var secondData []byte
+	var secondType *string
+	err := s.db.QueryRow(ctx, `
+		UPDATE scan_jobs
+		SET stage = $1, attempts = attempts + 1,
+			locked_until = NOW() + make_interval(secs => $2), updated_at = NOW()
+		WHERE id = (
+			SELECT id FROM scan_jobs
+			WHERE stage = $3
+			   OR (stage NOT IN ($4, $5, $6) AND locked_until < NOW() AND attempts < $7)
+			ORDER BY id
+			FOR UPDATE SKIP LOCKED
+			LIMIT 1
+		)
+		RETURNING id, user_id, credit_reservation_id, image_data, image_type, second_image_data, second_image_type`,
+		ScanStageIdentifying, scanJobLease.Seconds(), ScanStageQueued, ScanStageDone, ScanStageFailed,
+		ScanStageAwaitingConfirmation, scanJobMaxAttempts,
+	).Scan(&jobID, &userID, &reservationID, &upload.Data, &upload.ContentType, &secondData, &secondType)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to claim scan job: %w", err)
+	}
+
+	logger.Printf("Processing scan job %d for user %d", jobID, userID)
+
+	jobCtx := context.WithValue(ctx, common.UserIDCtxKey, userID)
+	hooks := scanHooks{}
+	hooks.progress = func(stage string) {
+		if _, err := s.db.Exec(ctx, `
+			UPDATE scan_jobs
+			SET stage = $1, locked_until = NOW() + make_interval(secs => $2), updated_at = NOW()
+			WHERE id = $3`,
+			stage, scanJobLease.Seconds(), jobID,
+		); err != nil {
+			logger.Printf("Warning: failed to update scan job %d stage: %v", jobID, err)
+		}
+	}
+	// The job is done in the same transaction that adds the car, so a crash
+	// in between can't leave a finished scan to be run again
+	hooks.complete = func(ctx context.Context, tx pgx.Tx, userCarID int) error {
+		_, err := tx.Exec(ctx, `
+			UPDATE scan_jobs
+			SET stage = $1, user_car_id = $2, image_data = NULL, second_image_data = NULL,
+				locked_until = NULL, finished_at = NOW(), updated_at = NOW()
+			WHERE id = $3`,
+			ScanStageDone, userCarID, jobID,
+		)
+		return err
+	}
+
+	var second *scanPhoto
+	if secondType != nil {
+		second = s.prepareScanPhoto(jobCtx, &Upload{Data: secondData, ContentType: *secondType})
+	}
+
+	var result *ScanResult
+	var scanErr error
+	if reservationID == nil {
+		// Jobs queued before credits were reserved on submission
+		var id int
+		id, scanErr = s.reserveScanCredit(jobCtx, userID, upload)
+		reservationID = &id
+	}
+	if scanErr == nil {
+		result, scanErr = s.processScan(jobCtx, userID, *reservationID, s.prepareScanPhoto(jobCtx, upload), second, hooks)
+	}
+	if scanErr != nil {
+		logger.Printf("Scan job %d failed: %v", jobID, scanErr)
+		_, err = s.db.Exec(ctx, `
+			UPDATE scan_jobs
+			SET stage = $1, error_message = $2, image_data = NULL, second_image_data = NULL,
+				locked_until = NULL, finished_at = NOW(), updated_at = NOW()
+			WHERE id = $3`,
+			ScanStageFailed, scanErr.Error(), jobID,
+		)
+	} else if result.Pending != nil {
+		logger.Printf("Scan job %d is awaiting confirmation of pending scan %d", jobID, result.Pending.ID)
+		_, err = s.db.Exec(ctx, `
+			UPDATE scan_jobs
+			SET stage = $1, pending_scan_id = $2, image_data = NULL, second_image_data = NULL,
+				locked_until = NULL, updated_at = NOW()
+			WHERE id = $3`,
+			ScanStageAwaitingConfirmation, result.Pending.ID, jobID,
+		)
+	}
+	if err != nil {
+		return true, fmt.Errorf("failed to finish scan job %d: %w", jobID, err)
+	}
+	return true, nil
+}
+
+// expireAbandonedJobs fails jobs that have run out of attempts and hands back
+// their credits
+func (s *Service) expireAbandonedJobs(ctx context.Context) error {
+	rows, err := s.db.Query(ctx, `
+		UPDATE scan_jobs
+		SET stage = $1, error_message = 'scan was interrupted too many times',
+			image_data = NULL, second_image_data = NULL, finished_at = NOW(), updated_at = NOW()
+		WHERE stage NOT IN ($1, $2, $4) AND attempts >= $3 AND locked_until < NOW()
+		RETURNING credit_reservation_id`,
+		ScanStageFailed, ScanStageDone, scanJobMaxAttempts, ScanStageAwaitingConfirmation,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to expire abandoned scan jobs: %w", err)
+	}
+	var reservationIDs []int
+	for rows.Next() {
+		var reservationID *int
+		if err := rows.Scan(&reservationID); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read abandoned scan job: %w", err)
+		}
+		if reservationID != nil {
+			reservationIDs = append(reservationIDs, *reservationID)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to expire abandoned scan jobs: %w", err)
+	}
+
+	for _, reservationID := range reservationIDs {
+		s.releaseScanCredit(ctx, reservationID)
+	}
+	return nil
+}
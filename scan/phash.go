@@ -0,0 +1,315 @@
+package scan
+
+import (
+	"CarBN/common"
+	"CarBN/storage"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// defaultPHashThreshold is the largest Hamming distance between two 64-bit
+// dHashes that still counts as the same photo. Recompression, resizing and
+// light edits usually stay well under it.
+const defaultPHashThreshold = 10
+
+// hammingDistanceSQL counts the differing bits between image_hash and $1
+const hammingDistanceSQL = `length(replace((image_hash # $1)::bit(64)::text, '0', ''))`
+
+// Hashes are indexed by their four 16-bit bands (multi-index hashing). Two
+// hashes within the threshold differ by at most threshold/4 bits in one of
+// their bands, so the lookup only reads the rows with a band within that many
+// bits of the photo's, and works out the full distance for those.
+const (
+	hashBands    = 4
+	hashBandBits = 16
+)
+
+// hashBandsSQL matches column against the band values passed as the arrays
+// $param to $param+3, using the indexes of migration 023
+func hashBandsSQL(column string, param int) string {
+	conditions := make([]string, hashBands)
+	for i := range conditions {
+		shift := (hashBands - 1 - i) * hashBandBits
+		conditions[i] = fmt.Sprintf("((%s >> %d) & 65535) = ANY($%d)", column, shift, param+i)
+	}
+	return "(" + strings.Join(conditions, " OR ") + ")"
+}
+
+// hashBandProbes returns, for each band of hash from the most significant,
+// every value within threshold/4 bits of it
+func hashBandProbes(hash uint64, threshold int) [][]int64 {
+	maxBits := min(max(threshold, 0)/hashBands, hashBandBits)
+	probes := make([][]int64, hashBands)
+	for i := range probes {
+		shift := (hashBands - 1 - i) * hashBandBits
+		band := (hash >> shift) & (1<<hashBandBits - 1)
+		probes[i] = flipBits(band, 0, maxBits, nil)
+	}
+	return probes
+}
+
+// flipBits appends value and every value made by flipping up to n of its
+// bits from bit `from` up
+func flipBits(value uint64, from, n int, out []int64) []int64 {
+	out = append(out, int64(value))
+	if n == 0 {
+		return out
+	}
+	for bit := from; bit < hashBandBits; bit++ {
+		out = flipBits(value^(1<<bit), bit+1, n-1, out)
+	}
+	return out
+}
+
+// dHash computes a 64-bit difference hash: the image is reduced to a 9x8
+// grayscale grid and each bit records whether a cell is brighter than its
+// right-hand neighbour.
+func dHash(img image.Image) uint64 {
+	const cols, rows = 9, 8
+	var sums [rows][cols]uint64
+	var counts [rows][cols]uint64
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w == 0 || h == 0 {
+		return 0
+	}
+
+	// Average luminance per cell. JPEGs decode to YCbCr, so read the luma
+	// plane directly rather than converting every pixel.
+	ycc, isYCbCr := img.(*image.YCbCr)
+	for y := 0; y < h; y++ {
+		row := y * rows / h
+		for x := 0; x < w; x++ {
+			col := x * cols / w
+			var lum uint64
+			if isYCbCr {
+				lum = uint64(ycc.Y[ycc.YOffset(b.Min.X+x, b.Min.Y+y)]) << 8
+			} else {
+				r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+				lum = (299*uint64(r) + 587*uint64(g) + 114*uint64(bl)) / 1000
+			}
+			sums[row][col] += lum
+			counts[row][col]++
+		}
+	}
+
+	var hash uint64
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cols-1; col++ {
+			left := sums[row][col] / max(counts[row][col], 1)
+			right := sums[row][col+1] / max(counts[row][col+1], 1)
+			hash <<= 1
+			if left > right {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// hashImageData decodes an image and returns its dHash
+func hashImageData(data []byte) (uint64, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode image: %w", err)
+	}
+	return dHash(img), nil
+}
+
+// recycledScanFilter limits the scans a photo can be recycled from to those
+// that added a car or were rejected for the photo itself. A scan that failed
+// for any other reason, like an AI error, can be retried with the same photo.
+const recycledScanFilter = `(success OR outcome IN ('rejected_fake', 'recycled_image', 'exif_rejected'))`
+
+// pendingScanFilter limits the pending scans a photo can be recycled from to
+// those that can still be confirmed
+const pendingScanFilter = `status IN ('pending', 'confirming') AND expires_at > NOW()`
+
+// checkRecycledImages rejects a scan when either of its photos was recycled.
+// Photos without a hash can't be checked; inspectScanImage has already
+// recorded them as violating the policy. pendingID is the pending scan being
+// confirmed, whose own photos don't count, or 0.
+func (s *Service) checkRecycledImages(ctx context.Context, userID int, evidence *scanEvidence, pendingID int) error {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+
+	if s.phashThreshold < 0 {
+		return nil
+	}
+	for _, imageHash := range []*int64{evidence.imageHash, evidence.secondPhoto().imageHash} {
+		if imageHash == nil {
+			continue
+		}
+		match, err := s.findRecycledImage(ctx, uint64(*imageHash), pendingID)
+		if err != nil {
+			logger.Printf("Failed to check for recycled image: %v", err)
+			return err
+		}
+		if match != "" {
+			logger.Printf("Rejecting recycled scan for user %d: %s", userID, match)
+			return withOutcomeDetail(ScanOutcomeRecycledImage, "recycled image: "+match, common.ErrRecycledScan)
+		}
+	}
+	return nil
+}
+
+// findRecycledImage looks for a prior scan photo by any user (either photo of
+// a two-photo scan), including scans still awaiting confirmation other than
+// pendingID, or a generated catalog image, within the configured Hamming
+// distance of hash. It returns a description of the match, or "" if the image
+// is new.
+func (s *Service) findRecycledImage(ctx context.Context, hash uint64, pendingID int) (string, error) {
+	probes := hashBandProbes(hash, s.phashThreshold)
+	var source string
+	var scanID, distance int
+	err := s.db.QueryRow(ctx, `
+		SELECT source, id, `+hammingDistanceSQL+` AS distance
+		FROM (
+			SELECT 'scan' AS source, id, image_hash FROM scan_history
+			WHERE `+recycledScanFilter+` AND `+hashBandsSQL("image_hash", 4)+`
+			UNION ALL
+			SELECT 'scan', id, second_image_hash FROM scan_history
+			WHERE `+recycledScanFilter+` AND `+hashBandsSQL("second_image_hash", 4)+`
+			UNION ALL
+			SELECT 'pending scan', id, image_hash FROM pending_scans WHERE id <> $3 AND `+pendingScanFilter+`
+			UNION ALL
+			SELECT 'pending scan', id, second_image_hash FROM pending_scans
+			WHERE second_image_hash IS NOT NULL AND id <> $3 AND `+pendingScanFilter+`
+		) AS scan_hashes
+		WHERE image_hash IS NOT NULL AND `+hammingDistanceSQL+` <= $2
+		ORDER BY distance
+		LIMIT 1`,
+		int64(hash), s.phashThreshold, pendingID, probes[0], probes[1], probes[2], probes[3],
+	).Scan(&source, &scanID, &distance)
+	if err == nil {
+		return fmt.Sprintf("matches %s %d (distance %d)", source, scanID, distance), nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return "", fmt.Errorf("failed to check scan history hashes: %w", err)
+	}
+
+	var imagePath string
+	err = s.db.QueryRow(ctx, `
+		SELECT image_path, `+hammingDistanceSQL+` AS distance
+		FROM generated_image_hashes
+		WHERE `+hashBandsSQL("image_hash", 3)+` AND `+hammingDistanceSQL+` <= $2
+		ORDER BY distance
+		LIMIT 1`,
+		int64(hash), s.phashThreshold, probes[0], probes[1], probes[2], probes[3],
+	).Scan(&imagePath, &distance)
+	if err == nil {
+		return fmt.Sprintf("matches generated image %s (distance %d)", imagePath, distance), nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return "", fmt.Errorf("failed to check generated image hashes: %w", err)
+	}
+	return "", nil
+}
+
+// indexGeneratedImage stores the hash of a generated catalog image so scans
+// of it can be caught
+func (s *Service) indexGeneratedImage(ctx context.Context, imagePath string, hash uint64) error {
+	_, err := s.db.Exec(ctx, `
+		INSERT INTO generated_image_hashes (image_path, image_hash)
+		VALUES ($1, $2)
+		ON CONFLICT (image_path) DO NOTHING`,
+		imagePath, int64(hash),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to index generated image: %w", err)
+	}
+	return nil
+}
+
+// IndexGeneratedImages hashes any generated high res images in storage that
+// aren't indexed yet. Images rendered by this process are indexed as they are
+// saved; this picks up everything else, such as premium upgrade images.
+func (s *Service) IndexGeneratedImages(ctx context.Context) error {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+
+	rows, err := s.db.Query(ctx, "SELECT image_path FROM generated_image_hashes")
+	if err != nil {
+		return fmt.Errorf("failed to load indexed images: %w", err)
+	}
+	indexed := make(map[string]bool)
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan indexed image: %w", err)
+		}
+		indexed[path] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to load indexed images: %w", err)
+	}
+
+	added := 0
+	err = s.store.List(ctx, storage.GeneratedPrefix, func(obj storage.Object) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		name := path.Base(obj.Key)
+		if !strings.HasPrefix(name, "high_res") || !strings.HasSuffix(name, ".jpg") || indexed[obj.Key] {
+			return nil
+		}
+
+		data, err := storage.ReadAll(ctx, s.store, obj.Key)
+		if err != nil {
+			return err
+		}
+		hash, err := hashImageData(data)
+		if err != nil {
+			logger.Printf("Warning: failed to hash generated image %s: %v", obj.Key, err)
+			return nil
+		}
+		if err := s.indexGeneratedImage(ctx, obj.Key, hash); err != nil {
+			return err
+		}
+		added++
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to index generated images: %w", err)
+	}
+
+	if added > 0 {
+		logger.Printf("Indexed %d generated images", added)
+	}
+	return nil
+}
+
+// StartGeneratedImageIndexer indexes generated images now and then every
+// interval until ctx is cancelled
+func (s *Service) StartGeneratedImageIndexer(ctx context.Context, interval time.Duration) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := s.IndexGeneratedImages(ctx); err != nil {
+				logger.Printf("Generated image indexer error: %v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
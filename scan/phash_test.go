@@ -0,0 +1,171 @@
+package scan
+
+import (
+	"image"
+	"image/color"
+	"math/bits"
+	"math/rand"
+	"slices"
+	"testing"
+
+	"golang.org/x/image/draw"
+)
+
+// gradient is an image that gets darker from left to right, with a black
+// block over the first two hash cells of the first two rows
+func gradient(w, h int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := 255 - x*255/w
+			if x < 2*w/9 && y < h/4 {
+				v = 0
+			}
+			img.SetGray(x, y, color.Gray{Y: uint8(v)})
+		}
+	}
+	return img
+}
+
+func TestDHash(t *testing.T) {
+	img := gradient(90, 80)
+	hash := dHash(img)
+
+	// Every cell is brighter than its right-hand neighbour except in the
+	// dark corner, which covers the first two cells of the first two rows
+	var want uint64
+	for row := 0; row < 8; row++ {
+		for col := 0; col < 8; col++ {
+			want <<= 1
+			if row >= 2 || col >= 2 {
+				want |= 1
+			}
+		}
+	}
+	if hash != want {
+		t.Errorf("dHash = %064b\nwant   %064b", hash, want)
+	}
+
+	// Resizing hardly changes the hash
+	small := image.NewRGBA(image.Rect(0, 0, 45, 40))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), img, img.Bounds(), draw.Src, nil)
+	if d := bits.OnesCount64(dHash(small) ^ hash); d > defaultPHashThreshold {
+		t.Errorf("resized image is %d bits away", d)
+	}
+
+	// A different image isn't close
+	flipped := image.NewGray(img.Bounds())
+	for y := 0; y < 80; y++ {
+		for x := 0; x < 90; x++ {
+			flipped.SetGray(89-x, y, img.GrayAt(x, y))
+		}
+	}
+	if d := bits.OnesCount64(dHash(flipped) ^ hash); d <= defaultPHashThreshold {
+		t.Errorf("mirrored image is only %d bits away", d)
+	}
+
+	if got := dHash(image.NewGray(image.Rect(0, 0, 0, 0))); got != 0 {
+		t.Errorf("dHash of an empty image = %x, want 0", got)
+	}
+}
+
+func TestHashImageData(t *testing.T) {
+	if _, err := hashImageData(testPNG(t)); err != nil {
+		t.Errorf("hashImageData of a PNG: %v", err)
+	}
+	if _, err := hashImageData([]byte("not an image")); err == nil {
+		t.Error("hashImageData of garbage succeeded")
+	}
+}
+
+func TestFlipBits(t *testing.T) {
+	tests := []struct {
+		n    int
+		want int
+	}{
+		{0, 1},
+		{1, 1 + 16},
+		{2, 1 + 16 + 120},
+		{3, 1 + 16 + 120 + 560},
+	}
+	for _, tt := range tests {
+		values := flipBits(0xabcd, 0, tt.n, nil)
+		if len(values) != tt.want {
+			t.Errorf("flipBits(n=%d) returned %d values, want %d", tt.n, len(values), tt.want)
+		}
+		seen := make(map[int64]bool, len(values))
+		for _, v := range values {
+			if seen[v] {
+				t.Fatalf("flipBits(n=%d) returned %x twice", tt.n, v)
+			}
+			seen[v] = true
+			if d := bits.OnesCount64(uint64(v) ^ 0xabcd); d > tt.n || v>>hashBandBits != 0 {
+				t.Fatalf("flipBits(n=%d) returned %x, %d bits away", tt.n, v, d)
+			}
+		}
+	}
+}
+
+func TestHashBandProbes(t *testing.T) {
+	const hash = 0x1234_5678_9abc_def0
+
+	tests := []struct {
+		threshold int
+		perBand   int
+	}{
+		{-1, 1},
+		{0, 1},
+		{3, 1},
+		{4, 17},
+		{defaultPHashThreshold, 137},
+	}
+	for _, tt := range tests {
+		probes := hashBandProbes(hash, tt.threshold)
+		if len(probes) != hashBands {
+			t.Fatalf("threshold %d: %d bands, want %d", tt.threshold, len(probes), hashBands)
+		}
+		for i, band := range probes {
+			if len(band) != tt.perBand {
+				t.Errorf("threshold %d: band %d has %d probes, want %d", tt.threshold, i, len(band), tt.perBand)
+			}
+		}
+		if want := []int64{0x1234, 0x5678, 0x9abc, 0xdef0}; probes[0][0] != want[0] || probes[1][0] != want[1] ||
+			probes[2][0] != want[2] || probes[3][0] != want[3] {
+			t.Errorf("threshold %d: bands start with %x %x %x %x, want %x", tt.threshold,
+				probes[0][0], probes[1][0], probes[2][0], probes[3][0], want)
+		}
+	}
+}
+
+// Every hash within the threshold must share a probed band value, or the
+// indexed lookup would miss it
+func TestHashBandProbesFindEveryMatch(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for n := 0; n < 5000; n++ {
+		hash := rng.Uint64()
+		other := hash
+		for _, bit := range rng.Perm(64)[:rng.Intn(defaultPHashThreshold+1)] {
+			other ^= 1 << bit
+		}
+
+		probes := hashBandProbes(hash, defaultPHashThreshold)
+		found := false
+		for i, band := range probes {
+			shift := (hashBands - 1 - i) * hashBandBits
+			if slices.Contains(band, int64((other>>shift)&0xffff)) {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("%016x is within %d bits of %016x but no band matches", other, defaultPHashThreshold, hash)
+		}
+	}
+}
+
+func TestHashBandsSQL(t *testing.T) {
+	want := "(((image_hash >> 48) & 65535) = ANY($4) OR ((image_hash >> 32) & 65535) = ANY($5) OR " +
+		"((image_hash >> 16) & 65535) = ANY($6) OR ((image_hash >> 0) & 65535) = ANY($7))"
+	if got := hashBandsSQL("image_hash", 4); got != want {
+		t.Errorf("hashBandsSQL =\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,203 @@
+package scan
+
+import (
+	"CarBN/common"
+	"CarBN/storage"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const placeholderBackfillBatchSize = 50
+
+// placeholderColumns are a table's image path and the columns of its placeholder
+type placeholderColumns struct {
+	table, path, blurHash, dominantColor string
+}
+
+var placeholderTables = []placeholderColumns{
+	{"user_cars", "high_res_image", "image_blurhash", "image_dominant_color"},
+	{"users", "profile_picture", "profile_picture_blurhash", "profile_picture_dominant_color"},
+}
+
+// BackfillPlaceholders computes the placeholders of car renders, user cars
+// and profile pictures saved before placeholders existed, or whose
+// placeholder failed when they were saved. Images that are missing or can't
+// be decoded get an empty hash, so they aren't tried again.
+func (s *Service) BackfillPlaceholders(ctx context.Context) error {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+
+	renders, err := s.backfillRenderPlaceholders(ctx)
+	if err != nil {
+		return err
+	}
+	filled := renders
+	for _, columns := range placeholderTables {
+		n, err := s.backfillTablePlaceholders(ctx, columns)
+		if err != nil {
+			return err
+		}
+		filled += n
+	}
+
+	if filled > 0 {
+		logger.Printf("Backfilled %d image placeholders", filled)
+	}
+	return nil
+}
+
+// backfillRenderPlaceholders fills in the placeholders of cars.color_images
+func (s *Service) backfillRenderPlaceholders(ctx context.Context) (int, error) {
+	filled := 0
+	for {
+		rows, err := s.db.Query(ctx, `
+			SELECT c.id, img.key, img.value->>'high_res'
+			FROM cars c,
+				jsonb_each(CASE WHEN jsonb_typeof(c.color_images) = 'object' THEN c.color_images ELSE '{}' END) img
+			WHERE jsonb_typeof(img.value) = 'object' AND img.value->>'high_res' IS NOT NULL
+				AND NOT img.value ? 'blurhash'
+			LIMIT $1`,
+			placeholderBackfillBatchSize,
+		)
+		if err != nil {
+			return filled, fmt.Errorf("failed to query renders missing placeholders: %w", err)
+		}
+		type render struct {
+			carID        int
+			color, image string
+		}
+		var batch []render
+		for rows.Next() {
+			var r render
+			if err := rows.Scan(&r.carID, &r.color, &r.image); err != nil {
+				rows.Close()
+				return filled, fmt.Errorf("failed to read render: %w", err)
+			}
+			batch = append(batch, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return filled, fmt.Errorf("failed to query renders missing placeholders: %w", err)
+		}
+		if len(batch) == 0 {
+			return filled, nil
+		}
+
+		for _, r := range batch {
+			placeholder, err := s.computePlaceholder(ctx, r.image)
+			if err != nil {
+				return filled, err
+			}
+			if _, err := s.db.Exec(ctx, `
+				UPDATE cars
+				SET color_images = jsonb_set(color_images, ARRAY[$2::text],
+					(color_images->$2::text) || jsonb_build_object('blurhash', $3::text, 'dominant_color', $4::text))
+				WHERE id = $1 AND color_images ? $2::text`,
+				r.carID, r.color, placeholder.BlurHash, placeholder.DominantColor,
+			); err != nil {
+				return filled, fmt.Errorf("failed to store placeholder of %s: %w", r.image, err)
+			}
+			filled++
+		}
+	}
+}
+
+// backfillTablePlaceholders fills in the placeholders of one table's images.
+// Rows sharing an image, like user cars of the same render, share the work.
+func (s *Service) backfillTablePlaceholders(ctx context.Context, c placeholderColumns) (int, error) {
+	filled := 0
+	for {
+		rows, err := s.db.Query(ctx, fmt.Sprintf(`
+			SELECT DISTINCT %[2]s FROM %[1]s
+			WHERE %[3]s IS NULL AND %[2]s IS NOT NULL AND %[2]s <> '' AND %[2]s <> $1
+			LIMIT $2`, c.table, c.path, c.blurHash),
+			common.PlaceholderImagePath, placeholderBackfillBatchSize,
+		)
+		if err != nil {
+			return filled, fmt.Errorf("failed to query %s missing placeholders: %w", c.table, err)
+		}
+		var batch []string
+		for rows.Next() {
+			var image string
+			if err := rows.Scan(&image); err != nil {
+				rows.Close()
+				return filled, fmt.Errorf("failed to read %s image: %w", c.table, err)
+			}
+			batch = append(batch, image)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return filled, fmt.Errorf("failed to query %s missing placeholders: %w", c.table, err)
+		}
+		if len(batch) == 0 {
+			return filled, nil
+		}
+
+		for _, image := range batch {
+			placeholder, err := s.computePlaceholder(ctx, image)
+			if err != nil {
+				return filled, err
+			}
+			if _, err := s.db.Exec(ctx, fmt.Sprintf(`
+				UPDATE %[1]s SET %[3]s = $1, %[4]s = NULLIF($2, '')
+				WHERE %[2]s = $3 AND %[3]s IS NULL`, c.table, c.path, c.blurHash, c.dominantColor),
+				placeholder.BlurHash, placeholder.DominantColor, image,
+			); err != nil {
+				return filled, fmt.Errorf("failed to store placeholder of %s: %w", image, err)
+			}
+			filled++
+		}
+	}
+}
+
+// computePlaceholder computes the placeholder of the image at key from its
+// smallest variant, falling back to the image. An image that's missing or
+// can't be decoded gets an empty placeholder; other errors are returned so
+// the next run tries again.
+func (s *Service) computePlaceholder(ctx context.Context, key string) (*storage.Placeholder, error) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+
+	data, err := storage.ReadAll(ctx, s.store, storage.VariantKey(key, storage.Variants[0].Width))
+	if errors.Is(err, storage.ErrNotFound) {
+		data, err = storage.ReadAll(ctx, s.store, key)
+	}
+	if errors.Is(err, storage.ErrNotFound) {
+		logger.Printf("Warning: image %s is missing, leaving it without a placeholder", key)
+		return &storage.Placeholder{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+
+	placeholder, err := storage.ComputePlaceholder(data)
+	if err != nil {
+		logger.Printf("Warning: failed to compute placeholder of %s: %v", key, err)
+		return &storage.Placeholder{}, nil
+	}
+	return placeholder, nil
+}
+
+// StartPlaceholderBackfill backfills placeholders now and then every interval
+// until ctx is cancelled
+func (s *Service) StartPlaceholderBackfill(ctx context.Context, interval time.Duration) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := s.BackfillPlaceholders(ctx); err != nil {
+				logger.Printf("Placeholder backfill error: %v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,101 @@
+package scan
+
+import (
+	"CarBN/prompts"
+	"context"
+	"fmt"
+	"sort"
+)
+
+// PromptVersionStats is how often a prompt version has been used and, for
+// the scan prompt, how many of its scans were rejected
+type PromptVersionStats struct {
+	Name    string `json:"name"`
+	Version int    `json:"version"`
+	Ref     string `json:"ref"`
+	Weight  int    `json:"weight"` // 0 for versions no longer served
+	Uses    int    `json:"uses"`   // Scans, cars, renders or upgrades produced with the version
+
+	// Scan prompt only
+	Rejected      *int     `json:"rejected,omitempty"` // Scans rejected as not genuine photos of a car
+	RejectionRate *float64 `json:"rejection_rate,omitempty"`
+}
+
+// GetPromptStats returns every version of every prompt, in the registry or
+// recorded on earlier scans, with what each produced
+func (s *Service) GetPromptStats(ctx context.Context) ([]PromptVersionStats, error) {
+	rows, err := s.db.Query(ctx, `
+		SELECT prompt_version, COUNT(*), COUNT(*) FILTER (WHERE outcome = $1)
+		FROM scan_history WHERE prompt_version IS NOT NULL GROUP BY prompt_version
+		UNION ALL
+		SELECT prompt_version, COUNT(*), 0
+		FROM cars WHERE prompt_version IS NOT NULL GROUP BY prompt_version
+		UNION ALL
+		SELECT i.value->>'prompt_version', COUNT(*), 0
+		FROM cars c, jsonb_each(c.color_images) i
+		WHERE jsonb_typeof(i.value) = 'object' AND i.value->>'prompt_version' IS NOT NULL
+		GROUP BY 1
+		UNION ALL
+		SELECT prompt_version, COUNT(*), 0
+		FROM car_upgrades WHERE prompt_version IS NOT NULL GROUP BY prompt_version`,
+		ScanOutcomeRejectedFake,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query prompt usage: %w", err)
+	}
+	defer rows.Close()
+
+	type usage struct{ uses, rejected int }
+	used := make(map[string]usage)
+	for rows.Next() {
+		var ref string
+		var u usage
+		if err := rows.Scan(&ref, &u.uses, &u.rejected); err != nil {
+			return nil, fmt.Errorf("failed to read prompt usage: %w", err)
+		}
+		prev := used[ref]
+		used[ref] = usage{prev.uses + u.uses, prev.rejected + u.rejected}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query prompt usage: %w", err)
+	}
+
+	var stats []PromptVersionStats
+	for _, p := range s.prompts.Versions() {
+		stats = append(stats, PromptVersionStats{Name: p.Name, Version: p.Version, Ref: p.Ref(), Weight: p.Weight})
+	}
+	known := make(map[string]bool, len(stats))
+	for _, st := range stats {
+		known[st.Ref] = true
+	}
+	for ref := range used {
+		if known[ref] {
+			continue
+		}
+		// Versions removed from the registry still have their history
+		if name, version, ok := prompts.ParseRef(ref); ok {
+			stats = append(stats, PromptVersionStats{Name: name, Version: version, Ref: ref})
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Name != stats[j].Name {
+			return stats[i].Name < stats[j].Name
+		}
+		return stats[i].Version < stats[j].Version
+	})
+
+	for i := range stats {
+		u := used[stats[i].Ref]
+		stats[i].Uses = u.uses
+		if stats[i].Name != prompts.ScanImage {
+			continue
+		}
+		rejected := u.rejected
+		stats[i].Rejected = &rejected
+		if u.uses > 0 {
+			rate := float64(u.rejected) / float64(u.uses)
+			stats[i].RejectionRate = &rate
+		}
+	}
+	return stats, nil
+}
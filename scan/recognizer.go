@@ -0,0 +1,556 @@
+package scan
+
+import (
+	"CarBN/common"
+	"CarBN/replay"
+	"CarBN/usage"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+// CarRecognizer identifies a car from a photo and looks up its specifications,
+// sending the prompts it's given (rendered from the prompt registry).
+// Implementations must return common.ErrScanRejected when the photo is judged
+// not to be a genuine real-world capture. mimeType is the type of the base64
+// encoded photo, e.g. image/jpeg or image/heic. IdentifyCarSpecs returns the
+// spec sheet validated against specFields.
+type CarRecognizer interface {
+	Name() string
+	IdentifyCar(ctx context.Context, prompt, base64Image, mimeType string) (*CarDetails, error)
+	IdentifyCarSpecs(ctx context.Context, prompt string) (*CarSpecs, error)
+}
+
+const (
+	defaultProviderTimeout  = 60 * time.Second
+	defaultBreakerThreshold = 3
+	defaultBreakerCooldown  = time.Minute
+	defaultGeminiModel      = "gemini-2.0-flash"
+)
+
+// NewRecognizerFromEnv builds the provider chain described by VISION_PROVIDERS,
+// a comma separated list of provider names tried in order. Supported names are
+// "default" and "fallback" (OpenAI-compatible endpoints configured through the
+// DEFAULT_* and FALLBACK_* variables), "gemini" and "fake". Each provider may
+// override its timeout with <NAME>_TIMEOUT (e.g. GEMINI_TIMEOUT=30s).
+// OpenAI-compatible endpoints that don't support structured outputs need
+// <NAME>_STRUCTURED_OUTPUTS=false. AI_REPLAY_MODE records or replays the
+// providers' traffic (see the replay package). Every call to a provider is
+// recorded with usageService.
+func NewRecognizerFromEnv(usageService *usage.Service) CarRecognizer {
+	names := os.Getenv("VISION_PROVIDERS")
+	if names == "" {
+		names = "default,fallback"
+	}
+
+	threshold := defaultBreakerThreshold
+	if v, err := strconv.Atoi(os.Getenv("VISION_BREAKER_THRESHOLD")); err == nil && v > 0 {
+		threshold = v
+	}
+	cooldown := defaultBreakerCooldown
+	if v, err := time.ParseDuration(os.Getenv("VISION_BREAKER_COOLDOWN")); err == nil && v > 0 {
+		cooldown = v
+	}
+
+	var providers []*provider
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		timeout := defaultProviderTimeout
+		if v, err := time.ParseDuration(os.Getenv(strings.ToUpper(name) + "_TIMEOUT")); err == nil && v > 0 {
+			timeout = v
+		}
+
+		var rec CarRecognizer
+		switch name {
+		case "default", "fallback":
+			prefix := strings.ToUpper(name)
+			structuredOutputs, err := strconv.ParseBool(os.Getenv(prefix + "_STRUCTURED_OUTPUTS"))
+			if err != nil {
+				structuredOutputs = true
+			}
+			client := replay.NewClientFromEnv()
+			client.Timeout = timeout
+			rec = &OpenAIRecognizer{
+				name:              name,
+				baseURL:           os.Getenv(prefix + "_BASE_URL"),
+				apiKey:            os.Getenv(prefix + "_API_KEY"),
+				chatModel:         os.Getenv(prefix + "_CHAT_MODEL"),
+				visionModel:       os.Getenv(prefix + "_VISION_MODEL"),
+				structuredOutputs: structuredOutputs,
+				client:            client,
+			}
+		case "gemini":
+			gemini, err := NewGeminiRecognizer(context.Background(), os.Getenv("GEMINI_API_KEY"), os.Getenv("GEMINI_VISION_MODEL"))
+			if err != nil {
+				log.Printf("Warning: skipping gemini vision provider: %v", err)
+				continue
+			}
+			rec = gemini
+		case "fake":
+			rec = &FakeRecognizer{}
+		default:
+			log.Printf("Warning: unknown vision provider %q in VISION_PROVIDERS", name)
+			continue
+		}
+
+		log.Printf("Vision provider %d: %s (timeout %s)", len(providers)+1, name, timeout)
+		providers = append(providers, &provider{
+			recognizer: rec,
+			timeout:    timeout,
+			breaker:    &circuitBreaker{threshold: threshold, cooldown: cooldown},
+		})
+	}
+
+	return &RecognizerChain{providers: providers, usage: usageService}
+}
+
+type provider struct {
+	recognizer CarRecognizer
+	timeout    time.Duration
+	breaker    *circuitBreaker
+}
+
+// RecognizerChain tries each provider in order until one succeeds. A
+// rejection is a definitive answer and stops the chain; any other error
+// counts against the provider's circuit breaker and moves on to the next.
+type RecognizerChain struct {
+	providers []*provider
+	usage     *usage.Service
+}
+
+func (c *RecognizerChain) Name() string {
+	names := make([]string, 0, len(c.providers))
+	for _, p := range c.providers {
+		names = append(names, p.recognizer.Name())
+	}
+	return strings.Join(names, ",")
+}
+
+func (c *RecognizerChain) IdentifyCar(ctx context.Context, prompt, base64Image, mimeType string) (*CarDetails, error) {
+	var carDetails *CarDetails
+	err := c.run(ctx, usage.KindVision, func(ctx context.Context, rec CarRecognizer) (err error) {
+		carDetails, err = rec.IdentifyCar(ctx, prompt, base64Image, mimeType)
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, common.ErrScanRejected) {
+			return nil, err
+		}
+		log.Printf("Failed to identify car: %v", err)
+		return nil, common.UpstreamFailure("failed to identify car").Wrap(err)
+	}
+	return carDetails, nil
+}
+
+func (c *RecognizerChain) IdentifyCarSpecs(ctx context.Context, prompt string) (*CarSpecs, error) {
+	var specs *CarSpecs
+	err := c.run(ctx, usage.KindChat, func(ctx context.Context, rec CarRecognizer) (err error) {
+		specs, err = rec.IdentifyCarSpecs(ctx, prompt)
+		return err
+	})
+	return specs, err
+}
+
+// run calls each provider in turn, recording every call as kind
+func (c *RecognizerChain) run(ctx context.Context, kind string, call func(context.Context, CarRecognizer) error) error {
+	if len(c.providers) == 0 {
+		return errors.New("no vision providers configured")
+	}
+
+	var lastErr error
+	for _, p := range c.providers {
+		name := p.recognizer.Name()
+		if !p.breaker.allow() {
+			log.Printf("Skipping vision provider %s: circuit open", name)
+			lastErr = fmt.Errorf("%s: circuit open", name)
+			continue
+		}
+
+		metered := &usage.Call{Kind: kind, Provider: name}
+		callCtx, cancel := context.WithTimeout(usage.WithCall(ctx, metered), p.timeout)
+		start := time.Now()
+		err := call(callCtx, p.recognizer)
+		cancel()
+
+		// A rejection is a successful call as far as spend goes
+		metered.Latency = time.Since(start)
+		if !errors.Is(err, common.ErrScanRejected) {
+			metered.Err = err
+		}
+		c.usage.Record(ctx, metered)
+
+		if err == nil {
+			p.breaker.success()
+			return nil
+		}
+		// A rejection means the provider did its job; don't try to overrule it.
+		if errors.Is(err, common.ErrScanRejected) {
+			p.breaker.success()
+			return err
+		}
+		// The caller gave up; no point trying the remaining providers.
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		p.breaker.failure()
+		log.Printf("Vision provider %s failed: %v", name, err)
+		lastErr = fmt.Errorf("%s: %w", name, err)
+	}
+	return lastErr
+}
+
+// circuitBreaker stops calling a provider for a cooldown period after a run
+// of consecutive failures.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Now().After(b.openUntil)
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+}
+
+func (b *circuitBreaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+		b.failures = 0
+	}
+}
+
+// OpenAIRecognizer talks to any OpenAI-compatible /chat/completions endpoint.
+// With structuredOutputs the spec sheet is requested with a strict JSON schema.
+type OpenAIRecognizer struct {
+	name              string
+	baseURL           string
+	apiKey            string
+	chatModel         string
+	visionModel       string
+	structuredOutputs bool
+	client            *http.Client
+}
+
+func (r *OpenAIRecognizer) Name() string {
+	return r.name
+}
+
+func (r *OpenAIRecognizer) IdentifyCar(ctx context.Context, prompt, base64Image, mimeType string) (*CarDetails, error) {
+	usage.SetModel(ctx, r.visionModel)
+	payload := struct {
+		Model    string        `json:"model"`
+		Messages []interface{} `json:"messages"`
+	}{
+		Model: r.visionModel,
+		Messages: []interface{}{
+			map[string]interface{}{
+				"role": "user",
+				"content": []interface{}{
+					map[string]interface{}{
+						"type": "text",
+						"text": prompt,
+					},
+					map[string]interface{}{
+						"type": "image_url",
+						"image_url": map[string]string{
+							"url":    fmt.Sprintf("data:%s;base64,%s", mimeType, base64Image),
+							"detail": "high",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	content, err := r.makeAIRequest(ctx, payloadBytes)
+	if err != nil {
+		return nil, err
+	}
+	var scanResp ScanImageResponse
+	if err := unmarshalJSONContent(content, &scanResp); err != nil {
+		return nil, err
+	}
+	return scanResp.toCarDetails()
+}
+
+func (r *OpenAIRecognizer) IdentifyCarSpecs(ctx context.Context, prompt string) (*CarSpecs, error) {
+	usage.SetModel(ctx, r.chatModel)
+	payload := ChatPayload{
+		Model: r.chatModel,
+		Messages: []ChatMessage{
+			{
+				Role:    "user",
+				Content: prompt,
+			},
+		},
+	}
+	if r.structuredOutputs {
+		payload.ResponseFormat = map[string]interface{}{
+			"type": "json_schema",
+			"json_schema": map[string]interface{}{
+				"name":   "car_specs",
+				"strict": true,
+				"schema": specsJSONSchema(),
+			},
+		}
+	}
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal chat payload: %w", err)
+	}
+
+	content, err := r.makeAIRequest(ctx, payloadBytes)
+	if err != nil {
+		return nil, err
+	}
+	return parseCarSpecs(ctx, content)
+}
+
+// makeAIRequest sends a chat completion and returns the reply's content
+func (r *OpenAIRecognizer) makeAIRequest(ctx context.Context, payload []byte) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/chat/completions", r.baseURL), bytes.NewReader(payload))
+	if err != nil {
+		return "", fmt.Errorf("failed to create AI request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+r.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("AI request error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+		logger.Printf("AI API error response (status %d): %s", resp.StatusCode, string(body))
+		return "", fmt.Errorf("AI API returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var aiResp AIResponse
+	if err := json.Unmarshal(body, &aiResp); err != nil {
+		return "", fmt.Errorf("failed to decode AI response: %w", err)
+	}
+	if aiResp.Usage != nil {
+		usage.SetTokens(ctx, &aiResp.Usage.PromptTokens, &aiResp.Usage.CompletionTokens)
+	}
+
+	if len(aiResp.Choices) == 0 {
+		return "", fmt.Errorf("no response from AI")
+	}
+
+	return aiResp.Choices[0].Message.Content, nil
+}
+
+// GeminiRecognizer uses the Gemini API for both vision and spec lookups.
+type GeminiRecognizer struct {
+	client *genai.Client
+	model  string
+}
+
+func NewGeminiRecognizer(ctx context.Context, apiKey, model string) (*GeminiRecognizer, error) {
+	if apiKey == "" {
+		return nil, errors.New("GEMINI_API_KEY not set")
+	}
+	if model == "" {
+		model = defaultGeminiModel
+	}
+
+	client, err := genai.NewClient(ctx, common.NewGeminiConfig(apiKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Gemini client: %w", err)
+	}
+	return &GeminiRecognizer{client: client, model: model}, nil
+}
+
+func (r *GeminiRecognizer) Name() string {
+	return "gemini"
+}
+
+func (r *GeminiRecognizer) IdentifyCar(ctx context.Context, prompt, base64Image, mimeType string) (*CarDetails, error) {
+	imageData, err := base64.StdEncoding.DecodeString(base64Image)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode base64 image: %w", err)
+	}
+
+	content := genai.NewUserContentFromParts([]*genai.Part{
+		genai.NewPartFromText(prompt),
+		genai.NewPartFromBytes(imageData, mimeType),
+	})
+
+	text, err := r.generate(ctx, content, nil)
+	if err != nil {
+		return nil, err
+	}
+	var scanResp ScanImageResponse
+	if err := unmarshalJSONContent(text, &scanResp); err != nil {
+		return nil, err
+	}
+	return scanResp.toCarDetails()
+}
+
+func (r *GeminiRecognizer) IdentifyCarSpecs(ctx context.Context, prompt string) (*CarSpecs, error) {
+	content := genai.NewUserContentFromParts([]*genai.Part{genai.NewPartFromText(prompt)})
+
+	text, err := r.generate(ctx, content, &genai.GenerateContentConfig{
+		ResponseMIMEType: "application/json",
+		ResponseSchema:   specsGeminiSchema(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return parseCarSpecs(ctx, text)
+}
+
+// generate returns the text of the model's reply to content
+func (r *GeminiRecognizer) generate(ctx context.Context, content *genai.Content, config *genai.GenerateContentConfig) (string, error) {
+	usage.SetModel(ctx, r.model)
+	resp, err := r.client.Models.GenerateContent(ctx, r.model, []*genai.Content{content}, config)
+	if err != nil {
+		return "", fmt.Errorf("Gemini request error: %w", err)
+	}
+	if meta := resp.UsageMetadata; meta != nil {
+		usage.SetTokens(ctx, tokenCount(meta.PromptTokenCount), tokenCount(meta.CandidatesTokenCount))
+	}
+
+	text, err := resp.Text()
+	if err != nil {
+		return "", fmt.Errorf("failed to read Gemini response: %w", err)
+	}
+	if text == "" {
+		return "", fmt.Errorf("no response from AI")
+	}
+	return text, nil
+}
+
+func tokenCount(n *int64) *int {
+	if n == nil {
+		return nil
+	}
+	count := int(*n)
+	return &count
+}
+
+// FakeRecognizer is an in-process recognizer for development and tests. With
+// no fields set it identifies every photo as a white 2020 Toyota Corolla.
+type FakeRecognizer struct {
+	Details *CarDetails
+	Specs   *CarSpecs
+	Reject  bool
+	Err     error
+}
+
+func (r *FakeRecognizer) Name() string {
+	return "fake"
+}
+
+func (r *FakeRecognizer) IdentifyCar(ctx context.Context, prompt, base64Image, mimeType string) (*CarDetails, error) {
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	if r.Reject {
+		return nil, common.ErrScanRejected
+	}
+	if r.Details != nil {
+		details := *r.Details
+		return &details, nil
+	}
+	return &CarDetails{
+		Make:  "Toyota",
+		Model: "Corolla",
+		Trim:  "LE",
+		Year:  "2020",
+		Color: "White",
+	}, nil
+}
+
+func (r *FakeRecognizer) IdentifyCarSpecs(ctx context.Context, prompt string) (*CarSpecs, error) {
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	if r.Specs != nil {
+		specs := *r.Specs
+		return &specs, nil
+	}
+	return parseCarSpecs(ctx, `{
+		"horsepower": 139, "torque": 171, "top_speed": 190, "acceleration": 8.9,
+		"engine_type": "I4", "fuel_type": "Gasoline", "displacement": 1.8, "cylinder_count": 4,
+		"forced_induction": false, "hybrid": false, "drivetrain_type": "FWD",
+		"battery_capacity": null, "range": null, "charging_time": null,
+		"transmission_type": "CVT", "gear_count": 1, "curb_weight": 1340,
+		"length": 4630, "width": 1780, "height": 1435, "wheelbase": 2700, "ground_clearance": 135,
+		"body_type": "Sedan", "doors": 4, "wheel_size": 16,
+		"price": 20000, "description": "A dependable compact sedan."
+	}`)
+}
+
+func (r ScanImageResponse) toCarDetails() (*CarDetails, error) {
+	if r.Reject {
+		// Modified error message on scan rejection.
+		return nil, common.ErrScanRejected
+	}
+
+	return &CarDetails{
+		Make:       r.Make,
+		Model:      r.Model,
+		Trim:       r.Trim,
+		Year:       r.Year,
+		Color:      r.Color,
+		Confidence: r.Confidence,
+		Candidates: r.Candidates,
+	}, nil
+}
+
+// unmarshalJSONContent decodes the JSON object embedded in a model reply,
+// ignoring any prose or code fences around it.
+func unmarshalJSONContent(content string, out interface{}) error {
+	// Extract JSON content between curly braces
+	start := strings.Index(content, "{")
+	end := strings.LastIndex(content, "}")
+	if start >= 0 && end > start {
+		content = content[start : end+1]
+	}
+
+	return json.Unmarshal([]byte(content), out)
+}
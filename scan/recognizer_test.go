@@ -0,0 +1,162 @@
+package scan
+
+import (
+	"CarBN/common"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// stubRecognizer counts its calls and answers them with identify
+type stubRecognizer struct {
+	FakeRecognizer
+	name     string
+	calls    int
+	identify func(ctx context.Context) (*CarDetails, error)
+}
+
+func (r *stubRecognizer) Name() string {
+	return r.name
+}
+
+func (r *stubRecognizer) IdentifyCar(ctx context.Context, prompt, base64Image, mimeType string) (*CarDetails, error) {
+	r.calls++
+	if r.identify != nil {
+		return r.identify(ctx)
+	}
+	return r.FakeRecognizer.IdentifyCar(ctx, prompt, base64Image, mimeType)
+}
+
+func failing(err error) func(context.Context) (*CarDetails, error) {
+	return func(context.Context) (*CarDetails, error) { return nil, err }
+}
+
+func hanging(ctx context.Context) (*CarDetails, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func newTestChain(timeout time.Duration, threshold int, cooldown time.Duration, recognizers ...CarRecognizer) *RecognizerChain {
+	chain := &RecognizerChain{}
+	for _, rec := range recognizers {
+		chain.providers = append(chain.providers, &provider{
+			recognizer: rec,
+			timeout:    timeout,
+			breaker:    &circuitBreaker{threshold: threshold, cooldown: cooldown},
+		})
+	}
+	return chain
+}
+
+func TestRecognizerChain(t *testing.T) {
+	down := errors.New("provider down")
+
+	tests := []struct {
+		name       string
+		first      func(context.Context) (*CarDetails, error)
+		wantModel  string
+		wantErr    error
+		wantSecond int
+	}{
+		{"first succeeds", nil, "Corolla", nil, 0},
+		{"falls back after an error", failing(down), "Corolla", nil, 1},
+		{"falls back after a timeout", hanging, "Corolla", nil, 1},
+		{"rejection stops the chain", failing(common.ErrScanRejected), "", common.ErrScanRejected, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := &stubRecognizer{name: "first", identify: tt.first}
+			second := &stubRecognizer{name: "second"}
+			chain := newTestChain(20*time.Millisecond, defaultBreakerThreshold, time.Minute, first, second)
+
+			details, err := chain.IdentifyCar(testContext(), "prompt", "", "image/jpeg")
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if details.Model != tt.wantModel {
+				t.Errorf("model = %q, want %q", details.Model, tt.wantModel)
+			}
+			if second.calls != tt.wantSecond {
+				t.Errorf("second provider called %d times, want %d", second.calls, tt.wantSecond)
+			}
+		})
+	}
+}
+
+func TestRecognizerChainAllFail(t *testing.T) {
+	down := errors.New("provider down")
+	chain := newTestChain(time.Second, defaultBreakerThreshold, time.Minute,
+		&stubRecognizer{name: "first", identify: failing(down)},
+		&stubRecognizer{name: "second", identify: failing(down)})
+
+	_, err := chain.IdentifyCar(testContext(), "prompt", "", "image/jpeg")
+	if !errors.Is(err, down) {
+		t.Fatalf("err = %v, want %v", err, down)
+	}
+	if !errors.Is(err, common.ErrUpstreamFailure) {
+		t.Errorf("err = %v, want an upstream failure", err)
+	}
+}
+
+func TestRecognizerChainCircuitBreaker(t *testing.T) {
+	first := &stubRecognizer{name: "first", identify: failing(errors.New("provider down"))}
+	second := &stubRecognizer{name: "second"}
+	chain := newTestChain(time.Second, 2, 50*time.Millisecond, first, second)
+
+	identify := func() {
+		t.Helper()
+		if _, err := chain.IdentifyCar(testContext(), "prompt", "", "image/jpeg"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// Two failures in a row open the circuit, so the third scan skips it
+	identify()
+	identify()
+	identify()
+	if first.calls != 2 || second.calls != 3 {
+		t.Fatalf("calls = %d, %d, want 2, 3", first.calls, second.calls)
+	}
+
+	// Once the cooldown is over the provider is tried again
+	time.Sleep(60 * time.Millisecond)
+	identify()
+	if first.calls != 3 {
+		t.Errorf("first provider called %d times after the cooldown, want 3", first.calls)
+	}
+
+	// A success closes the circuit and resets the failure count
+	first.identify = nil
+	identify()
+	first.identify = failing(errors.New("provider down"))
+	identify()
+	identify()
+	if first.calls != 6 {
+		t.Errorf("first provider called %d times, want 6", first.calls)
+	}
+}
+
+func TestNewRecognizerFromEnvTimeout(t *testing.T) {
+	t.Setenv("VISION_PROVIDERS", "default,fallback")
+	t.Setenv("AI_REPLAY_MODE", "")
+	t.Setenv("DEFAULT_TIMEOUT", "90s")
+	t.Setenv("FALLBACK_TIMEOUT", "")
+
+	chain := NewRecognizerFromEnv(nil).(*RecognizerChain)
+	want := []time.Duration{90 * time.Second, defaultProviderTimeout}
+	if len(chain.providers) != len(want) {
+		t.Fatalf("got %d providers, want %d", len(chain.providers), len(want))
+	}
+	for i, p := range chain.providers {
+		if p.timeout != want[i] {
+			t.Errorf("provider %d timeout = %s, want %s", i, p.timeout, want[i])
+		}
+		if client := p.recognizer.(*OpenAIRecognizer).client; client.Timeout != want[i] {
+			t.Errorf("provider %d client timeout = %s, want %s", i, client.Timeout, want[i])
+		}
+	}
+}
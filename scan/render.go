@@ -0,0 +1,301 @@
+package scan
+
+import (
+	"CarBN/common"
+	"CarBN/prompts"
+	"CarBN/storage"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Render job statuses. Jobs that run out of attempts are left as dead so they
+// can be inspected and requeued by hand.
+const (
+	RenderStatusPending    = "pending"
+	RenderStatusProcessing = "processing"
+	RenderStatusDone       = "done"
+	RenderStatusDead       = "dead"
+)
+
+const (
+	renderJobLease        = 5 * time.Minute
+	renderJobMaxAttempts  = 5
+	renderJobBaseBackoff  = 30 * time.Second
+	renderJobPollInterval = 5 * time.Second
+)
+
+// enqueueRender queues image generation for a car/color pair within the scan
+// transaction. If a job for the pair is already queued the scan shares it.
+func (s *Service) enqueueRender(ctx context.Context, tx pgx.Tx, carID int, color string) error {
+	_, err := tx.Exec(ctx, `
+		INSERT INTO render_jobs (car_id, color)
+		VALUES ($1, $2)
+		ON CONFLICT (car_id, color) WHERE status IN ('pending', 'processing') DO NOTHING`,
+		carID, strings.ToLower(color),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to enqueue render job: %w", err)
+	}
+	return nil
+}
+
+// signalRender wakes an idle render worker
+func (s *Service) signalRender() {
+	select {
+	case s.renderSignal <- struct{}{}:
+	default:
+	}
+}
+
+// StartRenderWorkers launches n render workers that run until ctx is cancelled
+func (s *Service) StartRenderWorkers(ctx context.Context, n int) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+	logger.Printf("Starting %d render workers", n)
+
+	for i := 0; i < n; i++ {
+		go s.runRenderWorker(ctx)
+	}
+}
+
+func (s *Service) runRenderWorker(ctx context.Context) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+	ticker := time.NewTicker(renderJobPollInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			claimed, err := s.processNextRender(ctx)
+			if err != nil {
+				logger.Printf("Render worker error: %v", err)
+				break
+			}
+			if !claimed {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.renderSignal:
+		case <-ticker.C:
+		}
+	}
+}
+
+// processNextRender claims one due render job and runs it, reporting whether
+// there was a job to claim.
+func (s *Service) processNextRender(ctx context.Context) (bool, error) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+
+	// Jobs whose worker died on the final attempt go straight to the dead letter list
+	if _, err := s.db.Exec(ctx, `
+		UPDATE render_jobs
+		SET status = $1, last_error = 'render was interrupted too many times',
+			finished_at = NOW(), updated_at = NOW()
+		WHERE status = $2 AND attempts >= $3 AND locked_until < NOW()`,
+		RenderStatusDead, RenderStatusProcessing, renderJobMaxAttempts,
+	); err != nil {
+		return false, fmt.Errorf("failed to expire abandoned render jobs: %w", err)
+	}
+
+	var jobID, carID, attempts int
+	var color string
+	err := s.db.QueryRow(ctx, `
+		UPDATE render_jobs
+		SET status = $1, attempts = attempts + 1,
+			locked_until = NOW() + make_interval(secs => $2), updated_at = NOW()
+		WHERE id = (
+			SELECT id FROM render_jobs
+			WHERE (status = $3 AND next_attempt_at <= NOW())
+			   OR (status = $1 AND locked_until < NOW())
+			ORDER BY next_attempt_at
+			FOR UPDATE SKIP LOCKED
+			LIMIT 1
+		)
+		RETURNING id, car_id, color, attempts`,
+		RenderStatusProcessing, renderJobLease.Seconds(), RenderStatusPending,
+	).Scan(&jobID, &carID, &color, &attempts)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to claim render job: %w", err)
+	}
+
+	logger.Printf("Rendering car %d in %s (render job %d, attempt %d)", carID, color, jobID, attempts)
+
+	if renderErr := s.renderCarImage(ctx, carID, color); renderErr != nil {
+		logger.Printf("Render job %d failed: %v", jobID, renderErr)
+
+		if attempts >= renderJobMaxAttempts {
+			logger.Printf("Render job %d exhausted its attempts, moving to dead letter list", jobID)
+			_, err = s.db.Exec(ctx, `
+				UPDATE render_jobs
+				SET status = $1, last_error = $2, locked_until = NULL,
+					finished_at = NOW(), updated_at = NOW()
+				WHERE id = $3`,
+				RenderStatusDead, renderErr.Error(), jobID,
+			)
+		} else {
+			// Exponential backoff: 30s, 1m, 2m, 4m...
+			backoff := renderJobBaseBackoff * time.Duration(1<<(attempts-1))
+			_, err = s.db.Exec(ctx, `
+				UPDATE render_jobs
+				SET status = $1, last_error = $2, locked_until = NULL,
+					next_attempt_at = NOW() + make_interval(secs => $3), updated_at = NOW()
+				WHERE id = $4`,
+				RenderStatusPending, renderErr.Error(), backoff.Seconds(), jobID,
+			)
+		}
+	} else {
+		_, err = s.db.Exec(ctx, `
+			UPDATE render_jobs
+			SET status = $1, last_error = NULL, locked_until = NULL,
+				finished_at = NOW(), updated_at = NOW()
+			WHERE id = $2`,
+			RenderStatusDone, jobID,
+		)
+	}
+	if err != nil {
+		return true, fmt.Errorf("failed to finish render job %d: %w", jobID, err)
+	}
+	return true, nil
+}
+
+// renderCarImage generates and saves the images for a car/color pair, then
+// swaps them in for the placeholder on every user car waiting on them
+func (s *Service) renderCarImage(ctx context.Context, carID int, color string) error {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+
+	var year, make, model, trim string
+	err := s.db.QueryRow(ctx, `
+		SELECT COALESCE(year, ''), make, model, COALESCE(trim, '')
+		FROM cars WHERE id = $1`,
+		carID,
+	).Scan(&year, &make, &model, &trim)
+	if err != nil {
+		return fmt.Errorf("failed to load car %d: %w", carID, err)
+	}
+
+	// A previous job may already have rendered this color
+	imagePaths, err := s.getCarImagePaths(ctx, s.db, carID, color)
+	if err != nil {
+		return err
+	}
+
+	generated := imagePaths == nil
+	promptVersion := ""
+	if generated {
+		prompt, err := s.prompts.Pick(prompts.CarImage)
+		if err != nil {
+			return err
+		}
+		promptVersion = prompt.Ref()
+		text, err := prompt.Render(prompts.Vars{
+			"year":  year,
+			"make":  make,
+			"model": model,
+			"trim":  trim,
+			"color": color,
+		})
+		if err != nil {
+			return err
+		}
+
+		generatedImage, err := s.images.GenerateCarImage(ctx, common.ImageRequest{
+			Prompt: text,
+			CarID:  carID,
+			Year:   year,
+			Make:   make,
+			Model:  model,
+			Trim:   trim,
+			Color:  color,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to generate car image: %w", err)
+		}
+
+		imageData, err := common.DecodeBase64Image(generatedImage)
+		if err != nil {
+			return fmt.Errorf("failed to decode generated image: %w", err)
+		}
+		lowResData, err := storage.Resize(imageData, common.LowResImageSize)
+		if err != nil {
+			return fmt.Errorf("failed to create low res image: %w", err)
+		}
+
+		timestamp := time.Now().UnixNano() / int64(time.Millisecond)
+		colorDir := fmt.Sprintf("%scar_%d/%s", storage.GeneratedPrefix, carID, color)
+		imagePaths = &CarImagePaths{
+			HighRes: fmt.Sprintf("%s/high_res_%d.jpg", colorDir, timestamp),
+			LowRes:  fmt.Sprintf("%s/low_res_%d.jpg", colorDir, timestamp),
+		}
+
+		placeholder, err := storage.SaveImage(ctx, s.store, imagePaths.HighRes, imageData)
+		if err != nil {
+			return fmt.Errorf("failed to save high res image: %w", err)
+		}
+		imagePaths.Placeholder = placeholder
+		if err := storage.PutImage(ctx, s.store, imagePaths.LowRes, lowResData); err != nil {
+			return fmt.Errorf("failed to save low res image: %w", err)
+		}
+
+		// Index the render so photos of it can't be scanned
+		if hash, err := hashImageData(imageData); err != nil {
+			logger.Printf("Warning: failed to hash generated image: %v", err)
+		} else if err := s.indexGeneratedImage(ctx, imagePaths.HighRes, hash); err != nil {
+			logger.Printf("Warning: %v", err)
+		}
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+			logger.Printf("Warning: transaction rollback error: %v", err)
+		}
+	}()
+
+	if generated {
+		// Merge rather than overwrite so other colors of the car are kept
+		if _, err := tx.Exec(ctx, `
+			UPDATE cars
+			SET color_images = COALESCE(color_images, '{}'::jsonb) ||
+				jsonb_build_object($1::text, jsonb_build_object(
+					'high_res', $2::text, 'low_res', $3::text, 'prompt_version', $4::text,
+					'blurhash', $5::text, 'dominant_color', $6::text))
+			WHERE id = $7`,
+			color, imagePaths.HighRes, imagePaths.LowRes, promptVersion,
+			imagePaths.Placeholder.BlurHash, imagePaths.Placeholder.DominantColor, carID,
+		); err != nil {
+			return fmt.Errorf("failed to update car color images: %w", err)
+		}
+	}
+
+	blurHash, dominantColor := imagePaths.Placeholder.Columns()
+	tag, err := tx.Exec(ctx, `
+		UPDATE user_cars
+		SET high_res_image = $1, low_res_image = $2, image_blurhash = $3, image_dominant_color = $4
+		WHERE car_id = $5 AND LOWER(color) = $6 AND high_res_image = $7`,
+		imagePaths.HighRes, imagePaths.LowRes, blurHash, dominantColor, carID, color, common.PlaceholderImagePath,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update user car images: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	logger.Printf("Rendered car %d in %s, updated %d user cars", carID, color, tag.RowsAffected())
+	return nil
+}
@@ -1,73 +1,90 @@
 package scan
 
 import (
+	"CarBN/catalog"
 	"CarBN/common"
 	"CarBN/feed"
+	"CarBN/prompts"
+	"CarBN/rarity"
+	"CarBN/storage"
 	"CarBN/subscription"
-	"bytes"
+	"CarBN/usage"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	_ "image/png"
-	"io"
 	"log"
-	"net/http"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
-	"unicode"
 
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 )
 
+// defaultSyncScanTimeout caps how long POST /scan waits on a scan. Slower
+// scans fail, and clients that can wait longer should submit a job instead.
+const defaultSyncScanTimeout = 90 * time.Second
+
 type CarImagePaths struct {
-	LowRes  string
-	HighRes string
+	LowRes      string
+	HighRes     string
+	Placeholder *storage.Placeholder // nil until the backfill has computed it
 }
 
 type Service struct {
 	db                  *pgxpool.Pool
 	feedService         *feed.Service
 	subscriptionService *subscription.SubscriptionService
-	defaultAPIKey       string
-	defaultBaseURL      string
-	fallbackAPIKey      string
-	fallbackBaseURL     string
-	defaultChatModel    string
-	defaultVisionModel  string
-	fallbackChatModel   string
-	fallbackVisionModel string
-	client              *http.Client
-	scanSaveDir         string
-	generatedSaveDir    string
+	catalog             *catalog.Service
+	rarity              *rarity.Service
+	recognizer          CarRecognizer
+	prompts             *prompts.Registry
+	images              common.ImageGenerator
+	store               storage.BlobStore
+	signer              *storage.URLSigner
+	jobSignal           chan struct{}
+	renderSignal        chan struct{}
+	phashThreshold      int
+	exifPolicy          ExifPolicy
+	confidenceThreshold float64
+	maxCandidates       int
+	confirmationTTL     time.Duration
+	maxUploadBytes      int64
+	maxVisionDimension  int
+	requireTwoPhotos    bool
+	backfillSignal      chan struct{}
+	specBackfillDelay   time.Duration
+	syncScanTimeout     time.Duration
 }
 
 type car struct {
-	ID             int     `json:"id"`
-	UserCarID      int     `json:"user_car_id"`
-	UserID         int     `json:"user_id"`
-	Make           string  `json:"make"`
-	Model          string  `json:"model"`
-	Year           string  `json:"year"`
-	Color          string  `json:"color"`
-	Trim           string  `json:"trim,omitempty"`
-	Horsepower     int     `json:"horsepower"`
-	Torque         int     `json:"torque"`
-	TopSpeed       int     `json:"top_speed"`
-	Acceleration   float64 `json:"acceleration"`
-	EngineType     string  `json:"engine_type"`
-	DrivetrainType string  `json:"drivetrain_type"`
-	CurbWeight     float64 `json:"curb_weight"`
-	Price          int     `json:"price"`
-	Description    string  `json:"description"`
-	Rarity         int     `json:"rarity"`
-	LowResImage    string  `json:"low_res_image"`
-	HighResImage   string  `json:"high_res_image"`
-	DateCollected  string  `json:"date_collected"`
+	ID                int                  `json:"id"`
+	UserCarID         int                  `json:"user_car_id"`
+	UserID            int                  `json:"user_id"`
+	Make              string               `json:"make"`
+	Model             string               `json:"model"`
+	Year              string               `json:"year"`
+	Color             string               `json:"color"`
+	Trim              string               `json:"trim,omitempty"`
+	Horsepower        int                  `json:"horsepower"`
+	Torque            int                  `json:"torque"`
+	TopSpeed          int                  `json:"top_speed"`
+	Acceleration      float64              `json:"acceleration"`
+	EngineType        string               `json:"engine_type"`
+	DrivetrainType    string               `json:"drivetrain_type"`
+	CurbWeight        float64              `json:"curb_weight"`
+	Price             int                  `json:"price"`
+	Description       string               `json:"description"`
+	Rarity            int                  `json:"rarity"`
+	RarityExplanation *rarity.Explanation  `json:"rarity_explanation,omitempty"`
+	LowResImage       string               `json:"low_res_image"`
+	HighResImage      string               `json:"high_res_image"`
+	ImageVariants     *storage.VariantURLs `json:"image_variants,omitempty"`
+	ImagePlaceholder  *storage.Placeholder `json:"image_placeholder,omitempty"`
+	DateCollected     string               `json:"date_collected"`
+	catalog.Specs
 }
 
 type AIResponse struct {
@@ -76,271 +93,427 @@ type AIResponse struct {
 			Content string `json:"content"`
 		} `json:"message"`
 	} `json:"choices"`
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
 }
 
 type CarDetails struct {
-	Make           string  `json:"make"`
-	Model          string  `json:"model"`
-	Year           string  `json:"year"`
-	Color          string  `json:"color"`
-	Trim           string  `json:"trim"`
-	Horsepower     string  `json:"horsepower"`
-	Torque         string  `json:"torque"`
-	TopSpeed       string  `json:"top_speed"`
-	Acceleration   string  `json:"acceleration"`
-	EngineType     string  `json:"engine_type"`
-	DrivetrainType string  `json:"drivetrain_type"`
-	CurbWeight     string  `json:"curb_weight"`
-	Price          string  `json:"price"`
-	Description    string  `json:"description"`
-	Rarity         *string `json:"rarity"`
+	Make  string `json:"make"`
+	Model string `json:"model"`
+	Year  string `json:"year"`
+	Color string `json:"color"`
+	Trim  string `json:"trim"`
+
+	// Set by IdentifyCar. Confidence is nil when the provider didn't report one.
+	Confidence *float64       `json:"confidence,omitempty"`
+	Candidates []CarCandidate `json:"candidates,omitempty"`
 }
 
 type ScanImageResponse struct {
-	Make   string `json:"make"`
-	Model  string `json:"model"`
-	Trim   string `json:"trim"`
-	Year   string `json:"year"`
-	Color  string `json:"color"`
-	Reject bool   `json:"reject"`
+	Make       string         `json:"make"`
+	Model      string         `json:"model"`
+	Trim       string         `json:"trim"`
+	Year       string         `json:"year"`
+	Color      string         `json:"color"`
+	Confidence *float64       `json:"confidence"`
+	Candidates []CarCandidate `json:"candidates"`
+	Reject     bool           `json:"reject"`
 }
 type ChatMessage struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
 }
 type ChatPayload struct {
-	Model    string        `json:"model"`
-	Messages []ChatMessage `json:"messages"`
+	Model          string        `json:"model"`
+	Messages       []ChatMessage `json:"messages"`
+	ResponseFormat interface{}   `json:"response_format,omitempty"`
 }
 
-func NewService(db *pgxpool.Pool, feedService *feed.Service, subscriptionService *subscription.SubscriptionService) *Service {
-	defaultAPIKey := os.Getenv("DEFAULT_API_KEY")
-	defaultBaseURL := os.Getenv("DEFAULT_BASE_URL")
-	fallbackAPIKey := os.Getenv("FALLBACK_API_KEY")
-	fallbackBaseURL := os.Getenv("FALLBACK_BASE_URL")
-	defaultChatModel := os.Getenv("DEFAULT_CHAT_MODEL")
-	defaultVisionModel := os.Getenv("DEFAULT_VISION_MODEL")
-	fallbackChatModel := os.Getenv("FALLBACK_CHAT_MODEL")
-	fallbackVisionModel := os.Getenv("FALLBACK_VISION_MODEL")
-	scanSaveDir := os.Getenv("SCAN_SAVE_DIR")
-	generatedSaveDir := os.Getenv("GENERATED_SAVE_DIR")
-
-	// Add logging to verify environment variables
-	log.Printf("Environment variables loaded:")
-	log.Printf("SCAN_SAVE_DIR: %s", scanSaveDir)
-	log.Printf("GENERATED_SAVE_DIR: %s", generatedSaveDir)
-
-	// Verify directories exist and are accessible
-	if generatedSaveDir != "" {
-		if err := os.MkdirAll(generatedSaveDir, 0750); err != nil {
-			log.Printf("Warning: Failed to create GENERATED_SAVE_DIR: %v", err)
+func NewService(db *pgxpool.Pool, feedService *feed.Service, subscriptionService *subscription.SubscriptionService, catalogService *catalog.Service, rarityService *rarity.Service, recognizer CarRecognizer, promptRegistry *prompts.Registry, images common.ImageGenerator, store storage.BlobStore, signer *storage.URLSigner) *Service {
+	// A negative threshold turns off the recycled image check; hashes are still stored
+	phashThreshold := defaultPHashThreshold
+	if v := os.Getenv("SCAN_PHASH_THRESHOLD"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			phashThreshold = n
+		} else {
+			log.Printf("Warning: invalid SCAN_PHASH_THRESHOLD %q, using %d", v, defaultPHashThreshold)
 		}
-	} else {
-		log.Printf("Warning: GENERATED_SAVE_DIR is empty")
 	}
 
-	if scanSaveDir != "" {
-		if err := os.MkdirAll(scanSaveDir, 0750); err != nil {
-			log.Printf("Warning: Failed to create SCAN_SAVE_DIR: %v", err)
+	// Scans below the confidence threshold wait for the user to pick a
+	// candidate; 0 turns confirmation off
+	confidenceThreshold := defaultConfidenceThreshold
+	if v := os.Getenv("SCAN_CONFIDENCE_THRESHOLD"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f >= 0 && f <= 1 {
+			confidenceThreshold = f
+		} else {
+			log.Printf("Warning: invalid SCAN_CONFIDENCE_THRESHOLD %q, using %.2f", v, defaultConfidenceThreshold)
 		}
 	}
+	maxCandidates := defaultMaxCandidates
+	if v, err := strconv.Atoi(os.Getenv("SCAN_MAX_CANDIDATES")); err == nil && v > 0 {
+		maxCandidates = v
+	}
+	confirmationTTL := defaultConfirmationTTL
+	if v, err := time.ParseDuration(os.Getenv("SCAN_CONFIRMATION_TTL")); err == nil && v > 0 {
+		confirmationTTL = v
+	}
 
-	client := &http.Client{
-		Timeout: 60 * time.Second,
+	maxUploadBytes := int64(defaultMaxUploadBytes)
+	if v, err := strconv.Atoi(os.Getenv("SCAN_MAX_UPLOAD_MB")); err == nil && v > 0 {
+		maxUploadBytes = int64(v) << 20
+	}
+	// Photos are downscaled to this many pixels on their longest side before
+	// they're sent to the vision model; 0 sends them as uploaded
+	maxVisionDimension := defaultMaxVisionDimension
+	if v, err := strconv.Atoi(os.Getenv("SCAN_MAX_IMAGE_DIMENSION")); err == nil && v >= 0 {
+		maxVisionDimension = v
+	}
+	requireTwoPhotos, _ := strconv.ParseBool(os.Getenv("SCAN_REQUIRE_TWO_PHOTOS"))
+	specBackfillDelay := defaultSpecBackfillDelay
+	if v, err := time.ParseDuration(os.Getenv("SPEC_BACKFILL_DELAY")); err == nil && v >= 0 {
+		specBackfillDelay = v
+	}
+	syncScanTimeout := defaultSyncScanTimeout
+	if v, err := time.ParseDuration(os.Getenv("SCAN_SYNC_TIMEOUT")); err == nil && v > 0 {
+		syncScanTimeout = v
 	}
+
 	return &Service{
 		db:                  db,
 		feedService:         feedService,
 		subscriptionService: subscriptionService,
-		defaultAPIKey:       defaultAPIKey,
-		defaultBaseURL:      defaultBaseURL,
-		fallbackAPIKey:      fallbackAPIKey,
-		fallbackBaseURL:     fallbackBaseURL,
-		defaultChatModel:    defaultChatModel,
-		defaultVisionModel:  defaultVisionModel,
-		fallbackChatModel:   fallbackChatModel,
-		fallbackVisionModel: fallbackVisionModel,
-		client:              client,
-		scanSaveDir:         scanSaveDir,
-		generatedSaveDir:    generatedSaveDir,
+		catalog:             catalogService,
+		rarity:              rarityService,
+		recognizer:          recognizer,
+		prompts:             promptRegistry,
+		images:              images,
+		store:               store,
+		signer:              signer,
+		jobSignal:           make(chan struct{}, 1),
+		renderSignal:        make(chan struct{}, 1),
+		phashThreshold:      phashThreshold,
+		exifPolicy:          NewExifPolicyFromEnv(),
+		confidenceThreshold: confidenceThreshold,
+		maxCandidates:       maxCandidates,
+		confirmationTTL:     confirmationTTL,
+		maxUploadBytes:      maxUploadBytes,
+		maxVisionDimension:  maxVisionDimension,
+		requireTwoPhotos:    requireTwoPhotos,
+		backfillSignal:      make(chan struct{}, 1),
+		specBackfillDelay:   specBackfillDelay,
+		syncScanTimeout:     syncScanTimeout,
 	}
 }
 
-func (s *Service) ScanImage(ctx context.Context, userID int, base64Image string) (*car, error) {
-	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+// ScanResult is either a scanned car or, when the vision model wasn't
+// confident enough, a scan waiting for the user to pick the right car
+type ScanResult struct {
+	Car     *car
+	Pending *PendingScan
+}
 
-	hasCredits, err := s.subscriptionService.HasScanCredits(ctx, userID)
+// scanHooks let a scan job follow the scan it runs. Either may be nil.
+type scanHooks struct {
+	// progress is called as the scan enters each stage
+	progress func(stage string)
+	// complete runs in the transaction that adds the car to the collection,
+	// so whatever it records commits if and only if the car is added
+	complete func(ctx context.Context, tx pgx.Tx, userCarID int) error
+}
+
+func (h scanHooks) enter(stage string) {
+	if h.progress != nil {
+		h.progress(stage)
+	}
+}
+
+// ScanImage scans a car from one photo, or from two photos of it taken from
+// different angles when second isn't nil
+func (s *Service) ScanImage(ctx context.Context, userID int, upload, second *Upload) (*ScanResult, error) {
+	if second == nil && s.requireTwoPhotos {
+		return nil, common.ErrSecondPhotoRequired
+	}
+
+	reservationID, err := s.reserveScanCredit(ctx, userID, upload)
 	if err != nil {
-		logger.Printf("Failed to check scan credits: %v", err)
-		return nil, fmt.Errorf("failed to check scan credits: %w", err)
+		return nil, err
 	}
-	if !hasCredits {
-		return nil, fmt.Errorf("no scan credits remaining")
+
+	var secondPhoto *scanPhoto
+	if second != nil {
+		secondPhoto = s.prepareScanPhoto(ctx, second)
 	}
+	return s.processScan(ctx, userID, reservationID, s.prepareScanPhoto(ctx, upload), secondPhoto, scanHooks{})
+}
 
-	tx, err := s.db.Begin(ctx)
+// reserveScanCredit holds a credit for a scan that's starting, recording the
+// scan as failed when the user has none left
+func (s *Service) reserveScanCredit(ctx context.Context, userID int, upload *Upload) (int, error) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+
+	reservationID, err := s.subscriptionService.ReserveScanCredit(ctx, userID)
 	if err != nil {
-		logger.Printf("Failed to begin transaction: %v", err)
-		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+		if errors.Is(err, common.ErrNoScanCredits) {
+			err = withOutcome(ScanOutcomeNoCredits, err)
+			s.recordFailedScan(ctx, userID, upload, &scanAttempt{}, err)
+			return 0, err
+		}
+		logger.Printf("Failed to reserve scan credit: %v", err)
+		return 0, fmt.Errorf("failed to reserve scan credit: %w", err)
 	}
+	return reservationID, nil
+}
 
+// releaseScanCredit hands back the credit of a scan that didn't add a car
+func (s *Service) releaseScanCredit(ctx context.Context, reservationID int) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+
+	releaseCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	if err := s.subscriptionService.ReleaseScanCredit(releaseCtx, reservationID); err != nil {
+		logger.Printf("Warning: failed to release scan credit %d: %v", reservationID, err)
+	}
+}
+
+// processScan runs the full scan pipeline, reporting each stage it enters to
+// hooks so asynchronous jobs can expose it to clients. Every outcome,
+// successful or not, ends up in scan_history; a scan awaiting confirmation is
+// recorded once it's confirmed. The credit reserved for the scan is spent if
+// the car is added and released otherwise.
+func (s *Service) processScan(ctx context.Context, userID, reservationID int, photo, second *scanPhoto, hooks scanHooks) (result *ScanResult, err error) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+	ctx = usage.WithUser(ctx, userID)
+
+	attempt := &scanAttempt{}
 	defer func() {
-		if err := tx.Rollback(ctx); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
-			logger.Printf("Warning: transaction rollback error: %v", err)
+		if err != nil && !attempt.recorded {
+			s.recordFailedScan(ctx, userID, photo.Upload, attempt, err)
+		}
+		if err != nil || result.Pending != nil {
+			s.releaseScanCredit(ctx, reservationID)
 		}
 	}()
 
-	carDetails, err := s.identifyCar(ctx, base64Image)
-	if err != nil {
-		// Record failed scan in history if it's a rejection
-		if err.Error() == common.RejectedScanError {
-			scanPath := fmt.Sprintf("user_%d/rejected_scan_%d.jpg", userID, time.Now().Unix())
-			if s.scanSaveDir != "" {
-				if saveErr := s.saveImage(base64Image, s.scanSaveDir, scanPath); saveErr != nil {
-					logger.Printf("Warning: failed to save rejected scan: %v", saveErr)
-				}
-			}
-			// if recordErr := s.recordScanHistory(ctx, tx, userID, 0, "", scanPath, false, err.Error()); recordErr != nil {
-			// 	logger.Printf("Warning: failed to record scan history: %v", recordErr)
-			// }
-			// if commitErr := tx.Commit(ctx); commitErr != nil {
-			// 	logger.Printf("Warning: failed to commit rejected scan history: %v", commitErr)
-			// }
+	// Catch recycled and doctored photos before spending an AI call on them
+	evidence := s.inspectScanImage(ctx, photo.Data)
+	if second != nil {
+		evidence.second = s.inspectScanImage(ctx, second.Data)
+		for _, violation := range evidence.second.violations {
+			evidence.violations = append(evidence.violations, "second photo: "+violation)
 		}
-		logger.Printf("Failed to identify car: %v", err)
-		return nil, err
 	}
+	attempt.evidence = evidence
 
-	// Check for duplicate scans
-	if err := s.checkForDuplicateScan(ctx, tx, userID, carDetails.Make, carDetails.Model, carDetails.Trim, carDetails.Year); err != nil {
-		logger.Printf("Duplicate scan check failed: %v", err)
+	if err := s.checkRecycledImages(ctx, userID, evidence, 0); err != nil {
 		return nil, err
 	}
 
-	// Continue with the existing scan logic
-	carID, err := s.fetchOrCreateCar(ctx, tx, carDetails)
+	if second != nil {
+		if err := s.checkDistinctPhotos(photo.Upload, second.Upload, evidence); err != nil {
+			logger.Printf("Rejecting two-photo scan for user %d: %v", userID, err)
+			return nil, err
+		}
+	}
+
+	if len(evidence.violations) > 0 {
+		reason := "exif: " + strings.Join(evidence.violations, "; ")
+		if s.exifPolicy.Action == ExifPolicyReject {
+			logger.Printf("Rejecting scan for user %d: %s", userID, reason)
+			return nil, withOutcomeDetail(ScanOutcomeExifRejected, reason, common.ErrScanMetadataRejected)
+		}
+		logger.Printf("Flagging scan for user %d: %s", userID, reason)
+	}
+
+	// Record the prompt version before identifying, so rejections count
+	// towards it too
+	prompt, err := s.prompts.Pick(prompts.ScanImage)
+	if err != nil {
+		return nil, err
+	}
+	attempt.promptVersion = prompt.Ref()
+	promptText, err := prompt.Render(nil)
 	if err != nil {
-		logger.Printf("Failed to fetch or create car: %v", err)
-		return nil, fmt.Errorf("fetchOrCreateCar failed: %w", err)
+		return nil, err
 	}
 
-	imagePaths, err := s.getCarImagePaths(ctx, tx, carID, carDetails.Color)
+	hooks.enter(ScanStageIdentifying)
+	carDetails, err := s.identifyScan(ctx, promptText, photo, second)
 	if err != nil {
-		logger.Printf("Failed to get car image paths for car ID %d: %v", carID, err)
-		return nil, fmt.Errorf("failed to get car image paths: %w", err)
+		return nil, err
 	}
+	attempt.color = carDetails.Color
 
-	var highResPath, lowResPath string
-	if imagePaths == nil {
-		logger.Printf("Generating new images for car ID %d", carID)
-		generatedImage, err := common.GenerateCarImage(ctx, carDetails.Year, carDetails.Make, carDetails.Model, carDetails.Trim, carDetails.Color, false, "")
+	// When the model isn't sure, let the user pick the right car before a
+	// credit is spent on it. The credit is reserved again on confirmation.
+	candidates := rankCandidates(carDetails, s.maxCandidates)
+	if candidates[0].Confidence < s.confidenceThreshold {
+		logger.Printf("Low confidence scan for user %d (%.2f), awaiting confirmation", userID, candidates[0].Confidence)
+		pending, err := s.createPendingScan(ctx, userID, photo.Upload, second.upload(), carDetails.Color, candidates, evidence, attempt.promptVersion)
 		if err != nil {
-			logger.Printf("Failed to generate car image: %v", err)
-			return nil, fmt.Errorf("failed to generate car image: %w", err)
+			logger.Printf("Failed to create pending scan: %v", err)
+			return nil, err
 		}
+		return &ScanResult{Pending: pending}, nil
+	}
 
-		// Create a timestamp for unique filenames
-		timestamp := time.Now().UnixNano() / int64(time.Millisecond)
+	scanned, err := s.completeScan(ctx, userID, reservationID, photo.Upload, second.upload(), candidates[0].toCarDetails(carDetails.Color), attempt, hooks)
+	if err != nil {
+		return nil, err
+	}
+	return &ScanResult{Car: scanned}, nil
+}
+
+// completeScan adds an identified car to the user's collection and spends the
+// reserved scan credit in the same transaction, along with hooks.complete.
+// attempt must carry the scan's evidence; second is nil for single photo scans.
+func (s *Service) completeScan(ctx context.Context, userID, reservationID int, upload, second *Upload, carDetails *CarDetails, attempt *scanAttempt, hooks scanHooks) (*car, error) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+	evidence := attempt.evidence
+
+	// Map the model's names onto the catalog, so "BMW 330i" and
+	// "BMW 3 Series 330i" are the same car
+	identity, err := s.catalog.Normalize(ctx, s.db, catalog.Identity{
+		Make:  carDetails.Make,
+		Model: carDetails.Model,
+		Trim:  carDetails.Trim,
+		Year:  carDetails.Year,
+	})
+	if err != nil {
+		logger.Printf("Failed to normalize car details: %v", err)
+		return nil, fmt.Errorf("failed to normalize car details: %w", err)
+	}
 
-		// Define relative paths for database storage - now including 'generated' in the path and timestamp
-		colorDir := fmt.Sprintf("car_%d/%s", carID, strings.ToLower(carDetails.Color))
-		highResFileName := fmt.Sprintf("high_res_%d.jpg", timestamp)
-		lowResFileName := fmt.Sprintf("low_res_%d.jpg", timestamp)
-		highResPath = filepath.Join("generated", colorDir, highResFileName)
-		lowResPath = filepath.Join("generated", colorDir, lowResFileName)
+	// The specs of a new car come from the AI, so they're fetched before the
+	// transaction opens rather than holding it for the call
+	carID, specs, err := s.fetchCarOrSpecs(ctx, identity, hooks.enter)
+	if err != nil {
+		logger.Printf("Failed to fetch car: %v", err)
+		return nil, fmt.Errorf("failed to fetch car: %w", err)
+	}
 
-		// Use full paths for actual file saving
-		// fullHighResPath := filepath.Join(s.generatedSaveDir, colorDir, highResFileName)
-		fullLowResPath := filepath.Join(s.generatedSaveDir, colorDir, lowResFileName)
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		logger.Printf("Failed to begin transaction: %v", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
 
-		// Save using full paths
-		if err := s.saveImage(generatedImage, s.generatedSaveDir, filepath.Join(colorDir, highResFileName)); err != nil {
-			logger.Printf("Failed to save high res image: %v", err)
-			return nil, fmt.Errorf("failed to save high res image: %w", err)
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+			logger.Printf("Warning: transaction rollback error: %v", err)
 		}
+	}()
 
-		if err := s.saveLowResImage(generatedImage, fullLowResPath); err != nil {
-			logger.Printf("Failed to save low res image: %v", err)
-			return nil, fmt.Errorf("failed to save low res image: %w", err)
+	if carID == 0 {
+		carID, err = s.createCar(ctx, tx, identity, specs)
+		if err != nil {
+			logger.Printf("Failed to create car: %v", err)
+			return nil, fmt.Errorf("failed to create car: %w", err)
 		}
+	}
+	attempt.carID = &carID
 
-		colorImages := make(map[string]map[string]string)
-		colorImages[strings.ToLower(carDetails.Color)] = map[string]string{
-			"high_res": highResPath,
-			"low_res":  lowResPath,
+	// Check for duplicate scans
+	if err := s.checkForDuplicateScan(ctx, tx, userID, carID); err != nil {
+		logger.Printf("Duplicate scan check failed: %v", err)
+		if errors.Is(err, common.ErrDuplicateScan) {
+			return nil, withOutcomeDetail(ScanOutcomeDuplicate, fmt.Sprintf("%s: %s %s %s %s",
+				err.Error(), identity.Year, identity.Make, identity.Model, identity.Trim), err)
 		}
+		return nil, err
+	}
 
-		if _, err := tx.Exec(ctx, "UPDATE cars SET color_images = $1 WHERE id = $2",
-			colorImages, carID); err != nil {
-			logger.Printf("Failed to update car color images: %v", err)
-			return nil, fmt.Errorf("failed to update car color images: %w", err)
+	imagePaths, err := s.getCarImagePaths(ctx, tx, carID, carDetails.Color)
+	if err != nil {
+		logger.Printf("Failed to get car image paths for car ID %d: %v", carID, err)
+		return nil, fmt.Errorf("failed to get car image paths: %w", err)
+	}
+
+	// New colors get a placeholder until the render queue has generated the
+	// image, so a flaky image backend can't fail the scan
+	highResPath, lowResPath := common.PlaceholderImagePath, common.PlaceholderImagePath
+	var placeholder *storage.Placeholder
+	queuedRender := false
+	if imagePaths == nil {
+		logger.Printf("Queueing image render for car ID %d", carID)
+		if err := s.enqueueRender(ctx, tx, carID, carDetails.Color); err != nil {
+			logger.Printf("Failed to queue image render: %v", err)
+			return nil, withOutcome(ScanOutcomeImageGenError, err)
 		}
+		queuedRender = true
 	} else {
 		logger.Printf("Using existing images for car ID %d", carID)
 		highResPath = imagePaths.HighRes
 		lowResPath = imagePaths.LowRes
+		placeholder = imagePaths.Placeholder
 	}
 
+	blurHash, dominantColor := placeholder.Columns()
 	var userCarID int
 	err = tx.QueryRow(ctx,
-		`INSERT INTO user_cars (user_id, car_id, color, high_res_image, low_res_image)
-		 VALUES ($1, $2, $3, $4, $5)
+		`INSERT INTO user_cars (user_id, car_id, color, high_res_image, low_res_image, image_blurhash, image_dominant_color)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)
 		 RETURNING id`,
-		userID, carID, carDetails.Color, highResPath, lowResPath,
+		userID, carID, carDetails.Color, highResPath, lowResPath, blurHash, dominantColor,
 	).Scan(&userCarID)
 	if err != nil {
 		logger.Printf("Failed to create user_cars entry: %v", err)
 		return nil, fmt.Errorf("failed to create user_cars entry: %w", err)
 	}
 
-	if s.scanSaveDir != "" {
-		scanPath := fmt.Sprintf("user_%d/scan_%d.jpg", userID, userCarID)
-		if err := s.saveImage(base64Image, s.scanSaveDir, scanPath); err != nil {
-			logger.Printf("Warning: failed to save original scan: %v", err)
+	scanPath := fmt.Sprintf("%suser_%d/scan_%d%s", storage.ScansPrefix, userID, userCarID, upload.extension())
+	if err := s.store.Put(ctx, scanPath, upload.Data, upload.ContentType); err != nil {
+		logger.Printf("Warning: failed to save original scan: %v", err)
+	}
+
+	secondScanPath := ""
+	if second != nil {
+		secondScanPath = fmt.Sprintf("%suser_%d/scan_%d_2%s", storage.ScansPrefix, userID, userCarID, second.extension())
+		if err := s.store.Put(ctx, secondScanPath, second.Data, second.ContentType); err != nil {
+			logger.Printf("Warning: failed to save second scan photo: %v", err)
 		}
 	}
 
 	// Record successful scan in history
-	scanPath := fmt.Sprintf("user_%d/scan_%d.jpg", userID, userCarID)
-	if err := s.recordScanHistory(ctx, tx, userID, carID, carDetails.Color, scanPath, true, ""); err != nil {
+	if err := s.recordScanHistory(ctx, tx, userID, carID, carDetails.Color, scanPath, secondScanPath, evidence, attempt.promptVersion); err != nil {
 		logger.Printf("Failed to record scan history: %v", err)
 		return nil, fmt.Errorf("failed to record scan history: %w", err)
 	}
 
+	if err := s.subscriptionService.CaptureScanCredit(ctx, tx, reservationID, fmt.Sprintf("user_car:%d", userCarID)); err != nil {
+		logger.Printf("Failed to capture scan credit: %v", err)
+		if errors.Is(err, common.ErrNoScanCredits) {
+			return nil, withOutcome(ScanOutcomeNoCredits, err)
+		}
+		return nil, fmt.Errorf("failed to capture scan credit: %w", err)
+	}
+
+	if hooks.complete != nil {
+		if err := hooks.complete(ctx, tx, userCarID); err != nil {
+			logger.Printf("Failed to record scan completion: %v", err)
+			return nil, fmt.Errorf("failed to record scan completion: %w", err)
+		}
+	}
+
 	if err := tx.Commit(ctx); err != nil {
 		logger.Printf("Failed to commit transaction: %v", err)
 		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
+	attempt.recorded = true
+
+	if queuedRender {
+		s.signalRender()
+	}
 
 	// Fetch the complete car details using the main database connection
-	var result car
-	var dateCollected time.Time
-	err = s.db.QueryRow(ctx, `
-		SELECT c.id, uc.id, c.make, c.model, c.year, uc.color, c.trim,
-			c.horsepower, c.torque, c.top_speed, c.acceleration,
-			c.engine_type, c.drivetrain_type, c.curb_weight,
-			c.price, c.description, c.rarity,
-			uc.low_res_image, uc.high_res_image, uc.date_collected
-		FROM cars c
-		JOIN user_cars uc ON c.id = uc.car_id
-		WHERE uc.id = $1`, userCarID).Scan(
-		&result.ID, &result.UserCarID, &result.Make, &result.Model,
-		&result.Year, &result.Color, &result.Trim, &result.Horsepower,
-		&result.Torque, &result.TopSpeed, &result.Acceleration,
-		&result.EngineType, &result.DrivetrainType, &result.CurbWeight,
-		&result.Price, &result.Description, &result.Rarity,
-		&result.LowResImage, &result.HighResImage, &dateCollected)
+	result, err := s.getScannedCar(ctx, userCarID)
 	if err != nil {
 		logger.Printf("Failed to fetch complete car details: %v", err)
-		return nil, fmt.Errorf("failed to fetch complete car details: %w", err)
+		return nil, err
 	}
 
-	// Set the UserID in the result
-	result.UserID = userID
-
-	// Format the date using common.FormatTimestamp
-	result.DateCollected = common.FormatTimestamp(dateCollected)
-
 	if result.Rarity >= 4 {
 		// Create feed entry after successful transaction
 		err = s.feedService.CreateFeed(ctx, userID, "car_scanned", userCarID, 0)
@@ -349,311 +522,158 @@ func (s *Service) ScanImage(ctx context.Context, userID int, base64Image string)
 		}
 	}
 
-	// Deduct scan credit after successful car creation
-	if err := s.subscriptionService.DeductScanCredit(ctx, userID); err != nil {
-		logger.Printf("Failed to deduct scan credit: %v", err)
-		return nil, fmt.Errorf("failed to deduct scan credit: %w", err)
-	}
-
 	logger.Printf("Successfully created scan entry for user %d, car ID %d", userID, carID)
-	return &result, nil
+	return result, nil
 }
 
-func (s *Service) identifyCar(ctx context.Context, base64Image string) (*CarDetails, error) {
-	carDetails, err := s.callVisionAPI(ctx, s.defaultBaseURL, s.defaultAPIKey, s.defaultVisionModel, base64Image)
-	if err == nil {
-		return carDetails, nil
-	}
-	// If scan rejected, return error immediately.
-	if err.Error() == common.RejectedScanError {
-		return nil, err
-	}
-	log.Printf("Default AI request failed: %v, falling back to Fallback AI", err)
-	carDetails, err = s.callVisionAPI(ctx, s.fallbackBaseURL, s.fallbackAPIKey, s.fallbackVisionModel, base64Image)
-	if err != nil {
-		// Ensure error is properly formatted as JSON
-		if err.Error() == common.RejectedScanError {
-			return nil, errors.New(common.RejectedScanError)
-		}
-		log.Printf("Failed to identify car: %v", err)
-		return nil, fmt.Errorf(`{"error": "Failed to identify car: %s"}`, err.Error())
-	}
-	return carDetails, nil
-}
-
-func (s *Service) identifyCarDetails(ctx context.Context, make string, model string, trim string, year string) (*CarDetails, error) {
-	carDetails, err := s.callChatAPI(ctx, s.defaultBaseURL, s.defaultAPIKey, s.defaultChatModel, make, model, trim, year)
-	if err == nil {
-		return carDetails, nil
-	}
-
-	log.Printf("OpenAI request failed (details): %v, falling back to XAI", err)
-	return s.callChatAPI(ctx, s.fallbackBaseURL, s.fallbackAPIKey, s.fallbackChatModel, make, model, trim, year)
-}
-
-func (s *Service) callVisionAPI(ctx context.Context, baseURL, apiKey, model, base64Image string) (*CarDetails, error) {
-	payload := struct {
-		Model    string        `json:"model"`
-		Messages []interface{} `json:"messages"`
-	}{
-		Model: model,
-		Messages: []interface{}{
-			map[string]interface{}{
-				"role": "user",
-				"content": []interface{}{
-					map[string]interface{}{
-						"type": "text",
-						"text": common.SCAN_IMAGE,
-					},
-					map[string]interface{}{
-						"type": "image_url",
-						"image_url": map[string]string{
-							"url":    fmt.Sprintf("data:image/jpeg;base64,%s", base64Image),
-							"detail": "high",
-						},
-					},
-				},
-			},
-		},
-	}
-
-	payloadBytes, err := json.Marshal(payload)
+// getScannedCar loads the car card for a user_cars row created by a scan, in
+// the units its owner prefers
+func (s *Service) getScannedCar(ctx context.Context, userCarID int) (*car, error) {
+	var result car
+	var dateCollected time.Time
+	var units string
+	var blurHash, dominantColor *string
+	err := s.db.QueryRow(ctx, `
+		SELECT c.id, uc.id, uc.user_id, c.make, c.model, c.year, uc.color, c.trim,
+			COALESCE(c.horsepower, 0), COALESCE(c.torque, 0), COALESCE(c.top_speed, 0), COALESCE(c.acceleration, 0),
+			COALESCE(c.engine_type, ''), COALESCE(c.drivetrain_type, ''), COALESCE(c.curb_weight, 0),
+			COALESCE(c.price, 0), COALESCE(c.description, ''), c.rarity, c.rarity_explanation,
+			uc.low_res_image, uc.high_res_image, uc.image_blurhash, uc.image_dominant_color, uc.date_collected,
+			COALESCE(u.unit_preference, '`+catalog.DefaultUnits+`'), `+catalog.SpecColumns+`
+		FROM cars c
+		JOIN user_cars uc ON c.id = uc.car_id
+		LEFT JOIN users u ON u.id = uc.user_id
+		WHERE uc.id = $1`, userCarID).Scan(append([]interface{}{
+		&result.ID, &result.UserCarID, &result.UserID, &result.Make, &result.Model,
+		&result.Year, &result.Color, &result.Trim, &result.Horsepower,
+		&result.Torque, &result.TopSpeed, &result.Acceleration,
+		&result.EngineType, &result.DrivetrainType, &result.CurbWeight,
+		&result.Price, &result.Description, &result.Rarity, &result.RarityExplanation,
+		&result.LowResImage, &result.HighResImage, &blurHash, &dominantColor, &dateCollected, &units}, result.Specs.ScanTargets()...)...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+		return nil, fmt.Errorf("failed to fetch complete car details: %w", err)
 	}
 
-	var scanResp ScanImageResponse
-	if err := s.makeAIRequest(ctx, baseURL, apiKey, payloadBytes, &scanResp); err != nil {
-		return nil, err
-	}
+	result.Torque = catalog.Torque(result.Torque, units)
+	result.TopSpeed = catalog.Speed(result.TopSpeed, units)
+	result.CurbWeight = catalog.Weight(result.CurbWeight, units)
+	result.Specs.ConvertUnits(units)
 
-	if scanResp.Reject {
-		// Modified error message on scan rejection.
-		return nil, errors.New(common.RejectedScanError)
-	}
-
-	return &CarDetails{
-		Make:  scanResp.Make,
-		Model: scanResp.Model,
-		Trim:  scanResp.Trim,
-		Year:  scanResp.Year,
-		Color: scanResp.Color,
-	}, nil
+	// Format the date using common.FormatTimestamp
+	result.DateCollected = common.FormatTimestamp(dateCollected)
+	result.ImagePlaceholder = storage.NewPlaceholder(blurHash, dominantColor)
+	result.ImageVariants = s.signer.SignVariants(storage.URLsFor(result.HighResImage))
+	result.LowResImage = s.signer.Sign(result.LowResImage)
+	result.HighResImage = s.signer.Sign(result.HighResImage)
+	return &result, nil
 }
 
-func (s *Service) callChatAPI(ctx context.Context, baseURL string, apiKey string, aiModel string, make string, model string, trim string, year string) (*CarDetails, error) {
-	prompt := fmt.Sprintf(common.IDENTIFY_CAR_DETAILS, year, make, model, trim)
-	payload := ChatPayload{
-		Model: aiModel,
-		Messages: []ChatMessage{
-			{
-				Role:    "user",
-				Content: prompt,
-			},
-		},
-	}
-	payloadBytes, err := json.Marshal(payload)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal chat payload: %w", err)
-	}
-
-	var carDetails CarDetails
-	if err := s.makeAIRequest(ctx, baseURL, apiKey, payloadBytes, &carDetails); err != nil {
-		return nil, err
-	}
-	return &carDetails, nil
+// newCarSpecs are the specs a car missing from the catalog is created with
+type newCarSpecs struct {
+	*CarSpecs
+	promptVersion string
 }
 
-func (s *Service) makeAIRequest(ctx context.Context, baseURL, apiKey string, payload []byte, out interface{}) error {
-	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/chat/completions", baseURL), bytes.NewReader(payload))
-	if err != nil {
-		return fmt.Errorf("failed to create AI request: %w", err)
-	}
-
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-	req.Header.Set("Content-Type", "application/json")
+// fetchCarOrSpecs returns the ID of the catalog car matching a normalized
+// identity or, when there's none yet, the specs to create it with from the AI
+func (s *Service) fetchCarOrSpecs(ctx context.Context, c catalog.Identity, progress func(stage string)) (int, *newCarSpecs, error) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+	logger.Printf("Attempting to fetch car: %s %s %s %s",
+		c.Year, c.Make, c.Model, c.Trim)
 
-	resp, err := s.client.Do(req)
+	carID, err := s.catalog.FindCar(ctx, s.db, c)
 	if err != nil {
-		return fmt.Errorf("AI request error: %w", err)
+		logger.Printf("Error querying for existing car: %v", err)
+		return 0, nil, fmt.Errorf("failed to query car: %w", err)
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("failed to read response body: %w", err)
+	if carID != 0 {
+		logger.Printf("Found existing car with ID: %d", carID)
+		return carID, nil, nil
 	}
 
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
-		logger.Printf("AI API error response (status %d): %s", resp.StatusCode, string(body))
-		return fmt.Errorf("AI API returned status %d: %s", resp.StatusCode, string(body))
+	logger.Printf("Car not found, fetching specs from AI")
+	progress(ScanStageFetchingSpecs)
+	specs, promptVersion, aiErr := s.identifyCarSpecs(ctx, c.Make, c.Model, c.Trim, c.Year)
+	if aiErr != nil {
+		logger.Printf("Failed to get car specs from AI: %v", aiErr)
+		return 0, nil, withOutcome(ScanOutcomeAIError, fmt.Errorf("failed to get car specs: %w", aiErr))
 	}
+	return 0, &newCarSpecs{CarSpecs: specs, promptVersion: promptVersion}, nil
+}
 
-	var aiResp AIResponse
-	if err := json.Unmarshal(body, &aiResp); err != nil {
-		return fmt.Errorf("failed to decode AI response: %w", err)
-	}
+// createCar adds a car to the catalog with the specs fetched for it. Scans
+// of the same make and model take turns, so when another scan created a
+// matching car while the specs were fetched, that car is used instead.
+func (s *Service) createCar(ctx context.Context, tx pgx.Tx, c catalog.Identity, specs *newCarSpecs) (int, error) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
 
-	if len(aiResp.Choices) == 0 {
-		return fmt.Errorf("no response from AI")
+	if _, err := tx.Exec(ctx,
+		"SELECT pg_advisory_xact_lock(hashtext(LOWER($1) || '/' || LOWER($2)))",
+		c.Make, c.Model,
+	); err != nil {
+		return 0, fmt.Errorf("failed to lock car: %w", err)
 	}
-
-	content := aiResp.Choices[0].Message.Content
-
-	// Extract JSON content between curly braces
-	start := strings.Index(content, "{")
-	end := strings.LastIndex(content, "}")
-	if start >= 0 && end > start {
-		content = content[start : end+1]
+	carID, err := s.catalog.FindCar(ctx, tx, c)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query car: %w", err)
 	}
-
-	return json.Unmarshal([]byte(content), out)
-}
-
-// Add this helper function before fetchOrCreateCar
-func calculateRarity(price int) int {
-	switch {
-	case price >= 500000:
-		return 5
-	case price >= 150000:
-		return 4
-	case price >= 50000:
-		return 3
-	case price >= 25000:
-		return 2
-	default:
-		return 1
+	if carID != 0 {
+		logger.Printf("Car was created by another scan, using ID: %d", carID)
+		return carID, nil
 	}
-}
-
-func (s *Service) fetchOrCreateCar(ctx context.Context, tx pgx.Tx, c *CarDetails) (int, error) {
-	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
-	logger.Printf("Attempting to fetch or create car: %s %s %s %s",
-		c.Year, c.Make, c.Model, c.Trim)
-
-	var carID int
-	baseQuery := "SELECT id FROM cars WHERE LOWER(make)=LOWER($1) AND LOWER(model)=LOWER($2)"
-	args := []interface{}{c.Make, c.Model}
-	paramCount := 2
 
-	// Add year to query if present
-	if c.Year != "" {
-		paramCount++
-		baseQuery += fmt.Sprintf(" AND year=$%d", paramCount)
-		args = append(args, c.Year)
+	// A new car has a single copy; the scheduled recompute keeps
+	// scarcity current from here on
+	price := 0
+	if specs.Price != nil {
+		price = *specs.Price
 	}
-
-	// Add trim to query if present
-	if c.Trim != "" {
-		paramCount++
-		baseQuery += fmt.Sprintf(" AND LOWER(trim)=LOWER($%d)", paramCount)
-		args = append(args, c.Trim)
+	explanation, err := s.rarity.Evaluate(ctx, tx, price, 1)
+	if err != nil {
+		return 0, fmt.Errorf("failed to evaluate rarity: %w", err)
 	}
 
-	logger.Printf("Executing query to find existing car: %s", baseQuery)
-	err := tx.QueryRow(ctx, baseQuery, args...).Scan(&carID)
+	logger.Printf("Creating new car entry with details: %s %s (Year: %s)", c.Make, c.Model, c.Year)
+	err = tx.QueryRow(ctx,
+		`INSERT INTO cars (
+			make, model, year, trim, year_start, year_end,
+			horsepower, torque, top_speed, acceleration,
+			engine_type, drivetrain_type, curb_weight,
+			price, description, rarity, rarity_explanation, rarity_updated_at,
+			fuel_type, displacement, cylinder_count, forced_induction, hybrid,
+			battery_capacity, range, charging_time, transmission_type, gear_count,
+			length, width, height, wheelbase, ground_clearance,
+			body_type, doors, wheel_size, specs_enriched_at, prompt_version
+		) VALUES (
+			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, NOW(),
+			$18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29, $30, $31, $32, $33, $34, $35, NOW(), $36
+		)
+		RETURNING id`,
+		c.Make, c.Model, c.Year, c.Trim, nullableYear(c.YearStart), nullableYear(c.YearEnd),
+		specs.Horsepower, specs.Torque, specs.TopSpeed, specs.Acceleration,
+		specs.EngineType, specs.DrivetrainType, specs.CurbWeight,
+		price, specs.Description, explanation.Rarity, explanation,
+		specs.FuelType, specs.Displacement, specs.CylinderCount, specs.ForcedInduction, specs.Hybrid,
+		specs.BatteryCapacity, specs.Range, specs.ChargingTime, specs.TransmissionType, specs.GearCount,
+		specs.Length, specs.Width, specs.Height, specs.Wheelbase, specs.GroundClearance,
+		specs.BodyType, specs.Doors, specs.WheelSize, specs.promptVersion,
+	).Scan(&carID)
 	if err != nil {
-		if !errors.Is(err, pgx.ErrNoRows) {
-			logger.Printf("Error querying for existing car: %v", err)
-			return 0, fmt.Errorf("failed to query car: %w", err)
-		}
-
-		logger.Printf("Car not found, fetching additional details from AI")
-		additionalDetails, aiErr := s.identifyCarDetails(ctx, c.Make, c.Model, c.Trim, c.Year)
-		if aiErr != nil {
-			logger.Printf("Failed to get additional car details from AI: %v", aiErr)
-			return 0, fmt.Errorf("failed to get additional car details: %w", aiErr)
-		}
-
-		price := convertToInt(additionalDetails.Price)
-		rarity := calculateRarity(price)
-
-		logger.Printf("Creating new car entry with details: %s %s (Year: %s)", c.Make, c.Model, c.Year)
-		err = tx.QueryRow(ctx,
-			`INSERT INTO cars (
-				make, model, year, trim,
-				horsepower, torque, top_speed, acceleration,
-				engine_type, drivetrain_type, curb_weight,
-				price, description, rarity
-			) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
-			RETURNING id`,
-			c.Make, c.Model, c.Year, c.Trim,
-			convertToInt(additionalDetails.Horsepower),
-			convertToInt(additionalDetails.Torque),
-			convertToInt(additionalDetails.TopSpeed),
-			convertToFloat64(additionalDetails.Acceleration),
-			additionalDetails.EngineType,
-			additionalDetails.DrivetrainType,
-			convertToFloat64(additionalDetails.CurbWeight),
-			price,
-			additionalDetails.Description,
-			rarity,
-		).Scan(&carID)
-		if err != nil {
-			logger.Printf("Failed to create new car entry: %v", err)
-			return 0, fmt.Errorf("failed to create car entry: %w", err)
-		}
-		logger.Printf("Successfully created new car with ID: %d", carID)
-	} else {
-		logger.Printf("Found existing car with ID: %d", carID)
+		logger.Printf("Failed to create new car entry: %v", err)
+		return 0, fmt.Errorf("failed to create car entry: %w", err)
 	}
+	logger.Printf("Successfully created new car with ID: %d", carID)
 	return carID, nil
 }
 
-// Add these helper functions for type conversion
-func convertToInt(v interface{}) int {
-	switch t := v.(type) {
-	case int:
-		return t
-	case float64:
-		return int(t)
-	case string:
-		// Remove any non-numeric characters except decimal point and negative sign
-		clean := strings.TrimFunc(t, func(r rune) bool {
-			return !unicode.IsDigit(r) && r != '.' && r != '-'
-		})
-		if i, err := strconv.ParseInt(clean, 10, 64); err == nil {
-			return int(i)
-		}
-		if f, err := strconv.ParseFloat(clean, 64); err == nil {
-			return int(f)
-		}
-	}
-	return 0
-}
-
-func convertToFloat64(v interface{}) float64 {
-	switch t := v.(type) {
-	case float64:
-		return t
-	case int:
-		return float64(t)
-	case string:
-		// Remove any non-numeric characters except decimal point and negative sign
-		clean := strings.TrimFunc(t, func(r rune) bool {
-			return !unicode.IsDigit(r) && r != '.' && r != '-'
-		})
-		if f, err := strconv.ParseFloat(clean, 64); err == nil {
-			return f
-		}
-	}
-	return 0
+// queryRower is satisfied by both the pool and a transaction
+type queryRower interface {
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
 }
 
-// saveImage wrapper to maintain compatibility
-func (s *Service) saveImage(base64Image string, baseDir string, relativePath string) error {
-	return common.SaveImage(base64Image, baseDir, relativePath, 0755)
-}
-
-// saveLowResImage wrapper to maintain compatibility
-func (s *Service) saveLowResImage(originalImage string, savePath string) error {
-	return common.SaveLowResVersion(originalImage, savePath, 95, 0755)
-}
-
-func (s *Service) getCarImagePaths(ctx context.Context, tx pgx.Tx, carID int, color string) (*CarImagePaths, error) {
+func (s *Service) getCarImagePaths(ctx context.Context, q queryRower, carID int, color string) (*CarImagePaths, error) {
 	var colorImages map[string]map[string]string
-	err := tx.QueryRow(ctx, "SELECT color_images FROM cars WHERE id = $1", carID).Scan(&colorImages)
+	err := q.QueryRow(ctx, "SELECT color_images FROM cars WHERE id = $1", carID).Scan(&colorImages)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, nil
@@ -669,9 +689,11 @@ func (s *Service) getCarImagePaths(ctx context.Context, tx pgx.Tx, carID int, co
 	if colorData, exists := colorImages[colorKey]; exists {
 		if highRes, ok := colorData["high_res"]; ok {
 			if lowRes, ok := colorData["low_res"]; ok {
+				blurHash, dominantColor := colorData["blurhash"], colorData["dominant_color"]
 				return &CarImagePaths{
-					HighRes: highRes,
-					LowRes:  lowRes,
+					HighRes:     highRes,
+					LowRes:      lowRes,
+					Placeholder: storage.NewPlaceholder(&blurHash, &dominantColor),
 				}, nil
 			}
 		}
@@ -679,44 +701,63 @@ func (s *Service) getCarImagePaths(ctx context.Context, tx pgx.Tx, carID int, co
 	return nil, nil
 }
 
-func (s *Service) checkForDuplicateScan(ctx context.Context, tx pgx.Tx, userID int, make, model, trim string, year string) error {
+func (s *Service) checkForDuplicateScan(ctx context.Context, tx pgx.Tx, userID, carID int) error {
 	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
 
-	// Build query to find car ID
-	baseQuery := "SELECT c.id FROM cars c INNER JOIN scan_history sh ON c.id = sh.car_id WHERE sh.user_id = $1 AND LOWER(c.make) = LOWER($2) AND LOWER(c.model) = LOWER($3)"
-	args := []interface{}{userID, make, model}
-	paramCount := 3
-
-	if year != "" {
-		paramCount++
-		baseQuery += fmt.Sprintf(" AND c.year = $%d", paramCount)
-		args = append(args, year)
+	var exists bool
+	err := tx.QueryRow(ctx, `
+		SELECT EXISTS(
+			SELECT 1 FROM scan_history
+			WHERE user_id = $1 AND car_id = $2 AND success
+			  AND scanned_at > NOW() - INTERVAL '24 hours'
+		)`,
+		userID, carID,
+	).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("error checking for duplicate scan: %w", err)
 	}
-
-	if trim != "" {
-		paramCount++
-		baseQuery += fmt.Sprintf(" AND LOWER(c.trim) = LOWER($%d)", paramCount)
-		args = append(args, trim)
+	if exists {
+		logger.Printf("Found duplicate scan for user %d, car %d within last 24 hours", userID, carID)
+		return common.ErrDuplicateScan
 	}
+	return nil
+}
 
-	baseQuery += " AND sh.scanned_at > NOW() - INTERVAL '24 hours'"
-
-	var carID int
-	err := tx.QueryRow(ctx, baseQuery, args...).Scan(&carID)
-	if err == nil {
-		logger.Printf("Found duplicate scan for user %d, car %d within last 24 hours", userID, carID)
-		return errors.New(common.DuplicateScanError)
+// nullableYear stores unparsed years as NULL
+func nullableYear(year int) *int {
+	if year == 0 {
+		return nil
 	}
-	if err != pgx.ErrNoRows {
-		return fmt.Errorf("error checking for duplicate scan: %w", err)
+	return &year
+}
+
+// recordScanHistory records a successful scan, along with the AI calls made
+// for it; failures go through recordFailedScan
+func (s *Service) recordScanHistory(ctx context.Context, tx pgx.Tx, userID, carID int, color, imagePath, secondImagePath string, evidence *scanEvidence, promptVersion string) error {
+	second := evidence.secondPhoto()
+	var scanHistoryID int
+	err := tx.QueryRow(ctx,
+		`INSERT INTO scan_history (user_id, car_id, color, image_path, success, outcome, rejection_reason, image_hash, exif, flagged, flag_reasons,
+			photo_count, second_image_path, second_image_hash, second_exif, prompt_version)
+		 VALUES ($1, $2, $3, $4, true, $5, '', $6, $7, $8, $9, $10, NULLIF($11, ''), $12, $13, NULLIF($14, ''))
+		 RETURNING id`,
+		userID, carID, color, imagePath, ScanOutcomeSuccess,
+		evidence.imageHash, evidence.metadata, len(evidence.violations) > 0, evidence.violations,
+		evidence.photoCount(), secondImagePath, second.imageHash, second.metadata, promptVersion,
+	).Scan(&scanHistoryID)
+	if err != nil {
+		return err
 	}
-	return nil
+	return usage.LinkScan(ctx, tx, scanHistoryID)
 }
 
-func (s *Service) recordScanHistory(ctx context.Context, tx pgx.Tx, userID, carID int, color, imagePath string, success bool, rejectionReason string) error {
-	_, err := tx.Exec(ctx,
-		`INSERT INTO scan_history (user_id, car_id, color, image_path, success, rejection_reason)
-		 VALUES ($1, $2, $3, $4, $5, $6)`,
-		userID, carID, color, imagePath, success, rejectionReason)
-	return err
+// saveRejectedScan keeps a copy of a rejected scan for review and returns its path
+func (s *Service) saveRejectedScan(ctx context.Context, userID int, upload *Upload) string {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+
+	scanPath := fmt.Sprintf("%suser_%d/rejected_scan_%d%s", storage.ScansPrefix, userID, time.Now().Unix(), upload.extension())
+	if err := s.store.Put(ctx, scanPath, upload.Data, upload.ContentType); err != nil {
+		logger.Printf("Warning: failed to save rejected scan: %v", err)
+	}
+	return scanPath
 }
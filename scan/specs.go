@@ -0,0 +1,294 @@
+package scan
+
+import (
+	"CarBN/catalog"
+	"CarBN/common"
+	"CarBN/prompts"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+
+	"google.golang.org/genai"
+)
+
+// CarSpecs is the spec sheet the AI returns for a car, after validation.
+// Values that were missing, of the wrong type or implausible are nil.
+type CarSpecs struct {
+	Horsepower     *int     `json:"horsepower"`
+	Torque         *int     `json:"torque"`    // Nm
+	TopSpeed       *int     `json:"top_speed"` // km/h
+	Acceleration   *float64 `json:"acceleration"`
+	EngineType     *string  `json:"engine_type"`
+	DrivetrainType *string  `json:"drivetrain_type"`
+	CurbWeight     *float64 `json:"curb_weight"` // kg
+	Price          *int     `json:"price"`
+	Description    *string  `json:"description"`
+	catalog.Specs
+}
+
+// specField describes one field of the spec sheet: the type the model must
+// return it as, the unit it's in, and the range of plausible values. Units
+// are the metric ones specs are stored in (see catalog.ConvertUnits).
+// Strings with an enum must be one of its values.
+type specField struct {
+	name     string
+	kind     string // "integer", "number", "string" or "boolean"
+	describe string
+	min, max float64
+	enum     []string
+	// fixUnit converts a value the model commonly gives in the wrong unit,
+	// e.g. displacement in cc rather than liters. It's only applied to values
+	// outside min and max.
+	fixUnit func(float64) float64
+}
+
+func fromInches(v float64) float64      { return v * 25.4 }
+func fromThousandths(v float64) float64 { return v / 1000 }
+
+var specFields = []specField{
+	{name: "horsepower", kind: "integer", describe: "peak power in hp", min: 20, max: 2000},
+	{name: "torque", kind: "integer", describe: "peak torque in Nm", min: 27, max: 3400},
+	{name: "top_speed", kind: "integer", describe: "top speed in km/h", min: 50, max: 515},
+	{name: "acceleration", kind: "number", describe: "0-60 mph time in seconds", min: 1.5, max: 30},
+	{name: "engine_type", kind: "string", describe: "engine layout",
+		enum: []string{"I2", "I3", "I4", "I5", "I6", "V6", "V8", "V10", "V12", "W12", "W16", "Flat-4", "Flat-6", "Rotary", "Electric"}},
+	{name: "fuel_type", kind: "string", describe: "fuel the car runs on",
+		enum: []string{"Gasoline", "Diesel", "Electric", "Hybrid", "Plug-in Hybrid", "Hydrogen", "Flex Fuel"}},
+	{name: "displacement", kind: "number", describe: "engine displacement in liters, null for electric cars", min: 0.5, max: 10, fixUnit: fromThousandths},
+	{name: "cylinder_count", kind: "integer", describe: "number of cylinders, null for electric cars", min: 1, max: 16},
+	{name: "forced_induction", kind: "boolean", describe: "whether the engine is turbocharged or supercharged"},
+	{name: "hybrid", kind: "boolean", describe: "whether the car is a hybrid"},
+	{name: "drivetrain_type", kind: "string", describe: "driven wheels", enum: []string{"FWD", "RWD", "AWD", "4WD"}},
+	{name: "battery_capacity", kind: "number", describe: "traction battery capacity in kWh, null without one", min: 0.5, max: 250, fixUnit: fromThousandths},
+	{name: "range", kind: "number", describe: "electric range on a full charge in km, null for cars that can't drive on electricity alone", min: 8, max: 1200},
+	{name: "charging_time", kind: "number", describe: "hours to fully charge on a level 2 charger, null for cars that can't be plugged in", min: 0.25, max: 48},
+	{name: "transmission_type", kind: "string", describe: "transmission",
+		enum: []string{"Automatic", "Manual", "CVT", "Dual-Clutch", "Single-Speed"}},
+	{name: "gear_count", kind: "integer", describe: "number of forward gears", min: 1, max: 10},
+	{name: "curb_weight", kind: "number", describe: "curb weight in kg", min: 360, max: 5500},
+	{name: "length", kind: "number", describe: "overall length in mm", min: 2200, max: 7200, fixUnit: fromInches},
+	{name: "width", kind: "number", describe: "overall width without mirrors in mm", min: 1250, max: 2550, fixUnit: fromInches},
+	{name: "height", kind: "number", describe: "overall height in mm", min: 850, max: 2800, fixUnit: fromInches},
+	{name: "wheelbase", kind: "number", describe: "wheelbase in mm", min: 1500, max: 5100, fixUnit: fromInches},
+	{name: "ground_clearance", kind: "number", describe: "ground clearance in mm", min: 50, max: 510, fixUnit: fromInches},
+	{name: "body_type", kind: "string", describe: "body style",
+		enum: []string{"Sedan", "Coupe", "Convertible", "Roadster", "Hatchback", "Wagon", "SUV", "Crossover", "Pickup", "Minivan", "Van"}},
+	{name: "doors", kind: "integer", describe: "number of doors", min: 2, max: 5},
+	{name: "wheel_size", kind: "number", describe: "standard wheel diameter in inches", min: 12, max: 24},
+	{name: "price", kind: "integer", describe: "private sale value in USD", min: 500, max: 100000000},
+	{name: "description", kind: "string", describe: "2-3 sentence description"},
+}
+
+// parseCarSpecs decodes the model's reply against specFields, dropping values
+// that don't fit and logging what was dropped. It only fails when the reply
+// isn't a JSON object.
+func parseCarSpecs(ctx context.Context, content string) (*CarSpecs, error) {
+	var raw map[string]interface{}
+	if err := unmarshalJSONContent(content, &raw); err != nil {
+		return nil, fmt.Errorf("failed to decode car specs: %w", err)
+	}
+
+	clean, problems := validateSpecs(raw)
+	if len(problems) > 0 {
+		if logger, ok := ctx.Value(common.LoggerCtxKey).(*log.Logger); ok {
+			logger.Printf("Dropped invalid car specs: %s", strings.Join(problems, "; "))
+		}
+	}
+
+	data, err := json.Marshal(clean)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode car specs: %w", err)
+	}
+	var specs CarSpecs
+	if err := json.Unmarshal(data, &specs); err != nil {
+		return nil, fmt.Errorf("failed to decode car specs: %w", err)
+	}
+	return &specs, nil
+}
+
+// validateSpecs returns the values of raw that match specFields, and a
+// description of every value it dropped or fixed
+func validateSpecs(raw map[string]interface{}) (map[string]interface{}, []string) {
+	clean := make(map[string]interface{}, len(specFields))
+	var problems []string
+	known := make(map[string]bool, len(specFields))
+
+	for _, f := range specFields {
+		known[f.name] = true
+		v, ok := raw[f.name]
+		if !ok || v == nil {
+			continue
+		}
+
+		switch f.kind {
+		case "integer", "number":
+			n, ok := v.(float64)
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s: expected a number, got %v", f.name, v))
+				continue
+			}
+			if (n < f.min || n > f.max) && f.fixUnit != nil {
+				if fixed := f.fixUnit(n); fixed >= f.min && fixed <= f.max {
+					problems = append(problems, fmt.Sprintf("%s: converted %v to %v", f.name, n, fixed))
+					n = fixed
+				}
+			}
+			if n < f.min || n > f.max {
+				problems = append(problems, fmt.Sprintf("%s: %v is outside %v-%v", f.name, n, f.min, f.max))
+				continue
+			}
+			if f.kind == "integer" {
+				n = math.Round(n)
+			} else {
+				n = math.Round(n*100) / 100
+			}
+			clean[f.name] = n
+		case "boolean":
+			b, ok := v.(bool)
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s: expected a boolean, got %v", f.name, v))
+				continue
+			}
+			clean[f.name] = b
+		case "string":
+			s, ok := v.(string)
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s: expected a string, got %v", f.name, v))
+				continue
+			}
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+			if f.enum != nil {
+				match := ""
+				for _, option := range f.enum {
+					if strings.EqualFold(option, s) {
+						match = option
+						break
+					}
+				}
+				if match == "" {
+					problems = append(problems, fmt.Sprintf("%s: %q isn't one of %s", f.name, s, strings.Join(f.enum, ", ")))
+					continue
+				}
+				s = match
+			}
+			clean[f.name] = s
+		}
+	}
+
+	var unknown []string
+	for name := range raw {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		problems = append(problems, "unknown fields "+strings.Join(unknown, ", "))
+	}
+	return clean, problems
+}
+
+// specsJSONSchema is the spec sheet as a strict JSON schema for
+// OpenAI-compatible structured outputs. Every field is required but nullable.
+func specsJSONSchema() map[string]interface{} {
+	properties := make(map[string]interface{}, len(specFields))
+	required := make([]string, 0, len(specFields))
+	for _, f := range specFields {
+		property := map[string]interface{}{
+			"type":        []string{f.kind, "null"},
+			"description": f.describe,
+		}
+		if f.enum != nil {
+			enum := make([]interface{}, 0, len(f.enum)+1)
+			for _, option := range f.enum {
+				enum = append(enum, option)
+			}
+			property["enum"] = append(enum, nil)
+		}
+		properties[f.name] = property
+		required = append(required, f.name)
+	}
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": false,
+	}
+}
+
+// specsGeminiSchema is the spec sheet as a Gemini response schema
+func specsGeminiSchema() *genai.Schema {
+	kinds := map[string]genai.Type{
+		"integer": genai.TypeInteger,
+		"number":  genai.TypeNumber,
+		"string":  genai.TypeString,
+		"boolean": genai.TypeBoolean,
+	}
+
+	schema := &genai.Schema{
+		Type:       genai.TypeObject,
+		Properties: make(map[string]*genai.Schema, len(specFields)),
+	}
+	for _, f := range specFields {
+		property := &genai.Schema{
+			Type:        kinds[f.kind],
+			Description: f.describe,
+			Nullable:    true,
+		}
+		if f.enum != nil {
+			property.Format = "enum"
+			property.Enum = f.enum
+		}
+		schema.Properties[f.name] = property
+		schema.Required = append(schema.Required, f.name)
+		schema.PropertyOrdering = append(schema.PropertyOrdering, f.name)
+	}
+	return schema
+}
+
+// identifyCarSpecs asks the recognizer for the spec sheet of a car with a
+// version of the spec prompt picked from the registry, returning the
+// version's ref along with the specs
+func (s *Service) identifyCarSpecs(ctx context.Context, make, model, trim, year string) (*CarSpecs, string, error) {
+	prompt, err := s.prompts.Pick(prompts.IdentifyCarDetails)
+	if err != nil {
+		return nil, "", err
+	}
+	text, err := specsPrompt(prompt, make, model, trim, year)
+	if err != nil {
+		return nil, "", err
+	}
+
+	specs, err := s.recognizer.IdentifyCarSpecs(ctx, text)
+	if err != nil {
+		return nil, "", err
+	}
+	return specs, prompt.Ref(), nil
+}
+
+// specsPrompt renders the prompt asking for the spec sheet of a car, listing
+// every field with its unit for providers that don't enforce the schema
+func specsPrompt(prompt *prompts.Prompt, make, model, trim, year string) (string, error) {
+	var fields strings.Builder
+	for _, f := range specFields {
+		fmt.Fprintf(&fields, "- %s (%s): %s", f.name, f.kind, f.describe)
+		if f.enum != nil {
+			fmt.Fprintf(&fields, ", one of [%s]", strings.Join(f.enum, ", "))
+		}
+		fields.WriteString("\n")
+	}
+	return prompt.Render(prompts.Vars{
+		"year":   year,
+		"make":   make,
+		"model":  model,
+		"trim":   trim,
+		"fields": fields.String(),
+	})
+}
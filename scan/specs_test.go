@@ -0,0 +1,120 @@
+package scan
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateSpecs(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      map[string]interface{}
+		want     map[string]interface{}
+		problems []string
+	}{
+		{
+			name: "valid values kept",
+			raw: map[string]interface{}{
+				"horsepower": 473.0, "acceleration": 3.94, "engine_type": "I6",
+				"forced_induction": true, "description": " A fast sedan. ", "range": nil,
+			},
+			want: map[string]interface{}{
+				"horsepower": 473.0, "acceleration": 3.94, "engine_type": "I6",
+				"forced_induction": true, "description": "A fast sedan.",
+			},
+		},
+		{
+			name: "numbers rounded",
+			raw:  map[string]interface{}{"horsepower": 472.6, "displacement": 2.9985},
+			want: map[string]interface{}{"horsepower": 473.0, "displacement": 3.0},
+		},
+		{
+			name: "enums matched case insensitively",
+			raw:  map[string]interface{}{"drivetrain_type": "awd", "body_type": "suv"},
+			want: map[string]interface{}{"drivetrain_type": "AWD", "body_type": "SUV"},
+		},
+		{
+			name:     "enum mismatch dropped",
+			raw:      map[string]interface{}{"engine_type": "V7"},
+			want:     map[string]interface{}{},
+			problems: []string{"engine_type: \"V7\" isn't one of"},
+		},
+		{
+			name:     "cc converted to liters",
+			raw:      map[string]interface{}{"displacement": 2998.0},
+			want:     map[string]interface{}{"displacement": 3.0},
+			problems: []string{"displacement: converted 2998 to 2.998"},
+		},
+		{
+			name:     "inches converted to mm",
+			raw:      map[string]interface{}{"length": 185.0},
+			want:     map[string]interface{}{"length": 4699.0},
+			problems: []string{"length: converted 185 to 4699"},
+		},
+		{
+			name:     "unconvertible value dropped",
+			raw:      map[string]interface{}{"ground_clearance": 1.0},
+			want:     map[string]interface{}{},
+			problems: []string{"ground_clearance: 1 is outside 50-510"},
+		},
+		{
+			name:     "out of range dropped",
+			raw:      map[string]interface{}{"horsepower": 5000.0, "doors": 1.0},
+			want:     map[string]interface{}{},
+			problems: []string{"horsepower: 5000 is outside 20-2000", "doors: 1 is outside 2-5"},
+		},
+		{
+			name:     "wrong types dropped",
+			raw:      map[string]interface{}{"horsepower": "473", "hybrid": "no", "description": 4.0},
+			want:     map[string]interface{}{},
+			problems: []string{"horsepower: expected a number", "hybrid: expected a boolean", "description: expected a string"},
+		},
+		{
+			name:     "blank strings dropped",
+			raw:      map[string]interface{}{"fuel_type": "  "},
+			want:     map[string]interface{}{},
+			problems: nil,
+		},
+		{
+			name:     "unknown fields reported",
+			raw:      map[string]interface{}{"horsepower": 300.0, "zero_to_100": 5.1, "color": "red"},
+			want:     map[string]interface{}{"horsepower": 300.0},
+			problems: []string{"unknown fields color, zero_to_100"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clean, problems := validateSpecs(tt.raw)
+			if !reflect.DeepEqual(clean, tt.want) {
+				t.Errorf("clean = %v, want %v", clean, tt.want)
+			}
+			if len(problems) != len(tt.problems) {
+				t.Fatalf("problems = %q, want %q", problems, tt.problems)
+			}
+			for i, want := range tt.problems {
+				if !strings.HasPrefix(problems[i], want) {
+					t.Errorf("problem %d = %q, want %q...", i, problems[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseCarSpecs(t *testing.T) {
+	specs, err := parseCarSpecs(testContext(), "```json\n{\"horsepower\": 382, \"torque\": 500, \"curb_weight\": 1730, \"length\": 4794, \"price\": \"lots\"}\n```")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if specs.Horsepower == nil || *specs.Horsepower != 382 || specs.Torque == nil || *specs.Torque != 500 ||
+		specs.CurbWeight == nil || *specs.CurbWeight != 1730 || specs.Length == nil || *specs.Length != 4794 {
+		t.Errorf("specs = %+v", specs)
+	}
+	if specs.Price != nil {
+		t.Errorf("price = %d, want nil", *specs.Price)
+	}
+
+	if _, err := parseCarSpecs(testContext(), "not json"); err == nil {
+		t.Error("parseCarSpecs of a non-JSON reply succeeded")
+	}
+}
@@ -0,0 +1,156 @@
+package scan
+
+import (
+	"CarBN/catalog"
+	"CarBN/common"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/bits"
+	"slices"
+	"strings"
+)
+
+// Two-photo scans show the same car from two angles. The photos must be
+// separate captures, and the vision model must see the same car in both,
+// which makes scanning a picture of a car found online much harder.
+
+// checkDistinctPhotos rejects a second photo that's the first one again,
+// re-encoded, resized or lightly edited
+func (s *Service) checkDistinctPhotos(first, second *Upload, evidence *scanEvidence) error {
+	if bytes.Equal(first.Data, second.Data) {
+		return withOutcomeDetail(ScanOutcomePhotosNotDistinct, "photos are identical", common.ErrScanPhotosNotDistinct)
+	}
+
+	if evidence.imageHash != nil && evidence.second.imageHash != nil {
+		distance := bits.OnesCount64(uint64(*evidence.imageHash ^ *evidence.second.imageHash))
+		if distance <= max(s.phashThreshold, 0) {
+			return withOutcomeDetail(ScanOutcomePhotosNotDistinct,
+				fmt.Sprintf("photos match (distance %d)", distance), common.ErrScanPhotosNotDistinct)
+		}
+	}
+
+	// Cropping defeats the hash, but not the capture time. EXIF times only
+	// have second precision, and walking around a car takes longer than that.
+	a, b := evidence.metadata, evidence.second.metadata
+	if a != nil && b != nil && a.CapturedAt != nil && b.CapturedAt != nil &&
+		a.CapturedAt.Equal(*b.CapturedAt) && a.CameraModel == b.CameraModel {
+		return withOutcomeDetail(ScanOutcomePhotosNotDistinct,
+			"photos have the same capture time "+common.FormatTimestamp(*a.CapturedAt), common.ErrScanPhotosNotDistinct)
+	}
+	return nil
+}
+
+// identifyScan identifies the car in a scan's photos. With two photos both
+// are identified at once, and they must agree on the make, model and color;
+// the more confident of the two identifications is used. prompt is the
+// rendered scan prompt sent with every photo.
+func (s *Service) identifyScan(ctx context.Context, prompt string, photo, second *scanPhoto) (*CarDetails, error) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+
+	if second == nil {
+		return s.identifyPhoto(ctx, prompt, photo)
+	}
+
+	type identified struct {
+		details *CarDetails
+		err     error
+	}
+	secondResult := make(chan identified, 1)
+	go func() {
+		details, err := s.identifyPhoto(ctx, prompt, second)
+		secondResult <- identified{details, err}
+	}()
+
+	firstDetails, firstErr := s.identifyPhoto(ctx, prompt, photo)
+	other := <-secondResult
+	// A rejection of either photo outranks any other failure
+	for _, err := range []error{firstErr, other.err} {
+		if err != nil && errors.Is(err, common.ErrScanRejected) {
+			return nil, err
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if other.err != nil {
+		return nil, other.err
+	}
+
+	if err := s.checkPhotosAgree(ctx, firstDetails, other.details); err != nil {
+		return nil, err
+	}
+
+	logger.Printf("Both photos show a %s %s %s", firstDetails.Color, firstDetails.Make, firstDetails.Model)
+	if topConfidence(other.details) > topConfidence(firstDetails) {
+		return other.details, nil
+	}
+	return firstDetails, nil
+}
+
+func (s *Service) identifyPhoto(ctx context.Context, prompt string, photo *scanPhoto) (*CarDetails, error) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+
+	carDetails, err := s.recognizer.IdentifyCar(ctx, prompt, photo.visionImage, photo.visionType)
+	if err != nil {
+		logger.Printf("Failed to identify car: %v", err)
+		if errors.Is(err, common.ErrScanRejected) {
+			return nil, withOutcome(ScanOutcomeRejectedFake, err)
+		}
+		return nil, withOutcome(ScanOutcomeAIError, err)
+	}
+	return carDetails, nil
+}
+
+// checkPhotosAgree compares the make and model after catalog normalization,
+// so "VW" and "Volkswagen" agree. Trims and years are left to the confidence
+// of each identification, since they're often hard to tell from one angle.
+func (s *Service) checkPhotosAgree(ctx context.Context, a, b *CarDetails) error {
+	first, err := s.catalog.Normalize(ctx, s.db, catalog.Identity{Make: a.Make, Model: a.Model})
+	if err != nil {
+		return fmt.Errorf("failed to normalize car details: %w", err)
+	}
+	second, err := s.catalog.Normalize(ctx, s.db, catalog.Identity{Make: b.Make, Model: b.Model})
+	if err != nil {
+		return fmt.Errorf("failed to normalize car details: %w", err)
+	}
+
+	if !strings.EqualFold(first.Make, second.Make) || !strings.EqualFold(first.Model, second.Model) ||
+		!colorsAgree(a.Color, b.Color) {
+		return withOutcomeDetail(ScanOutcomePhotosMismatch,
+			fmt.Sprintf("photos disagree: %s %s %s vs %s %s %s",
+				a.Color, first.Make, first.Model, b.Color, second.Make, second.Model),
+			common.ErrScanPhotosMismatch)
+	}
+	return nil
+}
+
+// colorsAgree allows for one photo being more specific than the other, so
+// "Blue" agrees with "Dark Blue" but not with "Red"
+func colorsAgree(a, b string) bool {
+	a, b = strings.ToLower(strings.TrimSpace(a)), strings.ToLower(strings.TrimSpace(b))
+	if a == b {
+		return true
+	}
+	if a == "" || b == "" {
+		return false
+	}
+	return containsWords(a, b) || containsWords(b, a)
+}
+
+// containsWords reports whether every word of sub appears in s
+func containsWords(s, sub string) bool {
+	words := strings.Fields(s)
+	for _, w := range strings.Fields(sub) {
+		if !slices.Contains(words, w) {
+			return false
+		}
+	}
+	return true
+}
+
+func topConfidence(details *CarDetails) float64 {
+	return rankCandidates(details, 1)[0].Confidence
+}
@@ -0,0 +1,310 @@
+package scan
+
+import (
+	"CarBN/common"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// legacyMaxBodyBytes caps JSON bodies carrying a base64 image
+	legacyMaxBodyBytes        = 10 << 20
+	defaultMaxUploadBytes     = 20 << 20
+	defaultMaxVisionDimension = 2048
+	visionJPEGQuality         = 90
+	// maxImagePixels caps the size of a photo once decoded. A small file can
+	// claim huge dimensions, and decoding it would take gigabytes.
+	maxImagePixels = 50_000_000
+)
+
+// Extensions of the image types a scan accepts, keyed by MIME type. HEIC
+// can't be decoded here, so HEIC photos go to the vision model as uploaded.
+var scanImageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+	"image/heic": ".heic",
+}
+
+// Upload is a scan photo as received from the client. ContentType is sniffed
+// from the data rather than taken from the request.
+type Upload struct {
+	Data        []byte
+	ContentType string
+}
+
+// NewUpload checks that data is a supported image that isn't too large to
+// decode, and detects its type
+func NewUpload(data []byte) (*Upload, error) {
+	contentType, err := checkImageType(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkImagePixels(contentType, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	return &Upload{Data: data, ContentType: contentType}, nil
+}
+
+// checkImagePixels rejects images of contentType, read from r, that are too
+// large to decode. Images whose header can't be read are left to the vision
+// model, since nothing can decode them past it either.
+func checkImagePixels(contentType string, r io.Reader) error {
+	if contentType == "image/heic" {
+		return nil
+	}
+	if config, _, err := image.DecodeConfig(r); err == nil &&
+		int64(config.Width)*int64(config.Height) > maxImagePixels {
+		return common.BadRequest(fmt.Sprintf("image is %dx%d, larger than %d megapixels",
+			config.Width, config.Height, maxImagePixels/1_000_000))
+	}
+	return nil
+}
+
+// checkImageType returns the type of the image starting with data, which
+// must be a supported one
+func checkImageType(data []byte) (string, error) {
+	if len(data) == 0 {
+		return "", common.BadRequest("missing image")
+	}
+	contentType := sniffImageType(data)
+	if _, ok := scanImageExtensions[contentType]; !ok {
+		return "", common.UnsupportedMedia(fmt.Sprintf("unsupported image type %s, use JPEG, PNG, WebP or HEIC", contentType))
+	}
+	return contentType, nil
+}
+
+// extension is the file extension scans of this type are saved with
+func (u *Upload) extension() string {
+	return scanImageExtensions[u.ContentType]
+}
+
+// sniffImageType detects an image's MIME type from its first bytes. HEIC
+// isn't known to http.DetectContentType, so its ftyp box is checked here.
+func sniffImageType(data []byte) string {
+	if len(data) >= 12 && string(data[4:8]) == "ftyp" {
+		switch string(data[8:12]) {
+		case "heic", "heix", "hevc", "hevx", "heim", "heis", "mif1", "msf1":
+			return "image/heic"
+		}
+	}
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	return contentType
+}
+
+// readUploads reads the photos from a scan request: the photo of the car,
+// and for two-photo scans a second photo from another angle (nil otherwise).
+// multipart/form-data bodies (fields "image" and "second_image") and raw
+// image bodies are spooled to a temp file as they stream in, and only read
+// into memory once they've passed validation; JSON bodies with base64_image and second_base64_image are still
+// accepted for older clients. maxBytes applies to each photo.
+func readUploads(w http.ResponseWriter, r *http.Request, maxBytes int64) (*Upload, *Upload, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	switch {
+	case mediaType == "multipart/form-data":
+		r.Body = http.MaxBytesReader(w, r.Body, 2*maxBytes)
+		reader, err := r.MultipartReader()
+		if err != nil {
+			return nil, nil, common.BadRequest("invalid multipart body").Wrap(err)
+		}
+		var upload, second *Upload
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, nil, uploadReadError(err)
+			}
+			switch part.FormName() {
+			case "image":
+				upload, err = streamUpload(io.LimitReader(part, maxBytes+1), maxBytes)
+			case "second_image":
+				second, err = streamUpload(io.LimitReader(part, maxBytes+1), maxBytes)
+			}
+			part.Close()
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if upload == nil {
+			return nil, nil, common.BadRequest("missing image")
+		}
+		return upload, second, nil
+
+	case strings.HasPrefix(mediaType, "image/") || mediaType == "application/octet-stream":
+		r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+		upload, err := streamUpload(r.Body, maxBytes)
+		return upload, nil, err
+
+	default:
+		r.Body = http.MaxBytesReader(w, r.Body, legacyMaxBodyBytes)
+		var req struct {
+			Base64Image       string `json:"base64_image"`
+			SecondBase64Image string `json:"second_base64_image"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, nil, uploadReadError(err)
+		}
+		if req.Base64Image == "" {
+			return nil, nil, common.BadRequest("missing base64_image")
+		}
+		upload, err := decodeBase64Upload(req.Base64Image)
+		if err != nil || req.SecondBase64Image == "" {
+			return upload, nil, err
+		}
+		second, err := decodeBase64Upload(req.SecondBase64Image)
+		return upload, second, err
+	}
+}
+
+func decodeBase64Upload(base64Image string) (*Upload, error) {
+	// Remove data URL prefix if present
+	if idx := strings.Index(base64Image, ","); idx != -1 {
+		base64Image = base64Image[idx+1:]
+	}
+	data, err := base64.StdEncoding.DecodeString(base64Image)
+	if err != nil {
+		return nil, common.BadRequest("invalid base64 format")
+	}
+	return NewUpload(data)
+}
+
+// streamUpload reads a photo from src, rejecting anything that isn't a
+// supported image before the rest of it is read. The photo is spooled to a
+// temp file so oversized ones are turned away without being held in memory.
+// src must be limited to maxBytes+1 bytes or fewer.
+func streamUpload(src io.Reader, maxBytes int64) (*Upload, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, uploadReadError(err)
+	}
+	contentType, err := checkImageType(head[:n])
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.CreateTemp("", "scan-upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload file: %w", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	size, err := io.Copy(file, io.MultiReader(bytes.NewReader(head[:n]), src))
+	if err != nil {
+		return nil, uploadReadError(err)
+	}
+	if size > maxBytes {
+		return nil, common.PayloadTooLarge(fmt.Sprintf("image is larger than %d MB", maxBytes>>20))
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to rewind upload file: %w", err)
+	}
+	if err := checkImagePixels(contentType, bufio.NewReader(file)); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, size)
+	if _, err := file.ReadAt(data, 0); err != nil {
+		return nil, fmt.Errorf("failed to read upload file: %w", err)
+	}
+	return &Upload{Data: data, ContentType: contentType}, nil
+}
+
+func uploadReadError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return common.PayloadTooLarge(fmt.Sprintf("image is larger than %d MB", maxBytesErr.Limit>>20)).Wrap(err)
+	}
+	return common.BadRequest("invalid request body").Wrap(err)
+}
+
+// scanPhoto is an upload prepared for the scan pipeline. The original bytes
+// are kept for hashing, EXIF and the saved scan; the vision model gets a copy
+// that's been downscaled when the photo is oversized.
+type scanPhoto struct {
+	*Upload
+	visionImage string // Base64
+	visionType  string
+}
+
+// upload returns the photo's upload, nil for a nil photo
+func (p *scanPhoto) upload() *Upload {
+	if p == nil {
+		return nil
+	}
+	return p.Upload
+}
+
+// prepareScanPhoto encodes the photo for the vision model once, downscaling
+// it first when it's oversized
+func (s *Service) prepareScanPhoto(ctx context.Context, upload *Upload) *scanPhoto {
+	data, contentType := s.downscaleForVision(ctx, upload)
+	return &scanPhoto{
+		Upload:      upload,
+		visionImage: base64.StdEncoding.EncodeToString(data),
+		visionType:  contentType,
+	}
+}
+
+// downscaleForVision re-encodes photos whose longest side is over the vision
+// limit as smaller JPEGs. Photos that can't be decoded are sent as they are,
+// since the vision model is the final judge of whether they're usable.
+func (s *Service) downscaleForVision(ctx context.Context, upload *Upload) ([]byte, string) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+	if upload.ContentType == "image/heic" || s.maxVisionDimension <= 0 {
+		return upload.Data, upload.ContentType
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(upload.Data))
+	if err != nil {
+		logger.Printf("Warning: failed to read scan image size: %v", err)
+		return upload.Data, upload.ContentType
+	}
+	longest := max(config.Width, config.Height)
+	if longest <= s.maxVisionDimension {
+		return upload.Data, upload.ContentType
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(upload.Data))
+	if err != nil {
+		logger.Printf("Warning: failed to decode scan image: %v", err)
+		return upload.Data, upload.ContentType
+	}
+
+	scale := float64(s.maxVisionDimension) / float64(longest)
+	width := max(int(float64(config.Width)*scale), 1)
+	height := max(int(float64(config.Height)*scale), 1)
+	resized := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.ApproxBiLinear.Scale(resized, resized.Bounds(), img, img.Bounds(), draw.Over, nil)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, resized, &jpeg.Options{Quality: visionJPEGQuality}); err != nil {
+		logger.Printf("Warning: failed to encode downscaled scan image: %v", err)
+		return upload.Data, upload.ContentType
+	}
+
+	logger.Printf("Downscaled %dx%d scan image to %dx%d for the vision model", config.Width, config.Height, width, height)
+	return buf.Bytes(), "image/jpeg"
+}
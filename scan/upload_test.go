@@ -0,0 +1,72 @@
+package scan
+
+import (
+	"CarBN/common"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"testing"
+)
+
+// pngHeader is the start of a PNG claiming to be width by height, which is
+// all image.DecodeConfig reads
+func pngHeader(width, height uint32) []byte {
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], width)
+	binary.BigEndian.PutUint32(ihdr[8:], height)
+	ihdr[12], ihdr[13] = 8, 0 // 8-bit grayscale
+
+	data := []byte("\x89PNG\r\n\x1a\n")
+	data = binary.BigEndian.AppendUint32(data, 13)
+	data = append(data, ihdr...)
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(ihdr))
+}
+
+func TestStreamUpload(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	png := testPNG(t)
+	const maxBytes = 1 << 20
+
+	tests := []struct {
+		name     string
+		data     []byte
+		wantType string
+		wantErr  error
+	}{
+		{"png", png, "image/png", nil},
+		{"heic", append([]byte{0, 0, 0, 0x18}, []byte("ftypheic\x00\x00\x00\x00mif1heic")...), "image/heic", nil},
+		{"empty", nil, "", common.ErrBadRequest},
+		{"not an image", []byte("<html>hello</html>"), "", common.ErrUnsupportedMedia},
+		{"too large", append(png, make([]byte, maxBytes)...), "", common.ErrPayloadTooLarge},
+		{"too many pixels", pngHeader(10000, 10000), "", common.ErrBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := io.LimitReader(bytes.NewReader(tt.data), maxBytes+1)
+			upload, err := streamUpload(src, maxBytes)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("streamUpload error = %v, want %v", err, tt.wantErr)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("streamUpload: %v", err)
+				}
+				if upload.ContentType != tt.wantType || !bytes.Equal(upload.Data, tt.data) {
+					t.Errorf("upload = %s, %d bytes, want %s, %d bytes", upload.ContentType, len(upload.Data), tt.wantType, len(tt.data))
+				}
+			}
+
+			// The spooled copy is always cleaned up
+			if entries, err := os.ReadDir(tmp); err != nil || len(entries) > 0 {
+				t.Errorf("temp dir holds %d files (%v)", len(entries), err)
+			}
+		})
+	}
+}
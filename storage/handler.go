@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"CarBN/common"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timestampedName matches file names ending in a millisecond timestamp, like
+// high_res_1700000000000.jpg. Images are never rewritten under such names, so
+// they can be cached forever.
+var timestampedName = regexp.MustCompile(`_\d{13,}\.[A-Za-z]+$`)
+
+const (
+	immutableCacheControl  = "public, max-age=31536000, immutable"
+	revalidateCacheControl = "public, no-cache"
+)
+
+type HTTPHandler struct {
+	store  BlobStore
+	signer *URLSigner
+}
+
+func NewHTTPHandler(store BlobStore, signer *URLSigner) *HTTPHandler {
+	return &HTTPHandler{store: store, signer: signer}
+}
+
+// ServesImages reports whether the server must serve /images/ itself: in
+// development, when the images are in a bucket nothing else can read, and
+// whenever URLs are signed, since only the server checks their signatures
+func ServesImages(devMode bool, signer *URLSigner) bool {
+	return devMode || BackendFromEnv() != BackendLocal || signer != nil
+}
+
+// HandleGetImage serves the public image at /images/{key}. With ?w= it serves
+// the variant closest to that width, creating it on first request. Images
+// the signer's policy covers need the exp and sig it signed them with.
+func (h *HTTPHandler) HandleGetImage(w http.ResponseWriter, r *http.Request) {
+	logger := r.Context().Value(common.LoggerCtxKey).(*log.Logger)
+
+	// Scan photos share the store but are never served
+	key, err := CleanKey(strings.TrimPrefix(r.URL.Path, "/images/"))
+	if err != nil || !IsPublic(key) {
+		http.NotFound(w, r)
+		return
+	}
+
+	signed := h.signer.RequiresSignature(key)
+	if err := h.signer.Verify(key, r.URL.Query()); err != nil {
+		common.WriteError(w, r, common.Forbidden(err.Error()))
+		return
+	}
+
+	if v := r.URL.Query().Get("w"); v != "" {
+		width, err := strconv.Atoi(v)
+		if err != nil || width < 1 {
+			common.WriteError(w, r, common.BadRequest("w must be a positive width"))
+			return
+		}
+		if _, _, ok := VariantSource(key); !ok {
+			key = VariantKey(key, SnapWidth(width))
+		}
+	}
+
+	body, obj, err := h.open(r, key)
+	if errors.Is(err, ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		logger.Printf("Failed to read image %s: %v", key, err)
+		common.WriteError(w, r, common.Internal("failed to read image"))
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("ETag", objectETag(obj))
+	cacheControl := revalidateCacheControl
+	if timestampedName.MatchString(path.Base(key)) {
+		cacheControl = immutableCacheControl
+	}
+	// Keep shared caches from serving a signed image past its URL's expiry
+	if signed {
+		cacheControl = strings.Replace(cacheControl, "public", "private", 1)
+	}
+	w.Header().Set("Cache-Control", cacheControl)
+	if obj.ContentType != "" {
+		w.Header().Set("Content-Type", obj.ContentType)
+	}
+
+	// Handles If-None-Match, ranges and HEAD
+	http.ServeContent(w, r, path.Base(key), obj.ModTime, body)
+}
+
+// objectETag is the store's ETag for obj, or one made from its size and
+// modification time when the store has none. Either changes whenever the
+// blob is rewritten, without reading it.
+func objectETag(obj *Object) string {
+	if obj.ETag != "" {
+		return obj.ETag
+	}
+	return fmt.Sprintf(`"%x-%x"`, obj.ModTime.UnixNano(), obj.Size)
+}
+
+// open returns the blob at key, resizing a missing variant from its image.
+// The caller closes it.
+func (h *HTTPHandler) open(r *http.Request, key string) (io.ReadSeekCloser, *Object, error) {
+	logger := r.Context().Value(common.LoggerCtxKey).(*log.Logger)
+
+	body, obj, err := h.store.Get(r.Context(), key)
+	if err == nil {
+		seeker, err := seekable(body)
+		return seeker, obj, err
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, nil, err
+	}
+	source, width, ok := VariantSource(key)
+	if !ok {
+		return nil, nil, err
+	}
+
+	original, err := h.readBlob(r, source)
+	if err != nil {
+		return nil, nil, err
+	}
+	resized, err := Resize(original, width)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Serve the variant even if it can't be kept; the next request tries again
+	if err := h.store.Put(r.Context(), key, resized, "image/jpeg"); err != nil {
+		logger.Printf("Warning: failed to store variant %s: %v", key, err)
+	}
+	obj = &Object{Key: key, Size: int64(len(resized)), ModTime: time.Now(), ContentType: "image/jpeg"}
+	return nopSeekCloser{bytes.NewReader(resized)}, obj, nil
+}
+
+func (h *HTTPHandler) readBlob(r *http.Request, key string) ([]byte, error) {
+	body, _, err := h.store.Get(r.Context(), key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// seekable returns body as is when it can seek, as local files can, and
+// otherwise reads it into memory so ranges can be served from it
+func seekable(body io.ReadCloser) (io.ReadSeekCloser, error) {
+	if seeker, ok := body.(io.ReadSeekCloser); ok {
+		return seeker, nil
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return nopSeekCloser{bytes.NewReader(data)}, nil
+}
+
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error { return nil }
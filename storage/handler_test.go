@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"CarBN/common"
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandleGetImageETag(t *testing.T) {
+	store, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewGray(image.Rect(0, 0, 640, 480))); err != nil {
+		t.Fatal(err)
+	}
+	const key = GeneratedPrefix + "car_1/red/high_res_1700000000000.png"
+	if err := store.Put(context.Background(), key, img.Bytes(), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHTTPHandler(store, nil)
+
+	get := func(path, etag string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/images/"+path, nil)
+		r = r.WithContext(context.WithValue(r.Context(), common.LoggerCtxKey, log.New(io.Discard, "", 0)))
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		handler.HandleGetImage(w, r)
+		return w
+	}
+
+	for _, path := range []string{key, key + "?w=256"} {
+		if first := get(path, ""); first.Code != http.StatusOK || first.Body.Len() == 0 {
+			t.Fatalf("GET %s = %d with %d bytes", path, first.Code, first.Body.Len())
+		}
+
+		// A missing variant is stored by the first request, so from the
+		// second on its ETag is the stored file's
+		etag := get(path, "").Header().Get("ETag")
+		if etag == "" {
+			t.Fatalf("GET %s has no ETag", path)
+		}
+		if again := get(path, "").Header().Get("ETag"); again != etag {
+			t.Errorf("GET %s ETag changed from %s to %s", path, etag, again)
+		}
+		if cached := get(path, etag); cached.Code != http.StatusNotModified {
+			t.Errorf("GET %s with If-None-Match = %d, want %d", path, cached.Code, http.StatusNotModified)
+		}
+	}
+	if served := get(key, ""); !bytes.Equal(served.Body.Bytes(), img.Bytes()) {
+		t.Error("served image differs from the stored one")
+	}
+
+	// Rewriting the image changes its ETag
+	before := get(key, "").Header().Get("ETag")
+	if err := store.Put(context.Background(), key, append(img.Bytes(), 0), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	if after := get(key, "").Header().Get("ETag"); after == before {
+		t.Errorf("ETag %s unchanged after the image was rewritten", after)
+	}
+}
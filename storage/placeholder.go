@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	// BlurHash components across and down; 4x3 suits the landscape car renders
+	blurHashX = 4
+	blurHashY = 3
+	// placeholderWidth is the width images are shrunk to before they're
+	// summarised, which is plenty for a hash of 12 components
+	placeholderWidth = 32
+)
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// Placeholder is what clients draw while an image loads: a BlurHash
+// (https://blurha.sh) and the image's dominant color as #rrggbb
+type Placeholder struct {
+	BlurHash      string `json:"blurhash"`
+	DominantColor string `json:"dominant_color"`
+}
+
+// NewPlaceholder returns the placeholder stored in a pair of nullable
+// columns, or nil when there's none. An empty hash means it couldn't be
+// computed.
+func NewPlaceholder(blurHash, dominantColor *string) *Placeholder {
+	if blurHash == nil || *blurHash == "" {
+		return nil
+	}
+	p := &Placeholder{BlurHash: *blurHash}
+	if dominantColor != nil {
+		p.DominantColor = *dominantColor
+	}
+	return p
+}
+
+// Columns returns the placeholder as the values of a pair of nullable columns
+func (p *Placeholder) Columns() (blurHash, dominantColor *string) {
+	if p == nil {
+		return nil, nil
+	}
+	return &p.BlurHash, &p.DominantColor
+}
+
+// ComputePlaceholder works out the placeholder of an encoded image
+func ComputePlaceholder(data []byte) (*Placeholder, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return nil, errors.New("image is empty")
+	}
+	width := min(bounds.Dx(), placeholderWidth)
+	height := max(1, bounds.Dy()*width/bounds.Dx())
+	small := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), img, bounds, draw.Src, nil)
+
+	return &Placeholder{
+		BlurHash:      blurHash(small),
+		DominantColor: dominantColor(small),
+	}, nil
+}
+
+// blurHash encodes img following the reference implementation at
+// https://github.com/woltapp/blurhash
+func blurHash(img *image.RGBA) string {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+
+	// Linear RGB of every pixel, computed once for all components
+	linear := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := img.PixOffset(x, y)
+			linear[y*width+x] = [3]float64{
+				sRGBToLinear(img.Pix[i]),
+				sRGBToLinear(img.Pix[i+1]),
+				sRGBToLinear(img.Pix[i+2]),
+			}
+		}
+	}
+
+	var factors [blurHashX * blurHashY][3]float64
+	for j := 0; j < blurHashY; j++ {
+		for i := 0; i < blurHashX; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var r, g, b float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := math.Cos(math.Pi*float64(i*x)/float64(width)) * math.Cos(math.Pi*float64(j*y)/float64(height))
+					pixel := linear[y*width+x]
+					r += basis * pixel[0]
+					g += basis * pixel[1]
+					b += basis * pixel[2]
+				}
+			}
+			scale := normalisation / float64(width*height)
+			factors[j*blurHashX+i] = [3]float64{r * scale, g * scale, b * scale}
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encode83((blurHashX-1)+(blurHashY-1)*9, 1))
+
+	dc, ac := factors[0], factors[1:]
+	maximum := 0.0
+	for _, f := range ac {
+		maximum = max(maximum, math.Abs(f[0]), math.Abs(f[1]), math.Abs(f[2]))
+	}
+	quantisedMaximum := int(math.Max(0, math.Min(82, math.Floor(maximum*166-0.5))))
+	maximumValue := float64(quantisedMaximum+1) / 166
+	hash.WriteString(encode83(quantisedMaximum, 1))
+
+	hash.WriteString(encode83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+	for _, f := range ac {
+		hash.WriteString(encode83(quantiseAC(f[0], maximumValue)*19*19+quantiseAC(f[1], maximumValue)*19+quantiseAC(f[2], maximumValue), 2))
+	}
+	return hash.String()
+}
+
+func quantiseAC(value, maximumValue float64) int {
+	v := value / maximumValue
+	signed := math.Copysign(math.Sqrt(math.Abs(v)), v)
+	return int(math.Max(0, math.Min(18, math.Floor(signed*9+9.5))))
+}
+
+func encode83(value, length int) string {
+	var b strings.Builder
+	for i := length - 1; i >= 0; i-- {
+		digit := (value / int(math.Pow(83, float64(i)))) % 83
+		b.WriteByte(base83Chars[digit])
+	}
+	return b.String()
+}
+
+func sRGBToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+// dominantColor returns the average of the most common colors in img, with
+// colors grouped by the top 4 bits of each channel
+func dominantColor(img *image.RGBA) string {
+	type bucket struct {
+		count   int
+		r, g, b int
+	}
+	buckets := make(map[int]*bucket)
+	var top *bucket
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		r, g, b := int(img.Pix[i]), int(img.Pix[i+1]), int(img.Pix[i+2])
+		key := (r>>4)<<8 | (g>>4)<<4 | b>>4
+		bk := buckets[key]
+		if bk == nil {
+			bk = &bucket{}
+			buckets[key] = bk
+		}
+		bk.count++
+		bk.r += r
+		bk.g += g
+		bk.b += b
+		if top == nil || bk.count > top.count {
+			top = bk
+		}
+	}
+	return fmt.Sprintf("#%02x%02x%02x", top.r/top.count, top.g/top.count, top.b/top.count)
+}
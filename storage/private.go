@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// ArchivePrefix is where the image garbage collector moves the images it
+// archives, keeping their key
+const ArchivePrefix = "archive/"
+
+// privatePrefixes are the keys that must never be readable by anything
+// serving the store's files directly
+var privatePrefixes = []string{ScansPrefix, ArchivePrefix}
+
+func isPrivateKey(key string) bool {
+	for _, prefix := range privatePrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// privateStore keeps scan photos and archived images in a store of their own,
+// and everything else in the public one. A local public store's directory can
+// then be served by a reverse proxy without exposing scan photos, which carry
+// the user's location in their EXIF.
+type privateStore struct {
+	public  BlobStore
+	private BlobStore
+}
+
+// NewPrivateStore routes the keys under scans/ and archive/ to private and
+// all others to public
+func NewPrivateStore(public, private BlobStore) BlobStore {
+	return &privateStore{public: public, private: private}
+}
+
+func (s *privateStore) storeFor(key string) BlobStore {
+	if isPrivateKey(key) {
+		return s.private
+	}
+	return s.public
+}
+
+func (s *privateStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	return s.storeFor(key).Put(ctx, key, data, contentType)
+}
+
+func (s *privateStore) Get(ctx context.Context, key string) (io.ReadCloser, *Object, error) {
+	return s.storeFor(key).Get(ctx, key)
+}
+
+func (s *privateStore) Delete(ctx context.Context, key string) error {
+	return s.storeFor(key).Delete(ctx, key)
+}
+
+func (s *privateStore) List(ctx context.Context, prefix string, fn func(Object) error) error {
+	if isPrivateKey(prefix) {
+		return s.private.List(ctx, prefix, fn)
+	}
+
+	err := s.public.List(ctx, prefix, func(obj Object) error {
+		if isPrivateKey(obj.Key) {
+			return nil
+		}
+		return fn(obj)
+	})
+	if err != nil {
+		return err
+	}
+	for _, private := range privatePrefixes {
+		if strings.HasPrefix(private, prefix) {
+			if err := s.private.List(ctx, private, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkPrivateDir makes sure the private directory of the local backend
+// can't be reached through the public one, or the other way round
+func checkPrivateDir(publicDir, privateDir string) error {
+	public, err := filepath.Abs(publicDir)
+	if err != nil {
+		return err
+	}
+	private, err := filepath.Abs(privateDir)
+	if err != nil {
+		return err
+	}
+	for _, pair := range [][2]string{{public, private}, {private, public}} {
+		if rel, err := filepath.Rel(pair[0], pair[1]); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("SCAN_STORAGE_DIR %s must be outside STORAGE_DIR %s", privateDir, publicDir)
+		}
+	}
+	return nil
+}
+
+// movePrivateBlobs moves scan photos and archived images saved in the public
+// store by earlier versions into the private one. It returns how many were
+// moved.
+func movePrivateBlobs(ctx context.Context, public, private BlobStore) (int, error) {
+	var keys []string
+	for _, prefix := range privatePrefixes {
+		err := public.List(ctx, prefix, func(obj Object) error {
+			keys = append(keys, obj.Key)
+			return nil
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to list %s: %w", prefix, err)
+		}
+	}
+
+	for i, key := range keys {
+		body, obj, err := public.Get(ctx, key)
+		if err != nil {
+			return i, fmt.Errorf("failed to read %s: %w", key, err)
+		}
+		data, err := io.ReadAll(body)
+		body.Close()
+		if err != nil {
+			return i, fmt.Errorf("failed to read %s: %w", key, err)
+		}
+		if err := private.Put(ctx, key, data, obj.ContentType); err != nil {
+			return i, fmt.Errorf("failed to move %s: %w", key, err)
+		}
+		if err := public.Delete(ctx, key); err != nil {
+			return i, fmt.Errorf("failed to remove %s: %w", key, err)
+		}
+	}
+	return len(keys), nil
+}
@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Image URL policies
+const (
+	// Profile pictures and premium images need a signed URL; car renders,
+	// which everyone who collects the car shares, don't
+	URLPolicyPrivate = "private"
+	// Every image needs a signed URL
+	URLPolicyAll = "all"
+)
+
+const defaultURLTTL = 24 * time.Hour
+
+// premiumImage matches premium upgrade images, which are rendered for one user
+var premiumImage = regexp.MustCompile(`^` + GeneratedPrefix + `car_\d+/premium/`)
+
+var (
+	ErrURLUnsigned = errors.New("image URL is not signed")
+	ErrURLExpired  = errors.New("image URL has expired")
+	ErrURLInvalid  = errors.New("image URL signature is invalid")
+)
+
+// URLSigner signs image paths with an HMAC and an expiry, so an image can only
+// be fetched through a URL handed out by an endpoint that checked the caller
+// may see it. A nil signer signs nothing and accepts everything.
+type URLSigner struct {
+	secret []byte
+	ttl    time.Duration
+	policy string
+}
+
+// NewURLSignerFromEnv creates the signer from IMAGE_URL_SECRET.
+// IMAGE_URL_TTL sets how long URLs stay valid (default 24h) and
+// IMAGE_URL_POLICY which images need them. The secret is required outside
+// development; in development, leaving it empty turns signing off and every
+// served image is public.
+func NewURLSignerFromEnv(devMode bool) (*URLSigner, error) {
+	secret := os.Getenv("IMAGE_URL_SECRET")
+	if secret == "" {
+		if !devMode {
+			return nil, errors.New("IMAGE_URL_SECRET must be set")
+		}
+		log.Printf("Warning: IMAGE_URL_SECRET is empty, image URLs won't be signed")
+		return nil, nil
+	}
+
+	ttl := defaultURLTTL
+	if v := os.Getenv("IMAGE_URL_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			ttl = d
+		} else {
+			log.Printf("Warning: invalid IMAGE_URL_TTL %q, using %s", v, defaultURLTTL)
+		}
+	}
+
+	policy := strings.ToLower(os.Getenv("IMAGE_URL_POLICY"))
+	switch policy {
+	case "":
+		policy = URLPolicyPrivate
+	case URLPolicyPrivate, URLPolicyAll:
+	default:
+		log.Printf("Warning: unknown IMAGE_URL_POLICY %q, using %s", policy, URLPolicyPrivate)
+		policy = URLPolicyPrivate
+	}
+
+	return &URLSigner{secret: []byte(secret), ttl: ttl, policy: policy}, nil
+}
+
+// RequiresSignature reports whether the image at key is only served through a
+// signed URL
+func (s *URLSigner) RequiresSignature(key string) bool {
+	if s == nil || !IsPublic(key) {
+		return false
+	}
+	if s.policy == URLPolicyAll {
+		return true
+	}
+	key = signedKey(key)
+	return strings.HasPrefix(key, ProfilePicturesPrefix) || premiumImage.MatchString(key)
+}
+
+// Sign returns an image path, relative to /images/ and optionally with a
+// query like ?w=256, with an expiry and signature added when its image needs
+// them. Expiries are rounded so a path signs the same for a whole TTL, which
+// keeps the URLs cacheable.
+func (s *URLSigner) Sign(path string) string {
+	escaped, query, _ := strings.Cut(path, "?")
+	key, err := url.PathUnescape(escaped)
+	if err != nil || !s.RequiresSignature(key) {
+		return path
+	}
+
+	expires := time.Now().Truncate(s.ttl).Add(2 * s.ttl).Unix()
+	signature := "exp=" + strconv.FormatInt(expires, 10) + "&sig=" + s.signature(signedKey(key), expires)
+	if query == "" {
+		return escaped + "?" + signature
+	}
+	return escaped + "?" + query + "&" + signature
+}
+
+// SignPtr signs a nullable path in place
+func (s *URLSigner) SignPtr(path *string) {
+	if path != nil && *path != "" {
+		*path = s.Sign(*path)
+	}
+}
+
+// SignVariants signs each of an image's variant paths
+func (s *URLSigner) SignVariants(urls *VariantURLs) *VariantURLs {
+	if urls == nil {
+		return nil
+	}
+	return &VariantURLs{
+		Thumb:  s.Sign(urls.Thumb),
+		Medium: s.Sign(urls.Medium),
+		Full:   s.Sign(urls.Full),
+	}
+}
+
+// Verify checks the expiry and signature in query for the image at key.
+// The signature covers the image, not the width, so it's good for every
+// variant.
+func (s *URLSigner) Verify(key string, query url.Values) error {
+	if !s.RequiresSignature(key) {
+		return nil
+	}
+
+	exp, sig := query.Get("exp"), query.Get("sig")
+	if exp == "" || sig == "" {
+		return ErrURLUnsigned
+	}
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return ErrURLInvalid
+	}
+	if !hmac.Equal([]byte(sig), []byte(s.signature(signedKey(key), expires))) {
+		return ErrURLInvalid
+	}
+	if time.Now().Unix() > expires {
+		return ErrURLExpired
+	}
+	return nil
+}
+
+// signedKey is the key a signature covers: the image itself, for a variant
+func signedKey(key string) string {
+	if source, _, ok := VariantSource(key); ok {
+		return source
+	}
+	return key
+}
+
+func (s *URLSigner) signature(key string, expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(key + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewURLSignerFromEnv(t *testing.T) {
+	tests := []struct {
+		name       string
+		secret     string
+		devMode    bool
+		wantSigner bool
+		wantErr    bool
+	}{
+		{"production with a secret", "image secret", false, true, false},
+		{"production without a secret", "", false, false, true},
+		{"development with a secret", "image secret", true, true, false},
+		{"development without a secret", "", true, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("IMAGE_URL_SECRET", tt.secret)
+			t.Setenv("JWT_SECRET", "jwt secret")
+			signer, err := NewURLSignerFromEnv(tt.devMode)
+			if (err != nil) != tt.wantErr || (signer != nil) != tt.wantSigner {
+				t.Fatalf("NewURLSignerFromEnv = %v, %v", signer, err)
+			}
+			if signer != nil && string(signer.secret) != tt.secret {
+				t.Errorf("secret = %q, want %q", signer.secret, tt.secret)
+			}
+		})
+	}
+}
+
+func testSigner(policy string) *URLSigner {
+	return &URLSigner{secret: []byte("test secret"), ttl: time.Hour, policy: policy}
+}
+
+// signedQuery signs path and returns its key and query
+func signedQuery(t *testing.T, s *URLSigner, path string) (string, url.Values) {
+	t.Helper()
+	escaped, rawQuery, _ := strings.Cut(s.Sign(path), "?")
+	key, err := url.PathUnescape(escaped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, query
+}
+
+func TestURLSignerRequiresSignature(t *testing.T) {
+	tests := []struct {
+		key     string
+		private bool
+		all     bool
+	}{
+		{"generated/car_1/white/high_res_1.jpg", false, true},
+		{"generated/car_1/premium/high_res_1.jpg", true, true},
+		{"profile_pictures/user_1.jpg", true, true},
+		{VariantKey("profile_pictures/user_1.jpg", 256), true, true},
+		{VariantKey("generated/car_1/white/high_res_1.jpg", 256), false, true},
+		{"scans/user_1/scan_1.jpg", false, false},
+	}
+	for _, tt := range tests {
+		if got := testSigner(URLPolicyPrivate).RequiresSignature(tt.key); got != tt.private {
+			t.Errorf("private policy: RequiresSignature(%q) = %v, want %v", tt.key, got, tt.private)
+		}
+		if got := testSigner(URLPolicyAll).RequiresSignature(tt.key); got != tt.all {
+			t.Errorf("all policy: RequiresSignature(%q) = %v, want %v", tt.key, got, tt.all)
+		}
+	}
+
+	var nilSigner *URLSigner
+	if nilSigner.RequiresSignature("profile_pictures/user_1.jpg") {
+		t.Error("a nil signer requires signatures")
+	}
+}
+
+func TestURLSignerSignVerify(t *testing.T) {
+	s := testSigner(URLPolicyPrivate)
+	const picture = "profile_pictures/user_1.jpg"
+
+	key, query := signedQuery(t, s, picture)
+	if key != picture || query.Get("exp") == "" || query.Get("sig") == "" {
+		t.Fatalf("Sign(%q) = %q %v, want an expiry and signature", picture, key, query)
+	}
+	if err := s.Verify(key, query); err != nil {
+		t.Errorf("Verify of a signed URL: %v", err)
+	}
+
+	// The signature covers the image, so it's good for every variant
+	_, query = signedQuery(t, s, picture+"?w=256")
+	if query.Get("w") != "256" {
+		t.Errorf("width lost when signing: %v", query)
+	}
+	if err := s.Verify(VariantKey(picture, 256), query); err != nil {
+		t.Errorf("Verify of a variant: %v", err)
+	}
+
+	// Paths that don't need a signature are left alone
+	if got := s.Sign("generated/car_1/white/high_res_1.jpg"); got != "generated/car_1/white/high_res_1.jpg" {
+		t.Errorf("Sign of a shared render = %q", got)
+	}
+
+	// Signatures are rounded to the TTL, so the same path signs the same
+	if a, b := s.Sign(picture), s.Sign(picture); a != b {
+		t.Errorf("signatures differ: %q, %q", a, b)
+	}
+}
+
+func TestURLSignerVerifyRejects(t *testing.T) {
+	s := testSigner(URLPolicyPrivate)
+	const picture = "profile_pictures/user_1.jpg"
+	_, signed := signedQuery(t, s, picture)
+
+	expired := url.Values{}
+	past := time.Now().Add(-time.Minute).Unix()
+	expired.Set("exp", strconv.FormatInt(past, 10))
+	expired.Set("sig", s.signature(picture, past))
+
+	tampered := url.Values{}
+	tampered.Set("exp", strconv.FormatInt(time.Now().Add(24*365*time.Hour).Unix(), 10))
+	tampered.Set("sig", signed.Get("sig"))
+
+	tests := []struct {
+		name  string
+		key   string
+		query url.Values
+		want  error
+	}{
+		{"unsigned", picture, url.Values{}, ErrURLUnsigned},
+		{"expired", picture, expired, ErrURLExpired},
+		{"expiry changed", picture, tampered, ErrURLInvalid},
+		{"other image", "profile_pictures/user_2.jpg", signed, ErrURLInvalid},
+		{"bad expiry", picture, url.Values{"exp": {"soon"}, "sig": {"x"}}, ErrURLInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.Verify(tt.key, tt.query); !errors.Is(err, tt.want) {
+				t.Errorf("Verify = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	other := &URLSigner{secret: []byte("other secret"), ttl: time.Hour, policy: URLPolicyPrivate}
+	if err := other.Verify(picture, signed); !errors.Is(err, ErrURLInvalid) {
+		t.Errorf("Verify with another secret = %v, want %v", err, ErrURLInvalid)
+	}
+}
@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Storage backends
+const (
+	BackendLocal = "local"
+	BackendS3    = "s3"
+)
+
+const (
+	defaultLocalDir   = "_resources/images"
+	defaultPrivateDir = "_resources/private"
+)
+
+// Key prefixes. Keys are what the database stores for an image, and what
+// clients append to /images/ to fetch it.
+const (
+	GeneratedPrefix       = "generated/"        // Car renders and premium upgrades
+	ProfilePicturesPrefix = "profile_pictures/" // User profile pictures
+	ScansPrefix           = "scans/"            // Scan photos, kept for review and never served
+)
+
+// ErrNotFound is returned for a key with no blob
+var ErrNotFound = errors.New("blob not found")
+
+// Object describes a stored blob
+type Object struct {
+	Key         string
+	Size        int64
+	ModTime     time.Time
+	ContentType string
+	ETag        string // Quoted, as sent in an ETag header. Empty when the store doesn't keep one.
+}
+
+// BlobStore stores images by key. Keys are slash separated paths relative to
+// the store's root, like generated/car_1/red/high_res_1700000000000.jpg.
+type BlobStore interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	// Get returns ErrNotFound when there's no blob at key. The caller closes
+	// the reader.
+	Get(ctx context.Context, key string) (io.ReadCloser, *Object, error)
+	// Delete removes the blob at key. Deleting a missing blob isn't an error.
+	Delete(ctx context.Context, key string) error
+	// List calls fn for every blob whose key starts with prefix
+	List(ctx context.Context, prefix string, fn func(Object) error) error
+}
+
+// BackendFromEnv returns the backend named by STORAGE_BACKEND
+func BackendFromEnv() string {
+	backend := strings.ToLower(os.Getenv("STORAGE_BACKEND"))
+	if backend == "" {
+		return BackendLocal
+	}
+	return backend
+}
+
+// NewFromEnv builds the store named by STORAGE_BACKEND: "local" (the default)
+// keeps blobs under STORAGE_DIR, with scan photos and archived images under
+// SCAN_STORAGE_DIR, "s3" in the S3_BUCKET of any S3-compatible service.
+func NewFromEnv() (BlobStore, error) {
+	backend := BackendFromEnv()
+	switch backend {
+	case BackendLocal:
+		dir := os.Getenv("STORAGE_DIR")
+		if dir == "" {
+			dir = defaultLocalDir
+		}
+		privateDir := os.Getenv("SCAN_STORAGE_DIR")
+		if privateDir == "" {
+			privateDir = defaultPrivateDir
+		}
+		if err := checkPrivateDir(dir, privateDir); err != nil {
+			return nil, err
+		}
+		public, err := NewLocalStore(dir)
+		if err != nil {
+			return nil, err
+		}
+		private, err := NewLocalStore(privateDir)
+		if err != nil {
+			return nil, err
+		}
+		moved, err := movePrivateBlobs(context.Background(), public, private)
+		if err != nil {
+			return nil, fmt.Errorf("failed to move scan photos out of %s: %w", dir, err)
+		}
+		if moved > 0 {
+			log.Printf("Moved %d scan photos and archived images from %s to %s", moved, dir, privateDir)
+		}
+		log.Printf("Image storage: local directory %s, scan photos in %s", dir, privateDir)
+		return NewPrivateStore(public, private), nil
+	case BackendS3:
+		pathStyle := os.Getenv("S3_ENDPOINT") != ""
+		if v := os.Getenv("S3_PATH_STYLE"); v != "" {
+			var err error
+			if pathStyle, err = strconv.ParseBool(v); err != nil {
+				return nil, fmt.Errorf("invalid S3_PATH_STYLE %q: %w", v, err)
+			}
+		}
+		store, err := NewS3Store(S3Config{
+			Endpoint:        os.Getenv("S3_ENDPOINT"),
+			Region:          os.Getenv("S3_REGION"),
+			Bucket:          os.Getenv("S3_BUCKET"),
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+			PathStyle:       pathStyle,
+		})
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Image storage: S3 bucket %s at %s", store.bucket, store.endpoint.Host)
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q", backend)
+	}
+}
+
+// CleanKey validates a key and returns it in canonical form. Keys can't be
+// absolute or climb out of the store's root.
+func CleanKey(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	cleaned := path.Clean(key)
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return cleaned, nil
+}
+
+// IsPublic reports whether the blob at key may be served to clients. Scan
+// photos are private; variants are as public as the image they come from.
+func IsPublic(key string) bool {
+	if source, _, ok := VariantSource(key); ok {
+		key = source
+	}
+	return strings.HasPrefix(key, GeneratedPrefix) || strings.HasPrefix(key, ProfilePicturesPrefix)
+}
+
+// PutImage stores image data with the content type sniffed from it
+func PutImage(ctx context.Context, store BlobStore, key string, data []byte) error {
+	return store.Put(ctx, key, data, http.DetectContentType(data))
+}
+
+// ReadAll returns the contents of the blob at key
+func ReadAll(ctx context.Context, store BlobStore, key string) ([]byte, error) {
+	body, _, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
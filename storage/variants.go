@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// VariantsPrefix is where resized copies of images are kept, as
+// variants/w<width>/<key of the image>
+const VariantsPrefix = "variants/"
+
+// variantQuality is the JPEG quality of resized images
+const variantQuality = 90
+
+// Variant is a width images are resized to
+type Variant struct {
+	Name  string
+	Width int
+}
+
+// Variants are the widths images are served at, smallest first. A request for
+// any other width gets the next larger one.
+var Variants = []Variant{
+	{Name: "thumb", Width: 256},
+	{Name: "medium", Width: 512},
+	{Name: "full", Width: 1024},
+}
+
+// VariantURLs are the paths of an image's variants. Like the image's own key
+// they're relative to /images/.
+type VariantURLs struct {
+	Thumb  string `json:"thumb"`
+	Medium string `json:"medium"`
+	Full   string `json:"full"`
+}
+
+// URLsFor returns the variant paths of the image at key, or nil when key isn't
+// a served image, like the placeholder of a car still rendering
+func URLsFor(key string) *VariantURLs {
+	if !IsPublic(key) {
+		return nil
+	}
+	path := (&url.URL{Path: key}).EscapedPath()
+	return &VariantURLs{
+		Thumb:  path + "?w=" + strconv.Itoa(Variants[0].Width),
+		Medium: path + "?w=" + strconv.Itoa(Variants[1].Width),
+		Full:   path + "?w=" + strconv.Itoa(Variants[2].Width),
+	}
+}
+
+// SnapWidth returns the variant width to serve for a requested width
+func SnapWidth(width int) int {
+	for _, v := range Variants {
+		if width <= v.Width {
+			return v.Width
+		}
+	}
+	return Variants[len(Variants)-1].Width
+}
+
+// VariantKey is the key of the image at key resized to width
+func VariantKey(key string, width int) string {
+	return fmt.Sprintf("%sw%d/%s", VariantsPrefix, width, key)
+}
+
+// VariantSource returns the key of the image a variant key was resized from,
+// and the variant's width. Only the widths in Variants are variant keys.
+func VariantSource(key string) (string, int, bool) {
+	rest, ok := strings.CutPrefix(key, VariantsPrefix+"w")
+	if !ok {
+		return "", 0, false
+	}
+	w, source, ok := strings.Cut(rest, "/")
+	width, err := strconv.Atoi(w)
+	if !ok || err != nil || source == "" || SnapWidth(width) != width {
+		return "", 0, false
+	}
+	return source, width, true
+}
+
+// SaveImage stores an image along with all its variants and returns its
+// placeholder
+func SaveImage(ctx context.Context, store BlobStore, key string, data []byte) (*Placeholder, error) {
+	if err := PutImage(ctx, store, key, data); err != nil {
+		return nil, err
+	}
+	for _, v := range Variants {
+		resized, err := Resize(data, v.Width)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s variant of %s: %w", v.Name, key, err)
+		}
+		if err := store.Put(ctx, VariantKey(key, v.Width), resized, "image/jpeg"); err != nil {
+			return nil, err
+		}
+	}
+	placeholder, err := ComputePlaceholder(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute placeholder of %s: %w", key, err)
+	}
+	return placeholder, nil
+}
+
+// Resize scales an image to width, keeping its aspect ratio, and encodes it as
+// a JPEG. Images narrower than width keep their size.
+func Resize(data []byte, width int) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	bounds := img.Bounds()
+	if bounds.Dx() > width {
+		height := max(1, bounds.Dy()*width/bounds.Dx())
+		resized := image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.CatmullRom.Scale(resized, resized.Bounds(), img, bounds, draw.Over, nil)
+		img = resized
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: variantQuality}); err != nil {
+		return nil, fmt.Errorf("failed to encode JPEG: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,308 @@
+package subscription
+
+import (
+	"CarBN/common"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Credit buckets. Scans spend promo credits that expire first (soonest first),
+// then the subscription allowance, then promo credits that don't expire, and
+// pack credits last, so the credits a user paid for outright last longest.
+const (
+	CreditBucketSubscription = "subscription"
+	CreditBucketPack         = "pack"
+	CreditBucketPromo        = "promo"
+)
+
+// Columns holding the buckets that aren't kept per grant
+var creditBucketColumns = map[string]string{
+	CreditBucketSubscription: "subscription_credits",
+	CreditBucketPack:         "pack_credits",
+}
+
+// CreditBuckets breaks a user's scan credits down by where they came from
+type CreditBuckets struct {
+	Subscription       int     `json:"subscription"`
+	Pack               int     `json:"pack"`
+	Promo              int     `json:"promo"`
+	PromoExpiresAt     *string `json:"promo_expires_at,omitempty"`       // When the next promo credits expire
+	SubscriptionResets *string `json:"subscription_resets_at,omitempty"` // When the allowance resets or lapses
+
+	expiringPromo int
+}
+
+// Total is the number of credits the user can spend
+func (b *CreditBuckets) Total() int {
+	return b.Subscription + b.Pack + b.Promo
+}
+
+func (b *CreditBuckets) get(bucket string) int {
+	switch bucket {
+	case CreditBucketSubscription:
+		return b.Subscription
+	case CreditBucketPack:
+		return b.Pack
+	case CreditBucketPromo:
+		return b.Promo
+	}
+	return 0
+}
+
+// nextScanBucket picks the bucket the next scan is paid from
+func (b *CreditBuckets) nextScanBucket() string {
+	switch {
+	case b.expiringPromo > 0:
+		return CreditBucketPromo
+	case b.Subscription > 0:
+		return CreditBucketSubscription
+	case b.Promo > 0:
+		return CreditBucketPromo
+	}
+	return CreditBucketPack
+}
+
+type queryRower interface {
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// readCreditBuckets returns the user's credits as of now, leaving out lapsed
+// allowances and expired promo credits even before they're written off. It
+// returns pgx.ErrNoRows for users whose credits haven't been touched yet.
+func readCreditBuckets(ctx context.Context, q queryRower, userID int) (*CreditBuckets, error) {
+	var buckets CreditBuckets
+	var subscriptionEnd, promoExpiresAt *time.Time
+	err := q.QueryRow(ctx, `
+		SELECT
+			CASE WHEN us.subscription_end < NOW() THEN 0 ELSE us.subscription_credits END,
+			us.pack_credits,
+			COALESCE(SUM(pc.remaining), 0),
+			COALESCE(SUM(pc.remaining) FILTER (WHERE pc.expires_at IS NOT NULL), 0),
+			MIN(pc.expires_at),
+			us.subscription_end
+		FROM user_subscriptions us
+		LEFT JOIN promo_credits pc ON pc.user_id = us.user_id AND pc.remaining > 0
+			AND (pc.expires_at IS NULL OR pc.expires_at > NOW())
+		WHERE us.user_id = $1
+		GROUP BY us.user_id, us.subscription_end, us.subscription_credits, us.pack_credits`,
+		userID,
+	).Scan(&buckets.Subscription, &buckets.Pack, &buckets.Promo, &buckets.expiringPromo,
+		&promoExpiresAt, &subscriptionEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	if promoExpiresAt != nil {
+		formatted := common.FormatTimestamp(*promoExpiresAt)
+		buckets.PromoExpiresAt = &formatted
+	}
+	if buckets.Subscription > 0 && subscriptionEnd != nil {
+		formatted := common.FormatTimestamp(*subscriptionEnd)
+		buckets.SubscriptionResets = &formatted
+	}
+	return &buckets, nil
+}
+
+// expireCredits writes off the user's lapsed allowance and expired promo
+// credits. The account must be locked.
+func (s *SubscriptionService) expireCredits(ctx context.Context, tx pgx.Tx, userID int) error {
+	var lapsedAllowance int
+	err := tx.QueryRow(ctx, `
+		SELECT subscription_credits FROM user_subscriptions
+		WHERE user_id = $1 AND subscription_credits > 0 AND subscription_end < NOW()`,
+		userID,
+	).Scan(&lapsedAllowance)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("failed to check subscription allowance: %w", err)
+	}
+	if lapsedAllowance > 0 {
+		if _, err := tx.Exec(ctx, `
+			UPDATE user_subscriptions SET subscription_credits = 0 WHERE user_id = $1`,
+			userID,
+		); err != nil {
+			return fmt.Errorf("failed to expire subscription allowance: %w", err)
+		}
+		if err := s.recordExpiry(ctx, tx, userID, CreditBucketSubscription, lapsedAllowance, "subscription ended"); err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.Query(ctx, `
+		WITH expired AS (
+			SELECT id, remaining, note FROM promo_credits
+			WHERE user_id = $1 AND remaining > 0 AND expires_at < NOW()
+			FOR UPDATE
+		)
+		UPDATE promo_credits pc SET remaining = 0
+		FROM expired
+		WHERE pc.id = expired.id
+		RETURNING expired.remaining, expired.note`,
+		userID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to expire promo credits: %w", err)
+	}
+	type expired struct {
+		amount int
+		note   *string
+	}
+	var expiredPromos []expired
+	for rows.Next() {
+		var e expired
+		if err := rows.Scan(&e.amount, &e.note); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read expired promo credits: %w", err)
+		}
+		expiredPromos = append(expiredPromos, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to expire promo credits: %w", err)
+	}
+
+	for _, e := range expiredPromos {
+		note := "promo credits expired"
+		if e.note != nil {
+			note = *e.note + " expired"
+		}
+		if err := s.recordExpiry(ctx, tx, userID, CreditBucketPromo, e.amount, note); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordExpiry records credits written off by expireCredits and takes them
+// off the cached total
+func (s *SubscriptionService) recordExpiry(ctx context.Context, tx pgx.Tx, userID int, bucket string, amount int, note string) error {
+	var balance int
+	err := tx.QueryRow(ctx, `
+		UPDATE user_subscriptions SET scan_credits_remaining = GREATEST(COALESCE(scan_credits_remaining, 0) - $1, 0)
+		WHERE user_id = $2
+		RETURNING scan_credits_remaining`,
+		amount, userID,
+	).Scan(&balance)
+	if err != nil {
+		return fmt.Errorf("failed to update scan credits: %w", err)
+	}
+	_, err = s.recordCreditEntry(ctx, tx, userID, CreditEntryExpire, bucket, -amount, balance, "", note)
+	return err
+}
+
+// applyCredits adds amount (negative to remove credits) to one of the user's
+// buckets and records it in the ledger. expiresAt only applies to promo
+// credits; nil means they never expire. reference and note are optional.
+func (s *SubscriptionService) applyCredits(ctx context.Context, tx pgx.Tx, userID int, entryType, bucket string, amount int, expiresAt *time.Time, reference, note string) (*CreditEntry, error) {
+	buckets, err := s.lockCreditAccount(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if buckets.get(bucket)+amount < 0 {
+		return nil, errInsufficientCredits
+	}
+
+	switch {
+	case bucket == CreditBucketPromo && amount > 0:
+		_, err = tx.Exec(ctx, `
+			INSERT INTO promo_credits (user_id, amount, remaining, expires_at, note)
+			VALUES ($1, $2, $2, $3, NULLIF($4, ''))`,
+			userID, amount, expiresAt, note,
+		)
+	case bucket == CreditBucketPromo:
+		err = s.takePromoCredits(ctx, tx, userID, -amount)
+	case creditBucketColumns[bucket] != "":
+		column := creditBucketColumns[bucket]
+		_, err = tx.Exec(ctx, fmt.Sprintf(`
+			UPDATE user_subscriptions SET %s = %s + $1 WHERE user_id = $2`, column, column),
+			amount, userID,
+		)
+	default:
+		return nil, fmt.Errorf("unknown credit bucket %q", bucket)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update %s credits: %w", bucket, err)
+	}
+
+	balance := buckets.Total() + amount
+	if _, err := tx.Exec(ctx, `
+		UPDATE user_subscriptions SET scan_credits_remaining = $1 WHERE user_id = $2`,
+		balance, userID,
+	); err != nil {
+		return nil, fmt.Errorf("failed to update scan credits: %w", err)
+	}
+
+	return s.recordCreditEntry(ctx, tx, userID, entryType, bucket, amount, balance, reference, note)
+}
+
+// takePromoCredits removes promo credits in the order scans spend them
+func (s *SubscriptionService) takePromoCredits(ctx context.Context, tx pgx.Tx, userID, amount int) error {
+	rows, err := tx.Query(ctx, `
+		SELECT id, remaining FROM promo_credits
+		WHERE user_id = $1 AND remaining > 0 AND (expires_at IS NULL OR expires_at > NOW())
+		ORDER BY expires_at NULLS LAST, id
+		FOR UPDATE`,
+		userID,
+	)
+	if err != nil {
+		return err
+	}
+	type grant struct{ id, remaining int }
+	var grants []grant
+	for rows.Next() {
+		var g grant
+		if err := rows.Scan(&g.id, &g.remaining); err != nil {
+			rows.Close()
+			return err
+		}
+		grants = append(grants, g)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, g := range grants {
+		if amount == 0 {
+			break
+		}
+		taken := min(amount, g.remaining)
+		if _, err := tx.Exec(ctx, `
+			UPDATE promo_credits SET remaining = remaining - $1 WHERE id = $2`,
+			taken, g.id,
+		); err != nil {
+			return err
+		}
+		amount -= taken
+	}
+	if amount > 0 {
+		return errInsufficientCredits
+	}
+	return nil
+}
+
+// resetSubscriptionAllowance replaces whatever is left of the user's
+// allowance with a new period's allowance, so it doesn't roll over
+func (s *SubscriptionService) resetSubscriptionAllowance(ctx context.Context, tx pgx.Tx, userID, allowance int, reference, note string) error {
+	buckets, err := s.lockCreditAccount(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+
+	if buckets.Subscription > 0 {
+		if _, err := s.applyCredits(ctx, tx, userID, CreditEntryExpire, CreditBucketSubscription,
+			-buckets.Subscription, nil, reference, "allowance reset"); err != nil {
+			return err
+		}
+	}
+	if allowance > 0 {
+		if _, err := s.applyCredits(ctx, tx, userID, CreditEntryPurchase, CreditBucketSubscription,
+			allowance, nil, reference, note); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 type SubscriptionHandler struct {
@@ -23,14 +24,14 @@ func (h *SubscriptionHandler) HandleGetUserSubscription(w http.ResponseWriter, r
 
 	userID, ok := r.Context().Value(common.UserIDCtxKey).(int)
 	if !ok {
-		http.Error(w, "invalid user ID in context", http.StatusInternalServerError)
+		common.WriteError(w, r, common.ErrInvalidUserContext)
 		return
 	}
 
 	subscription, err := h.service.GetUserSubscription(r.Context(), userID)
 	if err != nil {
 		logger.Printf("Failed to get user subscription: %v", err)
-		http.Error(w, "failed to get subscription info", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to get subscription info"))
 		return
 	}
 
@@ -43,14 +44,14 @@ func (h *SubscriptionHandler) HandleGetUserSubscriptionStatus(w http.ResponseWri
 
 	requestedUserID, err := strconv.Atoi(r.PathValue("user_id"))
 	if err != nil {
-		http.Error(w, "invalid user ID", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("invalid user ID"))
 		return
 	}
 
 	isActive, err := h.service.HasActiveSubscription(r.Context(), requestedUserID)
 	if err != nil {
 		logger.Printf("Failed to get subscription status: %v", err)
-		http.Error(w, "failed to get subscription status", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to get subscription status"))
 		return
 	}
 
@@ -63,21 +64,21 @@ func (h *SubscriptionHandler) HandlePurchaseSubscription(w http.ResponseWriter,
 
 	userID, ok := r.Context().Value(common.UserIDCtxKey).(int)
 	if !ok {
-		http.Error(w, "invalid user ID in context", http.StatusInternalServerError)
+		common.WriteError(w, r, common.ErrInvalidUserContext)
 		return
 	}
 
 	var request PurchaseRequest
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 		logger.Printf("Failed to parse purchase request: %v", err)
-		http.Error(w, "invalid request body", http.StatusBadRequest)
+		common.WriteErrorOr(w, r, err, common.BadRequest("invalid request body"))
 		return
 	}
 	// logger.Printf("Received receipt data (first 20 chars): %s", request.ReceiptData[:20])
 
 	// Validate platform
 	if request.Platform != "apple" && request.Platform != "google" {
-		http.Error(w, "invalid platform, must be 'apple' or 'google'", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("invalid platform, must be 'apple' or 'google'"))
 		return
 	}
 
@@ -88,14 +89,7 @@ func (h *SubscriptionHandler) HandlePurchaseSubscription(w http.ResponseWriter,
 	response, err := h.service.ProcessPurchase(r.Context(), userID, &request)
 	if err != nil {
 		logger.Printf("Failed to process subscription purchase: %v", err)
-		if response != nil {
-			// Return structured error response
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(response)
-			return
-		}
-		http.Error(w, "failed to process purchase", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to process purchase"))
 		return
 	}
 
@@ -109,20 +103,20 @@ func (h *SubscriptionHandler) HandlePurchaseScanPack(w http.ResponseWriter, r *h
 
 	userID, ok := r.Context().Value(common.UserIDCtxKey).(int)
 	if !ok {
-		http.Error(w, "invalid user ID in context", http.StatusInternalServerError)
+		common.WriteError(w, r, common.ErrInvalidUserContext)
 		return
 	}
 
 	var request PurchaseRequest
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 		logger.Printf("Failed to parse scan pack purchase request: %v", err)
-		http.Error(w, "invalid request body", http.StatusBadRequest)
+		common.WriteErrorOr(w, r, err, common.BadRequest("invalid request body"))
 		return
 	}
 
 	// Validate platform
 	if request.Platform != "apple" && request.Platform != "google" {
-		http.Error(w, "invalid platform, must be 'apple' or 'google'", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("invalid platform, must be 'apple' or 'google'"))
 		return
 	}
 
@@ -133,14 +127,7 @@ func (h *SubscriptionHandler) HandlePurchaseScanPack(w http.ResponseWriter, r *h
 	response, err := h.service.ProcessPurchase(r.Context(), userID, &request)
 	if err != nil {
 		logger.Printf("Failed to process scan pack purchase: %v", err)
-		if response != nil {
-			// Return structured error response
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(response)
-			return
-		}
-		http.Error(w, "failed to process purchase", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to process purchase"))
 		return
 	}
 
@@ -160,7 +147,7 @@ func (h *SubscriptionHandler) HandleGetSubscriptionProducts(w http.ResponseWrite
 	products, err := h.service.GetSubscriptionProducts(r.Context(), platform, productType)
 	if err != nil {
 		logger.Printf("Failed to get subscription products: %v", err)
-		http.Error(w, "failed to get subscription products", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to get subscription products"))
 		return
 	}
 
@@ -177,7 +164,7 @@ func (h *SubscriptionHandler) HandleAppStoreNotification(w http.ResponseWriter,
 	var notification AppStoreNotificationPayload
 	if err := json.NewDecoder(r.Body).Decode(&notification); err != nil {
 		logger.Printf("Failed to decode notification: %v", err)
-		http.Error(w, "invalid notification payload", http.StatusBadRequest)
+		common.WriteErrorOr(w, r, err, common.BadRequest("invalid notification payload"))
 		return
 	}
 
@@ -196,7 +183,7 @@ func (h *SubscriptionHandler) HandleAppStoreNotification(w http.ResponseWriter,
 	if notification.Data.BundleId != "" && notification.Data.BundleId != expectedBundleID {
 		logger.Printf("Invalid bundle ID: %s, expected: %s",
 			notification.Data.BundleId, expectedBundleID)
-		http.Error(w, "invalid bundle ID", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("invalid bundle ID"))
 		return
 	}
 
@@ -291,3 +278,76 @@ func (h *SubscriptionHandler) logNotificationError(ctx context.Context, notifica
 		logger.Printf("Failed to log notification error to database: %v", dbErr)
 	}
 }
+
+// HandleGetCreditHistory returns the user's scan credit balance and ledger
+// entries, newest first
+func (h *SubscriptionHandler) HandleGetCreditHistory(w http.ResponseWriter, r *http.Request) {
+	logger := r.Context().Value(common.LoggerCtxKey).(*log.Logger)
+
+	userID, ok := r.Context().Value(common.UserIDCtxKey).(int)
+	if !ok {
+		common.WriteError(w, r, common.ErrInvalidUserContext)
+		return
+	}
+
+	pageSize := 20
+	if pageSizeStr := r.URL.Query().Get("page_size"); pageSizeStr != "" {
+		var err error
+		pageSize, err = strconv.Atoi(pageSizeStr)
+		if err != nil {
+			common.WriteError(w, r, common.BadRequest("invalid page_size"))
+			return
+		}
+	}
+
+	history, err := h.service.GetCreditHistory(r.Context(), userID, r.URL.Query().Get("cursor"), pageSize)
+	if err != nil {
+		logger.Printf("Failed to get credit history for user %d: %v", userID, err)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to get credit history"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+type adjustCreditsRequest struct {
+	Bucket    string     `json:"bucket"` // "subscription", "pack" or "promo"
+	Amount    int        `json:"amount"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Note      string     `json:"note"`
+}
+
+// HandleAdjustCredits adds or removes scan credits in one of a user's buckets
+func (h *SubscriptionHandler) HandleAdjustCredits(w http.ResponseWriter, r *http.Request) {
+	logger := r.Context().Value(common.LoggerCtxKey).(*log.Logger)
+
+	adminID, ok := r.Context().Value(common.UserIDCtxKey).(int)
+	if !ok {
+		common.WriteError(w, r, common.ErrInvalidUserContext)
+		return
+	}
+
+	userID, err := strconv.Atoi(r.PathValue("user_id"))
+	if err != nil {
+		common.WriteError(w, r, common.BadRequest("invalid user ID"))
+		return
+	}
+
+	var req adjustCreditsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		common.WriteError(w, r, common.BadRequest("invalid request body").Wrap(err))
+		return
+	}
+
+	entry, err := h.service.AdjustCredits(r.Context(), userID, req.Bucket, req.Amount, req.ExpiresAt, req.Note, adminID)
+	if err != nil {
+		logger.Printf("Failed to adjust credits for user %d: %v", userID, err)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to adjust credits"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(entry)
+}
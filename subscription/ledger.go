@@ -0,0 +1,375 @@
+package subscription
+
+import (
+	"CarBN/common"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Credit ledger entry types
+const (
+	CreditEntryGrant       = "grant"
+	CreditEntryPurchase    = "purchase"
+	CreditEntryScan        = "scan"
+	CreditEntryRefund      = "refund"
+	CreditEntryAdminAdjust = "admin_adjust"
+	CreditEntryExpire      = "expire"
+)
+
+// Credit reservation statuses
+const (
+	reservationHeld     = "held"
+	reservationCaptured = "captured"
+	reservationReleased = "released"
+	reservationExpired  = "expired"
+)
+
+const (
+	// freeScanCredits are granted to every user as promo credits that don't
+	// expire, the first time their credits are touched
+	freeScanCredits = 6
+
+	// creditReservationTTL bounds how long a scan can hold a credit. It covers
+	// scan jobs waiting in the queue, so it's well beyond the job lease.
+	creditReservationTTL = time.Hour
+)
+
+// errInsufficientCredits is returned by applyCredits when an entry would take
+// a bucket below zero
+var errInsufficientCredits = errors.New("insufficient scan credits")
+
+// CreditEntry is one change to a user's scan credits
+type CreditEntry struct {
+	ID           int     `json:"id"`
+	Type         string  `json:"type"`
+	Bucket       *string `json:"bucket"`
+	Amount       int     `json:"amount"`
+	BalanceAfter int     `json:"balance_after"`
+	Reference    *string `json:"reference,omitempty"`
+	Note         *string `json:"note,omitempty"`
+	CreatedAt    string  `json:"created_at"`
+}
+
+type PaginatedCreditHistory struct {
+	Balance    int            `json:"balance"`
+	Reserved   int            `json:"reserved"`
+	Credits    *CreditBuckets `json:"credits"`
+	Items      []CreditEntry  `json:"items"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// lockCreditAccount locks the user's user_subscriptions row for the rest of
+// tx, writes off expired credits and returns what's left. Users without a row
+// get one, along with their free credits.
+func (s *SubscriptionService) lockCreditAccount(ctx context.Context, tx pgx.Tx, userID int) (*CreditBuckets, error) {
+	var granted int
+	err := tx.QueryRow(ctx, `
+		INSERT INTO user_subscriptions (user_id, scan_credits_remaining, tier)
+		VALUES ($1, $2, 'none')
+		ON CONFLICT (user_id) DO NOTHING
+		RETURNING scan_credits_remaining`,
+		userID, freeScanCredits,
+	).Scan(&granted)
+	if err == nil {
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO promo_credits (user_id, amount, remaining, note)
+			VALUES ($1, $2, $2, 'free credits')`,
+			userID, granted,
+		); err != nil {
+			return nil, fmt.Errorf("failed to grant free credits: %w", err)
+		}
+		if _, err := s.recordCreditEntry(ctx, tx, userID, CreditEntryGrant, CreditBucketPromo,
+			granted, granted, "", "free credits"); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("failed to create credit account: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx, `
+		SELECT 1 FROM user_subscriptions WHERE user_id = $1 FOR UPDATE`,
+		userID,
+	); err != nil {
+		return nil, fmt.Errorf("failed to lock credit account: %w", err)
+	}
+
+	if err := s.expireCredits(ctx, tx, userID); err != nil {
+		return nil, err
+	}
+
+	buckets, err := readCreditBuckets(ctx, tx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scan credits: %w", err)
+	}
+	return buckets, nil
+}
+
+// recordCreditEntry adds an entry to the ledger. Callers update the buckets
+// and balance themselves.
+func (s *SubscriptionService) recordCreditEntry(ctx context.Context, tx pgx.Tx, userID int, entryType, bucket string, amount, balanceAfter int, reference, note string) (*CreditEntry, error) {
+	entry := CreditEntry{Type: entryType, Bucket: &bucket, Amount: amount, BalanceAfter: balanceAfter}
+	var createdAt time.Time
+	err := tx.QueryRow(ctx, `
+		INSERT INTO credit_ledger (user_id, entry_type, bucket, amount, balance_after, reference, note)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''))
+		RETURNING id, reference, note, created_at`,
+		userID, entryType, bucket, amount, balanceAfter, reference, note,
+	).Scan(&entry.ID, &entry.Reference, &entry.Note, &createdAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record credit entry: %w", err)
+	}
+	entry.CreatedAt = common.FormatTimestamp(createdAt)
+	return &entry, nil
+}
+
+// ReserveScanCredit sets a credit aside for a scan that's starting, failing
+// with ErrNoScanCredits when every credit is spent or held by other scans.
+// The reservation must be captured or released once the scan is over.
+func (s *SubscriptionService) ReserveScanCredit(ctx context.Context, userID int) (int, error) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Concurrent scans queue up on the account lock, so they can't both take
+	// the last credit
+	buckets, err := s.lockCreditAccount(ctx, tx, userID)
+	if err != nil {
+		return 0, err
+	}
+	balance := buckets.Total()
+
+	// Scans that crashed without settling stop holding credits once they expire
+	if _, err := tx.Exec(ctx, `
+		UPDATE credit_reservations SET status = $1, settled_at = NOW()
+		WHERE user_id = $2 AND status = $3 AND expires_at < NOW()`,
+		reservationExpired, userID, reservationHeld,
+	); err != nil {
+		return 0, fmt.Errorf("failed to expire credit reservations: %w", err)
+	}
+
+	var held int
+	if err := tx.QueryRow(ctx, `
+		SELECT COUNT(*) FROM credit_reservations WHERE user_id = $1 AND status = $2`,
+		userID, reservationHeld,
+	).Scan(&held); err != nil {
+		return 0, fmt.Errorf("failed to count credit reservations: %w", err)
+	}
+	if balance-held <= 0 {
+		logger.Printf("User %d has no scan credits available (%d, %d held)", userID, balance, held)
+		return 0, common.ErrNoScanCredits
+	}
+
+	var reservationID int
+	err = tx.QueryRow(ctx, `
+		INSERT INTO credit_reservations (user_id, status, expires_at)
+		VALUES ($1, $2, NOW() + make_interval(secs => $3))
+		RETURNING id`,
+		userID, reservationHeld, creditReservationTTL.Seconds(),
+	).Scan(&reservationID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to reserve scan credit: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	logger.Printf("Reserved scan credit %d for user %d (%d available)", reservationID, userID, balance-held-1)
+	return reservationID, nil
+}
+
+// CaptureScanCredit spends a reserved credit as part of tx, so the credit is
+// only gone if the scanned car is added too. reference names what the credit
+// was spent on.
+func (s *SubscriptionService) CaptureScanCredit(ctx context.Context, tx pgx.Tx, reservationID int, reference string) error {
+	var userID int
+	err := tx.QueryRow(ctx, `
+		SELECT user_id FROM credit_reservations WHERE id = $1`,
+		reservationID,
+	).Scan(&userID)
+	if err != nil {
+		return fmt.Errorf("failed to find credit reservation: %w", err)
+	}
+
+	// Lock the account before the reservation, in the same order as
+	// ReserveScanCredit
+	buckets, err := s.lockCreditAccount(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(ctx, `
+		UPDATE credit_reservations SET status = $1, settled_at = NOW()
+		WHERE id = $2 AND status = $3`,
+		reservationCaptured, reservationID, reservationHeld,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to capture credit reservation: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return common.ErrReservationExpired
+	}
+
+	entry, err := s.applyCredits(ctx, tx, userID, CreditEntryScan, buckets.nextScanBucket(), -1, nil, reference, "")
+	if err != nil {
+		if errors.Is(err, errInsufficientCredits) {
+			return common.ErrNoScanCredits
+		}
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, `
+		UPDATE credit_reservations SET ledger_entry_id = $1 WHERE id = $2`,
+		entry.ID, reservationID,
+	); err != nil {
+		return fmt.Errorf("failed to link credit reservation: %w", err)
+	}
+	return nil
+}
+
+// ReleaseScanCredit hands a reserved credit back after a scan that didn't add
+// a car. Releasing a settled reservation does nothing.
+func (s *SubscriptionService) ReleaseScanCredit(ctx context.Context, reservationID int) error {
+	if _, err := s.db.Exec(ctx, `
+		UPDATE credit_reservations SET status = $1, settled_at = NOW()
+		WHERE id = $2 AND status = $3`,
+		reservationReleased, reservationID, reservationHeld,
+	); err != nil {
+		return fmt.Errorf("failed to release credit reservation: %w", err)
+	}
+	return nil
+}
+
+// AdjustCredits lets an admin add or remove credits in one of a user's
+// buckets, though not below zero. expiresAt is only allowed for promo credits.
+func (s *SubscriptionService) AdjustCredits(ctx context.Context, userID int, bucket string, amount int, expiresAt *time.Time, note string, adminID int) (*CreditEntry, error) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+
+	switch {
+	case bucket != CreditBucketSubscription && bucket != CreditBucketPack && bucket != CreditBucketPromo:
+		return nil, common.BadRequest(`bucket must be "subscription", "pack" or "promo"`)
+	case amount == 0:
+		return nil, common.BadRequest("amount must not be zero")
+	case expiresAt != nil && (bucket != CreditBucketPromo || amount < 0):
+		return nil, common.BadRequest("only added promo credits can expire")
+	case expiresAt != nil && expiresAt.Before(time.Now()):
+		return nil, common.BadRequest("expires_at must be in the future")
+	}
+
+	var exists bool
+	if err := s.db.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)`, userID).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("failed to check user: %w", err)
+	}
+	if !exists {
+		return nil, common.NotFound("user not found")
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	entry, err := s.applyCredits(ctx, tx, userID, CreditEntryAdminAdjust, bucket, amount, expiresAt,
+		fmt.Sprintf("admin:%d", adminID), note)
+	if err != nil {
+		if errors.Is(err, errInsufficientCredits) {
+			return nil, common.BadRequest(fmt.Sprintf("adjustment would leave the user with negative %s credits", bucket))
+		}
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	logger.Printf("Admin %d adjusted %s credits for user %d by %d, balance %d",
+		adminID, bucket, userID, amount, entry.BalanceAfter)
+	return entry, nil
+}
+
+// GetCreditHistory returns a user's balance and ledger entries, newest first
+func (s *SubscriptionService) GetCreditHistory(ctx context.Context, userID int, cursor string, pageSize int) (*PaginatedCreditHistory, error) {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+
+	if pageSize <= 0 || pageSize > 100 {
+		pageSize = 20
+	}
+
+	cursorID := 0
+	if cursor != "" {
+		decoded, err := common.DecodeCursor(cursor)
+		if err != nil {
+			return nil, common.BadRequest("invalid cursor").Wrap(err)
+		}
+		cursorID = decoded.ID
+	}
+
+	// Users whose credits haven't been touched yet still have their free ones
+	buckets, err := readCreditBuckets(ctx, s.db, userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		buckets, err = &CreditBuckets{Promo: freeScanCredits}, nil
+	}
+	if err != nil {
+		logger.Printf("Failed to get credit balance for user %d: %v", userID, err)
+		return nil, fmt.Errorf("failed to get credit balance: %w", err)
+	}
+	result := &PaginatedCreditHistory{Balance: buckets.Total(), Credits: buckets}
+
+	err = s.db.QueryRow(ctx, `
+		SELECT COUNT(*) FROM credit_reservations
+		WHERE user_id = $1 AND status = $2 AND expires_at > NOW()`,
+		userID, reservationHeld,
+	).Scan(&result.Reserved)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count credit reservations: %w", err)
+	}
+
+	rows, err := s.db.Query(ctx, `
+		SELECT id, entry_type, bucket, amount, balance_after, reference, note, created_at
+		FROM credit_ledger
+		WHERE user_id = $1 AND ($2 = 0 OR id < $2)
+		ORDER BY id DESC
+		LIMIT $3`,
+		userID, cursorID, pageSize+1,
+	)
+	if err != nil {
+		logger.Printf("Failed to query credit history for user %d: %v", userID, err)
+		return nil, fmt.Errorf("failed to query credit history: %w", err)
+	}
+	defer rows.Close()
+
+	entries := make([]CreditEntry, 0, pageSize+1)
+	createdAts := make([]time.Time, 0, pageSize+1)
+	for rows.Next() {
+		var entry CreditEntry
+		var createdAt time.Time
+		if err := rows.Scan(&entry.ID, &entry.Type, &entry.Bucket, &entry.Amount, &entry.BalanceAfter,
+			&entry.Reference, &entry.Note, &createdAt); err != nil {
+			return nil, fmt.Errorf("failed to scan credit entry: %w", err)
+		}
+		entry.CreatedAt = common.FormatTimestamp(createdAt)
+		entries = append(entries, entry)
+		createdAts = append(createdAts, createdAt)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read credit history: %w", err)
+	}
+
+	result.Items = entries
+	if len(entries) > pageSize {
+		last := pageSize - 1
+		result.NextCursor = common.EncodeCursor(createdAts[last], entries[last].ID)
+		result.Items = entries[:pageSize]
+	}
+	return result, nil
+}
@@ -147,11 +147,12 @@ type PurchaseResponse struct {
 }
 
 type SubscriptionInfo struct {
-	IsActive             bool    `json:"is_active"`
-	Tier                 string  `json:"tier"`
-	SubscriptionStart    *string `json:"subscription_start,omitempty"`
-	SubscriptionEnd      *string `json:"subscription_end,omitempty"`
-	ScanCreditsRemaining int     `json:"scan_credits_remaining"`
+	IsActive             bool           `json:"is_active"`
+	Tier                 string         `json:"tier"`
+	SubscriptionStart    *string        `json:"subscription_start,omitempty"`
+	SubscriptionEnd      *string        `json:"subscription_end,omitempty"`
+	ScanCreditsRemaining int            `json:"scan_credits_remaining"` // Total of every bucket
+	Credits              *CreditBuckets `json:"credits"`
 }
 
 type SubscriptionProduct struct {
@@ -212,11 +213,13 @@ func (s *SubscriptionService) GetUserSubscription(ctx context.Context, userID in
 			COALESCE(is_active, false),
 			COALESCE(tier, 'none'),
 			subscription_start,
-			subscription_end,
-			COALESCE(scan_credits_remaining, 0)
+			subscription_end
 		FROM user_subscriptions
 		WHERE user_id = $1
-	`, userID).Scan(&info.IsActive, &info.Tier, &startTime, &endTime, &info.ScanCreditsRemaining)
+	`, userID).Scan(&info.IsActive, &info.Tier, &startTime, &endTime)
+	if err == nil {
+		info.Credits, err = readCreditBuckets(ctx, s.db, userID)
+	}
 
 	if err != nil {
 		if err == pgx.ErrNoRows {
@@ -225,13 +228,16 @@ func (s *SubscriptionService) GetUserSubscription(ctx context.Context, userID in
 			return &SubscriptionInfo{
 				IsActive:             false,
 				Tier:                 "none",
-				ScanCreditsRemaining: 6, // Default credits for new users
+				ScanCreditsRemaining: freeScanCredits,
+				Credits:              &CreditBuckets{Promo: freeScanCredits},
 			}, nil
 		}
 		logger.Printf("Error fetching subscription for user %d: %v", userID, err)
 		return nil, err
 	}
 
+	info.ScanCreditsRemaining = info.Credits.Total()
+
 	// Check if subscription has expired but is still marked as active
 	if info.IsActive && endTime != nil && time.Now().After(*endTime) {
 		logger.Printf("Subscription for user %d has expired at %s but is still marked as active. Updating status.",
@@ -297,59 +303,6 @@ func (s *SubscriptionService) HasActiveSubscription(ctx context.Context, userID
 	return isActive, nil
 }
 
-func (s *SubscriptionService) HasScanCredits(ctx context.Context, userID int) (bool, error) {
-	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
-	logger.Printf("Checking scan credits for user %d", userID)
-
-	var credits int
-	err := s.db.QueryRow(ctx, `
-		SELECT COALESCE(scan_credits_remaining, 6)
-		FROM user_subscriptions
-		WHERE user_id = $1
-	`, userID).Scan(&credits)
-
-	if err != nil {
-		if err == pgx.ErrNoRows {
-			logger.Printf("No subscription record found for user %d, assuming default credits", userID)
-			return true, nil // No subscription found, assume default credits
-		}
-		logger.Printf("Error checking scan credits for user %d: %v", userID, err)
-		return false, err
-	}
-
-	logger.Printf("User %d has %d scan credits remaining", userID, credits)
-	return credits > 0, nil
-}
-
-func (s *SubscriptionService) DeductScanCredit(ctx context.Context, userID int) error {
-	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
-
-	result, err := s.db.Exec(ctx, `
-		UPDATE user_subscriptions
-		SET scan_credits_remaining = scan_credits_remaining - 1
-		WHERE user_id = $1 AND scan_credits_remaining > 0
-	`, userID)
-
-	if err != nil {
-		return fmt.Errorf("failed to deduct scan credit: %w", err)
-	}
-
-	if result.RowsAffected() == 0 {
-		// If no row was updated, insert a new subscription row with default credits - 1
-		_, err = s.db.Exec(ctx, `
-			INSERT INTO user_subscriptions (user_id, scan_credits_remaining, tier)
-			VALUES ($1, 5, 'none')
-			ON CONFLICT (user_id) DO NOTHING
-		`, userID)
-		if err != nil {
-			return fmt.Errorf("failed to create initial subscription: %w", err)
-		}
-	}
-
-	logger.Printf("Successfully deducted scan credit for user %d", userID)
-	return nil
-}
-
 // ProcessPurchase handles subscription purchase from Apple or Google
 func (s *SubscriptionService) ProcessPurchase(ctx context.Context, userID int, request *PurchaseRequest) (*PurchaseResponse, error) {
 	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
@@ -386,12 +339,12 @@ func (s *SubscriptionService) ProcessPurchase(ctx context.Context, userID int, r
 			return s.processApplePurchase(ctx, userID, request.ReceiptData, request.PurchaseType)
 		}
 
-		return nil, errors.New("missing transaction_id or receipt_data for Apple purchase")
+		return nil, common.BadRequest("missing transaction_id or receipt_data for Apple purchase")
 	}
 
 	// Handle other platforms...
 
-	return nil, fmt.Errorf("unsupported platform: %s", request.Platform)
+	return nil, common.BadRequest(fmt.Sprintf("unsupported platform: %s", request.Platform))
 }
 
 // processApplePurchase verifies and processes Apple purchases (subscriptions or scan packs)
@@ -435,10 +388,7 @@ func (s *SubscriptionService) processApplePurchase(ctx context.Context, userID i
 		transaction, err = s.getTransactionById(ctx, transactionId)
 		if err != nil {
 			logger.Printf("Failed to get transaction from App Store API: %v", err)
-			return &PurchaseResponse{
-				Success: false,
-				Message: "Transaction verification failed",
-			}, fmt.Errorf("transaction verification failed: %w", err)
+			return nil, common.NewError(common.ErrBadRequest, "purchase_verification_failed", "transaction verification failed").Wrap(err)
 		}
 
 		// Add debug logging for the product ID
@@ -460,24 +410,21 @@ func (s *SubscriptionService) processApplePurchase(ctx context.Context, userID i
 			&product.Type,
 		)
 
-		if err != nil {
+		if err == pgx.ErrNoRows {
 			logger.Printf("Product not found: %s", transaction.ProductId)
 			// Dump the transaction details for debugging
 			jsonData, _ := json.Marshal(transaction)
 			logger.Printf("Transaction details: %s", string(jsonData))
-			return &PurchaseResponse{
-				Success: false,
-				Message: "Subscription product not recognized",
-			}, fmt.Errorf("product not found: %s", transaction.ProductId)
+			return nil, common.NewError(common.ErrBadRequest, "unknown_product", "product not recognized")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get product %s: %w", transaction.ProductId, err)
 		}
 
 		// Verify the purchase type matches
 		if product.Type != purchaseType {
 			logger.Printf("Product type mismatch: expected %s, got %s", purchaseType, product.Type)
-			return &PurchaseResponse{
-				Success: false,
-				Message: fmt.Sprintf("Invalid product type: expected %s", purchaseType),
-			}, fmt.Errorf("product type mismatch: %s", product.Type)
+			return nil, common.NewError(common.ErrBadRequest, "wrong_product_type", fmt.Sprintf("invalid product type: expected %s", purchaseType))
 		}
 	} else {
 		// Fall back to legacy verification for backward compatibility
@@ -487,28 +434,19 @@ func (s *SubscriptionService) processApplePurchase(ctx context.Context, userID i
 		verifyResp, err := s.verifyAppleReceipt(ctx, receiptData)
 		if err != nil {
 			logger.Printf("Apple receipt verification failed: %v", err)
-			return &PurchaseResponse{
-				Success: false,
-				Message: "Receipt verification failed",
-			}, fmt.Errorf("receipt verification failed: %w", err)
+			return nil, common.NewError(common.ErrBadRequest, "purchase_verification_failed", "receipt verification failed").Wrap(err)
 		}
 
 		// Check status (0 = success)
 		if verifyResp.Status != 0 {
 			logger.Printf("Apple receipt invalid, status: %d", verifyResp.Status)
-			return &PurchaseResponse{
-				Success: false,
-				Message: fmt.Sprintf("Invalid receipt, status: %d", verifyResp.Status),
-			}, fmt.Errorf("invalid receipt, status: %d", verifyResp.Status)
+			return nil, common.NewError(common.ErrBadRequest, "purchase_verification_failed", fmt.Sprintf("invalid receipt, status: %d", verifyResp.Status))
 		}
 
 		// Extract latest receipt info
 		if len(verifyResp.LatestReceiptInfo) == 0 {
 			logger.Printf("No receipt info found in response")
-			return &PurchaseResponse{
-				Success: false,
-				Message: "No subscription details found in receipt",
-			}, errors.New("no subscription details in receipt")
+			return nil, common.NewError(common.ErrBadRequest, "purchase_verification_failed", "no subscription details found in receipt")
 		}
 
 		// Get latest receipt info (sorted by purchase date)
@@ -531,21 +469,18 @@ func (s *SubscriptionService) processApplePurchase(ctx context.Context, userID i
 			&product.Type,
 		)
 
-		if err != nil {
+		if err == pgx.ErrNoRows {
 			logger.Printf("Product not found: %s", latestInfo.ProductID)
-			return &PurchaseResponse{
-				Success: false,
-				Message: "Product not recognized",
-			}, fmt.Errorf("product not found: %s", latestInfo.ProductID)
+			return nil, common.NewError(common.ErrBadRequest, "unknown_product", "product not recognized")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get product %s: %w", latestInfo.ProductID, err)
 		}
 
 		// Verify the purchase type matches
 		if product.Type != purchaseType {
 			logger.Printf("Product type mismatch: expected %s, got %s", purchaseType, product.Type)
-			return &PurchaseResponse{
-				Success: false,
-				Message: fmt.Sprintf("Invalid product type: expected %s", purchaseType),
-			}, fmt.Errorf("product type mismatch: %s", product.Type)
+			return nil, common.NewError(common.ErrBadRequest, "wrong_product_type", fmt.Sprintf("invalid product type: expected %s", purchaseType))
 		}
 
 		// Now get the transaction using the App Store Server API for consistent processing
@@ -556,10 +491,7 @@ func (s *SubscriptionService) processApplePurchase(ctx context.Context, userID i
 			// If API call fails, use the data from the receipt
 			purchaseTimeMs, err := strconv.ParseInt(latestInfo.PurchaseDateMs, 10, 64)
 			if err != nil {
-				return &PurchaseResponse{
-					Success: false,
-					Message: "Invalid purchase date in receipt",
-				}, fmt.Errorf("invalid purchase date: %w", err)
+				return nil, common.NewError(common.ErrBadRequest, "purchase_verification_failed", "invalid purchase date in receipt").Wrap(err)
 			}
 
 			// Create a synthetic transaction from legacy receipt data
@@ -589,10 +521,7 @@ func (s *SubscriptionService) processApplePurchase(ctx context.Context, userID i
 		return s.processScanPack(ctx, userID, transaction, product, receiptData)
 	} else {
 		logger.Printf("Unsupported purchase type: %s", purchaseType)
-		return &PurchaseResponse{
-			Success: false,
-			Message: fmt.Sprintf("Unsupported purchase type: %s", purchaseType),
-		}, fmt.Errorf("unsupported purchase type: %s", purchaseType)
+		return nil, common.BadRequest(fmt.Sprintf("unsupported purchase type: %s", purchaseType))
 	}
 }
 
@@ -613,37 +542,30 @@ func (s *SubscriptionService) processSubscription(ctx context.Context, userID in
 	// Process the subscription in a transaction
 	tx, err := s.db.Begin(ctx)
 	if err != nil {
-		return &PurchaseResponse{
-			Success: false,
-			Message: "Database error",
-		}, fmt.Errorf("failed to begin transaction: %w", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer tx.Rollback(ctx)
 
+	// Lock the account first, so a new subscriber's free credits are granted
+	// before their subscription row exists
+	if _, err := s.lockCreditAccount(ctx, tx, userID); err != nil {
+		return nil, err
+	}
+
 	// Check if this transaction has already been processed
 	var existingID int
+	var existingTransactionID *string
 	err = tx.QueryRow(ctx, `
-		SELECT id FROM user_subscriptions
+		SELECT id, transaction_id FROM user_subscriptions
 		WHERE user_id = $1 AND original_transaction_id = $2
-	`, userID, transaction.OriginalTransactionId).Scan(&existingID)
+	`, userID, transaction.OriginalTransactionId).Scan(&existingID, &existingTransactionID)
+
+	// Restoring a purchase resubmits the current transaction, whose allowance
+	// has already been granted
+	alreadyGranted := err == nil && existingTransactionID != nil && *existingTransactionID == transaction.TransactionId
 
 	// If existing subscription found, update it
 	if err == nil {
-		var currentCredits int
-		// Get current credits
-		err = tx.QueryRow(ctx, `
-			SELECT scan_credits_remaining
-			FROM user_subscriptions
-			WHERE id = $1
-		`, existingID).Scan(&currentCredits)
-
-		if err != nil && err != pgx.ErrNoRows {
-			return &PurchaseResponse{
-				Success: false,
-				Message: "Failed to retrieve current credits",
-			}, fmt.Errorf("failed to get current credits: %w", err)
-		}
-
 		// Update existing subscription
 		_, err = tx.Exec(ctx, `
 			UPDATE user_subscriptions
@@ -652,67 +574,61 @@ func (s *SubscriptionService) processSubscription(ctx context.Context, userID in
 				tier = $1,
 				subscription_start = $2,
 				subscription_end = $3,
-				scan_credits_remaining = $4,
-				receipt_data = $5,
-				transaction_id = $6,
-				original_transaction_id = $7,
-				environment = $8,
+				receipt_data = $4,
+				transaction_id = $5,
+				original_transaction_id = $6,
+				environment = $7,
 				platform = 'apple'
-			WHERE id = $9
-		`, product.Tier, purchaseTime, expiryTime, currentCredits+product.ScanCredits,
+			WHERE id = $8
+		`, product.Tier, purchaseTime, expiryTime,
 			receiptData, transaction.TransactionId, transaction.OriginalTransactionId,
 			transaction.Environment, existingID)
 
 		if err != nil {
-			return &PurchaseResponse{
-				Success: false,
-				Message: "Failed to update subscription",
-			}, fmt.Errorf("failed to update subscription: %w", err)
+			return nil, fmt.Errorf("failed to update subscription: %w", err)
 		}
 	} else if err == pgx.ErrNoRows {
 		// Insert new subscription
 		_, err = tx.Exec(ctx, `
 			INSERT INTO user_subscriptions
 			(user_id, is_active, tier, subscription_start, subscription_end, 
-			scan_credits_remaining, receipt_data, transaction_id, original_transaction_id, 
+			receipt_data, transaction_id, original_transaction_id, 
 			environment, platform)
 			VALUES
-			($1, true, $2, $3, $4, $5, $6, $7, $8, $9, 'apple')
+			($1, true, $2, $3, $4, $5, $6, $7, $8, 'apple')
 			ON CONFLICT (user_id) 
 			DO UPDATE SET
 				is_active = true,
 				tier = EXCLUDED.tier,
 				subscription_start = EXCLUDED.subscription_start,
 				subscription_end = EXCLUDED.subscription_end,
-				scan_credits_remaining = user_subscriptions.scan_credits_remaining + $5,
 				receipt_data = EXCLUDED.receipt_data,
 				transaction_id = EXCLUDED.transaction_id,
 				original_transaction_id = EXCLUDED.original_transaction_id,
 				environment = EXCLUDED.environment,
 				platform = 'apple'
-		`, userID, product.Tier, purchaseTime, expiryTime, product.ScanCredits,
+		`, userID, product.Tier, purchaseTime, expiryTime,
 			receiptData, transaction.TransactionId, transaction.OriginalTransactionId,
 			transaction.Environment)
 
 		if err != nil {
-			return &PurchaseResponse{
-				Success: false,
-				Message: "Failed to create subscription",
-			}, fmt.Errorf("failed to create subscription: %w", err)
+			return nil, fmt.Errorf("failed to create subscription: %w", err)
 		}
 	} else {
-		return &PurchaseResponse{
-			Success: false,
-			Message: "Database error",
-		}, fmt.Errorf("database error: %w", err)
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	// The new allowance replaces what's left of the old one
+	if !alreadyGranted {
+		if err := s.resetSubscriptionAllowance(ctx, tx, userID, product.ScanCredits,
+			transaction.TransactionId, product.Name); err != nil {
+			return nil, fmt.Errorf("failed to add scan credits: %w", err)
+		}
 	}
 
 	// Commit the transaction
 	if err := tx.Commit(ctx); err != nil {
-		return &PurchaseResponse{
-			Success: false,
-			Message: "Failed to save subscription",
-		}, fmt.Errorf("failed to commit transaction: %w", err)
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
 	// Get updated subscription info
@@ -736,10 +652,7 @@ func (s *SubscriptionService) processScanPack(ctx context.Context, userID int, t
 	// Start a transaction
 	tx, err := s.db.Begin(ctx)
 	if err != nil {
-		return &PurchaseResponse{
-			Success: false,
-			Message: "Database error",
-		}, fmt.Errorf("failed to begin transaction: %w", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer tx.Rollback(ctx)
 
@@ -753,17 +666,11 @@ func (s *SubscriptionService) processScanPack(ctx context.Context, userID int, t
 	`, transaction.TransactionId).Scan(&transactionExists)
 
 	if err != nil {
-		return &PurchaseResponse{
-			Success: false,
-			Message: "Database error",
-		}, fmt.Errorf("failed to check for existing purchase: %w", err)
+		return nil, fmt.Errorf("failed to check for existing purchase: %w", err)
 	}
 
 	if transactionExists {
-		return &PurchaseResponse{
-			Success: false,
-			Message: "This purchase has already been processed",
-		}, fmt.Errorf("duplicate transaction: %s", transaction.TransactionId)
+		return nil, common.NewError(common.ErrConflict, "purchase_already_processed", "this purchase has already been processed")
 	}
 
 	// Record the scan pack purchase
@@ -777,36 +684,19 @@ func (s *SubscriptionService) processScanPack(ctx context.Context, userID int, t
 		transaction.Environment, product.ScanCredits)
 
 	if err != nil {
-		return &PurchaseResponse{
-			Success: false,
-			Message: "Failed to record scan pack purchase",
-		}, fmt.Errorf("failed to record purchase: %w", err)
+		return nil, fmt.Errorf("failed to record purchase: %w", err)
 	}
 
 	// Add scan credits to the user's account
-	_, err = tx.Exec(ctx, `
-		INSERT INTO user_subscriptions (
-			user_id, scan_credits_remaining, tier
-		) VALUES (
-			$1, $2, 'none'
-		)
-		ON CONFLICT (user_id) DO UPDATE
-		SET scan_credits_remaining = user_subscriptions.scan_credits_remaining + $2
-	`, userID, product.ScanCredits)
-
+	_, err = s.applyCredits(ctx, tx, userID, CreditEntryPurchase, CreditBucketPack, product.ScanCredits,
+		nil, transaction.TransactionId, product.Name)
 	if err != nil {
-		return &PurchaseResponse{
-			Success: false,
-			Message: "Failed to add scan credits",
-		}, fmt.Errorf("failed to add scan credits: %w", err)
+		return nil, fmt.Errorf("failed to add scan credits: %w", err)
 	}
 
 	// Commit the transaction
 	if err := tx.Commit(ctx); err != nil {
-		return &PurchaseResponse{
-			Success: false,
-			Message: "Failed to complete purchase",
-		}, fmt.Errorf("failed to commit transaction: %w", err)
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
 	// Get updated subscription info
@@ -1444,20 +1334,32 @@ func (s *SubscriptionService) processSubscriptionRenewal(ctx context.Context, tr
 		`, transaction.ParsedExpiresDate, transaction.TransactionId, userID)
 	} else {
 		// Update with new product details and add scan credits
-		_, err = s.db.Exec(ctx, `
+		var tx pgx.Tx
+		tx, err = s.db.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		defer tx.Rollback(ctx)
+
+		_, err = tx.Exec(ctx, `
 			UPDATE user_subscriptions
 			SET 
 				is_active = true,
 				tier = $1,
 				subscription_end = $2,
-				scan_credits_remaining = scan_credits_remaining + $3,
-				transaction_id = $4
-			WHERE user_id = $5
+				transaction_id = $3
+			WHERE user_id = $4
 		`, product.Tier,
 			transaction.ParsedExpiresDate,
-			product.ScanCredits,
 			transaction.TransactionId,
 			userID)
+		if err == nil {
+			err = s.resetSubscriptionAllowance(ctx, tx, userID, product.ScanCredits,
+				transaction.TransactionId, product.Name+" renewal")
+		}
+		if err == nil {
+			err = tx.Commit(ctx)
+		}
 	}
 
 	if err != nil {
@@ -1556,9 +1458,24 @@ func (s *SubscriptionService) processRefund(ctx context.Context, transaction *Ap
 	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
 	logger.Printf("Processing refund for transaction %s", transaction.TransactionId)
 
+	// Scan packs are one-off purchases, so only their own credits go
+	var packUserID, packCredits int
+	err := s.db.QueryRow(ctx, `
+		SELECT user_id, credits_amount FROM scan_pack_purchases
+		WHERE transaction_id = $1
+	`, transaction.TransactionId).Scan(&packUserID, &packCredits)
+	if err == nil {
+		if err := s.refundScanPack(ctx, packUserID, packCredits, transaction.TransactionId); err != nil {
+			return fmt.Errorf("failed to refund scan pack: %w", err)
+		}
+		return nil
+	} else if err != pgx.ErrNoRows {
+		return fmt.Errorf("failed to find scan pack purchase: %w", err)
+	}
+
 	// Find the user associated with this subscription
 	var userID int
-	err := s.db.QueryRow(ctx, `
+	err = s.db.QueryRow(ctx, `
 		SELECT user_id FROM user_subscriptions 
 		WHERE transaction_id = $1 OR original_transaction_id = $2
 	`, transaction.TransactionId, transaction.OriginalTransactionId).Scan(&userID)
@@ -1573,16 +1490,7 @@ func (s *SubscriptionService) processRefund(ctx context.Context, transaction *Ap
 	}
 
 	// Mark subscription as inactive and remove scan credits
-	_, err = s.db.Exec(ctx, `
-		UPDATE user_subscriptions
-		SET 
-			is_active = false,
-			subscription_end = NOW(),
-			scan_credits_remaining = 6
-		WHERE user_id = $1
-	`, userID)
-
-	if err != nil {
+	if err := s.endSubscription(ctx, userID, transaction.TransactionId, "App Store refund"); err != nil {
 		return fmt.Errorf("failed to process refund: %w", err)
 	}
 
@@ -1612,20 +1520,89 @@ func (s *SubscriptionService) processRevoke(ctx context.Context, transaction *Ap
 	}
 
 	// Mark subscription as inactive
-	_, err = s.db.Exec(ctx, `
+	if err := s.endSubscription(ctx, userID, transaction.TransactionId, "App Store revocation"); err != nil {
+		return fmt.Errorf("failed to revoke subscription: %w", err)
+	}
+
+	logger.Printf("Successfully revoked subscription for user %d", userID)
+	return nil
+}
+
+// endSubscription deactivates a refunded or revoked subscription and takes
+// back what's left of its allowance. Pack and promo credits are kept.
+func (s *SubscriptionService) endSubscription(ctx context.Context, userID int, transactionID, note string) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	buckets, err := s.lockCreditAccount(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	if buckets.Subscription > 0 {
+		if _, err := s.applyCredits(ctx, tx, userID, CreditEntryRefund, CreditBucketSubscription,
+			-buckets.Subscription, nil, transactionID, note); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(ctx, `
 		UPDATE user_subscriptions
 		SET 
 			is_active = false,
-			subscription_end = NOW(),
-			scan_credits_remaining = 6
+			subscription_end = NOW()
 		WHERE user_id = $1
 	`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to deactivate subscription: %w", err)
+	}
+
+	return tx.Commit(ctx)
+}
 
+// refundScanPack takes back the credits of a refunded scan pack, as far as
+// they haven't been spent. A pack is only refunded once, however many times
+// the refund is delivered.
+func (s *SubscriptionService) refundScanPack(ctx context.Context, userID, credits int, transactionID string) error {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+
+	tx, err := s.db.Begin(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to revoke subscription: %w", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
+	defer tx.Rollback(ctx)
 
-	logger.Printf("Successfully revoked subscription for user %d", userID)
+	buckets, err := s.lockCreditAccount(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+
+	tag, err := tx.Exec(ctx, `
+		UPDATE scan_pack_purchases SET refunded_at = NOW(), updated_at = NOW()
+		WHERE transaction_id = $1 AND refunded_at IS NULL
+	`, transactionID)
+	if err != nil {
+		return fmt.Errorf("failed to mark scan pack refunded: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		logger.Printf("Scan pack %s was already refunded, ignoring", transactionID)
+		return nil
+	}
+	clawback := min(credits, buckets.Pack)
+	if clawback > 0 {
+		if _, err := s.applyCredits(ctx, tx, userID, CreditEntryRefund, CreditBucketPack,
+			-clawback, nil, transactionID, "App Store refund"); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	logger.Printf("Took back %d of %d scan pack credits from user %d", clawback, credits, userID)
 	return nil
 }
 
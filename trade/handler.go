@@ -38,21 +38,21 @@ func (h *HTTPHandler) HandleCreateTrade(w http.ResponseWriter, r *http.Request)
 	var req tradeRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		logger.Printf("Failed to decode create trade request: %v", err)
-		http.Error(w, "invalid request data", http.StatusBadRequest)
+		common.WriteErrorOr(w, r, err, common.BadRequest("invalid request data"))
 		return
 	}
 
 	userIDFrom, ok := r.Context().Value(common.UserIDCtxKey).(int)
 	if !ok {
 		logger.Printf("User ID not found in context")
-		http.Error(w, "invalid user ID in context", http.StatusInternalServerError)
+		common.WriteError(w, r, common.ErrInvalidUserContext)
 		return
 	}
 
 	logger.Printf("Creating trade request from user %d to user %d", userIDFrom, req.UserIDTo)
 	if err := h.service.CreateTrade(r.Context(), userIDFrom, req.UserIDTo, req.UserFromCarIDs, req.UserToCarIDs); err != nil {
 		logger.Printf("Failed to create trade: %v", err)
-		http.Error(w, "failed to create trade", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to create trade"))
 		return
 	}
 
@@ -66,14 +66,14 @@ func (h *HTTPHandler) HandleTradeRequestResponse(w http.ResponseWriter, r *http.
 	var req tradeRequestResponse
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		logger.Printf("Failed to decode trade response request: %v", err)
-		http.Error(w, "invalid request data", http.StatusBadRequest)
+		common.WriteErrorOr(w, r, err, common.BadRequest("invalid request data"))
 		return
 	}
 
 	userID, ok := r.Context().Value(common.UserIDCtxKey).(int)
 	if !ok {
 		logger.Printf("User ID not found in context")
-		http.Error(w, "invalid user ID in context", http.StatusInternalServerError)
+		common.WriteError(w, r, common.ErrInvalidUserContext)
 		return
 	}
 
@@ -82,20 +82,20 @@ func (h *HTTPHandler) HandleTradeRequestResponse(w http.ResponseWriter, r *http.
 	case "accept":
 		if err := h.service.AcceptTrade(r.Context(), userID, req.TradeID); err != nil {
 			logger.Printf("Failed to accept trade %d: %v", req.TradeID, err)
-			http.Error(w, "failed to accept trade", http.StatusInternalServerError)
+			common.WriteErrorOr(w, r, err, common.Internal("failed to accept trade"))
 			return
 		}
 		logger.Printf("Trade %d accepted successfully", req.TradeID)
 	case "decline":
 		if err := h.service.DeclineTrade(r.Context(), req.TradeID); err != nil {
 			logger.Printf("Failed to decline trade %d: %v", req.TradeID, err)
-			http.Error(w, "failed to decline trade", http.StatusInternalServerError)
+			common.WriteErrorOr(w, r, err, common.Internal("failed to decline trade"))
 			return
 		}
 		logger.Printf("Trade %d declined successfully", req.TradeID)
 	default:
 		logger.Printf("Invalid trade response received: %s", req.Response)
-		http.Error(w, "invalid response type, must be 'accept' or 'decline'", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("invalid response type, must be 'accept' or 'decline'"))
 		return
 	}
 
@@ -108,7 +108,7 @@ func (h *HTTPHandler) HandleGetUserTrades(w http.ResponseWriter, r *http.Request
 	userID, ok := r.Context().Value(common.UserIDCtxKey).(int)
 	if !ok {
 		logger.Printf("User ID not found in context")
-		http.Error(w, "invalid user ID in context", http.StatusInternalServerError)
+		common.WriteError(w, r, common.ErrInvalidUserContext)
 		return
 	}
 
@@ -131,7 +131,7 @@ func (h *HTTPHandler) HandleGetUserTrades(w http.ResponseWriter, r *http.Request
 	trades, totalCount, err := h.service.GetUserTrades(r.Context(), userID, page, pageSize)
 	if err != nil {
 		logger.Printf("Failed to get user trades: %v", err)
-		http.Error(w, "failed to get trades", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to get trades"))
 		return
 	}
 
@@ -143,7 +143,7 @@ func (h *HTTPHandler) HandleGetUserTrades(w http.ResponseWriter, r *http.Request
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
 		logger.Printf("Failed to encode response: %v", err)
-		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to encode response"))
 		return
 	}
 }
@@ -156,26 +156,26 @@ func (h *HTTPHandler) HandleGetTrade(w http.ResponseWriter, r *http.Request) {
 	tradeID, err := strconv.Atoi(tradeIDStr)
 	if err != nil {
 		logger.Printf("Invalid trade ID format: %s", tradeIDStr)
-		http.Error(w, "invalid trade ID", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("invalid trade ID"))
 		return
 	}
 
 	trade, err := h.service.GetTradeByID(r.Context(), tradeID)
 	if err != nil {
 		logger.Printf("Failed to get trade: %v", err)
-		http.Error(w, "failed to get trade", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to get trade"))
 		return
 	}
 
 	if trade == nil {
-		http.Error(w, "trade not found", http.StatusNotFound)
+		common.WriteError(w, r, common.NotFound("trade not found"))
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(trade); err != nil {
 		logger.Printf("Failed to encode response: %v", err)
-		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to encode response"))
 		return
 	}
 }
@@ -5,6 +5,7 @@ import (
 	"CarBN/feed"
 	"CarBN/subscription"
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"time"
@@ -38,7 +39,7 @@ func (s *Service) CreateTrade(ctx context.Context, userIDFrom, userIDTo int, use
 		return fmt.Errorf("failed to check from user subscription: %w", err)
 	}
 	if !hasSubscriptionFrom {
-		return fmt.Errorf("trading requires an active subscription")
+		return common.NewError(common.ErrPaymentRequired, "subscription_required", "trading requires an active subscription")
 	}
 
 	hasSubscriptionTo, err := s.subscriptionService.HasActiveSubscription(ctx, userIDTo)
@@ -46,7 +47,7 @@ func (s *Service) CreateTrade(ctx context.Context, userIDFrom, userIDTo int, use
 		return fmt.Errorf("failed to check to user subscription: %w", err)
 	}
 	if !hasSubscriptionTo {
-		return fmt.Errorf("cannot trade with a user without an active subscription")
+		return common.NewError(common.ErrForbidden, "recipient_subscription_required", "cannot trade with a user without an active subscription")
 	}
 
 	tx, err := s.db.Begin(ctx)
@@ -127,12 +128,15 @@ func (s *Service) AcceptTrade(ctx context.Context, userID int, tradeID int) erro
 	`, tradeID).Scan(&userIDFrom, &userIDTo, &status, &userFromCarIDs, &userToCarIDs)
 	if err != nil {
 		logger.Printf("Failed to fetch trade details: %v", err)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return common.NotFound("trade not found")
+		}
 		return fmt.Errorf("failed to get trade details: %w", err)
 	}
 
 	if userID != userIDTo {
 		logger.Printf("User %d is not the recipient of trade %d", userID, tradeID)
-		return fmt.Errorf("user is not the recipient of trade")
+		return common.Forbidden("user is not the recipient of trade")
 	}
 
 	logger.Printf("Verifying ownership of cars for user %d", userIDFrom)
@@ -149,7 +153,7 @@ func (s *Service) AcceptTrade(ctx context.Context, userID int, tradeID int) erro
 
 	if status != "pending" {
 		logger.Printf("Invalid trade status: %s", status)
-		return fmt.Errorf("trade is not pending")
+		return common.NewError(common.ErrConflict, "trade_not_pending", "trade is not pending")
 	}
 
 	logger.Printf("Updating car ownerships for trade ID %d", tradeID)
@@ -203,7 +207,7 @@ func (s *Service) DeclineTrade(ctx context.Context, tradeID int) error {
 
 	if result.RowsAffected() == 0 {
 		logger.Printf("No pending trade found with ID %d", tradeID)
-		return fmt.Errorf("no pending trade found with ID %d", tradeID)
+		return common.NotFound(fmt.Sprintf("no pending trade found with ID %d", tradeID))
 	}
 
 	logger.Printf("Trade %d declined successfully", tradeID)
@@ -257,7 +261,7 @@ func (s *Service) verifyCarOwnership(ctx context.Context, tx pgx.Tx, userID int,
 			return fmt.Errorf("failed to verify car ownership: %w", err)
 		}
 		if count == 0 {
-			return fmt.Errorf("user %d does not own car %d", userID, carID)
+			return common.NewError(common.ErrConflict, "car_not_owned", fmt.Sprintf("user %d does not own car %d", userID, carID))
 		}
 	}
 	return nil
@@ -0,0 +1,47 @@
+package usage
+
+import (
+	"CarBN/common"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultSummaryDays = 30
+	maxSummaryDays     = 365
+)
+
+type HTTPHandler struct {
+	service *Service
+}
+
+func NewHTTPHandler(s *Service) *HTTPHandler {
+	return &HTTPHandler{service: s}
+}
+
+// HandleGetSummary returns the AI spend per day, provider and user
+func (h *HTTPHandler) HandleGetSummary(w http.ResponseWriter, r *http.Request) {
+	logger := r.Context().Value(common.LoggerCtxKey).(*log.Logger)
+
+	days := defaultSummaryDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		var err error
+		days, err = strconv.Atoi(v)
+		if err != nil || days < 1 || days > maxSummaryDays {
+			common.WriteError(w, r, common.BadRequest("days must be between 1 and 365"))
+			return
+		}
+	}
+
+	summary, err := h.service.GetSummary(r.Context(), days)
+	if err != nil {
+		logger.Printf("Failed to get AI usage summary: %v", err)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to get AI usage"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
@@ -0,0 +1,258 @@
+package usage
+
+import (
+	"CarBN/common"
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Kinds of AI calls
+const (
+	KindVision = "vision" // Identifying the car in a scan photo
+	KindChat   = "chat"   // Looking up a car's spec sheet
+	KindImage  = "image"  // Rendering a car image
+)
+
+// Price is what a model costs in USD. Token prices are per million tokens.
+type Price struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+	Image  float64 `json:"image"`
+}
+
+// defaultPrices are the list prices of the models the server is usually
+// configured with. AI_PRICES adds to or overrides them.
+var defaultPrices = map[string]Price{
+	"gemini-2.0-flash":        {Input: 0.10, Output: 0.40},
+	"imagen-3.0-generate-002": {Image: 0.03},
+	"gpt-4o":                  {Input: 2.50, Output: 10.00},
+	"gpt-4o-mini":             {Input: 0.15, Output: 0.60},
+}
+
+// Execer is satisfied by both the pool and a transaction, so usage can be
+// linked to a scan inside the scan transaction
+type Execer interface {
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+}
+
+// Call is one request to an AI provider. Tokens are nil when the provider
+// didn't report them.
+type Call struct {
+	Kind         string
+	Provider     string
+	Model        string
+	InputTokens  *int
+	OutputTokens *int
+	Images       int
+	Latency      time.Duration
+	Err          error
+	CarID        *int
+}
+
+type Service struct {
+	db     *pgxpool.Pool
+	prices map[string]Price
+}
+
+// NewService creates the usage service. AI_PRICES is a JSON object of model
+// prices, e.g. {"grok-2-vision": {"input": 2, "output": 10}}; calls to models
+// without a price are recorded without a cost.
+func NewService(db *pgxpool.Pool) *Service {
+	prices := make(map[string]Price, len(defaultPrices))
+	for model, price := range defaultPrices {
+		prices[model] = price
+	}
+	if v := os.Getenv("AI_PRICES"); v != "" {
+		var custom map[string]Price
+		if err := json.Unmarshal([]byte(v), &custom); err != nil {
+			log.Printf("Warning: ignoring invalid AI_PRICES: %v", err)
+		}
+		for model, price := range custom {
+			prices[model] = price
+		}
+	}
+	return &Service{db: db, prices: prices}
+}
+
+// Record stores a call, linked to the user and scan in ctx. Failing to record
+// is only logged so accounting never fails a scan. A nil service records
+// nothing.
+func (s *Service) Record(ctx context.Context, call *Call) {
+	if s == nil {
+		return
+	}
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+
+	var errText *string
+	if call.Err != nil {
+		text := call.Err.Error()
+		errText = &text
+	}
+
+	sc, _ := ctx.Value(scopeKey{}).(*scope)
+	var userID, pendingScanID *int
+	if sc != nil {
+		userID, pendingScanID = sc.userID, sc.pendingScanID
+	}
+
+	// Use a fresh context so a call that timed out still gets recorded
+	recordCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+
+	var id int
+	err := s.db.QueryRow(recordCtx, `
+		INSERT INTO ai_usage (user_id, pending_scan_id, car_id, kind, provider, model, input_tokens, output_tokens,
+			images, latency_ms, success, error, estimated_cost)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, $8, $9, $10, $11, $12, $13)
+		RETURNING id`,
+		userID, pendingScanID, call.CarID, call.Kind, call.Provider, call.Model, call.InputTokens, call.OutputTokens,
+		call.Images, call.Latency.Milliseconds(), call.Err == nil, errText, s.cost(call),
+	).Scan(&id)
+	if err != nil {
+		logger.Printf("Warning: failed to record %s call to %s: %v", call.Kind, call.Provider, err)
+		return
+	}
+
+	if sc != nil {
+		sc.mu.Lock()
+		sc.ids = append(sc.ids, id)
+		sc.mu.Unlock()
+	}
+}
+
+// cost estimates what a call cost, or nil when the model has no price
+func (s *Service) cost(call *Call) *float64 {
+	price, ok := s.prices[call.Model]
+	if !ok {
+		return nil
+	}
+	cost := float64(call.Images) * price.Image
+	if call.InputTokens != nil {
+		cost += float64(*call.InputTokens) * price.Input / 1e6
+	}
+	if call.OutputTokens != nil {
+		cost += float64(*call.OutputTokens) * price.Output / 1e6
+	}
+	return &cost
+}
+
+// scope collects the calls made on behalf of a user's scan so they can be
+// linked to its scan_history row once it's written
+type scope struct {
+	userID        *int
+	pendingScanID *int
+
+	mu  sync.Mutex
+	ids []int
+}
+
+type scopeKey struct{}
+
+// WithUser attributes the calls made with the returned context to the user
+func WithUser(ctx context.Context, userID int) context.Context {
+	return context.WithValue(ctx, scopeKey{}, &scope{userID: &userID})
+}
+
+// WithPendingScan attributes the calls made with the returned context to the
+// user's pending scan. Linking the scan also links the calls that identified
+// it before it was left pending.
+func WithPendingScan(ctx context.Context, userID, pendingScanID int) context.Context {
+	return context.WithValue(ctx, scopeKey{}, &scope{userID: &userID, pendingScanID: &pendingScanID})
+}
+
+// LinkPendingScan links the calls recorded so far with ctx to a pending scan
+func LinkPendingScan(ctx context.Context, q Execer, pendingScanID int) error {
+	sc, _ := ctx.Value(scopeKey{}).(*scope)
+	if sc == nil {
+		return nil
+	}
+	sc.mu.Lock()
+	ids := append([]int(nil), sc.ids...)
+	sc.mu.Unlock()
+	if len(ids) == 0 {
+		return nil
+	}
+
+	_, err := q.Exec(ctx, `UPDATE ai_usage SET pending_scan_id = $1 WHERE id = ANY($2)`, pendingScanID, ids)
+	return err
+}
+
+// LinkScan links the calls recorded with ctx, and those of its pending scan,
+// to the scan's scan_history row
+func LinkScan(ctx context.Context, q Execer, scanHistoryID int) error {
+	sc, _ := ctx.Value(scopeKey{}).(*scope)
+	if sc == nil {
+		return nil
+	}
+	sc.mu.Lock()
+	ids := append([]int(nil), sc.ids...)
+	sc.mu.Unlock()
+	if len(ids) == 0 && sc.pendingScanID == nil {
+		return nil
+	}
+
+	_, err := q.Exec(ctx, `
+		UPDATE ai_usage SET scan_history_id = $1
+		WHERE id = ANY($2) OR pending_scan_id = $3`,
+		scanHistoryID, ids, sc.pendingScanID)
+	return err
+}
+
+type callKey struct{}
+
+// WithCall returns a context through which the provider handling the call
+// reports the model it used and the tokens it was billed for
+func WithCall(ctx context.Context, call *Call) context.Context {
+	return context.WithValue(ctx, callKey{}, call)
+}
+
+// SetModel sets the model of the call in ctx, if any
+func SetModel(ctx context.Context, model string) {
+	if call, ok := ctx.Value(callKey{}).(*Call); ok {
+		call.Model = model
+	}
+}
+
+// SetTokens sets the token counts of the call in ctx, if any
+func SetTokens(ctx context.Context, input, output *int) {
+	if call, ok := ctx.Value(callKey{}).(*Call); ok {
+		call.InputTokens, call.OutputTokens = input, output
+	}
+}
+
+// MeterImages wraps generator so every image it generates is recorded against
+// the car it was generated for
+func (s *Service) MeterImages(generator common.ImageGenerator) common.ImageGenerator {
+	return &meteredImageGenerator{ImageGenerator: generator, usage: s}
+}
+
+type meteredImageGenerator struct {
+	common.ImageGenerator
+	usage *Service
+}
+
+func (g *meteredImageGenerator) GenerateCarImage(ctx context.Context, req common.ImageRequest) (string, error) {
+	start := time.Now()
+	image, err := g.ImageGenerator.GenerateCarImage(ctx, req)
+
+	call := &Call{
+		Kind:     KindImage,
+		Provider: g.Name(),
+		Model:    g.Model(),
+		Latency:  time.Since(start),
+		Err:      err,
+		CarID:    &req.CarID,
+	}
+	if err == nil {
+		call.Images = 1
+	}
+	g.usage.Record(ctx, call)
+	return image, err
+}
@@ -0,0 +1,159 @@
+package usage
+
+import (
+	"CarBN/common"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// topUsers is how many of the biggest spenders the summary lists
+const topUsers = 50
+
+// Totals adds up a group of calls. EstimatedCost only covers the calls to
+// models with a price.
+type Totals struct {
+	Calls         int     `json:"calls"`
+	Failed        int     `json:"failed"`
+	InputTokens   int64   `json:"input_tokens"`
+	OutputTokens  int64   `json:"output_tokens"`
+	Images        int     `json:"images"`
+	EstimatedCost float64 `json:"estimated_cost"`
+	AvgLatencyMs  int     `json:"avg_latency_ms"`
+}
+
+type DayUsage struct {
+	Day string `json:"day"`
+	Totals
+}
+
+type ProviderUsage struct {
+	Provider string `json:"provider"`
+	Model    string `json:"model,omitempty"`
+	Kind     string `json:"kind"`
+	Totals
+}
+
+type UserUsage struct {
+	UserID      int    `json:"user_id"`
+	DisplayName string `json:"display_name"`
+	Scans       int    `json:"scans"`
+	Totals
+}
+
+// Summary is the AI spend over a period, broken down by day, provider and
+// user. Calls made for no user, such as spec backfills, count towards the
+// days and providers only.
+type Summary struct {
+	From       string          `json:"from"`
+	To         string          `json:"to"`
+	Total      Totals          `json:"total"`
+	ByDay      []DayUsage      `json:"by_day"`
+	ByProvider []ProviderUsage `json:"by_provider"`
+	ByUser     []UserUsage     `json:"by_user"`
+}
+
+const totalsColumns = `COUNT(*), COUNT(*) FILTER (WHERE NOT success),
+	COALESCE(SUM(input_tokens), 0), COALESCE(SUM(output_tokens), 0), COALESCE(SUM(images), 0),
+	COALESCE(SUM(estimated_cost), 0)::float8, COALESCE(AVG(latency_ms), 0)::int`
+
+func (t *Totals) scanTargets() []interface{} {
+	return []interface{}{&t.Calls, &t.Failed, &t.InputTokens, &t.OutputTokens, &t.Images, &t.EstimatedCost, &t.AvgLatencyMs}
+}
+
+// GetSummary returns the AI usage of the last days days, today included
+func (s *Service) GetSummary(ctx context.Context, days int) (*Summary, error) {
+	to := time.Now().UTC()
+	from := to.Truncate(24*time.Hour).AddDate(0, 0, 1-days)
+	summary := &Summary{
+		From:       common.FormatTimestamp(from),
+		To:         common.FormatTimestamp(to),
+		ByDay:      []DayUsage{},
+		ByProvider: []ProviderUsage{},
+		ByUser:     []UserUsage{},
+	}
+
+	if err := s.db.QueryRow(ctx, `SELECT `+totalsColumns+` FROM ai_usage WHERE created_at >= $1`, from).
+		Scan(summary.Total.scanTargets()...); err != nil {
+		return nil, fmt.Errorf("failed to get usage totals: %w", err)
+	}
+
+	rows, err := s.db.Query(ctx, `
+		SELECT to_char(created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD') AS day, `+totalsColumns+`
+		FROM ai_usage
+		WHERE created_at >= $1
+		GROUP BY day
+		ORDER BY day DESC`, from)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get usage by day: %w", err)
+	}
+	err = scanRows(rows, func(rows pgx.Rows) error {
+		var d DayUsage
+		if err := rows.Scan(append([]interface{}{&d.Day}, d.scanTargets()...)...); err != nil {
+			return err
+		}
+		summary.ByDay = append(summary.ByDay, d)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get usage by day: %w", err)
+	}
+
+	rows, err = s.db.Query(ctx, `
+		SELECT provider, COALESCE(model, ''), kind, `+totalsColumns+`
+		FROM ai_usage
+		WHERE created_at >= $1
+		GROUP BY provider, model, kind
+		ORDER BY SUM(estimated_cost) DESC NULLS LAST, COUNT(*) DESC`, from)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get usage by provider: %w", err)
+	}
+	err = scanRows(rows, func(rows pgx.Rows) error {
+		var p ProviderUsage
+		if err := rows.Scan(append([]interface{}{&p.Provider, &p.Model, &p.Kind}, p.scanTargets()...)...); err != nil {
+			return err
+		}
+		summary.ByProvider = append(summary.ByProvider, p)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get usage by provider: %w", err)
+	}
+
+	rows, err = s.db.Query(ctx, `
+		SELECT a.user_id, COALESCE(u.display_name, ''), COUNT(DISTINCT a.scan_history_id), `+totalsColumns+`
+		FROM ai_usage a
+		JOIN users u ON u.id = a.user_id
+		WHERE a.created_at >= $1
+		GROUP BY a.user_id, u.display_name
+		ORDER BY SUM(a.estimated_cost) DESC NULLS LAST, COUNT(*) DESC
+		LIMIT $2`, from, topUsers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get usage by user: %w", err)
+	}
+	err = scanRows(rows, func(rows pgx.Rows) error {
+		var u UserUsage
+		if err := rows.Scan(append([]interface{}{&u.UserID, &u.DisplayName, &u.Scans}, u.scanTargets()...)...); err != nil {
+			return err
+		}
+		summary.ByUser = append(summary.ByUser, u)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get usage by user: %w", err)
+	}
+
+	return summary, nil
+}
+
+func scanRows(rows pgx.Rows, scan func(pgx.Rows) error) error {
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
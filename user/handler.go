@@ -1,7 +1,9 @@
 package user
 
 import (
+	"CarBN/catalog"
 	"CarBN/common"
+	"CarBN/storage"
 	"context"
 	"encoding/base64"
 	"encoding/json"
@@ -29,7 +31,7 @@ func (h *HTTPHandler) HandleGetCarCollection(w http.ResponseWriter, r *http.Requ
 	userID, ok := r.Context().Value(common.UserIDCtxKey).(int)
 	if !ok {
 		logger.Printf("Invalid user ID in context")
-		http.Error(w, "invalid user ID in context", http.StatusInternalServerError)
+		common.WriteError(w, r, common.ErrInvalidUserContext)
 		return
 	}
 
@@ -39,7 +41,7 @@ func (h *HTTPHandler) HandleGetCarCollection(w http.ResponseWriter, r *http.Requ
 	if requestedUserIDParam != "" {
 		requestedUserID, err = strconv.Atoi(requestedUserIDParam)
 		if err != nil {
-			http.Error(w, "invalid requested user ID", http.StatusBadRequest)
+			common.WriteError(w, r, common.BadRequest("invalid requested user ID"))
 			return
 		}
 	} else {
@@ -81,13 +83,13 @@ func (h *HTTPHandler) HandleGetCarCollection(w http.ResponseWriter, r *http.Requ
 	cars, err := h.service.GetCarCollection(r.Context(), userID, requestedUserID, limit, offset, sort)
 	if err != nil {
 		logger.Printf("Failed to get car collection: %v", err)
-		http.Error(w, "failed to retrieve cars", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to retrieve cars"))
 		return
 	}
 
 	// if len(cars) == 0 {
 	// 	logger.Printf("No cars found for user %d", requestedUserID)
-	// 	http.Error(w, "no cars found", http.StatusNotFound)
+	// 	common.WriteError(w, r, common.NotFound("no cars found"))
 	// 	return
 	// }
 
@@ -95,7 +97,7 @@ func (h *HTTPHandler) HandleGetCarCollection(w http.ResponseWriter, r *http.Requ
 
 	if err := json.NewEncoder(w).Encode(cars); err != nil {
 		logger.Printf("Failed to encode cars response: %v", err)
-		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to encode response"))
 		return
 	}
 
@@ -110,7 +112,7 @@ func (h *HTTPHandler) HandleGetSpecificUserCars(w http.ResponseWriter, r *http.R
 	// Parse car IDs from query parameter
 	idsParam := r.URL.Query().Get("ids")
 	if idsParam == "" {
-		http.Error(w, "ids parameter is required", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("ids parameter is required"))
 		return
 	}
 
@@ -119,22 +121,23 @@ func (h *HTTPHandler) HandleGetSpecificUserCars(w http.ResponseWriter, r *http.R
 	for _, idStr := range idStrs {
 		id, err := strconv.Atoi(strings.TrimSpace(idStr))
 		if err != nil {
-			http.Error(w, "invalid car ID format", http.StatusBadRequest)
+			common.WriteError(w, r, common.BadRequest("invalid car ID format"))
 			return
 		}
 		userCarIDs = append(userCarIDs, id)
 	}
 
-	cars, err := h.service.GetSpecificUserCars(r.Context(), userCarIDs)
+	userID := r.Context().Value(common.UserIDCtxKey).(int)
+	cars, err := h.service.GetSpecificUserCars(r.Context(), userID, userCarIDs)
 	if err != nil {
 		logger.Printf("Failed to get specific user cars: %v", err)
-		http.Error(w, "failed to retrieve cars", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to retrieve cars"))
 		return
 	}
 
 	if len(cars) == 0 {
 		logger.Printf("No cars found for IDs: %v", userCarIDs)
-		http.Error(w, "no cars found", http.StatusNotFound)
+		common.WriteError(w, r, common.NotFound("no cars found"))
 		return
 	}
 
@@ -142,7 +145,7 @@ func (h *HTTPHandler) HandleGetSpecificUserCars(w http.ResponseWriter, r *http.R
 
 	if err := json.NewEncoder(w).Encode(cars); err != nil {
 		logger.Printf("Failed to encode cars response: %v", err)
-		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to encode response"))
 		return
 	}
 
@@ -156,7 +159,7 @@ func (h *HTTPHandler) HandleGetPendingFriendRequests(w http.ResponseWriter, r *h
 	userID, ok := r.Context().Value(common.UserIDCtxKey).(int)
 	if !ok {
 		logger.Printf("Invalid user ID in context")
-		http.Error(w, "invalid user ID in context", http.StatusInternalServerError)
+		common.WriteError(w, r, common.ErrInvalidUserContext)
 		return
 	}
 
@@ -164,7 +167,7 @@ func (h *HTTPHandler) HandleGetPendingFriendRequests(w http.ResponseWriter, r *h
 	requests, err := h.service.GetPendingFriendRequests(r.Context(), userID)
 	if err != nil {
 		logger.Printf("Failed to fetch friend requests: %v", err)
-		http.Error(w, "failed to fetch requests", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to fetch requests"))
 		return
 	}
 
@@ -172,7 +175,7 @@ func (h *HTTPHandler) HandleGetPendingFriendRequests(w http.ResponseWriter, r *h
 
 	if err := json.NewEncoder(w).Encode(requests); err != nil {
 		logger.Printf("Failed to encode friend requests response: %v", err)
-		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to encode response"))
 		return
 	}
 
@@ -186,7 +189,7 @@ func (h *HTTPHandler) HandleUploadProfilePicture(w http.ResponseWriter, r *http.
 	userID, ok := r.Context().Value(common.UserIDCtxKey).(int)
 	if !ok {
 		logger.Printf("Invalid user ID in context")
-		http.Error(w, "invalid user ID in context", http.StatusInternalServerError)
+		common.WriteError(w, r, common.ErrInvalidUserContext)
 		return
 	}
 
@@ -195,7 +198,7 @@ func (h *HTTPHandler) HandleUploadProfilePicture(w http.ResponseWriter, r *http.
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		logger.Printf("Failed to decode request body: %v", err)
-		http.Error(w, "invalid request body", http.StatusBadRequest)
+		common.WriteErrorOr(w, r, err, common.BadRequest("invalid request body"))
 		return
 	}
 
@@ -204,7 +207,7 @@ func (h *HTTPHandler) HandleUploadProfilePicture(w http.ResponseWriter, r *http.
 
 	// Validate and decode base64 image
 	if req.Base64Image == "" {
-		http.Error(w, "missing base64_image", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("missing base64_image"))
 		return
 	}
 
@@ -217,17 +220,13 @@ func (h *HTTPHandler) HandleUploadProfilePicture(w http.ResponseWriter, r *http.
 	imageData, err := base64.StdEncoding.DecodeString(base64Data)
 	if err != nil {
 		logger.Printf("Failed to decode base64 image: %v", err)
-		http.Error(w, "invalid base64 image", http.StatusBadRequest)
+		common.WriteErrorOr(w, r, err, common.BadRequest("invalid base64 image"))
 		return
 	}
 
 	if err := h.service.UpdateProfilePicture(r.Context(), userID, imageData); err != nil {
-		if err.Error() == "image must be 512x512 pixels" {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
 		logger.Printf("Failed to update profile picture: %v", err)
-		http.Error(w, "failed to update profile picture", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to update profile picture"))
 		return
 	}
 
@@ -244,7 +243,7 @@ func (h *HTTPHandler) HandleGetUserProfile(w http.ResponseWriter, r *http.Reques
 	requestedUserIDStr := r.PathValue("user_id")
 	requestedUserID, err := strconv.Atoi(requestedUserIDStr)
 	if err != nil {
-		http.Error(w, "invalid user ID", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("invalid user ID"))
 		return
 	}
 
@@ -258,7 +257,7 @@ func (h *HTTPHandler) HandleGetUserProfile(w http.ResponseWriter, r *http.Reques
 	user, err := h.service.GetUserInfo(r.Context(), requestedUserID, currentUserID)
 	if err != nil {
 		logger.Printf("Failed to get user info: %v", err)
-		http.Error(w, fmt.Sprintf("user not found: %v", err), http.StatusNotFound)
+		common.WriteErrorOr(w, r, err, common.NotFound("user not found"))
 		return
 	}
 
@@ -266,7 +265,7 @@ func (h *HTTPHandler) HandleGetUserProfile(w http.ResponseWriter, r *http.Reques
 
 	if err := json.NewEncoder(w).Encode(user); err != nil {
 		logger.Printf("Failed to encode response: %v", err)
-		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to encode response"))
 		return
 	}
 
@@ -281,14 +280,14 @@ func (h *HTTPHandler) HandleSearchUsers(w http.ResponseWriter, r *http.Request)
 
 	query := r.URL.Query().Get("q")
 	if query == "" {
-		http.Error(w, "search query is required", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("search query is required"))
 		return
 	}
 
 	users, err := h.service.SearchUsers(r.Context(), query, userID)
 	if err != nil {
 		logger.Printf("Failed to search users: %v", err)
-		http.Error(w, "failed to search users", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to search users"))
 		return
 	}
 
@@ -296,7 +295,7 @@ func (h *HTTPHandler) HandleSearchUsers(w http.ResponseWriter, r *http.Request)
 
 	if err := json.NewEncoder(w).Encode(users); err != nil {
 		logger.Printf("Failed to encode search results: %v", err)
-		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to encode response"))
 		return
 	}
 
@@ -312,18 +311,14 @@ func (h *HTTPHandler) HandleSellCar(w http.ResponseWriter, r *http.Request) {
 
 	userCarID, err := strconv.Atoi(r.PathValue("user_car_id"))
 	if err != nil {
-		http.Error(w, "invalid car ID", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("invalid car ID"))
 		return
 	}
 
 	currencyEarned, err := h.service.SellCar(r.Context(), userID, userCarID)
 	if err != nil {
 		logger.Printf("Failed to sell car: %v", err)
-		if err.Error() == "car not found or not owned by user" {
-			http.Error(w, err.Error(), http.StatusNotFound)
-			return
-		}
-		http.Error(w, "failed to sell car", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to sell car"))
 		return
 	}
 
@@ -343,22 +338,14 @@ func (h *HTTPHandler) HandleUpgradeCarImage(w http.ResponseWriter, r *http.Reque
 	userID := r.Context().Value(common.UserIDCtxKey).(int)
 	userCarID, err := strconv.Atoi(r.PathValue("user_car_id"))
 	if err != nil {
-		http.Error(w, "invalid car ID", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("invalid car ID"))
 		return
 	}
 
 	result, err := h.service.UpgradeCarImage(r.Context(), userID, userCarID)
 	if err != nil {
 		logger.Printf("Failed to upgrade car image: %v", err)
-		if err.Error() == "active subscription required" || err.Error() == "insufficient currency" {
-			http.Error(w, err.Error(), http.StatusPaymentRequired)
-			return
-		}
-		if err.Error() == "car not found or not owned by user" {
-			http.Error(w, err.Error(), http.StatusNotFound)
-			return
-		}
-		http.Error(w, "failed to upgrade car image", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to upgrade car image"))
 		return
 	}
 
@@ -367,8 +354,10 @@ func (h *HTTPHandler) HandleUpgradeCarImage(w http.ResponseWriter, r *http.Reque
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"message":            "car image upgraded successfully",
 		"remaining_currency": result.RemainingCurrency,
-		"high_res_image":     result.HighResImage,
-		"low_res_image":      result.LowResImage,
+		"high_res_image":     h.service.signer.Sign(result.HighResImage),
+		"low_res_image":      h.service.signer.Sign(result.LowResImage),
+		"image_variants":     h.service.signer.SignVariants(storage.URLsFor(result.HighResImage)),
+		"image_placeholder":  result.Placeholder,
 	})
 }
 
@@ -380,27 +369,25 @@ func (h *HTTPHandler) HandleRevertCarImage(w http.ResponseWriter, r *http.Reques
 	userID := r.Context().Value(common.UserIDCtxKey).(int)
 	userCarID, err := strconv.Atoi(r.PathValue("user_car_id"))
 	if err != nil {
-		http.Error(w, "invalid car ID", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("invalid car ID"))
 		return
 	}
 
 	result, err := h.service.RevertCarImage(r.Context(), userID, userCarID)
 	if err != nil {
 		logger.Printf("Failed to revert car image: %v", err)
-		if err.Error() == "car not found or not owned by user" {
-			http.Error(w, err.Error(), http.StatusNotFound)
-			return
-		}
-		http.Error(w, "failed to revert car image", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to revert car image"))
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"message":        "car image reverted successfully",
-		"high_res_image": result.HighResImage,
-		"low_res_image":  result.LowResImage,
+		"message":           "car image reverted successfully",
+		"high_res_image":    h.service.signer.Sign(result.HighResImage),
+		"low_res_image":     h.service.signer.Sign(result.LowResImage),
+		"image_variants":    h.service.signer.SignVariants(storage.URLsFor(result.HighResImage)),
+		"image_placeholder": result.Placeholder,
 	})
 }
 
@@ -410,14 +397,14 @@ func (h *HTTPHandler) HandleGetCarUpgrades(w http.ResponseWriter, r *http.Reques
 
 	userCarID, err := strconv.Atoi(r.PathValue("user_car_id"))
 	if err != nil {
-		http.Error(w, "invalid car ID", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("invalid car ID"))
 		return
 	}
 
 	upgrades, err := h.service.GetCarUpgrades(r.Context(), userID, userCarID)
 	if err != nil {
 		logger.Printf("Failed to get car upgrades: %v", err)
-		http.Error(w, "failed to retrieve upgrades", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to retrieve upgrades"))
 		return
 	}
 
@@ -425,7 +412,7 @@ func (h *HTTPHandler) HandleGetCarUpgrades(w http.ResponseWriter, r *http.Reques
 
 	if err := json.NewEncoder(w).Encode(upgrades); err != nil {
 		logger.Printf("Failed to encode upgrades response: %v", err)
-		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to encode response"))
 		return
 	}
 }
@@ -442,18 +429,39 @@ func (h *HTTPHandler) HandleUpdateDisplayName(w http.ResponseWriter, r *http.Req
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		logger.Printf("Failed to decode request body: %v", err)
-		http.Error(w, "invalid request body", http.StatusBadRequest)
+		common.WriteErrorOr(w, r, err, common.BadRequest("invalid request body"))
 		return
 	}
 
 	if err := h.service.UpdateDisplayName(r.Context(), userID, req.DisplayName); err != nil {
-		if err.Error() == "display name must be between 3 and 50 characters" ||
-			err.Error() == "display name contains inappropriate content" {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
 		logger.Printf("Failed to update display name: %v", err)
-		http.Error(w, "failed to update display name", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to update display name"))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandleUpdateUnitPreference handles requests to change the units a user's
+// car specs are shown in
+func (h *HTTPHandler) HandleUpdateUnitPreference(w http.ResponseWriter, r *http.Request) {
+	logger := r.Context().Value(common.LoggerCtxKey).(*log.Logger)
+	logger.Printf("Request received: POST update unit preference - Method: %s, Path: %s", r.Method, r.URL.Path)
+
+	userID := r.Context().Value(common.UserIDCtxKey).(int)
+
+	var req struct {
+		UnitPreference string `json:"unit_preference"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Printf("Failed to decode request body: %v", err)
+		common.WriteErrorOr(w, r, err, common.BadRequest("invalid request body"))
+		return
+	}
+
+	if err := h.service.UpdateUnitPreference(r.Context(), userID, req.UnitPreference); err != nil {
+		logger.Printf("Failed to update unit preference: %v", err)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to update unit preference"))
 		return
 	}
 
@@ -470,19 +478,15 @@ func (h *HTTPHandler) HandleCreateShareLink(w http.ResponseWriter, r *http.Reque
 
 	userCarID, err := strconv.Atoi(r.PathValue("user_car_id"))
 	if err != nil {
-		http.Error(w, "invalid car ID", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("invalid car ID"))
 		return
 	}
 
 	// Generate a unique share token for this car (ownership check removed)
 	shareToken, err := h.service.CreateShareLink(r.Context(), requestingUserID, userCarID)
 	if err != nil {
-		if err.Error() == "car not found" {
-			http.Error(w, err.Error(), http.StatusNotFound)
-			return
-		}
 		logger.Printf("Failed to create share link: %v", err)
-		http.Error(w, "failed to create share link", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to create share link"))
 		return
 	}
 
@@ -509,19 +513,22 @@ func (h *HTTPHandler) HandleGetSharedCar(w http.ResponseWriter, r *http.Request)
 
 	shareToken := r.PathValue("share_token")
 	if shareToken == "" {
-		http.Error(w, "share token is required", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("share token is required"))
+		return
+	}
+
+	// Viewers can ask for specs in their own units; otherwise the owner's are used
+	units := r.URL.Query().Get("units")
+	if units != "" && !catalog.ValidUnits(units) {
+		common.WriteError(w, r, common.BadRequest(fmt.Sprintf("units must be %q or %q", catalog.UnitsMetric, catalog.UnitsImperial)))
 		return
 	}
 
 	// Get the shared car data
-	sharedCar, err := h.service.GetSharedCarByToken(r.Context(), shareToken)
+	sharedCar, err := h.service.GetSharedCarByToken(r.Context(), shareToken, units)
 	if err != nil {
-		if err.Error() == "share token not found or expired" {
-			http.Error(w, err.Error(), http.StatusNotFound)
-			return
-		}
 		logger.Printf("Failed to get shared car: %v", err)
-		http.Error(w, "failed to retrieve shared car", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to retrieve shared car"))
 		return
 	}
 
@@ -538,7 +545,7 @@ func (h *HTTPHandler) HandleGetSharedCar(w http.ResponseWriter, r *http.Request)
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(sharedCar); err != nil {
 		logger.Printf("Failed to encode shared car response: %v", err)
-		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("failed to encode response"))
 		return
 	}
 
@@ -550,7 +557,7 @@ func (h *HTTPHandler) HandleServeSharePage(w http.ResponseWriter, r *http.Reques
 	// Read the HTML file
 	content, err := os.ReadFile("shared_car/index.html")
 	if err != nil {
-		http.Error(w, "Error loading page", http.StatusInternalServerError)
+		common.WriteError(w, r, common.Internal("Error loading page"))
 		return
 	}
 
@@ -572,7 +579,7 @@ func (h *HTTPHandler) HandleServeShareStaticFiles(w http.ResponseWriter, r *http
 	case "script.js":
 		filePath = "shared_car/script.js"
 	default:
-		http.Error(w, "File not found", http.StatusNotFound)
+		common.WriteError(w, r, common.NotFound("File not found"))
 		return
 	}
 
@@ -602,21 +609,21 @@ func (h *HTTPHandler) HandleDeleteAccount(w http.ResponseWriter, r *http.Request
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		logger.Printf("Failed to parse request body: %v", err)
-		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		common.WriteErrorOr(w, r, err, common.BadRequest("Invalid request format"))
 		return
 	}
 
 	// Confirm deletion is explicitly set to true
 	if !req.Confirm {
 		logger.Printf("Account deletion not confirmed for user %d", userID)
-		http.Error(w, "Deletion not confirmed", http.StatusBadRequest)
+		common.WriteError(w, r, common.BadRequest("Deletion not confirmed"))
 		return
 	}
 
 	// Call service method to delete the account
 	if err := h.service.DeleteAccount(r.Context(), userID); err != nil {
 		logger.Printf("Failed to delete account for user %d: %v", userID, err)
-		http.Error(w, "Failed to delete account", http.StatusInternalServerError)
+		common.WriteErrorOr(w, r, err, common.Internal("Failed to delete account"))
 		return
 	}
 
@@ -1,7 +1,12 @@
 package user
 
 import (
+	"CarBN/catalog"
 	"CarBN/common"
+	"CarBN/prompts"
+	"CarBN/rarity"
+	"CarBN/storage"
+	"CarBN/usage"
 	"bytes"
 	"context"
 	"encoding/json"
@@ -12,7 +17,6 @@ import (
 	"log"
 	"math/rand"
 	"os"
-	"path/filepath"
 	"regexp"
 	"strings"
 	"time"
@@ -26,10 +30,13 @@ type ServiceConfig struct {
 	BaseURL string
 }
 
-func NewService(db *pgxpool.Pool, generatedSaveDir string) *Service {
+func NewService(db *pgxpool.Pool, store storage.BlobStore, signer *storage.URLSigner, promptRegistry *prompts.Registry, images common.ImageGenerator) *Service {
 	return &Service{
-		db:               db,
-		generatedSaveDir: generatedSaveDir,
+		db:      db,
+		store:   store,
+		signer:  signer,
+		prompts: promptRegistry,
+		images:  images,
 		config: ServiceConfig{
 			BaseURL: os.Getenv("BASE_URL"),
 		},
@@ -37,9 +44,12 @@ func NewService(db *pgxpool.Pool, generatedSaveDir string) *Service {
 }
 
 type Service struct {
-	db               *pgxpool.Pool
-	generatedSaveDir string
-	config           ServiceConfig
+	db      *pgxpool.Pool
+	store   storage.BlobStore
+	signer  *storage.URLSigner
+	prompts *prompts.Registry
+	images  common.ImageGenerator
+	config  ServiceConfig
 }
 
 type carUpgrade struct {
@@ -52,69 +62,103 @@ type carUpgrade struct {
 }
 
 type car struct {
-	ID             int          `json:"id"`
-	UserCarID      int          `json:"user_car_id,omitempty"`
-	UserID         int          `json:"user_id,omitempty"`
-	Make           string       `json:"make"`
-	Model          string       `json:"model"`
-	Year           string       `json:"year"`
-	Color          string       `json:"color"`
-	Trim           string       `json:"trim,omitempty"`
-	Horsepower     *int         `json:"horsepower,omitempty"`
-	Torque         *int         `json:"torque,omitempty"`
-	TopSpeed       *int         `json:"top_speed,omitempty"`
-	Acceleration   *float64     `json:"acceleration,omitempty"`
-	EngineType     *string      `json:"engine_type,omitempty"`
-	DrivetrainType *string      `json:"drivetrain_type,omitempty"`
-	CurbWeight     *float64     `json:"curb_weight,omitempty"`
-	Price          *int         `json:"price,omitempty"`
-	Description    *string      `json:"description,omitempty"`
-	Rarity         *int         `json:"rarity,omitempty"`
-	LowResImage    *string      `json:"low_res_image,omitempty"`
-	HighResImage   *string      `json:"high_res_image,omitempty"`
-	DateCollected  *string      `json:"date_collected,omitempty"`
-	LikesCount     int          `json:"likes_count"`
-	Upgrades       []carUpgrade `json:"upgrades"`
+	ID                int                  `json:"id"`
+	UserCarID         int                  `json:"user_car_id,omitempty"`
+	UserID            int                  `json:"user_id,omitempty"`
+	Make              string               `json:"make"`
+	Model             string               `json:"model"`
+	Year              string               `json:"year"`
+	Color             string               `json:"color"`
+	Trim              string               `json:"trim,omitempty"`
+	Horsepower        *int                 `json:"horsepower,omitempty"`
+	Torque            *int                 `json:"torque,omitempty"`
+	TopSpeed          *int                 `json:"top_speed,omitempty"`
+	Acceleration      *float64             `json:"acceleration,omitempty"`
+	EngineType        *string              `json:"engine_type,omitempty"`
+	DrivetrainType    *string              `json:"drivetrain_type,omitempty"`
+	CurbWeight        *float64             `json:"curb_weight,omitempty"`
+	Price             *int                 `json:"price,omitempty"`
+	Description       *string              `json:"description,omitempty"`
+	Rarity            *int                 `json:"rarity,omitempty"`
+	RarityExplanation *rarity.Explanation  `json:"rarity_explanation,omitempty"`
+	LowResImage       *string              `json:"low_res_image,omitempty"`
+	HighResImage      *string              `json:"high_res_image,omitempty"`
+	ImageVariants     *storage.VariantURLs `json:"image_variants,omitempty"`
+	ImagePlaceholder  *storage.Placeholder `json:"image_placeholder,omitempty"`
+	DateCollected     *string              `json:"date_collected,omitempty"`
+	LikesCount        int                  `json:"likes_count"`
+	Upgrades          []carUpgrade         `json:"upgrades"`
+	catalog.Specs
+}
+
+// convertUnits converts the car's specs, read in metric, to units
+func (c *car) convertUnits(units string) {
+	convertSpecs(units, c.Torque, c.TopSpeed, c.CurbWeight, &c.Specs)
 }
 
 type User struct {
-	ID             int     `json:"id"`
-	Email          *string `json:"email,omitempty"`
-	DisplayName    *string `json:"display_name,omitempty"`
-	FollowerCount  int     `json:"followers_count"`
-	FriendCount    int     `json:"friend_count"`
-	ProfilePicture *string `json:"profile_picture,omitempty"`
-	IsFriend       bool    `json:"is_friend,omitempty"`
-	IsPrivate      bool    `json:"is_private,omitempty"`
-	CarCount       int     `json:"car_count,omitempty"`
-	Currency       int     `json:"currency"`
-	CarScore       int     `json:"car_score"` // Added car_score field
+	ID                        int                  `json:"id"`
+	Email                     *string              `json:"email,omitempty"`
+	UnitPreference            *string              `json:"unit_preference,omitempty"`
+	DisplayName               *string              `json:"display_name,omitempty"`
+	FollowerCount             int                  `json:"followers_count"`
+	FriendCount               int                  `json:"friend_count"`
+	ProfilePicture            *string              `json:"profile_picture,omitempty"`
+	ProfilePicturePlaceholder *storage.Placeholder `json:"profile_picture_placeholder,omitempty"`
+	IsFriend                  bool                 `json:"is_friend,omitempty"`
+	IsPrivate                 bool                 `json:"is_private,omitempty"`
+	CarCount                  int                  `json:"car_count,omitempty"`
+	Currency                  int                  `json:"currency"`
+	CarScore                  int                  `json:"car_score"` // Added car_score field
 }
 
 // SharedCar represents the public data for a shared car
 type SharedCar struct {
-	Make           string       `json:"make"`
-	Model          string       `json:"model"`
-	Year           string       `json:"year"`
-	Color          string       `json:"color"`
-	Trim           string       `json:"trim,omitempty"`
-	Horsepower     *int         `json:"horsepower,omitempty"`
-	Torque         *int         `json:"torque,omitempty"`
-	TopSpeed       *int         `json:"top_speed,omitempty"`
-	Acceleration   *float64     `json:"acceleration,omitempty"`
-	EngineType     *string      `json:"engine_type,omitempty"`
-	DrivetrainType *string      `json:"drivetrain_type,omitempty"`
-	CurbWeight     *float64     `json:"curb_weight,omitempty"`
-	Price          *int         `json:"price,omitempty"`
-	Description    *string      `json:"description,omitempty"`
-	Rarity         *int         `json:"rarity,omitempty"`
-	LowResImage    string       `json:"low_res_image"`
-	HighResImage   string       `json:"high_res_image"`
-	DateCollected  string       `json:"date_collected"`
-	LikesCount     int          `json:"likes_count"`
-	ViewCount      int          `json:"view_count"`
-	OwnerName      string       `json:"owner_name"`
-	Upgrades       []carUpgrade `json:"upgrades"`
+	Make             string               `json:"make"`
+	Model            string               `json:"model"`
+	Year             string               `json:"year"`
+	Color            string               `json:"color"`
+	Trim             string               `json:"trim,omitempty"`
+	Horsepower       *int                 `json:"horsepower,omitempty"`
+	Torque           *int                 `json:"torque,omitempty"`
+	TopSpeed         *int                 `json:"top_speed,omitempty"`
+	Acceleration     *float64             `json:"acceleration,omitempty"`
+	EngineType       *string              `json:"engine_type,omitempty"`
+	DrivetrainType   *string              `json:"drivetrain_type,omitempty"`
+	CurbWeight       *float64             `json:"curb_weight,omitempty"`
+	Price            *int                 `json:"price,omitempty"`
+	Description      *string              `json:"description,omitempty"`
+	Rarity           *int                 `json:"rarity,omitempty"`
+	LowResImage      string               `json:"low_res_image"`
+	HighResImage     string               `json:"high_res_image"`
+	ImageVariants    *storage.VariantURLs `json:"image_variants,omitempty"`
+	ImagePlaceholder *storage.Placeholder `json:"image_placeholder,omitempty"`
+	DateCollected    string               `json:"date_collected"`
+	LikesCount       int                  `json:"likes_count"`
+	ViewCount        int                  `json:"view_count"`
+	OwnerName        string               `json:"owner_name"`
+	Upgrades         []carUpgrade         `json:"upgrades"`
+	catalog.Specs
+}
+
+// convertUnits converts the shared car's specs, read in metric, to units
+func (c *SharedCar) convertUnits(units string) {
+	convertSpecs(units, c.Torque, c.TopSpeed, c.CurbWeight, &c.Specs)
+}
+
+// convertSpecs converts the basic specs every car card shows and the full
+// spec sheet from metric to units
+func convertSpecs(units string, torque, topSpeed *int, curbWeight *float64, specs *catalog.Specs) {
+	if torque != nil {
+		*torque = catalog.Torque(*torque, units)
+	}
+	if topSpeed != nil {
+		*topSpeed = catalog.Speed(*topSpeed, units)
+	}
+	if curbWeight != nil {
+		*curbWeight = catalog.Weight(*curbWeight, units)
+	}
+	specs.ConvertUnits(units)
 }
 
 func (s *Service) GetCarCollection(ctx context.Context, userID, requestedUserID int, limit, offset int, sortBy string) ([]car, error) {
@@ -166,8 +210,9 @@ func (s *Service) GetCarCollection(ctx context.Context, userID, requestedUserID
 	query := `
 		SELECT c.id, uc.id as user_car_id, uc.user_id, c.make, c.model, c.year, uc.color, c.trim,
 		c.horsepower, c.torque, c.top_speed, c.acceleration, c.engine_type,
-		c.drivetrain_type, c.curb_weight, c.price, c.description, c.rarity,
-		uc.low_res_image, uc.high_res_image, uc.date_collected, uc.likes_count,
+		c.drivetrain_type, c.curb_weight, c.price, c.description, c.rarity, c.rarity_explanation,
+		uc.low_res_image, uc.high_res_image, uc.image_blurhash, uc.image_dominant_color, uc.date_collected, uc.likes_count,
+		` + catalog.SpecColumns + `,
 		COALESCE(
 			jsonb_agg(
 				jsonb_build_object(
@@ -187,11 +232,17 @@ func (s *Service) GetCarCollection(ctx context.Context, userID, requestedUserID
 		WHERE uc.user_id = $1
 		GROUP BY c.id, uc.id, c.make, c.model, c.year, uc.color, c.trim,
 		c.horsepower, c.torque, c.top_speed, c.acceleration, c.engine_type,
-		c.drivetrain_type, c.curb_weight, c.price, c.description, c.rarity,
-		uc.low_res_image, uc.high_res_image, uc.date_collected, uc.likes_count
+		c.drivetrain_type, c.curb_weight, c.price, c.description, c.rarity, c.rarity_explanation,
+		uc.low_res_image, uc.high_res_image, uc.image_blurhash, uc.image_dominant_color, uc.date_collected, uc.likes_count
 		ORDER BY ` + orderByClause + ` LIMIT $2 OFFSET $3
 	`
 
+	// Specs are shown in the units of the user viewing them
+	units, err := catalog.UnitPreference(ctx, s.db, userID)
+	if err != nil {
+		return nil, err
+	}
+
 	rows, err := s.db.Query(ctx, query, requestedUserID, limit, offset)
 	if err != nil {
 		return nil, err
@@ -203,21 +254,26 @@ func (s *Service) GetCarCollection(ctx context.Context, userID, requestedUserID
 		var car car
 		var upgradesJson []byte
 		var dateCollected time.Time
-		if err := rows.Scan(&car.ID, &car.UserCarID, &car.UserID, &car.Make, &car.Model, &car.Year,
+		var blurHash, dominantColor *string
+		dest := append([]interface{}{&car.ID, &car.UserCarID, &car.UserID, &car.Make, &car.Model, &car.Year,
 			&car.Color, &car.Trim, &car.Horsepower, &car.Torque, &car.TopSpeed,
 			&car.Acceleration, &car.EngineType, &car.DrivetrainType, &car.CurbWeight,
-			&car.Price, &car.Description, &car.Rarity, &car.LowResImage,
-			&car.HighResImage, &dateCollected, &car.LikesCount, &upgradesJson); err != nil {
+			&car.Price, &car.Description, &car.Rarity, &car.RarityExplanation, &car.LowResImage,
+			&car.HighResImage, &blurHash, &dominantColor, &dateCollected, &car.LikesCount}, car.Specs.ScanTargets()...)
+		if err := rows.Scan(append(dest, &upgradesJson)...); err != nil {
 			return nil, err
 		}
 
 		// Format the date using common.FormatTimestamp
 		formattedDate := common.FormatTimestamp(dateCollected)
 		car.DateCollected = &formattedDate
+		car.ImagePlaceholder = storage.NewPlaceholder(blurHash, dominantColor)
 
 		if err := json.Unmarshal(upgradesJson, &car.Upgrades); err != nil {
 			return nil, fmt.Errorf("failed to parse upgrades: %w", err)
 		}
+		s.signCarImages(&car)
+		car.convertUnits(units)
 		cars = append(cars, car)
 	}
 
@@ -229,16 +285,24 @@ func (s *Service) GetCarCollection(ctx context.Context, userID, requestedUserID
 	return cars, nil
 }
 
-func (s *Service) GetSpecificUserCars(ctx context.Context, userCarIDs []int) ([]car, error) {
+// GetSpecificUserCars returns the given user cars with their specs in
+// userID's units
+func (s *Service) GetSpecificUserCars(ctx context.Context, userID int, userCarIDs []int) ([]car, error) {
 	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
-	logger.Printf("Fetching specific user cars - UserCarIDs: %v", userCarIDs)
+	logger.Printf("Fetching specific user cars - UserID: %d, UserCarIDs: %v", userID, userCarIDs)
+
+	units, err := catalog.UnitPreference(ctx, s.db, userID)
+	if err != nil {
+		return nil, err
+	}
 
 	// Base query
 	query := `
 		SELECT c.id, uc.id as user_car_id, uc.user_id, c.make, c.model, c.year, uc.color, c.trim,
 		c.horsepower, c.torque, c.top_speed, c.acceleration, c.engine_type,
-		c.drivetrain_type, c.curb_weight, c.price, c.description, c.rarity,
-		uc.low_res_image, uc.high_res_image, uc.date_collected, uc.likes_count,
+		c.drivetrain_type, c.curb_weight, c.price, c.description, c.rarity, c.rarity_explanation,
+		uc.low_res_image, uc.high_res_image, uc.image_blurhash, uc.image_dominant_color, uc.date_collected, uc.likes_count,
+		` + catalog.SpecColumns + `,
 		COALESCE(
 			jsonb_agg(
 				jsonb_build_object(
@@ -258,8 +322,8 @@ func (s *Service) GetSpecificUserCars(ctx context.Context, userCarIDs []int) ([]
 		WHERE uc.id = ANY($1)
 		GROUP BY c.id, uc.id, uc.user_id, c.make, c.model, c.year, uc.color, c.trim,
 		c.horsepower, c.torque, c.top_speed, c.acceleration, c.engine_type,
-		c.drivetrain_type, c.curb_weight, c.price, c.description, c.rarity,
-		uc.low_res_image, uc.high_res_image, uc.date_collected, uc.likes_count
+		c.drivetrain_type, c.curb_weight, c.price, c.description, c.rarity, c.rarity_explanation,
+		uc.low_res_image, uc.high_res_image, uc.image_blurhash, uc.image_dominant_color, uc.date_collected, uc.likes_count
 		ORDER BY uc.id ASC
 	`
 
@@ -274,21 +338,26 @@ func (s *Service) GetSpecificUserCars(ctx context.Context, userCarIDs []int) ([]
 		var car car
 		var upgradesJson []byte
 		var dateCollected time.Time
-		if err := rows.Scan(&car.ID, &car.UserCarID, &car.UserID, &car.Make, &car.Model, &car.Year,
+		var blurHash, dominantColor *string
+		dest := append([]interface{}{&car.ID, &car.UserCarID, &car.UserID, &car.Make, &car.Model, &car.Year,
 			&car.Color, &car.Trim, &car.Horsepower, &car.Torque, &car.TopSpeed,
 			&car.Acceleration, &car.EngineType, &car.DrivetrainType, &car.CurbWeight,
-			&car.Price, &car.Description, &car.Rarity, &car.LowResImage,
-			&car.HighResImage, &dateCollected, &car.LikesCount, &upgradesJson); err != nil {
+			&car.Price, &car.Description, &car.Rarity, &car.RarityExplanation, &car.LowResImage,
+			&car.HighResImage, &blurHash, &dominantColor, &dateCollected, &car.LikesCount}, car.Specs.ScanTargets()...)
+		if err := rows.Scan(append(dest, &upgradesJson)...); err != nil {
 			return nil, err
 		}
 
 		// Format the date using common.FormatTimestamp
 		formattedDate := common.FormatTimestamp(dateCollected)
 		car.DateCollected = &formattedDate
+		car.ImagePlaceholder = storage.NewPlaceholder(blurHash, dominantColor)
 
 		if err := json.Unmarshal(upgradesJson, &car.Upgrades); err != nil {
 			return nil, fmt.Errorf("failed to parse upgrades: %w", err)
 		}
+		s.signCarImages(&car)
+		car.convertUnits(units)
 		cars = append(cars, car)
 	}
 
@@ -301,13 +370,15 @@ func (s *Service) GetSpecificUserCars(ctx context.Context, userCarIDs []int) ([]
 }
 
 type FriendRequest struct {
-	ID                   int     `json:"id"`
-	UserID               int     `json:"user_id"`
-	UserDisplayName      *string `json:"user_display_name"`
-	UserProfilePicture   *string `json:"user_profile_picture"`
-	FriendID             int     `json:"friend_id"`
-	FriendDisplayName    *string `json:"friend_display_name"`
-	FriendProfilePicture *string `json:"friend_profile_picture"`
+	ID                              int                  `json:"id"`
+	UserID                          int                  `json:"user_id"`
+	UserDisplayName                 *string              `json:"user_display_name"`
+	UserProfilePicture              *string              `json:"user_profile_picture"`
+	UserProfilePicturePlaceholder   *storage.Placeholder `json:"user_profile_picture_placeholder,omitempty"`
+	FriendID                        int                  `json:"friend_id"`
+	FriendDisplayName               *string              `json:"friend_display_name"`
+	FriendProfilePicture            *string              `json:"friend_profile_picture"`
+	FriendProfilePicturePlaceholder *storage.Placeholder `json:"friend_profile_picture_placeholder,omitempty"`
 }
 
 func (s *Service) GetPendingFriendRequests(ctx context.Context, userID int) ([]FriendRequest, error) {
@@ -315,7 +386,9 @@ func (s *Service) GetPendingFriendRequests(ctx context.Context, userID int) ([]F
 	logger.Printf("Fetching pending friend requests for user %d", userID)
 
 	rows, err := s.db.Query(ctx, `
-		SELECT f.id, f.user_id, f.friend_id, u.profile_picture, u.display_name, uf.display_name, uf.profile_picture
+		SELECT f.id, f.user_id, f.friend_id, u.profile_picture, u.display_name, uf.display_name, uf.profile_picture,
+			u.profile_picture_blurhash, u.profile_picture_dominant_color,
+			uf.profile_picture_blurhash, uf.profile_picture_dominant_color
 		FROM friends f
 		JOIN users u ON u.id = f.user_id
 		JOIN users uf ON uf.id = f.friend_id
@@ -330,9 +403,15 @@ func (s *Service) GetPendingFriendRequests(ctx context.Context, userID int) ([]F
 	var requests []FriendRequest
 	for rows.Next() {
 		var r FriendRequest
-		if err := rows.Scan(&r.ID, &r.UserID, &r.FriendID, &r.UserProfilePicture, &r.UserDisplayName, &r.FriendDisplayName, &r.FriendProfilePicture); err != nil {
+		var userBlurHash, userColor, friendBlurHash, friendColor *string
+		if err := rows.Scan(&r.ID, &r.UserID, &r.FriendID, &r.UserProfilePicture, &r.UserDisplayName, &r.FriendDisplayName, &r.FriendProfilePicture,
+			&userBlurHash, &userColor, &friendBlurHash, &friendColor); err != nil {
 			return nil, err
 		}
+		r.UserProfilePicturePlaceholder = storage.NewPlaceholder(userBlurHash, userColor)
+		r.FriendProfilePicturePlaceholder = storage.NewPlaceholder(friendBlurHash, friendColor)
+		s.signer.SignPtr(r.UserProfilePicture)
+		s.signer.SignPtr(r.FriendProfilePicture)
 		requests = append(requests, r)
 	}
 	logger.Printf("Found %d pending friend requests for user %d", len(requests), userID)
@@ -344,6 +423,7 @@ func (s *Service) GetUserInfo(ctx context.Context, requestedUserID, currentUserI
 	logger.Printf("Fetching user info for user %d (requested by %d)", requestedUserID, currentUserID)
 
 	var user User
+	var blurHash, dominantColor *string
 	err := s.db.QueryRow(ctx, `
 		WITH friend_status AS (
 			SELECT EXISTS (
@@ -379,7 +459,8 @@ func (s *Service) GetUserInfo(ctx context.Context, requestedUserID, currentUserI
 			JOIN cars c ON uc.car_id = c.id
 			WHERE uc.user_id = $2
 		)
-		SELECT u.id, u.display_name, u.followers_count, u.profile_picture, 
+		SELECT u.id, u.display_name, u.followers_count, u.profile_picture,
+			   u.profile_picture_blurhash, u.profile_picture_dominant_color,
 			   u.is_private, u.currency, f.is_friend, c.count, fc.count, cs.score
 		FROM users u
 		CROSS JOIN friend_status f
@@ -388,7 +469,7 @@ func (s *Service) GetUserInfo(ctx context.Context, requestedUserID, currentUserI
 		CROSS JOIN car_score_calc cs
 		WHERE u.id = $2
 	`, currentUserID, requestedUserID).Scan(
-		&user.ID, &user.DisplayName, &user.FollowerCount, &user.ProfilePicture,
+		&user.ID, &user.DisplayName, &user.FollowerCount, &user.ProfilePicture, &blurHash, &dominantColor,
 		&user.IsPrivate, &user.Currency, &user.IsFriend, &user.CarCount, &user.FriendCount, &user.CarScore,
 	)
 
@@ -396,13 +477,16 @@ func (s *Service) GetUserInfo(ctx context.Context, requestedUserID, currentUserI
 		logger.Printf("Failed to fetch user info: %v", err)
 		return User{}, fmt.Errorf("failed to get user info: %w", err)
 	}
+	user.ProfilePicturePlaceholder = storage.NewPlaceholder(blurHash, dominantColor)
+	s.signer.SignPtr(user.ProfilePicture)
 
-	// Only include email if user is requesting their own details
+	// Only include email and unit preference if user is requesting their own details
 	if currentUserID == requestedUserID {
-		var email string
-		err := s.db.QueryRow(ctx, "SELECT email FROM users WHERE id = $1", currentUserID).Scan(&email)
+		var email, units string
+		err := s.db.QueryRow(ctx, "SELECT email, unit_preference FROM users WHERE id = $1", currentUserID).Scan(&email, &units)
 		if err == nil {
 			user.Email = &email
+			user.UnitPreference = &units
 		}
 	}
 
@@ -418,7 +502,7 @@ func (s *Service) UpdateProfilePicture(ctx context.Context, userID int, imageDat
 	img, _, err := image.Decode(bytes.NewReader(imageData))
 	if err != nil {
 		logger.Printf("Image decode failed for user %d: %v", userID, err)
-		return fmt.Errorf("invalid image format")
+		return common.BadRequest("invalid image format")
 	}
 
 	bounds := img.Bounds()
@@ -426,41 +510,40 @@ func (s *Service) UpdateProfilePicture(ctx context.Context, userID int, imageDat
 		userID, bounds.Dx(), bounds.Dy())
 
 	if bounds.Dx() != 512 || bounds.Dy() != 512 {
-		return fmt.Errorf("image must be 512x512 pixels")
+		return common.BadRequest("image must be 512x512 pixels")
 	}
 
-	// Create directory if it doesn't exist
-	dirPath := filepath.Join("_resources", "images", "profile_pictures")
-	if err := os.MkdirAll(dirPath, 0755); err != nil {
-		logger.Printf("Failed to create directory: %v", err)
-		return fmt.Errorf("failed to create directory: %w", err)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+		logger.Printf("Failed to encode image: %v", err)
+		return fmt.Errorf("failed to save image: %w", err)
 	}
 
 	// Generate a unique timestamp (milliseconds since epoch)
 	timestamp := time.Now().UnixNano() / int64(time.Millisecond)
 
-	// Create filename with user ID and timestamp to break cache
-	fileName := fmt.Sprintf("user_%d_%d.jpg", userID, timestamp)
-	filePath := filepath.Join(dirPath, fileName)
-	f, err := os.Create(filePath)
-	if err != nil {
-		logger.Printf("Failed to create file: %v", err)
+	// Name the file with user ID and timestamp to break cache
+	relativePath := fmt.Sprintf("%suser_%d_%d.jpg", storage.ProfilePicturesPrefix, userID, timestamp)
+	if err := s.store.Put(ctx, relativePath, buf.Bytes(), "image/jpeg"); err != nil {
+		logger.Printf("Failed to store image: %v", err)
 		return fmt.Errorf("failed to save image: %w", err)
 	}
-	defer f.Close()
 
-	if err := jpeg.Encode(f, img, &jpeg.Options{Quality: 90}); err != nil {
-		logger.Printf("Failed to encode image: %v", err)
-		return fmt.Errorf("failed to save image: %w", err)
+	// Left NULL for the backfill if it can't be computed now
+	placeholder, err := storage.ComputePlaceholder(buf.Bytes())
+	if err != nil {
+		logger.Printf("Warning: failed to compute profile picture placeholder: %v", err)
 	}
+	blurHash, dominantColor := placeholder.Columns()
 
 	// Update database with the path including timestamp
-	relativePath := fmt.Sprintf("images/profile_pictures/user_%d_%d.jpg", userID, timestamp)
 	_, err = s.db.Exec(ctx, `
 		UPDATE users 
 		SET profile_picture = $1, 
+		    profile_picture_blurhash = $2,
+		    profile_picture_dominant_color = $3,
 		    updated_at = CURRENT_TIMESTAMP 
-		WHERE id = $2`, relativePath, userID)
+		WHERE id = $4`, relativePath, blurHash, dominantColor, userID)
 	if err != nil {
 		logger.Printf("Failed to update profile picture path: %v", err)
 		return fmt.Errorf("failed to update profile picture: %w", err)
@@ -487,6 +570,7 @@ func (s *Service) SearchUsers(ctx context.Context, query string, currentUserID i
 			GROUP BY user_id
 		)
 		SELECT u.id, u.display_name, u.followers_count, u.profile_picture,
+			   u.profile_picture_blurhash, u.profile_picture_dominant_color,
 			   u.is_private, COALESCE(f.is_friend, false), COALESCE(c.count, 0)
 		FROM users u
 		LEFT JOIN friend_status f ON (u.id = f.friend_id)
@@ -505,12 +589,15 @@ func (s *Service) SearchUsers(ctx context.Context, query string, currentUserID i
 	var users []User
 	for rows.Next() {
 		var user User
+		var blurHash, dominantColor *string
 		if err := rows.Scan(
-			&user.ID, &user.DisplayName, &user.FollowerCount, &user.ProfilePicture,
+			&user.ID, &user.DisplayName, &user.FollowerCount, &user.ProfilePicture, &blurHash, &dominantColor,
 			&user.IsPrivate, &user.IsFriend, &user.CarCount,
 		); err != nil {
 			return nil, err
 		}
+		user.ProfilePicturePlaceholder = storage.NewPlaceholder(blurHash, dominantColor)
+		s.signer.SignPtr(user.ProfilePicture)
 		users = append(users, user)
 	}
 
@@ -539,7 +626,7 @@ func (s *Service) SellCar(ctx context.Context, userID int, userCarID int) (int,
     `, userCarID, userID).Scan(&rarity)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
-			return 0, fmt.Errorf("car not found or not owned by user")
+			return 0, common.NotFound("car not found or not owned by user")
 		}
 		return 0, fmt.Errorf("failed to verify car ownership: %w", err)
 	}
@@ -581,6 +668,7 @@ type ImageUpgradeResult struct {
 	RemainingCurrency int
 	HighResImage      string
 	LowResImage       string
+	Placeholder       *storage.Placeholder
 }
 
 // UpgradeCarImage upgrades a car's image to a premium version
@@ -602,17 +690,20 @@ func (s *Service) UpgradeCarImage(ctx context.Context, userID int, userCarID int
 	var currentCurrency int
 	var hasActiveSubscription bool
 	var currentHighRes, currentLowRes string
+	var currentBlurHash, currentDominantColor *string
 
 	err = tx.QueryRow(ctx, `
         SELECT c.id, uc.color, c.year, c.make, c.model, c.trim, u.currency,
-               COALESCE(us.is_active, false) as has_subscription, uc.high_res_image, uc.low_res_image
+               COALESCE(us.is_active, false) as has_subscription, uc.high_res_image, uc.low_res_image,
+               uc.image_blurhash, uc.image_dominant_color
         FROM user_cars uc
         JOIN cars c ON uc.car_id = c.id
         JOIN users u ON uc.user_id = u.id
         LEFT JOIN user_subscriptions us ON u.id = us.user_id
         WHERE uc.id = $1 AND uc.user_id = $2
         AND (us.is_active = true AND (us.subscription_end IS NULL OR us.subscription_end > NOW()))
-    `, userCarID, userID).Scan(&carID, &color, &year, &make, &model, &trim, &currentCurrency, &hasActiveSubscription, &currentHighRes, &currentLowRes)
+    `, userCarID, userID).Scan(&carID, &color, &year, &make, &model, &trim, &currentCurrency, &hasActiveSubscription, &currentHighRes, &currentLowRes,
+		&currentBlurHash, &currentDominantColor)
 
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -627,19 +718,19 @@ func (s *Service) UpgradeCarImage(ctx context.Context, userID int, userCarID int
 				return nil, fmt.Errorf("failed to check car existence: %w", err)
 			}
 			if exists {
-				return nil, fmt.Errorf("active subscription required")
+				return nil, common.NewError(common.ErrPaymentRequired, "subscription_required", "active subscription required")
 			}
-			return nil, fmt.Errorf("car not found or not owned by user")
+			return nil, common.NotFound("car not found or not owned by user")
 		}
 		return nil, fmt.Errorf("failed to get car details: %w", err)
 	}
 
 	if !hasActiveSubscription {
-		return nil, fmt.Errorf("active subscription required")
+		return nil, common.NewError(common.ErrPaymentRequired, "subscription_required", "active subscription required")
 	}
 
 	if currentCurrency < common.UpgradeCost {
-		return nil, fmt.Errorf("insufficient currency")
+		return nil, common.ErrInsufficientCurrency
 	}
 
 	// Generate background index
@@ -653,23 +744,56 @@ func (s *Service) UpgradeCarImage(ctx context.Context, userID int, userCarID int
 	premiumDir := fmt.Sprintf("car_%d/premium/%d", carID, userID)
 	premiumImageName := fmt.Sprintf("premium_%d_%d.jpg", backgroundIndex, timestamp)
 	lowResPremiumImageName := fmt.Sprintf("low_res_%d_%d.jpg", backgroundIndex, timestamp)
-	relativeHighResPath := filepath.Join("generated", premiumDir, premiumImageName)
-	relativeLowResPath := filepath.Join("generated", premiumDir, lowResPremiumImageName)
+	relativeHighResPath := storage.GeneratedPrefix + premiumDir + "/" + premiumImageName
+	relativeLowResPath := storage.GeneratedPrefix + premiumDir + "/" + lowResPremiumImageName
+
+	prompt, err := s.prompts.Pick(prompts.PremiumCarImage)
+	if err != nil {
+		return nil, err
+	}
+	promptText, err := prompt.Render(prompts.Vars{
+		"year":       year,
+		"make":       make,
+		"model":      model,
+		"trim":       trim,
+		"color":      color,
+		"background": selectedBackground,
+	})
+	if err != nil {
+		return nil, err
+	}
 
 	// Always generate a new premium image with the timestamp
-	base64Image, err := common.GenerateCarImage(ctx, year, make, model, trim, color, true, selectedBackground)
+	base64Image, err := s.images.GenerateCarImage(usage.WithUser(ctx, userID), common.ImageRequest{
+		Prompt:  promptText,
+		CarID:   carID,
+		Year:    year,
+		Make:    make,
+		Model:   model,
+		Trim:    trim,
+		Color:   color,
+		Premium: true,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate premium image: %w", err)
 	}
 
 	// Save high-res premium image
-	if err := s.saveImage(base64Image, s.generatedSaveDir, filepath.Join(premiumDir, premiumImageName)); err != nil {
+	imageData, err := common.DecodeBase64Image(base64Image)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save premium image: %w", err)
+	}
+	placeholder, err := storage.SaveImage(ctx, s.store, relativeHighResPath, imageData)
+	if err != nil {
 		return nil, fmt.Errorf("failed to save premium image: %w", err)
 	}
 
 	// Create and save low-res version
-	absolutePremiumLowResPath := filepath.Join(s.generatedSaveDir, premiumDir, lowResPremiumImageName)
-	if err := s.saveLowResImage(base64Image, absolutePremiumLowResPath); err != nil {
+	lowResData, err := storage.Resize(imageData, common.LowResImageSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create low res version: %w", err)
+	}
+	if err := storage.PutImage(ctx, s.store, relativeLowResPath, lowResData); err != nil {
 		return nil, fmt.Errorf("failed to create low res version: %w", err)
 	}
 
@@ -686,24 +810,28 @@ func (s *Service) UpgradeCarImage(ctx context.Context, userID int, userCarID int
 	// Update car images with relative paths for database
 	_, err = tx.Exec(ctx, `
         UPDATE user_cars
-        SET high_res_image = $1, low_res_image = $2
-        WHERE id = $3 AND user_id = $4
-    `, relativeHighResPath, relativeLowResPath, userCarID, userID)
+        SET high_res_image = $1, low_res_image = $2, image_blurhash = $3, image_dominant_color = $4
+        WHERE id = $5 AND user_id = $6
+    `, relativeHighResPath, relativeLowResPath, placeholder.BlurHash, placeholder.DominantColor, userCarID, userID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to update car images: %w", err)
 	}
 
 	// Add upgrade record with background index and original image paths
 	_, err = tx.Exec(ctx, `
-        INSERT INTO car_upgrades (user_car_id, upgrade_type, metadata)
-        VALUES ($1, 'premium_image', $2)
-    `, userCarID, map[string]interface{}{
-		"premium_low_res":   relativeLowResPath,
-		"premium_high_res":  relativeHighResPath,
-		"original_low_res":  currentLowRes,
-		"original_high_res": currentHighRes,
-		"background_index":  backgroundIndex,
-		"timestamp":         timestamp,
+        INSERT INTO car_upgrades (user_car_id, upgrade_type, prompt_version, metadata)
+        VALUES ($1, 'premium_image', $2, $3)
+    `, userCarID, prompt.Ref(), map[string]interface{}{
+		"premium_low_res":         relativeLowResPath,
+		"premium_high_res":        relativeHighResPath,
+		"original_low_res":        currentLowRes,
+		"original_high_res":       currentHighRes,
+		"premium_blurhash":        placeholder.BlurHash,
+		"premium_dominant_color":  placeholder.DominantColor,
+		"original_blurhash":       currentBlurHash,
+		"original_dominant_color": currentDominantColor,
+		"background_index":        backgroundIndex,
+		"timestamp":               timestamp,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to record upgrade: %w", err)
@@ -717,6 +845,7 @@ func (s *Service) UpgradeCarImage(ctx context.Context, userID int, userCarID int
 		RemainingCurrency: currentCurrency - common.UpgradeCost,
 		HighResImage:      relativeHighResPath,
 		LowResImage:       relativeLowResPath,
+		Placeholder:       placeholder,
 	}, nil
 }
 
@@ -759,10 +888,10 @@ func (s *Service) RevertCarImage(ctx context.Context, userID int, userCarID int)
 			return nil, fmt.Errorf("failed to verify car ownership: %w", err)
 		}
 		if !exists {
-			return nil, fmt.Errorf("car not found or not owned by user")
+			return nil, common.NotFound("car not found or not owned by user")
 		}
 		// No upgrade to revert
-		return nil, fmt.Errorf("no active image upgrade found")
+		return nil, common.NotFound("no active image upgrade found")
 	}
 
 	// Extract original image paths from metadata
@@ -786,6 +915,14 @@ func (s *Service) RevertCarImage(ctx context.Context, userID int, userCarID int)
 		return nil, fmt.Errorf("failed to retrieve original image paths")
 	}
 
+	// Upgrades from before placeholders have none; the backfill fills it in
+	var originalPlaceholder *storage.Placeholder
+	if blurHash, ok := upgradeMetadata["original_blurhash"].(string); ok {
+		dominantColor, _ := upgradeMetadata["original_dominant_color"].(string)
+		originalPlaceholder = storage.NewPlaceholder(&blurHash, &dominantColor)
+	}
+	originalBlurHash, originalDominantColor := originalPlaceholder.Columns()
+
 	// Extract car ID for logging
 	var carID int
 	if err := tx.QueryRow(ctx, `
@@ -794,7 +931,7 @@ func (s *Service) RevertCarImage(ctx context.Context, userID int, userCarID int)
 		WHERE id = $1 AND user_id = $2
 	`, userCarID, userID).Scan(&carID); err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
-			return nil, fmt.Errorf("car not found or not owned by user")
+			return nil, common.NotFound("car not found or not owned by user")
 		}
 		return nil, fmt.Errorf("failed to get car details: %w", err)
 	}
@@ -805,9 +942,9 @@ func (s *Service) RevertCarImage(ctx context.Context, userID int, userCarID int)
 	// Update car images to original using relative paths from metadata
 	_, err = tx.Exec(ctx, `
         UPDATE user_cars
-        SET high_res_image = $1, low_res_image = $2
-        WHERE id = $3 AND user_id = $4
-    `, originalHighRes, originalLowRes, userCarID, userID)
+        SET high_res_image = $1, low_res_image = $2, image_blurhash = $3, image_dominant_color = $4
+        WHERE id = $5 AND user_id = $6
+    `, originalHighRes, originalLowRes, originalBlurHash, originalDominantColor, userCarID, userID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to update car images: %w", err)
 	}
@@ -829,6 +966,7 @@ func (s *Service) RevertCarImage(ctx context.Context, userID int, userCarID int)
 	return &ImageUpgradeResult{
 		HighResImage: originalHighRes,
 		LowResImage:  originalLowRes,
+		Placeholder:  originalPlaceholder,
 	}, nil
 }
 
@@ -848,7 +986,7 @@ func (s *Service) GetCarUpgrades(ctx context.Context, userID int, userCarID int)
 		return nil, fmt.Errorf("failed to verify car ownership: %w", err)
 	}
 	if !exists {
-		return nil, fmt.Errorf("car not found or not owned by user")
+		return nil, common.NotFound("car not found or not owned by user")
 	}
 
 	// Get active upgrades
@@ -880,17 +1018,37 @@ func (s *Service) GetCarUpgrades(ctx context.Context, userID int, userCarID int)
 		}
 		upgrades = append(upgrades, upgrade)
 	}
+	s.signUpgrades(upgrades)
 	return upgrades, nil
 }
 
-// saveImage wrapper to maintain compatibility
-func (s *Service) saveImage(base64Image string, baseDir string, relativePath string) error {
-	return common.SaveImage(base64Image, baseDir, relativePath, 0755)
+// upgradeImageKeys are the image paths kept in a premium upgrade's metadata
+var upgradeImageKeys = []string{"premium_low_res", "premium_high_res", "original_low_res", "original_high_res"}
+
+// signCarImages signs a car's image paths, and those of its upgrades, for a
+// response. The variants are worked out from the unsigned path.
+func (s *Service) signCarImages(c *car) {
+	if c.HighResImage != nil {
+		c.ImageVariants = s.signer.SignVariants(storage.URLsFor(*c.HighResImage))
+	}
+	s.signer.SignPtr(c.LowResImage)
+	s.signer.SignPtr(c.HighResImage)
+	s.signUpgrades(c.Upgrades)
 }
 
-// saveLowResImage wrapper to maintain compatibility
-func (s *Service) saveLowResImage(originalImage string, savePath string) error {
-	return common.SaveLowResVersion(originalImage, savePath, 95, 0755)
+// signUpgrades signs the image paths in the upgrades' metadata
+func (s *Service) signUpgrades(upgrades []carUpgrade) {
+	for _, upgrade := range upgrades {
+		metadata, ok := upgrade.Metadata.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, key := range upgradeImageKeys {
+			if path, ok := metadata[key].(string); ok {
+				metadata[key] = s.signer.Sign(path)
+			}
+		}
+	}
 }
 
 func (s *Service) UpdateDisplayName(ctx context.Context, userID int, newDisplayName string) error {
@@ -899,7 +1057,7 @@ func (s *Service) UpdateDisplayName(ctx context.Context, userID int, newDisplayN
 
 	// Validate display name length
 	if len(newDisplayName) < 3 || len(newDisplayName) > 50 {
-		return fmt.Errorf("display name must be between 3 and 50 characters")
+		return common.BadRequest("display name must be between 3 and 50 characters")
 	}
 
 	// Get regex patterns from environment
@@ -916,7 +1074,7 @@ func (s *Service) UpdateDisplayName(ctx context.Context, userID int, newDisplayN
 		}
 
 		if regex.MatchString(newDisplayName) {
-			return fmt.Errorf("display name contains inappropriate content")
+			return common.NewError(common.ErrBadRequest, "inappropriate_display_name", "display name contains inappropriate content")
 		}
 	}
 
@@ -937,6 +1095,30 @@ func (s *Service) UpdateDisplayName(ctx context.Context, userID int, newDisplayN
 	return nil
 }
 
+// UpdateUnitPreference sets the units the user's car specs are shown in
+func (s *Service) UpdateUnitPreference(ctx context.Context, userID int, units string) error {
+	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
+	logger.Printf("Updating unit preference for user %d to %s", userID, units)
+
+	if !catalog.ValidUnits(units) {
+		return common.BadRequest(fmt.Sprintf("unit preference must be %q or %q", catalog.UnitsMetric, catalog.UnitsImperial))
+	}
+
+	_, err := s.db.Exec(ctx, `
+		UPDATE users
+		SET unit_preference = $1,
+		    updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2`,
+		units, userID)
+	if err != nil {
+		logger.Printf("Failed to update unit preference: %v", err)
+		return fmt.Errorf("failed to update unit preference: %w", err)
+	}
+
+	logger.Printf("Successfully updated unit preference for user %d", userID)
+	return nil
+}
+
 // CreateShareLink generates a shareable link for any car
 func (s *Service) CreateShareLink(ctx context.Context, requestingUserID int, userCarID int) (string, error) {
 	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
@@ -953,7 +1135,7 @@ func (s *Service) CreateShareLink(ctx context.Context, requestingUserID int, use
 
 	if err != nil || !exists {
 		logger.Printf("Failed to find car: %v", err)
-		return "", fmt.Errorf("car not found")
+		return "", common.NotFound("car not found")
 	}
 
 	logger.Printf("Found car %d owned by user %d", userCarID, ownerID)
@@ -995,8 +1177,9 @@ func (s *Service) CreateShareLink(ctx context.Context, requestingUserID int, use
 	return token, nil
 }
 
-// GetSharedCarByToken retrieves car data for a shared link
-func (s *Service) GetSharedCarByToken(ctx context.Context, shareToken string) (*SharedCar, error) {
+// GetSharedCarByToken retrieves car data for a shared link. Specs are in
+// units, or the owner's unit preference when units is empty.
+func (s *Service) GetSharedCarByToken(ctx context.Context, shareToken, units string) (*SharedCar, error) {
 	logger := ctx.Value(common.LoggerCtxKey).(*log.Logger)
 	logger.Printf("Fetching shared car - Token: %s", shareToken)
 
@@ -1004,8 +1187,9 @@ func (s *Service) GetSharedCarByToken(ctx context.Context, shareToken string) (*
 		SELECT c.make, c.model, c.year, uc.color, c.trim,
 		    c.horsepower, c.torque, c.top_speed, c.acceleration, c.engine_type,
 		    c.drivetrain_type, c.curb_weight, c.price, c.description, c.rarity,
-		    uc.low_res_image, uc.high_res_image, uc.date_collected, 
-		    uc.likes_count, sc.view_count, u.display_name,
+		    uc.low_res_image, uc.high_res_image, uc.image_blurhash, uc.image_dominant_color, uc.date_collected,
+		    uc.likes_count, sc.view_count, u.display_name, u.unit_preference,
+		    ` + catalog.SpecColumns + `,
 		    COALESCE(
 		        jsonb_agg(
 		            jsonb_build_object(
@@ -1025,30 +1209,33 @@ func (s *Service) GetSharedCarByToken(ctx context.Context, shareToken string) (*
 		JOIN users u ON uc.user_id = u.id
 		LEFT JOIN car_upgrades cu ON uc.id = cu.user_car_id
 		WHERE sc.token = $1 AND sc.expires_at > NOW()
-		GROUP BY c.make, c.model, c.year, uc.color, c.trim,
+		GROUP BY c.id, c.make, c.model, c.year, uc.color, c.trim,
 		    c.horsepower, c.torque, c.top_speed, c.acceleration, c.engine_type,
 		    c.drivetrain_type, c.curb_weight, c.price, c.description, c.rarity,
-		    uc.low_res_image, uc.high_res_image, uc.date_collected, 
-		    uc.likes_count, sc.view_count, u.display_name
+		    uc.low_res_image, uc.high_res_image, uc.image_blurhash, uc.image_dominant_color, uc.date_collected,
+		    uc.likes_count, sc.view_count, u.display_name, u.unit_preference
 	`
 
 	var car SharedCar
 	var upgradesJson []byte
 	var dateCollected time.Time
 	var lowResImage, highResImage string
+	var blurHash, dominantColor *string
+	var ownerUnits string
 
-	err := s.db.QueryRow(ctx, query, shareToken).Scan(
+	dest := append([]interface{}{
 		&car.Make, &car.Model, &car.Year, &car.Color, &car.Trim,
 		&car.Horsepower, &car.Torque, &car.TopSpeed, &car.Acceleration, &car.EngineType,
 		&car.DrivetrainType, &car.CurbWeight, &car.Price, &car.Description, &car.Rarity,
-		&lowResImage, &highResImage, &dateCollected,
-		&car.LikesCount, &car.ViewCount, &car.OwnerName, &upgradesJson,
-	)
+		&lowResImage, &highResImage, &blurHash, &dominantColor, &dateCollected,
+		&car.LikesCount, &car.ViewCount, &car.OwnerName, &ownerUnits,
+	}, car.Specs.ScanTargets()...)
+	err := s.db.QueryRow(ctx, query, shareToken).Scan(append(dest, &upgradesJson)...)
 
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			logger.Printf("Share token not found or expired: %s", shareToken)
-			return nil, fmt.Errorf("share token not found or expired")
+			return nil, common.NotFound("share token not found or expired")
 		}
 		logger.Printf("Failed to get shared car: %v", err)
 		return nil, fmt.Errorf("failed to get shared car: %w", err)
@@ -1060,17 +1247,27 @@ func (s *Service) GetSharedCarByToken(ctx context.Context, shareToken string) (*
 	// Set image paths
 	car.LowResImage = lowResImage
 	if car.LowResImage == "" {
-		car.LowResImage = "images/placeholder.jpg"
+		car.LowResImage = common.PlaceholderImagePath
 	}
 
 	car.HighResImage = highResImage
 	if car.HighResImage == "" {
-		car.HighResImage = "images/placeholder.jpg"
+		car.HighResImage = common.PlaceholderImagePath
 	}
+	car.ImagePlaceholder = storage.NewPlaceholder(blurHash, dominantColor)
+	car.ImageVariants = s.signer.SignVariants(storage.URLsFor(car.HighResImage))
+	car.LowResImage = s.signer.Sign(car.LowResImage)
+	car.HighResImage = s.signer.Sign(car.HighResImage)
 
 	if err := json.Unmarshal(upgradesJson, &car.Upgrades); err != nil {
 		return nil, fmt.Errorf("failed to parse upgrades: %w", err)
 	}
+	s.signUpgrades(car.Upgrades)
+
+	if units == "" {
+		units = ownerUnits
+	}
+	car.convertUnits(units)
 
 	logger.Printf("Successfully retrieved shared car for token: %s", shareToken)
 	return &car, nil
@@ -1123,6 +1320,8 @@ func (s *Service) DeleteAccount(ctx context.Context, userID int) error {
 		    email = $1,
 		    auth_provider_id = $2,
 		    profile_picture = '',
+		    profile_picture_blurhash = NULL,
+		    profile_picture_dominant_color = NULL,
 		    is_private = true,
 		    currency = 0,
 		    is_private_email = true,